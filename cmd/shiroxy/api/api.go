@@ -48,17 +48,17 @@ func StartShiroxyAPI(config *models.Config, loadBalancer *proxy.LoadBalancer, do
 	newRouter.GET("/docs/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
 	router := newRouter.Group("/v1")
-	router.GET("/health", func(ctx *gin.Context) {
-		ctx.JSON(200, gin.H{
-			"status": "healthy",
-		})
-	})
+	router.GET("/health", healthHandler(domainStorage))
 
 	router.Use(gin.BasicAuth(account))
 
 	routes.DomainRoutes(router, &apiContext)
 	routes.AnalyticsRoutes(router, &apiContext)
 	routes.BackendsRoutes(router, &apiContext)
+	routes.CertificateRoutes(router, &apiContext)
+	routes.AccountRoutes(router, &apiContext)
+	routes.EncryptionRoutes(router, &apiContext)
+	routes.ClusterRoutes(router, &apiContext)
 
 	// Todo: remove this in final version ===============
 	router.GET("/auth", func(ctx *gin.Context) {
@@ -97,3 +97,27 @@ func StartShiroxyAPI(config *models.Config, loadBalancer *proxy.LoadBalancer, do
 	// 	}
 	// }()
 }
+
+// healthHandler reports whether shiroxy is healthy. With Redis storage the
+// state of the Redis connection is included: shiroxy is unhealthy while Redis
+// cannot be reached, and degraded while the domains could not be reloaded after
+// an outage.
+func healthHandler(domainStorage *domains.Storage) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		response := gin.H{
+			"status": "healthy",
+		}
+		status := 200
+		if health, ok := domainStorage.RedisHealth(); ok {
+			response["redis"] = health
+			switch health.Status {
+			case domains.RedisDown:
+				response["status"] = "unhealthy"
+				status = 503
+			case domains.RedisDegraded:
+				response["status"] = "degraded"
+			}
+		}
+		ctx.JSON(status, response)
+	}
+}
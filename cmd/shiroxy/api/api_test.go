@@ -4,8 +4,12 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/models"
+	"sync"
 	"testing"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gin-gonic/gin"
 )
 
@@ -169,3 +173,53 @@ func TestRouterGroupSetup(t *testing.T) {
 		t.Errorf("expected status 200, got %d", w.Code)
 	}
 }
+
+func TestHealthHandler_ReportsRedis(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	server := miniredis.RunT(t)
+	wg := &sync.WaitGroup{}
+	storage, err := domains.InitializeStorage(&models.Storage{Location: "redis", RedisConnectionString: "redis://" + server.Addr()}, "", "yes", nil, wg)
+	if err != nil {
+		t.Fatalf("initialize storage: %v", err)
+	}
+	defer wg.Wait()
+	defer storage.Close()
+
+	router := gin.New()
+	router.GET("/v1/health", healthHandler(storage))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", w.Code)
+	}
+
+	var response struct {
+		Status string `json:"status"`
+		Redis  struct {
+			Status string `json:"status"`
+			Mode   string `json:"mode"`
+		} `json:"redis"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if response.Status != "healthy" || response.Redis.Status != "up" || response.Redis.Mode != "standalone" {
+		t.Fatalf("unexpected response: %s", w.Body.String())
+	}
+}
+
+func TestHealthHandler_WithoutRedis(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/v1/health", healthHandler(&domains.Storage{}))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/v1/health", nil))
+
+	var response map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("failed to parse response: %v", err)
+	}
+	if w.Code != http.StatusOK || response["status"] != "healthy" || response["redis"] != nil {
+		t.Fatalf("unexpected response %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,118 @@
+package controllers
+
+import (
+	"errors"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AccountController struct {
+	Context     *types.APIContext
+	Middlewares *middlewares.Middlewares
+}
+
+// accountRequestBody identifies a stored ACME account.
+type accountRequestBody struct {
+	Issuer string `json:"issuer"` // empty selects the first configured issuer
+	Email  string `json:"email"`
+}
+
+// FetchAccounts lists the ACME accounts shared by the domains of each email, without their keys.
+func (a *AccountController) FetchAccounts(c *gin.Context) {
+	accounts, err := a.Context.DomainStorage.ListAccounts()
+	if err != nil {
+		a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 500)
+		return
+	}
+
+	a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"total":    len(accounts),
+			"accounts": accounts,
+		},
+	}, 200)
+}
+
+// RolloverAccountKey replaces the key of an ACME account at the CA.
+func (a *AccountController) RolloverAccountKey(c *gin.Context) {
+	requestBody, ok := a.bindAccount(c)
+	if !ok {
+		return
+	}
+
+	account, err := a.Context.DomainStorage.RolloverAccountKey(requestBody.Issuer, requestBody.Email)
+	if err != nil {
+		a.writeAccountError(c, err)
+		return
+	}
+
+	a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"account": account,
+		},
+	}, 200)
+}
+
+// DeactivateAccount deactivates an ACME account at the CA. The next order for the
+// email registers a new account.
+func (a *AccountController) DeactivateAccount(c *gin.Context) {
+	requestBody, ok := a.bindAccount(c)
+	if !ok {
+		return
+	}
+
+	err := a.Context.DomainStorage.DeactivateAccount(requestBody.Issuer, requestBody.Email)
+	if err != nil {
+		a.writeAccountError(c, err)
+		return
+	}
+
+	a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"issuer": requestBody.Issuer,
+			"email":  requestBody.Email,
+		},
+	}, 200)
+}
+
+// bindAccount reads the account request body, responding with 400 when it is invalid.
+func (a *AccountController) bindAccount(c *gin.Context) (accountRequestBody, bool) {
+	var requestBody accountRequestBody
+	err := c.ShouldBindJSON(&requestBody)
+	if err != nil {
+		a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return requestBody, false
+	}
+	if requestBody.Email == "" {
+		a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   "field email is required",
+		}, 400)
+		return requestBody, false
+	}
+	return requestBody, true
+}
+
+// writeAccountError responds with 404 for unknown accounts and 400 otherwise.
+func (a *AccountController) writeAccountError(c *gin.Context, err error) {
+	status := 400
+	if errors.Is(err, domains.ErrAccountNotFound) {
+		status = 404
+	}
+	a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: false,
+		Error:   err.Error(),
+	}, status)
+}
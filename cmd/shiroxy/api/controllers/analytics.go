@@ -14,27 +14,19 @@ type AnalyticsController struct {
 }
 
 func (a *AnalyticsController) FetchDomainAnalytics(c *gin.Context) {
-	response := map[string]interface{}{
-		"total":          len(a.Context.DomainStorage.DomainMetadata),
-		"total_active":   0,
-		"total_inactive": 0,
-	}
-
-	for _, domain := range a.Context.DomainStorage.DomainMetadata {
+	// A single snapshot keeps the counts consistent with each other.
+	snapshot := a.Context.DomainStorage.Domains().Snapshot()
+	active := 0
+	for _, domain := range snapshot.List() {
 		if domain.Status == "active" {
-			if response["total_active"] != nil {
-				response["total_active"] = (response["total_active"].(int) + 1)
-			} else {
-				response["total_active"] = 1
-			}
-		} else {
-			if response["total_inactive"] != nil {
-				response["total_inactive"] = (response["total_active"].(int) + 1)
-			} else {
-				response["total_inactive"] = 1
-			}
+			active++
 		}
 	}
+	response := map[string]interface{}{
+		"total":          snapshot.Len(),
+		"total_active":   active,
+		"total_inactive": snapshot.Len() - active,
+	}
 
 	a.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 		Success: true,
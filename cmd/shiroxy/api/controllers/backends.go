@@ -1,15 +1,11 @@
 package controllers
 
 import (
-	"fmt"
-	"net/http"
-	"net/url"
 	"reflect"
 	"shiroxy/cmd/shiroxy/api/middlewares"
 	"shiroxy/cmd/shiroxy/proxy"
 	"shiroxy/cmd/shiroxy/types"
-	"strings"
-	"sync"
+	"shiroxy/pkg/models"
 
 	"github.com/gin-gonic/gin"
 )
@@ -32,7 +28,7 @@ func (b *BackendController) FetchAllBackendServers(c *gin.Context) {
 
 		serverJson := map[string]any{}
 		for i := 0; i < serverReflect.NumField(); i++ {
-			if serverReflect.Type().Field(i).Name != "Shiroxy" {
+			if name := serverReflect.Type().Field(i).Name; name != "Shiroxy" && name != "Definition" {
 				serverJson[serverReflect.Type().Field(i).Name] = serverReflect.Field(i).Interface()
 			}
 
@@ -55,6 +51,14 @@ func (b *BackendController) RegisterNewBackendServer(c *gin.Context) {
 		Port      string `json:"port"`
 		HealthUrl string `json:"health_url"`
 		Tags      string `json:"tags"`
+		Scheme    string `json:"scheme"`
+		TLS       struct {
+			CAFile             string `json:"ca_file"`
+			CertFile           string `json:"cert_file"`
+			KeyFile            string `json:"key_file"`
+			ServerName         string `json:"server_name"`
+			InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+		} `json:"tls"`
 	}
 	var requestBody RegisternewBackendServerRequestBody
 	err := c.BindJSON(&requestBody)
@@ -66,36 +70,39 @@ func (b *BackendController) RegisterNewBackendServer(c *gin.Context) {
 		return
 	}
 
-	serverUrl := url.URL{
-		Scheme: b.Context.Configuration.Frontend.Mode,
-		Host:   fmt.Sprintf("%s:%s", requestBody.Host, requestBody.Port), // The actual address where domain1's server is running
-	}
-
-	server := proxy.Server{
-		Id:                            requestBody.Id,
-		Tags:                          strings.Split(requestBody.Tags, ","),
-		URL:                           &serverUrl,
-		HealthCheckUrl:                requestBody.HealthUrl,
-		Alive:                         false,
-		FireWebhookOnFirstHealthCheck: true,
-		Shiroxy: &proxy.Shiroxy{
-			Logger: b.Context.LogHandler,
-			Director: func(req *http.Request) {
-				targetQuery := serverUrl.RawQuery
-				req.URL.Scheme = serverUrl.Scheme
-				req.URL.Host = serverUrl.Host
-				req.URL.Path, req.URL.RawPath = proxy.JoinURLPath(&serverUrl, req.URL)
-				if targetQuery == "" || req.URL.RawQuery == "" {
-					req.URL.RawQuery = targetQuery + req.URL.RawQuery
-				} else {
-					req.URL.RawQuery = targetQuery + "&" + req.URL.RawQuery
-				}
-			},
+	server, err := proxy.NewBackendServer(models.BackendServer{
+		Id:        requestBody.Id,
+		Host:      requestBody.Host,
+		Port:      requestBody.Port,
+		HealthUrl: requestBody.HealthUrl,
+		Tags:      requestBody.Tags,
+		Scheme:    requestBody.Scheme,
+		TLS: models.BackendServerTLS{
+			CAFile:             requestBody.TLS.CAFile,
+			CertFile:           requestBody.TLS.CertFile,
+			KeyFile:            requestBody.TLS.KeyFile,
+			ServerName:         requestBody.TLS.ServerName,
+			InsecureSkipVerify: requestBody.TLS.InsecureSkipVerify,
 		},
-		Lock: &sync.RWMutex{},
+	}, b.Context.Configuration.Frontend.Mode, b.Context.LogHandler)
+	if err != nil {
+		b.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+	b.Context.LoadBalancer.RegisterServer(server)
+	if cluster := b.Context.DomainStorage.Cluster; cluster != nil {
+		// The other instances of the cluster register the backend too.
+		if err := cluster.ShareBackend(server.Definition); err != nil {
+			b.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   "registered on this instance only: " + err.Error(),
+			}, 500)
+			return
+		}
 	}
-
-	b.Context.LoadBalancer.Servers.Servers = append(b.Context.LoadBalancer.Servers.Servers, &server)
 
 	b.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 		Success: true,
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CertificateController struct {
+	Context     *types.APIContext
+	Middlewares *middlewares.Middlewares
+}
+
+// FetchCertificates returns the expiry dashboard: every certificate with its expiry,
+// renewal time and renewal failures, soonest expiry first. The optional
+// `expiring_within` query parameter (in days) limits the list to certificates
+// expiring within that many days.
+func (cc *CertificateController) FetchCertificates(c *gin.Context) {
+	expiries, err := cc.Context.DomainStorage.CertificateExpiries()
+	if err != nil {
+		cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 500)
+		return
+	}
+
+	var window time.Duration
+	if expiringWithin := c.Query("expiring_within"); expiringWithin != "" {
+		days, err := strconv.Atoi(expiringWithin)
+		if err != nil || days < 0 {
+			cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   "expiring_within must be a non-negative number of days",
+			}, 400)
+			return
+		}
+		window = time.Duration(days) * 24 * time.Hour
+	}
+
+	now := time.Now()
+	certificates := []any{}
+	expired, expiringSoon, failing := 0, 0, 0
+	for _, expiry := range expiries {
+		if window > 0 && expiry.NotAfter.Sub(now) > window {
+			continue
+		}
+		if expiry.Expired {
+			expired++
+		} else if expiry.NotAfter.Sub(now) < 14*24*time.Hour {
+			expiringSoon++
+		}
+		if expiry.Failures > 0 {
+			failing++
+		}
+		certificates = append(certificates, expiry)
+	}
+
+	cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"total":         len(certificates),
+			"expired":       expired,
+			"expiring_soon": expiringSoon,
+			"failing":       failing,
+			"certificates":  certificates,
+		},
+	}, 200)
+}
@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+type ClusterController struct {
+	Context     *types.APIContext
+	Middlewares *middlewares.Middlewares
+}
+
+// FetchClusterStatus reports this instance and the leader of its cluster.
+func (cc *ClusterController) FetchClusterStatus(c *gin.Context) {
+	cluster := cc.Context.DomainStorage.Cluster
+	if cluster == nil {
+		cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: true,
+			Data: map[string]any{
+				"enabled": false,
+				"leader":  true,
+			},
+		}, 200)
+		return
+	}
+
+	status, err := cluster.Status()
+	if err != nil {
+		cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 500)
+		return
+	}
+	cc.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"enabled":   true,
+			"node_id":   status.NodeID,
+			"leader":    status.Leader,
+			"leader_id": status.LeaderID,
+		},
+	}, 200)
+}
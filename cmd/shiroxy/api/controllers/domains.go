@@ -1,12 +1,18 @@
 package controllers
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/domains"
 	"shiroxy/cmd/shiroxy/types"
 	"shiroxy/utils"
+	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"google.golang.org/protobuf/proto"
 )
 
 type DomainController struct {
@@ -14,11 +20,64 @@ type DomainController struct {
 	Middlewares *middlewares.Middlewares
 }
 
+// clientAuthRequestBody overrides the client certificate (mTLS) settings of the bind for a domain.
+type clientAuthRequestBody struct {
+	Mode     string `json:"mode"`      // none, optional or required; empty inherits the bind
+	CABundle string `json:"ca_bundle"` // PEM encoded CAs trusted for client certificates
+}
+
+// policy converts the request body into the stored client certificate policy.
+func (b *clientAuthRequestBody) policy() *domains.ClientAuthPolicy {
+	if b == nil {
+		return nil
+	}
+	return &domains.ClientAuthPolicy{Mode: b.Mode, CaBundle: []byte(b.CABundle)}
+}
+
+// routingRequestBody selects the backends requests for a domain are routed to.
+type routingRequestBody struct {
+	Tags    []string `json:"tags"`    // Tags of the backends, tried in order
+	Backend string   `json:"backend"` // ID of the backend the domain is pinned to
+}
+
+// routing converts the request body into the stored routing.
+func (b *routingRequestBody) routing() *domains.DomainRouting {
+	if b == nil {
+		return nil
+	}
+	routing := &domains.DomainRouting{Backend: b.Backend}
+	for _, tag := range b.Tags {
+		routing.Tags = append(routing.Tags, domains.SplitTags(tag)...)
+	}
+	return routing
+}
+
+// validateRouting checks that the backend a domain is pinned to is load balanced.
+func (d *DomainController) validateRouting(routing *routingRequestBody) error {
+	if routing == nil {
+		return nil
+	}
+	return d.validateRecord(domains.DomainRecord{Backend: routing.Backend})
+}
+
+// validateRecord checks that the backend a domain record is pinned to is load balanced.
+func (d *DomainController) validateRecord(record domains.DomainRecord) error {
+	if d.Context.LoadBalancer == nil {
+		return nil
+	}
+	return d.Context.LoadBalancer.ValidateDomainRecord(record)
+}
+
 func (d *DomainController) RegisterDomain(c *gin.Context) {
 	type registerDomainRequestBody struct {
-		Domain   string            `json:"domain"`
-		Email    string            `json:"email"`
-		Metadata map[string]string `json:"metadata"`
+		Domain     string                 `json:"domain"`
+		Email      string                 `json:"email"`
+		Metadata   map[string]string      `json:"metadata"`
+		Routing    *routingRequestBody    `json:"routing"`
+		Challenge  string                 `json:"challenge"`
+		Aliases    []string               `json:"aliases"`
+		ClientAuth *clientAuthRequestBody `json:"client_auth"`
+		Issuer     string                 `json:"issuer"`
 	}
 
 	var requestBody registerDomainRequestBody
@@ -39,7 +98,24 @@ func (d *DomainController) RegisterDomain(c *gin.Context) {
 		return
 	}
 
-	dnsKey, err := d.Context.DomainStorage.RegisterDomain(requestBody.Domain, requestBody.Email, requestBody.Metadata)
+	if err := d.validateRouting(requestBody.Routing); err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	dnsKey, err := d.Context.DomainStorage.Register(domains.DomainRegistration{
+		Domain:             requestBody.Domain,
+		Email:              requestBody.Email,
+		Metadata:           requestBody.Metadata,
+		Routing:            requestBody.Routing.routing(),
+		PreferredChallenge: requestBody.Challenge,
+		Aliases:            requestBody.Aliases,
+		ClientAuth:         requestBody.ClientAuth.policy(),
+		Issuer:             requestBody.Issuer,
+	})
 	if err != nil {
 		d.Context.WebhookHandler.Fire("domain-register-failed", map[string]string{
 			"domain": requestBody.Domain,
@@ -50,28 +126,51 @@ func (d *DomainController) RegisterDomain(c *gin.Context) {
 			Error:   err.Error(),
 		}, 400)
 		return
-	} else {
-		fmt.Println("firing webhook")
-		d.Context.WebhookHandler.Fire("domain-register-success", map[string]string{
-			"domain": requestBody.Domain,
-		})
-		fmt.Println("webhook fired")
+	}
+
+	d.Context.WebhookHandler.Fire("domain-register-success", map[string]string{
+		"domain": requestBody.Domain,
+	})
+	if d.Context.DomainStorage.Issuance == nil {
+		// Issued synchronously; the certificate is in place already.
 		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 			Success: true,
 			Data: map[string]any{
 				"dns_key": dnsKey,
 			},
 		}, 200)
+		return
 	}
+	d.writeIssuanceStatus(c, requestBody.Domain, 202)
 }
 
 func (d *DomainController) ForceSSL(c *gin.Context) {
-	type forceSslRequestBody struct {
-		Domain string `json:"domain"`
+	domainName := c.Param("domain")
+
+	err := d.Context.DomainStorage.ForceSSL(domainName)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
 	}
+	d.writeIssuanceStatus(c, domainName, 202)
+}
 
-	var requestBody forceSslRequestBody
-	err := c.BindJSON(&requestBody)
+// UploadCertificate stores a certificate chain and key provided by the user (EV
+// certificates, corporate CAs). The certificate is managed manually afterwards:
+// automated issuance and renewal leave it alone.
+func (d *DomainController) UploadCertificate(c *gin.Context) {
+	type uploadCertificateRequestBody struct {
+		Certificate string `json:"certificate"` // PEM encoded chain, leaf first
+		PrivateKey  string `json:"private_key"` // PEM encoded key of the leaf
+	}
+
+	domainName := c.Param("domain")
+
+	var requestBody uploadCertificateRequestBody
+	err := c.ShouldBindJSON(&requestBody)
 	if err != nil {
 		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 			Success: false,
@@ -80,15 +179,15 @@ func (d *DomainController) ForceSSL(c *gin.Context) {
 		return
 	}
 
-	if requestBody.Domain == "" {
+	if requestBody.Certificate == "" || requestBody.PrivateKey == "" {
 		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 			Success: false,
-			Error:   "field domain is required",
+			Error:   "fields certificate and private_key is required",
 		}, 400)
 		return
 	}
 
-	err = d.Context.DomainStorage.ForceSSL(requestBody.Domain)
+	domainData, err := d.Context.DomainStorage.UploadCertificate(domainName, []byte(requestBody.Certificate), []byte(requestBody.PrivateKey))
 	if err != nil {
 		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 			Success: false,
@@ -96,14 +195,53 @@ func (d *DomainController) ForceSSL(c *gin.Context) {
 		}, 400)
 		return
 	}
+
+	// The response never carries the uploaded key.
 	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 		Success: true,
+		Data: map[string]any{
+			"domain": domains.SummarizeDomain(domainData),
+		},
 	}, 200)
 }
 
+func (d *DomainController) FetchIssuanceStatus(c *gin.Context) {
+	d.writeIssuanceStatus(c, c.Param("domain"), 200)
+}
+
+// writeIssuanceStatus responds with the issuance order state of domainName.
+func (d *DomainController) writeIssuanceStatus(c *gin.Context, domainName string, status int) {
+	issuanceStatus, err := d.Context.DomainStorage.IssuanceStatus(domainName)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   "domain not found",
+		}, 404)
+		return
+	}
+
+	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"domain":     issuanceStatus.Domain,
+			"status":     issuanceStatus.Status,
+			"state":      issuanceStatus.State,
+			"error":      issuanceStatus.Error,
+			"attempts":   issuanceStatus.Attempts,
+			"created_at": issuanceStatus.CreatedAt,
+			"updated_at": issuanceStatus.UpdatedAt,
+		},
+	}, status)
+}
+
 func (d *DomainController) UpdateDomain(c *gin.Context) {
 	type UpdateDomainRequestBody struct {
-		Metadata map[string]string `json:"metadata"`
+		Metadata   map[string]string      `json:"metadata"`
+		Routing    *routingRequestBody    `json:"routing"`
+		Challenge  *string                `json:"challenge"`
+		Aliases    *[]string              `json:"aliases"`
+		ClientAuth *clientAuthRequestBody `json:"client_auth"`
+		Issuer     *string                `json:"issuer"`
 	}
 
 	domainName := c.Param("domain")
@@ -118,11 +256,94 @@ func (d *DomainController) UpdateDomain(c *gin.Context) {
 		return
 	}
 
-	domainData := d.Context.DomainStorage.DomainMetadata[domainName]
-	if requestBody.Metadata != nil {
-		for key, value := range requestBody.Metadata {
-			domainData.Metadata[key] = value
+	domainData, ok := d.Context.DomainStorage.Domains().Get(domainName)
+	if !ok {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   "domain not found",
+		}, 400)
+		return
+	}
+
+	if requestBody.Challenge != nil {
+		if err := domains.ValidateChallengeType(*requestBody.Challenge); err != nil {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, 400)
+			return
+		}
+	}
+	if err := d.validateRouting(requestBody.Routing); err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	// Changing aliases requests a new certificate covering them.
+	if requestBody.Aliases != nil {
+		if err := d.Context.DomainStorage.SetAliases(domainName, *requestBody.Aliases); err != nil {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, 400)
+			return
 		}
+		domainData, _ = d.Context.DomainStorage.Domains().Get(domainName)
+	}
+
+	// An empty client_auth object removes the override.
+	if requestBody.ClientAuth != nil {
+		if err := d.Context.DomainStorage.SetClientAuth(domainName, requestBody.ClientAuth.policy()); err != nil {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, 400)
+			return
+		}
+		domainData, _ = d.Context.DomainStorage.Domains().Get(domainName)
+	}
+
+	// The issuer is used from the next certificate order on.
+	if requestBody.Issuer != nil {
+		if err := d.Context.DomainStorage.SetIssuer(domainName, *requestBody.Issuer); err != nil {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, 400)
+			return
+		}
+		domainData, _ = d.Context.DomainStorage.Domains().Get(domainName)
+	}
+
+	// Registered domains are shared with the proxy, so changes are made to a copy.
+	if requestBody.Challenge != nil || requestBody.Metadata != nil || requestBody.Routing != nil {
+		domainData = proto.Clone(domainData).(*domains.DomainMetadata)
+		if requestBody.Challenge != nil {
+			domainData.PreferredChallenge = *requestBody.Challenge
+		}
+		// The routing is replaced as a whole; an empty object removes it.
+		if requestBody.Routing != nil {
+			domainData.Routing = requestBody.Routing.routing()
+		}
+		if requestBody.Metadata != nil {
+			if domainData.Metadata == nil {
+				domainData.Metadata = make(map[string]string)
+			}
+			for key, value := range requestBody.Metadata {
+				domainData.Metadata[key] = value
+			}
+		}
+		if err := d.Context.DomainStorage.UpdateDomain(domainName, domainData); err != nil {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			}, 400)
+			return
+		}
+		domainData, _ = d.Context.DomainStorage.Domains().Get(domainName)
 	}
 
 	data, err := utils.DestructureStruct(domainData)
@@ -144,7 +365,7 @@ func (d *DomainController) UpdateDomain(c *gin.Context) {
 
 func (d *DomainController) RemoveDomain(c *gin.Context) {
 	domainName := c.Param("domain")
-	domainData := d.Context.DomainStorage.DomainMetadata[domainName]
+	domainData, _ := d.Context.DomainStorage.Domains().Get(domainName)
 
 	err := d.Context.DomainStorage.RemoveDomain(domainName)
 	if err != nil {
@@ -175,8 +396,8 @@ func (d *DomainController) RemoveDomain(c *gin.Context) {
 func (d *DomainController) FetchDomainInfo(c *gin.Context) {
 	domainName := c.Param("domain")
 
-	domainData := d.Context.DomainStorage.DomainMetadata[domainName]
-	if domainData == nil {
+	domainData, ok := d.Context.DomainStorage.Domains().Get(domainName)
+	if !ok {
 		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
 			Success: false,
 			Error:   "domain not found",
@@ -192,3 +413,209 @@ func (d *DomainController) FetchDomainInfo(c *gin.Context) {
 		},
 	}, 200)
 }
+
+// ListDomains returns a page of the registered domains. The status, tag, issuer,
+// expiring_within (in days) and q (a substring or wildcard pattern of the domain or
+// an alias) query parameters filter the domains, sort orders them and limit and
+// cursor select the page.
+func (d *DomainController) ListDomains(c *gin.Context) {
+	query := domains.DomainQuery{
+		Status: c.Query("status"),
+		Tag:    c.Query("tag"),
+		Issuer: c.Query("issuer"),
+		Search: c.Query("q"),
+		Sort:   c.Query("sort"),
+		Cursor: c.Query("cursor"),
+	}
+	if expiringWithin := c.Query("expiring_within"); expiringWithin != "" {
+		days, err := strconv.Atoi(expiringWithin)
+		if err != nil || days < 0 {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   "expiring_within must be a non-negative number of days",
+			}, 400)
+			return
+		}
+		query.ExpiringWithin = time.Duration(days) * 24 * time.Hour
+	}
+	if limit := c.Query("limit"); limit != "" {
+		size, err := strconv.Atoi(limit)
+		if err != nil || size < 1 {
+			d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+				Success: false,
+				Error:   "limit must be a positive number",
+			}, 400)
+			return
+		}
+		query.Limit = size
+	}
+
+	page, err := d.Context.DomainStorage.ListDomains(query)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"domains":     page.Domains,
+			"total":       page.Total,
+			"next_cursor": page.NextCursor,
+		},
+	}, 200)
+}
+
+// ImportDomains registers or updates every domain of a JSON, CSV or NDJSON domain
+// list; domains missing from the list are kept. The format is taken from the
+// format query parameter or the content type, and dry_run=true only reports the
+// changes.
+func (d *DomainController) ImportDomains(c *gin.Context) {
+	d.applyDomainList(c, false)
+}
+
+// ReconcileDomains makes the registered domains match a domain list: missing
+// domains are registered, changed ones updated and the others removed, except
+// those registered by on-demand TLS.
+func (d *DomainController) ReconcileDomains(c *gin.Context) {
+	d.applyDomainList(c, true)
+}
+
+// applyDomainList applies the domain list in the request body and responds with
+// the result for every domain.
+func (d *DomainController) applyDomainList(c *gin.Context, prune bool) {
+	dryRun, err := dryRunQuery(c)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	format := c.Query("format")
+	if format == "" {
+		format = domains.DetectFormat(c.ContentType())
+	}
+	records, err := domains.DecodeDomainRecords(c.Request.Body, format)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	report, err := d.Context.DomainStorage.ApplyDomainRecords(records, domains.BulkOptions{
+		DryRun:   dryRun,
+		Prune:    prune,
+		Validate: d.validateRecord,
+	})
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"report": report,
+		},
+	}, 200)
+}
+
+// ExportDomains responds with every registered domain as a JSON (default), CSV or
+// NDJSON domain list, selected by the format query parameter, that can be imported again.
+func (d *DomainController) ExportDomains(c *gin.Context) {
+	format := c.DefaultQuery("format", domains.FormatJSON)
+	var body bytes.Buffer
+	if err := domains.EncodeDomainRecords(&body, format, d.Context.DomainStorage.ExportDomains()); err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="domains.%s"`, format))
+	c.Data(200, domains.FormatContentType(format), body.Bytes())
+}
+
+// FetchDomainSyncStatus reports the outcome of the last sync with the configured domain source.
+func (d *DomainController) FetchDomainSyncStatus(c *gin.Context) {
+	domainSync := d.Context.DomainStorage.Sync
+	if domainSync == nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   "domain sync is not configured",
+		}, 404)
+		return
+	}
+
+	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"sync": domainSync.Status(),
+		},
+	}, 200)
+}
+
+// SyncDomains reconciles the domains with the configured domain source now;
+// dry_run=true only reports the changes. In cluster mode it must be sent to the leader.
+func (d *DomainController) SyncDomains(c *gin.Context) {
+	domainSync := d.Context.DomainStorage.Sync
+	if domainSync == nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   "domain sync is not configured",
+		}, 404)
+		return
+	}
+	dryRun, err := dryRunQuery(c)
+	if err != nil {
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, 400)
+		return
+	}
+
+	report, err := domainSync.Sync(dryRun)
+	if err != nil {
+		status := 502
+		if errors.Is(err, domains.ErrNotLeader) {
+			status = 409
+		}
+		d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, status)
+		return
+	}
+
+	d.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"report": report,
+		},
+	}, 200)
+}
+
+// dryRunQuery reads the dry_run query parameter.
+func dryRunQuery(c *gin.Context) (bool, error) {
+	value := c.Query("dry_run")
+	if value == "" {
+		return false, nil
+	}
+	dryRun, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New("dry_run must be true or false")
+	}
+	return dryRun, nil
+}
@@ -0,0 +1,40 @@
+package controllers
+
+import (
+	"errors"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+type EncryptionController struct {
+	Context     *types.APIContext
+	Middlewares *middlewares.Middlewares
+}
+
+// RotateEncryption encrypts every stored private key with the active master key.
+func (e *EncryptionController) RotateEncryption(c *gin.Context) {
+	rotation, err := e.Context.DomainStorage.RotateEncryption()
+	if err != nil {
+		status := 500
+		if errors.Is(err, domains.ErrEncryptionDisabled) {
+			status = 400
+		}
+		e.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		}, status)
+		return
+	}
+
+	e.Middlewares.WriteResponse(c, middlewares.ApiResponse{
+		Success: true,
+		Data: map[string]any{
+			"key_id":   rotation.KeyID,
+			"domains":  rotation.Domains,
+			"accounts": rotation.Accounts,
+		},
+	}, 200)
+}
@@ -31,24 +31,12 @@ func (d *DNSChallengeSolver) SolveDNSChallenge(c *gin.Context) {
 		return
 	}
 
-	domainName, ok := d.domainStorage.DnsChallengeToken[filename]
+	challengeKeyAuthorization, ok := d.domainStorage.HTTPChallengeResponse(filename)
 	if !ok {
 		c.Status(404)
 		return
 	}
 
-	domainMetadata, ok := d.domainStorage.DomainMetadata[domainName]
-	if !ok {
-		c.Status(404)
-		return
-	}
-
-	challengeKeyAuthorization := domainMetadata.DnsChallengeKey
-	if challengeKeyAuthorization == "" {
-		c.Status(404)
-		return
-	}
-
 	fmt.Fprint(c.Writer, challengeKeyAuthorization)
 	c.AbortWithStatus(200)
 }
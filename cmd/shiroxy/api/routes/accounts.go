@@ -0,0 +1,28 @@
+package routes
+
+import (
+	"shiroxy/cmd/shiroxy/api/controllers"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func AccountRoutes(router *gin.RouterGroup, apiContext *types.APIContext) error {
+	accountMiddleware, err := middlewares.InitializeMiddleware(apiContext.LogHandler, "")
+	if err != nil {
+		return err
+	}
+
+	accountController := controllers.AccountController{
+		Middlewares: accountMiddleware,
+		Context:     apiContext,
+	}
+	account := router.Group("/acme/accounts")
+
+	account.GET("", accountController.FetchAccounts)
+	account.POST("/rollover", accountController.RolloverAccountKey)
+	account.POST("/deactivate", accountController.DeactivateAccount)
+
+	return nil
+}
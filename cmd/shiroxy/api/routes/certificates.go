@@ -0,0 +1,25 @@
+package routes
+
+import (
+	"shiroxy/cmd/shiroxy/api/controllers"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func CertificateRoutes(router *gin.RouterGroup, apiContext *types.APIContext) error {
+	certificateMiddleware, err := middlewares.InitializeMiddleware(apiContext.LogHandler, "")
+	if err != nil {
+		return err
+	}
+
+	certificateController := controllers.CertificateController{
+		Middlewares: certificateMiddleware,
+		Context:     apiContext,
+	}
+
+	router.GET("/certificates", certificateController.FetchCertificates)
+
+	return nil
+}
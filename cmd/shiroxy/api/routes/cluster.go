@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"shiroxy/cmd/shiroxy/api/controllers"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func ClusterRoutes(router *gin.RouterGroup, apiContext *types.APIContext) error {
+	clusterMiddleware, err := middlewares.InitializeMiddleware(apiContext.LogHandler, "")
+	if err != nil {
+		return err
+	}
+
+	clusterController := controllers.ClusterController{
+		Middlewares: clusterMiddleware,
+		Context:     apiContext,
+	}
+	cluster := router.Group("/cluster")
+
+	cluster.GET("", clusterController.FetchClusterStatus)
+
+	return nil
+}
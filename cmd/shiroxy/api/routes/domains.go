@@ -24,8 +24,18 @@ func DomainRoutes(router *gin.RouterGroup, apiContext *types.APIContext) error {
 	domain.POST("/", domainController.RegisterDomain)
 	domain.PATCH("/:domain", domainController.UpdateDomain)
 	domain.PATCH("/:domain/retryssl", domainController.ForceSSL)
+	domain.PUT("/:domain/certificate", domainController.UploadCertificate)
 	domain.GET("/:domain", domainController.FetchDomainInfo)
+	domain.GET("/:domain/status", domainController.FetchIssuanceStatus)
 	domain.DELETE("/:domain", domainController.RemoveDomain)
 
+	domainList := router.Group("/domains")
+	domainList.GET("", domainController.ListDomains)
+	domainList.POST("/import", domainController.ImportDomains)
+	domainList.GET("/export", domainController.ExportDomains)
+	domainList.POST("/reconcile", domainController.ReconcileDomains)
+	domainList.GET("/sync", domainController.FetchDomainSyncStatus)
+	domainList.POST("/sync", domainController.SyncDomains)
+
 	return nil
 }
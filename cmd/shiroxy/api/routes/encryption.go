@@ -0,0 +1,26 @@
+package routes
+
+import (
+	"shiroxy/cmd/shiroxy/api/controllers"
+	"shiroxy/cmd/shiroxy/api/middlewares"
+	"shiroxy/cmd/shiroxy/types"
+
+	"github.com/gin-gonic/gin"
+)
+
+func EncryptionRoutes(router *gin.RouterGroup, apiContext *types.APIContext) error {
+	encryptionMiddleware, err := middlewares.InitializeMiddleware(apiContext.LogHandler, "")
+	if err != nil {
+		return err
+	}
+
+	encryptionController := controllers.EncryptionController{
+		Middlewares: encryptionMiddleware,
+		Context:     apiContext,
+	}
+	encryption := router.Group("/encryption")
+
+	encryption.POST("/rotate", encryptionController.RotateEncryption)
+
+	return nil
+}
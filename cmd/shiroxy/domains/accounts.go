@@ -0,0 +1,439 @@
+package domains
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/mholt/acmez/acme"
+	"google.golang.org/protobuf/proto"
+)
+
+// acmeAccountKeyPrefix prefixes the Redis keys ACME accounts are stored under.
+const acmeAccountKeyPrefix = "acme-account:"
+
+// ErrAccountNotFound is returned when no ACME account is stored for an issuer and email.
+var ErrAccountNotFound = errors.New("acme account not found")
+
+// accountKey returns the key the ACME account of email at issuer is stored under.
+func accountKey(issuer, email string) string {
+	return acmeAccountKeyPrefix + issuer + ":" + strings.ToLower(email)
+}
+
+// AccountInfo describes a stored ACME account without its key.
+type AccountInfo struct {
+	Issuer      string    `json:"issuer"`
+	Email       string    `json:"email"`
+	Location    string    `json:"location"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	KeyRolledAt time.Time `json:"key_rolled_at"`
+}
+
+// info describes the account without its key.
+func (a *AcmeAccount) info() AccountInfo {
+	info := AccountInfo{
+		Issuer:    a.Issuer,
+		Email:     a.Email,
+		Location:  a.Location,
+		Status:    a.Status,
+		CreatedAt: time.Unix(a.CreatedAt, 0).UTC(),
+	}
+	if a.KeyRolledAt != 0 {
+		info.KeyRolledAt = time.Unix(a.KeyRolledAt, 0).UTC()
+	}
+	return info
+}
+
+// acmeAccount returns the account orders for email are placed with at issuer. The
+// account is registered with the CA the first time and reused for every later order.
+// Parameters:
+//   - ctx: context.Context, bounds the CA requests.
+//   - client: *acme.Client, the client for the issuer's directory.
+//   - issuer: *ACMEIssuer, the issuer the account belongs to.
+//   - email: string, the contact email of the account.
+//   - legacyKey: []byte, the account key of domains registered before accounts were shared (may be empty).
+//
+// Returns:
+//   - acme.Account: the account, with its URL and key.
+//   - error: error if the account cannot be loaded, registered or stored.
+func (s *Storage) acmeAccount(ctx context.Context, client *acme.Client, issuer *ACMEIssuer, email string, legacyKey []byte) (acme.Account, error) {
+	// Held while registering so concurrent orders for the same email create one account.
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+
+	account := acme.Account{TermsOfServiceAgreed: true}
+	if email != "" {
+		account.Contact = []string{fmt.Sprintf("mailto:%s", email)}
+	}
+
+	stored, err := s.loadAccount(accountKey(issuer.Name, email))
+	if err == nil {
+		privateKey, err := x509.ParseECPrivateKey(stored.PrivateKey)
+		if err != nil {
+			return acme.Account{}, fmt.Errorf("acme account %s: %v", stored.Location, err)
+		}
+		account.PrivateKey = privateKey
+		account.Location = stored.Location
+		account.Status = stored.Status
+		return account, nil
+	}
+	if !errors.Is(err, ErrAccountNotFound) {
+		return acme.Account{}, err
+	}
+
+	// Domains registered before accounts were shared carry their own account key;
+	// adopt its account when the CA still knows it instead of creating another one.
+	if legacyPrivateKey, err := x509.ParseECPrivateKey(legacyKey); len(legacyKey) > 0 && err == nil {
+		account.PrivateKey = legacyPrivateKey
+		if existing, err := client.GetAccount(ctx, account); err == nil && existing.Status == acme.StatusValid {
+			account = existing
+		}
+	}
+
+	if account.Location == "" {
+		privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return acme.Account{}, fmt.Errorf("generating account key: %v", err)
+		}
+		account.PrivateKey = privateKey
+		if issuer.EAB != nil {
+			if err := account.SetExternalAccountBinding(ctx, client, *issuer.EAB); err != nil {
+				return acme.Account{}, fmt.Errorf("external account binding: %w", err)
+			}
+		}
+		account, err = client.NewAccount(ctx, account)
+		if err != nil {
+			return acme.Account{}, fmt.Errorf("new account: %w", err)
+		}
+	}
+
+	privateKeyBytes, err := x509.MarshalECPrivateKey(account.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		return acme.Account{}, err
+	}
+	err = s.storeAccount(&AcmeAccount{
+		Issuer:     issuer.Name,
+		Email:      email,
+		PrivateKey: privateKeyBytes,
+		Location:   account.Location,
+		Status:     account.Status,
+		CreatedAt:  time.Now().Unix(),
+	})
+	return account, err
+}
+
+// forgetAccount drops the stored account of email at issuer, e.g. after the CA
+// reported that it no longer exists. The next order registers a new account.
+func (s *Storage) forgetAccount(issuer, email string) {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+	_ = s.deleteAccount(accountKey(issuer, email))
+}
+
+// accountRejected reports whether err means the CA no longer accepts the account.
+func accountRejected(err error) bool {
+	var problem acme.Problem
+	return errors.As(err, &problem) &&
+		(problem.Type == acme.ProblemTypeAccountDoesNotExist || problem.Type == acme.ProblemTypeUnauthorized)
+}
+
+// ListAccounts returns the stored ACME accounts without their keys, ordered by issuer and email.
+// Returns:
+//   - []AccountInfo: the accounts.
+//   - error: error if the accounts cannot be read from Redis.
+func (s *Storage) ListAccounts() ([]AccountInfo, error) {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+
+	var accounts []*AcmeAccount
+	if s.RedisClient != nil {
+		keys, err := scanKeys(context.Background(), s.RedisClient, acmeAccountKeyPrefix+"*")
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			account, err := s.loadAccount(key)
+			if err != nil {
+				continue
+			}
+			accounts = append(accounts, account)
+		}
+	} else {
+		for _, account := range s.AcmeAccounts {
+			accounts = append(accounts, account)
+		}
+	}
+
+	infos := make([]AccountInfo, 0, len(accounts))
+	for _, account := range accounts {
+		infos = append(infos, account.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Issuer != infos[j].Issuer {
+			return infos[i].Issuer < infos[j].Issuer
+		}
+		return infos[i].Email < infos[j].Email
+	})
+	return infos, nil
+}
+
+// RolloverAccountKey replaces the key of a stored ACME account at the CA and in storage.
+// Parameters:
+//   - issuerName: string, the issuer of the account; empty selects the first issuer.
+//   - email: string, the contact email of the account.
+//
+// Returns:
+//   - *AccountInfo: the updated account.
+//   - error: error if the account is unknown or the CA rejects the new key.
+func (s *Storage) RolloverAccountKey(issuerName, email string) (*AccountInfo, error) {
+	issuer, err := s.findIssuer(issuerName)
+	if err != nil {
+		return nil, err
+	}
+
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+
+	stored, client, account, err := s.storedAccount(issuer, email)
+	if err != nil {
+		return nil, err
+	}
+
+	newPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating account key: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if _, err := client.AccountKeyRollover(ctx, account, newPrivateKey); err != nil {
+		return nil, err
+	}
+
+	privateKeyBytes, err := x509.MarshalECPrivateKey(newPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	updated := proto.Clone(stored).(*AcmeAccount)
+	updated.PrivateKey = privateKeyBytes
+	updated.KeyRolledAt = time.Now().Unix()
+	if err := s.storeAccount(updated); err != nil {
+		return nil, err
+	}
+	info := updated.info()
+	return &info, nil
+}
+
+// DeactivateAccount deactivates a stored ACME account at the CA and removes it
+// from storage. The next order for the email registers a new account.
+// Parameters:
+//   - issuerName: string, the issuer of the account; empty selects the first issuer.
+//   - email: string, the contact email of the account.
+//
+// Returns:
+//   - error: error if the account is unknown or the CA rejects the deactivation.
+func (s *Storage) DeactivateAccount(issuerName, email string) error {
+	issuer, err := s.findIssuer(issuerName)
+	if err != nil {
+		return err
+	}
+
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+
+	stored, client, account, err := s.storedAccount(issuer, email)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	account.Status = acme.StatusDeactivated
+	if _, err := client.UpdateAccount(ctx, account); err != nil {
+		return err
+	}
+	return s.deleteAccount(accountKey(stored.Issuer, stored.Email))
+}
+
+// storedAccount loads the account of email at issuer together with a client for
+// the issuer; callers hold accountLock.
+func (s *Storage) storedAccount(issuer *ACMEIssuer, email string) (*AcmeAccount, *acme.Client, acme.Account, error) {
+	stored, err := s.loadAccount(accountKey(issuer.Name, email))
+	if err != nil {
+		return nil, nil, acme.Account{}, err
+	}
+	privateKey, err := x509.ParseECPrivateKey(stored.PrivateKey)
+	if err != nil {
+		return nil, nil, acme.Account{}, err
+	}
+	client, err := s.newACMEClient(issuer)
+	if err != nil {
+		return nil, nil, acme.Account{}, err
+	}
+	account := acme.Account{Location: stored.Location, Status: stored.Status, PrivateKey: privateKey}
+	return stored, client, account, nil
+}
+
+// findIssuer returns the issuer named name, the first issuer when name is empty,
+// or an error when no issuer has that name or it is not an ACME issuer.
+func (s *Storage) findIssuer(name string) (*ACMEIssuer, error) {
+	if err := s.ValidateIssuer(name); err != nil {
+		return nil, err
+	}
+	issuer := s.issuer(name)
+	if issuer.Local != nil {
+		return nil, fmt.Errorf("issuer %q is a local CA and has no ACME accounts", issuer.Name)
+	}
+	return issuer, nil
+}
+
+// ExportAccounts returns the ACME accounts kept in memory, for persistence.
+func (s *Storage) ExportAccounts() []*AcmeAccount {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+	accounts := make([]*AcmeAccount, 0, len(s.AcmeAccounts))
+	for _, account := range s.AcmeAccounts {
+		accounts = append(accounts, account)
+	}
+	return accounts
+}
+
+// ImportAccounts stores persisted ACME accounts, replacing accounts with the same issuer and email.
+// Parameters:
+//   - accounts: []*AcmeAccount, the accounts to store.
+//
+// Returns:
+//   - error: error if an account cannot be stored.
+func (s *Storage) ImportAccounts(accounts []*AcmeAccount) error {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+	for _, account := range accounts {
+		if err := s.storeAccount(account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAccount reads an account from memory or Redis; callers hold accountLock.
+func (s *Storage) loadAccount(key string) (*AcmeAccount, error) {
+	if s.RedisClient != nil {
+		body, err := s.RedisClient.Get(context.Background(), key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			return nil, ErrAccountNotFound
+		}
+		if err != nil {
+			return nil, err
+		}
+		account := &AcmeAccount{}
+		if err := proto.Unmarshal(body, account); err != nil {
+			return nil, err
+		}
+		if IsSealed(account.PrivateKey) {
+			if s.Encryption == nil {
+				return nil, ErrSealedWithoutKey
+			}
+			account.PrivateKey, err = s.Encryption.Open(account.PrivateKey, accountKeyAssociatedData(key))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return account, nil
+	}
+
+	account, ok := s.AcmeAccounts[key]
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+	return account, nil
+}
+
+// storeAccount writes an account to memory or Redis; callers hold accountLock.
+func (s *Storage) storeAccount(account *AcmeAccount) error {
+	key := accountKey(account.Issuer, account.Email)
+	if s.RedisClient != nil {
+		if s.Encryption != nil {
+			sealed, err := s.Encryption.Seal(account.PrivateKey, accountKeyAssociatedData(key))
+			if err != nil {
+				return err
+			}
+			account = proto.Clone(account).(*AcmeAccount)
+			account.PrivateKey = sealed
+		}
+		body, err := proto.Marshal(account)
+		if err != nil {
+			return err
+		}
+		return s.RedisClient.Set(context.Background(), key, body, 0).Err()
+	}
+
+	if s.AcmeAccounts == nil {
+		s.AcmeAccounts = make(map[string]*AcmeAccount)
+	}
+	s.AcmeAccounts[key] = account
+	return nil
+}
+
+// accountKeyAssociatedData binds an encrypted account key to its storage key.
+func accountKeyAssociatedData(key string) []byte {
+	return []byte("account/" + key)
+}
+
+// resealAccounts encrypts again, with the active master key, every account in
+// Redis whose key is in plaintext or encrypted with an older master key.
+// Returns:
+//   - int: the number of accounts rewritten.
+//   - error: error if an account cannot be read or written.
+func (s *Storage) resealAccounts() (int, error) {
+	s.accountLock.Lock()
+	defer s.accountLock.Unlock()
+	if s.RedisClient == nil {
+		return 0, nil // Memory accounts only reach disk in the encrypted persistence file.
+	}
+
+	ctx := context.Background()
+	resealed := 0
+	keys, err := scanKeys(ctx, s.RedisClient, acmeAccountKeyPrefix+"*")
+	if err != nil {
+		return 0, err
+	}
+	for _, key := range keys {
+		body, err := s.RedisClient.Get(ctx, key).Bytes()
+		if err != nil {
+			continue // Deleted while scanning.
+		}
+		stored := &AcmeAccount{}
+		if err := proto.Unmarshal(body, stored); err != nil {
+			return resealed, err
+		}
+		if keyID, ok := SealedKeyID(stored.PrivateKey); ok && keyID == s.Encryption.KeyID() {
+			continue
+		}
+		account, err := s.loadAccount(key)
+		if err != nil {
+			return resealed, err
+		}
+		if err := s.storeAccount(account); err != nil {
+			return resealed, err
+		}
+		resealed++
+	}
+	return resealed, nil
+}
+
+// deleteAccount removes an account from memory or Redis; callers hold accountLock.
+func (s *Storage) deleteAccount(key string) error {
+	if s.RedisClient != nil {
+		return s.RedisClient.Del(context.Background(), key).Err()
+	}
+	delete(s.AcmeAccounts, key)
+	return nil
+}
@@ -0,0 +1,130 @@
+package domains
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"testing"
+)
+
+func TestACMEAccount_SharedAcrossDomains(t *testing.T) {
+	server := startFakeACMEServer(t)
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{server.issuer("ca")}
+
+	for _, domainName := range []string{"a.example.com", "b.example.com"} {
+		if _, err := st.obtainCertificate(newIssuerTestDomain(t, st, domainName)); err != nil {
+			t.Fatalf("obtain %s: %v", domainName, err)
+		}
+	}
+	if server.accountCount() != 1 {
+		t.Fatalf("expected one account for both domains, got %d", server.accountCount())
+	}
+
+	other, _ := st.prepareDomainMetadata("c.example.com", "security@example.com", nil)
+	if _, err := st.obtainCertificate(other); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	accounts, err := st.ListAccounts()
+	if err != nil {
+		t.Fatalf("list accounts: %v", err)
+	}
+	if server.accountCount() != 2 || len(accounts) != 2 || accounts[0].Email != "ops@example.com" || accounts[1].Email != "security@example.com" {
+		t.Fatalf("expected one account per email, got %d: %+v", server.accountCount(), accounts)
+	}
+	if accounts[0].Issuer != "ca" || accounts[0].Location != server.URL+"/account/1" || accounts[0].Status != "valid" {
+		t.Fatalf("unexpected account: %+v", accounts[0])
+	}
+
+	// Accounts survive a restart through persistence.
+	restored := newTestIssuanceStorage()
+	restored.Issuers = st.Issuers
+	if err := restored.ImportAccounts(st.ExportAccounts()); err != nil {
+		t.Fatalf("import accounts: %v", err)
+	}
+	if _, err := restored.obtainCertificate(newIssuerTestDomain(t, restored, "d.example.com")); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if server.accountCount() != 2 {
+		t.Fatalf("expected the restored account to be reused, got %d accounts", server.accountCount())
+	}
+}
+
+func TestACMEAccount_AdoptsLegacyDomainKey(t *testing.T) {
+	server := startFakeACMEServer(t)
+	server.existingAccount = true
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{server.issuer("ca")}
+
+	legacyKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	legacyKeyBytes, _ := x509.MarshalECPrivateKey(legacyKey)
+	domainMetadata := newIssuerTestDomain(t, st, "legacy.example.com")
+	domainMetadata.AcmeAccountPrivateKey = legacyKeyBytes
+
+	if _, err := st.obtainCertificate(domainMetadata); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if server.accountCount() != 0 {
+		t.Fatalf("expected the existing account to be adopted, %d accounts created", server.accountCount())
+	}
+	if stored := st.AcmeAccounts[accountKey("ca", "ops@example.com")]; stored == nil || !bytes.Equal(stored.PrivateKey, legacyKeyBytes) {
+		t.Fatalf("expected the legacy key to be stored as the shared account")
+	}
+}
+
+func TestACMEAccount_RolloverAndDeactivate(t *testing.T) {
+	server := startFakeACMEServer(t)
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{server.issuer("ca")}
+
+	if _, err := st.RolloverAccountKey("ca", "ops@example.com"); !errors.Is(err, ErrAccountNotFound) {
+		t.Fatalf("expected an unknown account to be reported, got %v", err)
+	}
+	if _, err := st.RolloverAccountKey("other", "ops@example.com"); err == nil {
+		t.Fatalf("expected an unknown issuer to be rejected")
+	}
+
+	if _, err := st.obtainCertificate(newIssuerTestDomain(t, st, "example.com")); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	key := accountKey("ca", "ops@example.com")
+	oldKey := st.AcmeAccounts[key].PrivateKey
+
+	info, err := st.RolloverAccountKey("", "ops@example.com")
+	if err != nil {
+		t.Fatalf("rollover: %v", err)
+	}
+	if server.keyChanges != 1 || bytes.Equal(st.AcmeAccounts[key].PrivateKey, oldKey) || info.KeyRolledAt.IsZero() {
+		t.Fatalf("expected the account key to be replaced")
+	}
+
+	if err := st.DeactivateAccount("ca", "ops@example.com"); err != nil {
+		t.Fatalf("deactivate: %v", err)
+	}
+	if server.deactivated != 1 || st.AcmeAccounts[key] != nil {
+		t.Fatalf("expected the account to be deactivated and removed")
+	}
+	if _, err := st.obtainCertificate(newIssuerTestDomain(t, st, "example.com")); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if server.accountCount() != 2 {
+		t.Fatalf("expected a new account after deactivation, got %d", server.accountCount())
+	}
+}
+
+func TestACMEAccount_ForgottenWhenRejected(t *testing.T) {
+	server := startFakeACMEServer(t)
+	server.rejectAccounts = true
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{server.issuer("ca")}
+
+	if _, err := st.obtainCertificate(newIssuerTestDomain(t, st, "example.com")); err == nil {
+		t.Fatalf("expected the order to fail")
+	}
+	if accounts, _ := st.ListAccounts(); len(accounts) != 0 {
+		t.Fatalf("expected the rejected account to be forgotten, got %+v", accounts)
+	}
+}
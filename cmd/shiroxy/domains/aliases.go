@@ -0,0 +1,114 @@
+package domains
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Names returns every hostname covered by the domain: the domain itself followed by its aliases.
+// Returns:
+//   - []string: the covered hostnames.
+func (x *DomainMetadata) Names() []string {
+	names := make([]string, 0, 1+len(x.GetAliases()))
+	names = append(names, x.GetDomain())
+	return append(names, x.GetAliases()...)
+}
+
+// normalizeAliases validates aliases and removes duplicates and the primary domain itself.
+// Parameters:
+//   - domainName: string, the primary domain.
+//   - aliases: []string, the requested aliases.
+//
+// Returns:
+//   - []string: the cleaned aliases.
+//   - error: error if an alias is not a valid domain name.
+func normalizeAliases(domainName string, aliases []string) ([]string, error) {
+	seen := map[string]bool{strings.ToLower(domainName): true}
+	cleaned := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		alias = strings.TrimSpace(alias)
+		if err := ValidateDomainName(alias); err != nil {
+			return nil, fmt.Errorf("alias: %v", err)
+		}
+		key := strings.ToLower(alias)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		cleaned = append(cleaned, alias)
+	}
+	return cleaned, nil
+}
+
+// checkAliasConflicts verifies that none of the names is already served by another domain.
+// Callers hold domainLock.
+// Parameters:
+//   - domainName: string, the domain the names will belong to.
+//   - names: []string, the names to check.
+//
+// Returns:
+//   - error: error naming the first conflicting hostname.
+func (s *Storage) checkAliasConflicts(domainName string, names []string) error {
+	snapshot := s.Domains().Snapshot()
+	for _, name := range names {
+		if owner, ok := snapshot.owner(name); ok && owner != domainName {
+			return fmt.Errorf("%s is already served by %s", name, owner)
+		}
+	}
+	return nil
+}
+
+// SetAliases replaces the aliases of a registered domain and requests a new
+// certificate covering them.
+// Parameters:
+//   - domainName: string, the domain to update.
+//   - aliases: []string, the new aliases.
+//
+// Returns:
+//   - error: error if an alias is invalid, already in use, or the domain does not exist.
+func (s *Storage) SetAliases(domainName string, aliases []string) error {
+	aliases, err := normalizeAliases(domainName, aliases)
+	if err != nil {
+		return err
+	}
+
+	s.domainLock.RLock()
+	err = s.checkAliasConflicts(domainName, aliases)
+	s.domainLock.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	manual, coverErr := false, error(nil)
+	err = s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		manual = domainMetadata.ManualCertificate
+		if manual {
+			// An uploaded certificate must already cover the new aliases.
+			_, coverErr = ValidateCertificateChain(domainMetadata.CertPemBlock, domainMetadata.KeyPemBlock, aliases, time.Now())
+			if coverErr != nil {
+				return
+			}
+		}
+		domainMetadata.Aliases = aliases
+	})
+	if err == nil {
+		err = coverErr
+	}
+	if err != nil || manual {
+		return err
+	}
+	return s.requestCertificate(domainName)
+}
+
+// ResolveDomain returns the domain serving a hostname. The hostname may be the
+// domain itself, one of its aliases, or a name covered by a wildcard domain or alias.
+// Parameters:
+//   - hostname: string, the hostname to resolve (SNI or Host header without port).
+//
+// Returns:
+//   - *DomainMetadata: the domain serving the hostname.
+//   - bool: false if no domain covers the hostname.
+func (s *Storage) ResolveDomain(hostname string) (*DomainMetadata, bool) {
+	return s.Domains().Resolve(hostname)
+}
@@ -0,0 +1,129 @@
+package domains
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shiroxy/pkg/models"
+)
+
+func TestResolveDomain(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.Domains().Put(&DomainMetadata{Domain: "example.com", Aliases: []string{"www.example.com", "*.example.org"}})
+	st.Domains().Put(&DomainMetadata{Domain: "*.wild.net"})
+
+	cases := map[string]string{
+		"example.com":        "example.com",
+		"WWW.Example.com":    "example.com",
+		"www.example.com.":   "example.com",
+		"shop.example.org":   "example.com",
+		"api.wild.net":       "*.wild.net",
+		"example.org":        "",
+		"a.b.example.org":    "",
+		"wild.net":           "",
+		"unknown.example.io": "",
+	}
+	for hostname, want := range cases {
+		domainMetadata, ok := st.ResolveDomain(hostname)
+		if want == "" {
+			if ok {
+				t.Errorf("expected %q not to resolve, got %s", hostname, domainMetadata.Domain)
+			}
+			continue
+		}
+		if !ok || domainMetadata.Domain != want {
+			t.Errorf("expected %q to resolve to %s, got %v", hostname, want, domainMetadata)
+		}
+	}
+}
+
+func TestRegister_AliasesIssuedAsOneCertificate(t *testing.T) {
+	st := newTestIssuanceStorage()
+	var requested []string
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		requested = domainMetadata.Names()
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(time.Hour)), nil
+	}
+
+	_, err := st.Register(DomainRegistration{
+		Domain:  "example.com",
+		Email:   "a@b.com",
+		Aliases: []string{"www.example.com", "WWW.example.com", "example.com", "shop.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if strings.Join(requested, ",") != "example.com,www.example.com,shop.example.com" {
+		t.Fatalf("unexpected names on the certificate order: %v", requested)
+	}
+
+	if _, err := st.Register(DomainRegistration{Domain: "shop.example.com", Email: "a@b.com"}); err == nil {
+		t.Fatalf("expected registering a name already served as an alias to fail")
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "other.com", Email: "a@b.com", Aliases: []string{"www.example.com"}}); err == nil {
+		t.Fatalf("expected an alias already served by another domain to be rejected")
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "other.com", Email: "a@b.com", Aliases: []string{"bad_alias.com"}}); err == nil {
+		t.Fatalf("expected an invalid alias to be rejected")
+	}
+}
+
+func TestSetAliasesAndRemoveDomain(t *testing.T) {
+	st := newTestIssuanceStorage()
+	issued := 0
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		issued++
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(time.Hour)), nil
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com", Aliases: []string{"www.example.com"}}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	if err := st.SetAliases("example.com", []string{"api.example.com"}); err != nil {
+		t.Fatalf("set aliases: %v", err)
+	}
+	if issued != 2 {
+		t.Fatalf("expected changing aliases to reissue the certificate, issued %d times", issued)
+	}
+	if _, ok := st.ResolveDomain("www.example.com"); ok {
+		t.Fatalf("expected removed alias to stop resolving")
+	}
+	if domainMetadata, ok := st.ResolveDomain("api.example.com"); !ok || domainMetadata.Domain != "example.com" {
+		t.Fatalf("expected new alias to resolve")
+	}
+
+	if err := st.RemoveDomain("example.com"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, ok := st.ResolveDomain("api.example.com"); ok {
+		t.Fatalf("expected aliases of a removed domain to stop resolving")
+	}
+}
+
+func TestResolveDomain_ConcurrentWithUpdates(t *testing.T) {
+	st := &Storage{Storage: &models.Storage{Location: "memory"}}
+	st.Domains().Put(&DomainMetadata{Domain: "example.com", Aliases: []string{"www.example.com"}})
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			_ = st.updateDomainMetadata("example.com", func(domainMetadata *DomainMetadata) {
+				domainMetadata.Status = "active"
+			})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			if _, ok := st.ResolveDomain("www.example.com"); !ok {
+				t.Errorf("alias stopped resolving during an update")
+				return
+			}
+		}
+	}()
+	wg.Wait()
+}
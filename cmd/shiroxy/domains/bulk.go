@@ -0,0 +1,597 @@
+package domains
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Formats of the domain lists read and written by the bulk operations.
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Actions reported for each domain by the bulk operations.
+const (
+	BulkCreate    = "create"
+	BulkUpdate    = "update"
+	BulkRemove    = "remove"
+	BulkUnchanged = "unchanged"
+	BulkFailed    = "failed"
+)
+
+// csvColumns are the columns of a CSV domain list besides the metadata.<label> columns.
+var csvColumns = []string{"domain", "email", "aliases", "tags", "backend", "challenge", "issuer", "status"}
+
+// csvMetadataPrefix prefixes the CSV columns holding metadata labels.
+const csvMetadataPrefix = "metadata."
+
+// DomainRecord is the portable description of a domain used by bulk imports,
+// exports and reconciliation. A record holds the desired value of every field it
+// describes: an empty field clears the stored value.
+type DomainRecord struct {
+	Domain    string            `json:"domain"`
+	Email     string            `json:"email"`
+	Aliases   []string          `json:"aliases,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Backend   string            `json:"backend,omitempty"`
+	Challenge string            `json:"challenge,omitempty"`
+	Issuer    string            `json:"issuer,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Status    string            `json:"status,omitempty"` // Exported for information; ignored on import.
+}
+
+// BulkResult reports what a bulk operation did, or would do, to a domain.
+type BulkResult struct {
+	Domain  string   `json:"domain"`
+	Action  string   `json:"action"`
+	Changes []string `json:"changes,omitempty"` // Fields of an updated domain that changed.
+	Error   string   `json:"error,omitempty"`
+}
+
+// BulkReport holds the per-domain results of a bulk operation.
+type BulkReport struct {
+	DryRun    bool         `json:"dry_run"`
+	Created   int          `json:"created"`
+	Updated   int          `json:"updated"`
+	Removed   int          `json:"removed"`
+	Unchanged int          `json:"unchanged"`
+	Failed    int          `json:"failed"`
+	Results   []BulkResult `json:"results"`
+}
+
+// BulkOptions controls how domain records are applied.
+type BulkOptions struct {
+	DryRun   bool                            // Report the changes without making them.
+	Prune    bool                            // Remove the domains missing from the records.
+	Validate func(record DomainRecord) error // Additional checks of each record, e.g. that its backend exists (optional).
+}
+
+// DetectFormat returns the domain list format named by a content type or by the
+// extension of a file name or URL path.
+// Parameters:
+//   - name: string, the content type, file name or URL path.
+//
+// Returns:
+//   - string: FormatJSON, FormatCSV, FormatNDJSON, or "" if the format is unknown.
+func DetectFormat(name string) string {
+	if mediaType, _, err := mime.ParseMediaType(name); err == nil && strings.Contains(mediaType, "/") {
+		switch mediaType {
+		case "application/json":
+			return FormatJSON
+		case "text/csv":
+			return FormatCSV
+		case "application/x-ndjson", "application/ndjson", "application/jsonl":
+			return FormatNDJSON
+		}
+		return ""
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".json":
+		return FormatJSON
+	case ".csv":
+		return FormatCSV
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	}
+	return ""
+}
+
+// FormatContentType returns the content type of a domain list format.
+// Parameters:
+//   - format: string, the domain list format.
+//
+// Returns:
+//   - string: the content type.
+func FormatContentType(format string) string {
+	switch format {
+	case FormatCSV:
+		return "text/csv"
+	case FormatNDJSON:
+		return "application/x-ndjson"
+	}
+	return "application/json"
+}
+
+// DecodeDomainRecords reads a domain list. Unknown fields and columns are
+// rejected, so that a misspelt field does not clear a value.
+// Parameters:
+//   - reader: io.Reader, the domain list.
+//   - format: string, FormatJSON, FormatCSV or FormatNDJSON.
+//
+// Returns:
+//   - []DomainRecord: the domain records.
+//   - error: error if the list is malformed or the format is unknown.
+func DecodeDomainRecords(reader io.Reader, format string) ([]DomainRecord, error) {
+	switch format {
+	case FormatJSON:
+		decoder := json.NewDecoder(reader)
+		decoder.DisallowUnknownFields()
+		var records []DomainRecord
+		if err := decoder.Decode(&records); err != nil {
+			return nil, fmt.Errorf("json domain list: %v", err)
+		}
+		return records, nil
+	case FormatNDJSON:
+		return decodeNDJSONRecords(reader)
+	case FormatCSV:
+		return decodeCSVRecords(reader)
+	}
+	return nil, fmt.Errorf("unknown domain list format %q; use json, csv or ndjson", format)
+}
+
+// decodeNDJSONRecords reads a domain list with one JSON record per line.
+func decodeNDJSONRecords(reader io.Reader) ([]DomainRecord, error) {
+	var records []DomainRecord
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		decoder := json.NewDecoder(bytes.NewReader(text))
+		decoder.DisallowUnknownFields()
+		var record DomainRecord
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("ndjson domain list, line %d: %v", line, err)
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("ndjson domain list: %v", err)
+	}
+	return records, nil
+}
+
+// decodeCSVRecords reads a CSV domain list. The header names the columns; aliases
+// and tags hold comma separated lists and metadata.<label> columns hold labels.
+func decodeCSVRecords(reader io.Reader) ([]DomainRecord, error) {
+	rows := csv.NewReader(reader)
+	rows.TrimLeadingSpace = true
+	header, err := rows.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("csv domain list: %v", err)
+	}
+	for i, column := range header {
+		header[i] = strings.TrimSpace(column)
+		if name := strings.ToLower(header[i]); containsString(csvColumns, name) {
+			header[i] = name
+		} else if !strings.HasPrefix(name, csvMetadataPrefix) {
+			return nil, fmt.Errorf("csv domain list: unknown column %q", column)
+		}
+	}
+
+	var records []DomainRecord
+	for {
+		row, err := rows.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("csv domain list: %v", err)
+		}
+		var record DomainRecord
+		for i, value := range row {
+			switch column := header[i]; column {
+			case "domain":
+				record.Domain = value
+			case "email":
+				record.Email = value
+			case "aliases":
+				record.Aliases = SplitTags(value)
+			case "tags":
+				record.Tags = SplitTags(value)
+			case "backend":
+				record.Backend = value
+			case "challenge":
+				record.Challenge = value
+			case "issuer":
+				record.Issuer = value
+			case "status":
+				record.Status = value
+			default:
+				if value == "" {
+					continue
+				}
+				if record.Metadata == nil {
+					record.Metadata = make(map[string]string)
+				}
+				record.Metadata[column[len(csvMetadataPrefix):]] = value
+			}
+		}
+		records = append(records, record)
+	}
+}
+
+// EncodeDomainRecords writes a domain list.
+// Parameters:
+//   - writer: io.Writer, the destination.
+//   - format: string, FormatJSON, FormatCSV or FormatNDJSON.
+//   - records: []DomainRecord, the domain records.
+//
+// Returns:
+//   - error: error if the list cannot be written or the format is unknown.
+func EncodeDomainRecords(writer io.Writer, format string, records []DomainRecord) error {
+	switch format {
+	case FormatJSON:
+		if records == nil {
+			records = []DomainRecord{}
+		}
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(records)
+	case FormatNDJSON:
+		encoder := json.NewEncoder(writer)
+		for _, record := range records {
+			if err := encoder.Encode(record); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		return encodeCSVRecords(writer, records)
+	}
+	return fmt.Errorf("unknown domain list format %q; use json, csv or ndjson", format)
+}
+
+// encodeCSVRecords writes a CSV domain list with a metadata.<label> column per label in use.
+func encodeCSVRecords(writer io.Writer, records []DomainRecord) error {
+	labelSet := map[string]bool{}
+	for _, record := range records {
+		for label := range record.Metadata {
+			labelSet[label] = true
+		}
+	}
+	labels := make([]string, 0, len(labelSet))
+	for label := range labelSet {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+
+	rows := csv.NewWriter(writer)
+	header := append([]string{}, csvColumns...)
+	for _, label := range labels {
+		header = append(header, csvMetadataPrefix+label)
+	}
+	if err := rows.Write(header); err != nil {
+		return err
+	}
+	for _, record := range records {
+		row := []string{
+			record.Domain,
+			record.Email,
+			strings.Join(record.Aliases, ","),
+			strings.Join(record.Tags, ","),
+			record.Backend,
+			record.Challenge,
+			record.Issuer,
+			record.Status,
+		}
+		for _, label := range labels {
+			row = append(row, record.Metadata[label])
+		}
+		if err := rows.Write(row); err != nil {
+			return err
+		}
+	}
+	rows.Flush()
+	return rows.Error()
+}
+
+// ExportDomains describes every registered domain, sorted by name.
+// Returns:
+//   - []DomainRecord: the domain records.
+func (s *Storage) ExportDomains() []DomainRecord {
+	domains := s.Domains().Snapshot().List()
+	records := make([]DomainRecord, 0, len(domains))
+	for _, domainMetadata := range domains {
+		records = append(records, DomainRecord{
+			Domain:    domainMetadata.Domain,
+			Email:     domainMetadata.Email,
+			Aliases:   domainMetadata.Aliases,
+			Tags:      domainMetadata.GetRouting().GetTags(),
+			Backend:   domainMetadata.GetRouting().GetBackend(),
+			Challenge: domainMetadata.PreferredChallenge,
+			Issuer:    domainMetadata.Issuer,
+			Metadata:  domainMetadata.Metadata,
+			Status:    domainMetadata.Status,
+		})
+	}
+	return records
+}
+
+// ApplyDomainRecords registers the domains of records that are missing and updates
+// those that differ. With options.Prune, registered domains missing from records
+// are removed, except those registered by on-demand TLS.
+// Parameters:
+//   - records: []DomainRecord, the desired domains.
+//   - options: BulkOptions, dry run, pruning and additional validation.
+//
+// Returns:
+//   - *BulkReport: the result for every domain.
+//   - error: error if pruning was requested with an empty list.
+func (s *Storage) ApplyDomainRecords(records []DomainRecord, options BulkOptions) (*BulkReport, error) {
+	if options.Prune && len(records) == 0 {
+		// An empty answer from a broken source must not remove every domain.
+		return nil, errors.New("refusing to remove every domain for an empty domain list")
+	}
+
+	report := &BulkReport{DryRun: options.DryRun, Results: make([]BulkResult, 0, len(records))}
+	listed := make(map[string]bool, len(records))
+	for _, record := range records {
+		report.add(s.applyDomainRecord(record, listed, options))
+	}
+	if !options.Prune {
+		return report, nil
+	}
+
+	for _, domainMetadata := range s.Domains().Snapshot().List() {
+		if listed[domainMetadata.Domain] || domainMetadata.OnDemand {
+			continue
+		}
+		result := BulkResult{Domain: domainMetadata.Domain, Action: BulkRemove}
+		if !options.DryRun {
+			if err := s.RemoveDomain(domainMetadata.Domain); err != nil {
+				result.Action = BulkFailed
+				result.Error = err.Error()
+			}
+		}
+		report.add(result)
+	}
+	return report, nil
+}
+
+// applyDomainRecord registers or updates the domain of a single record.
+// Parameters:
+//   - record: DomainRecord, the desired domain.
+//   - listed: map[string]bool, the domains of the records applied so far; updated.
+//   - options: BulkOptions, dry run and additional validation.
+//
+// Returns:
+//   - BulkResult: the result for the domain.
+func (s *Storage) applyDomainRecord(record DomainRecord, listed map[string]bool, options BulkOptions) BulkResult {
+	record.Domain = strings.TrimSpace(record.Domain)
+	record.Email = strings.TrimSpace(record.Email)
+	result := BulkResult{Domain: record.Domain}
+	fail := func(err error) BulkResult {
+		result.Action = BulkFailed
+		result.Error = err.Error()
+		return result
+	}
+
+	if listed[record.Domain] {
+		return fail(errors.New("domain is listed more than once"))
+	}
+	// Marked before validation, so that pruning keeps a domain whose record is invalid.
+	listed[record.Domain] = true
+	aliases, err := s.validateDomainRecord(record)
+	if err != nil {
+		return fail(err)
+	}
+	if options.Validate != nil {
+		if err := options.Validate(record); err != nil {
+			return fail(err)
+		}
+	}
+
+	current, ok := s.Domains().Get(record.Domain)
+	if !ok {
+		result.Action = BulkCreate
+		if options.DryRun {
+			s.domainLock.RLock()
+			err = s.checkAliasConflicts(record.Domain, append([]string{record.Domain}, aliases...))
+			s.domainLock.RUnlock()
+		} else {
+			_, err = s.Register(DomainRegistration{
+				Domain:             record.Domain,
+				Email:              record.Email,
+				Metadata:           record.Metadata,
+				Routing:            record.routing(),
+				PreferredChallenge: record.Challenge,
+				Aliases:            aliases,
+				Issuer:             record.Issuer,
+			})
+		}
+		if err != nil {
+			return fail(err)
+		}
+		return result
+	}
+
+	result.Changes = recordChanges(current, record, aliases)
+	if len(result.Changes) == 0 {
+		result.Action = BulkUnchanged
+		return result
+	}
+	result.Action = BulkUpdate
+	if options.DryRun {
+		return result
+	}
+	if err := s.updateFromRecord(record, aliases, result.Changes); err != nil {
+		return fail(err)
+	}
+	return result
+}
+
+// validateDomainRecord checks a record before it is applied.
+// Parameters:
+//   - record: DomainRecord, the record to check.
+//
+// Returns:
+//   - []string: the normalized aliases of the record.
+//   - error: error if a field is missing or invalid.
+func (s *Storage) validateDomainRecord(record DomainRecord) ([]string, error) {
+	if err := ValidateDomainName(record.Domain); err != nil {
+		return nil, err
+	}
+	if record.Email == "" {
+		return nil, errors.New("email is required")
+	}
+	for _, label := range []string{legacyTagsKey, legacyCertURLKey, legacyCertCAKey, legacyCertIssuerKey} {
+		if _, ok := record.Metadata[label]; ok {
+			return nil, fmt.Errorf("metadata label %q is reserved", label)
+		}
+	}
+	if err := ValidateChallengeType(record.Challenge); err != nil {
+		return nil, err
+	}
+	if err := s.ValidateIssuer(record.Issuer); err != nil {
+		return nil, err
+	}
+	return normalizeAliases(record.Domain, record.Aliases)
+}
+
+// updateFromRecord applies the changed fields of a record to its registered domain.
+// Aliases are set last, since they request a certificate with the other settings.
+// Parameters:
+//   - record: DomainRecord, the desired domain.
+//   - aliases: []string, the normalized aliases of the record.
+//   - changes: []string, the changed fields.
+//
+// Returns:
+//   - error: error if the domain cannot be updated.
+func (s *Storage) updateFromRecord(record DomainRecord, aliases []string, changes []string) error {
+	for _, field := range []string{"email", "tags", "backend", "challenge", "metadata"} {
+		if !containsString(changes, field) {
+			continue
+		}
+		err := s.updateDomainMetadata(record.Domain, func(domainMetadata *DomainMetadata) {
+			domainMetadata.Email = record.Email
+			domainMetadata.PreferredChallenge = record.Challenge
+			domainMetadata.Routing = record.routing()
+			domainMetadata.Metadata = record.Metadata
+		})
+		if err != nil {
+			return err
+		}
+		break
+	}
+	if containsString(changes, "issuer") {
+		if err := s.SetIssuer(record.Domain, record.Issuer); err != nil {
+			return err
+		}
+	}
+	if containsString(changes, "aliases") {
+		if err := s.SetAliases(record.Domain, aliases); err != nil && !errors.Is(err, ErrManualCertificate) {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordChanges lists the fields of a registered domain that differ from its record.
+// Parameters:
+//   - current: *DomainMetadata, the registered domain.
+//   - record: DomainRecord, the desired domain.
+//   - aliases: []string, the normalized aliases of the record.
+//
+// Returns:
+//   - []string: the names of the changed fields.
+func recordChanges(current *DomainMetadata, record DomainRecord, aliases []string) []string {
+	var changes []string
+	routing := record.routing()
+	for _, field := range []struct {
+		name    string
+		changed bool
+	}{
+		{"email", current.Email != record.Email},
+		{"aliases", !equalStrings(current.Aliases, aliases)},
+		{"tags", !equalStrings(current.GetRouting().GetTags(), routing.GetTags())},
+		{"backend", current.GetRouting().GetBackend() != routing.GetBackend()},
+		{"challenge", current.PreferredChallenge != record.Challenge},
+		{"issuer", current.Issuer != record.Issuer},
+		{"metadata", len(current.Metadata) != len(record.Metadata) || len(record.Metadata) > 0 && !reflect.DeepEqual(current.Metadata, record.Metadata)},
+	} {
+		if field.changed {
+			changes = append(changes, field.name)
+		}
+	}
+	return changes
+}
+
+// routing returns the routing described by the record, or nil if it has none.
+func (r DomainRecord) routing() *DomainRouting {
+	var tags []string
+	for _, tag := range r.Tags {
+		tags = append(tags, SplitTags(tag)...)
+	}
+	if len(tags) == 0 && r.Backend == "" {
+		return nil
+	}
+	return &DomainRouting{Tags: tags, Backend: strings.TrimSpace(r.Backend)}
+}
+
+// add records the result of a domain in the report.
+func (r *BulkReport) add(result BulkResult) {
+	switch result.Action {
+	case BulkCreate:
+		r.Created++
+	case BulkUpdate:
+		r.Updated++
+	case BulkRemove:
+		r.Removed++
+	case BulkUnchanged:
+		r.Unchanged++
+	case BulkFailed:
+		r.Failed++
+	}
+	r.Results = append(r.Results, result)
+}
+
+// equalStrings reports whether two lists hold the same strings in the same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// containsString reports whether list holds value.
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
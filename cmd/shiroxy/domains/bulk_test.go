@@ -0,0 +1,323 @@
+package domains
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shiroxy/pkg/models"
+)
+
+// newTestBulkStorage returns a storage that issues certificates immediately.
+func newTestBulkStorage(t *testing.T) *Storage {
+	st := newTestIssuanceStorage()
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	return st
+}
+
+// resultActions maps each domain of a report to its action.
+func resultActions(report *BulkReport) map[string]string {
+	actions := map[string]string{}
+	for _, result := range report.Results {
+		actions[result.Domain] = result.Action
+	}
+	return actions
+}
+
+func TestDomainRecords_RoundTrip(t *testing.T) {
+	records := []DomainRecord{
+		{Domain: "example.com", Email: "a@b.com", Aliases: []string{"www.example.com"}, Tags: []string{"eu", "blue"}, Backend: "backend-1", Challenge: "dns-01", Issuer: "le", Metadata: map[string]string{"Team": "web"}, Status: "active"},
+		{Domain: "example.org", Email: "c@d.com"},
+	}
+	for _, format := range []string{FormatJSON, FormatCSV, FormatNDJSON} {
+		var buffer bytes.Buffer
+		if err := EncodeDomainRecords(&buffer, format, records); err != nil {
+			t.Fatalf("%s: encode: %v", format, err)
+		}
+		decoded, err := DecodeDomainRecords(&buffer, format)
+		if err != nil {
+			t.Fatalf("%s: decode: %v", format, err)
+		}
+		if !reflect.DeepEqual(decoded, records) {
+			t.Fatalf("%s: round trip changed the records: %+v", format, decoded)
+		}
+	}
+}
+
+func TestDecodeDomainRecords_RejectsUnknownFields(t *testing.T) {
+	inputs := map[string]string{
+		FormatJSON:   `[{"domain":"example.com","email":"a@b.com","tag":"eu"}]`,
+		FormatNDJSON: `{"domain":"example.com","email":"a@b.com","tag":"eu"}`,
+		FormatCSV:    "domain,email,tag\nexample.com,a@b.com,eu\n",
+	}
+	for format, input := range inputs {
+		if _, err := DecodeDomainRecords(strings.NewReader(input), format); err == nil {
+			t.Errorf("%s: expected an unknown field to be rejected", format)
+		}
+	}
+	if _, err := DecodeDomainRecords(strings.NewReader("[]"), "yaml"); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+}
+
+func TestDetectFormat(t *testing.T) {
+	cases := map[string]string{
+		"domains.csv":                     FormatCSV,
+		"/exports/domains.ndjson":         FormatNDJSON,
+		"domains.jsonl":                   FormatNDJSON,
+		"application/json; charset=utf-8": FormatJSON,
+		"text/csv":                        FormatCSV,
+		"application/x-ndjson":            FormatNDJSON,
+		"domains.yaml":                    "",
+	}
+	for name, want := range cases {
+		if got := DetectFormat(name); got != want {
+			t.Errorf("DetectFormat(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestApplyDomainRecords(t *testing.T) {
+	st := newTestBulkStorage(t)
+	for _, name := range []string{"keep.com", "change.com", "extra.com"} {
+		if _, err := st.Register(DomainRegistration{Domain: name, Email: "a@b.com"}); err != nil {
+			t.Fatalf("register %s: %v", name, err)
+		}
+	}
+	st.Domains().Put(&DomainMetadata{Domain: "ondemand.com", Email: "a@b.com", OnDemand: true})
+
+	records := []DomainRecord{
+		{Domain: "keep.com", Email: "a@b.com"},
+		{Domain: "change.com", Email: "new@b.com", Tags: []string{"eu"}, Metadata: map[string]string{"team": "web"}},
+		{Domain: "new.com", Email: "a@b.com", Aliases: []string{"www.new.com"}},
+		{Domain: "bad domain", Email: "a@b.com"},
+		{Domain: "new.com", Email: "a@b.com"},
+	}
+
+	report, err := st.ApplyDomainRecords(records, BulkOptions{DryRun: true, Prune: true})
+	if err != nil {
+		t.Fatalf("dry run: %v", err)
+	}
+	if !report.DryRun || report.Created != 1 || report.Updated != 1 || report.Unchanged != 1 || report.Removed != 1 || report.Failed != 2 {
+		t.Fatalf("unexpected dry run report: %+v", report)
+	}
+	if _, ok := st.Domains().Get("new.com"); ok {
+		t.Fatalf("expected a dry run not to register domains")
+	}
+	if _, ok := st.Domains().Get("extra.com"); !ok {
+		t.Fatalf("expected a dry run not to remove domains")
+	}
+
+	report, err = st.ApplyDomainRecords(records, BulkOptions{Prune: true})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	actions := resultActions(report)
+	want := map[string]string{
+		"keep.com":   BulkUnchanged,
+		"change.com": BulkUpdate,
+		"new.com":    BulkFailed, // Listed twice; the first record created it.
+		"bad domain": BulkFailed,
+		"extra.com":  BulkRemove,
+	}
+	if !reflect.DeepEqual(actions, want) {
+		t.Fatalf("unexpected actions: %v", actions)
+	}
+	if report.Results[1].Changes == nil || strings.Join(report.Results[1].Changes, ",") != "email,tags,metadata" {
+		t.Fatalf("unexpected changes: %v", report.Results[1].Changes)
+	}
+
+	changed, _ := st.Domains().Get("change.com")
+	if changed.Email != "new@b.com" || changed.GetRouting().GetTags()[0] != "eu" || changed.Metadata["team"] != "web" {
+		t.Fatalf("expected change.com to be updated, got %+v", changed)
+	}
+	created, ok := st.Domains().Get("new.com")
+	if !ok || strings.Join(created.Aliases, ",") != "www.new.com" {
+		t.Fatalf("expected new.com to be registered with its alias, got %+v", created)
+	}
+	if _, ok := st.Domains().Get("extra.com"); ok {
+		t.Fatalf("expected extra.com to be removed")
+	}
+	if _, ok := st.Domains().Get("ondemand.com"); !ok {
+		t.Fatalf("expected the on-demand domain to be kept")
+	}
+
+	report, err = st.ApplyDomainRecords(records[:3], BulkOptions{Prune: true})
+	if err != nil || report.Unchanged != 3 || len(report.Results) != 3 {
+		t.Fatalf("expected a second reconcile to change nothing, got %+v (%v)", report, err)
+	}
+}
+
+func TestApplyDomainRecords_Validation(t *testing.T) {
+	st := newTestBulkStorage(t)
+	validate := func(record DomainRecord) error {
+		if record.Backend == "missing" {
+			return errors.New("backend is not registered")
+		}
+		return nil
+	}
+	records := []DomainRecord{
+		{Domain: "noemail.com"},
+		{Domain: "reserved.com", Email: "a@b.com", Metadata: map[string]string{"tags": "eu"}},
+		{Domain: "backend.com", Email: "a@b.com", Backend: "missing"},
+	}
+	report, err := st.ApplyDomainRecords(records, BulkOptions{Validate: validate})
+	if err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	if report.Failed != 3 {
+		t.Fatalf("expected every record to fail, got %+v", report)
+	}
+	if len(st.Domains().Snapshot().List()) != 0 {
+		t.Fatalf("expected no domain to be registered")
+	}
+
+	if _, err := st.ApplyDomainRecords(nil, BulkOptions{Prune: true}); err == nil {
+		t.Fatalf("expected pruning with an empty list to be refused")
+	}
+}
+
+func TestExportDomains(t *testing.T) {
+	st := newTestBulkStorage(t)
+	_, err := st.Register(DomainRegistration{
+		Domain:   "b.com",
+		Email:    "a@b.com",
+		Routing:  &DomainRouting{Tags: []string{"eu"}, Backend: "backend-1"},
+		Metadata: map[string]string{"team": "web"},
+	})
+	if err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "a.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	records := st.ExportDomains()
+	if len(records) != 2 || records[0].Domain != "a.com" || records[1].Domain != "b.com" {
+		t.Fatalf("expected the domains sorted by name, got %+v", records)
+	}
+	if records[1].Backend != "backend-1" || records[1].Tags[0] != "eu" || records[1].Metadata["team"] != "web" || records[1].Status != "active" {
+		t.Fatalf("unexpected export: %+v", records[1])
+	}
+
+	report, err := st.ApplyDomainRecords(records, BulkOptions{Prune: true})
+	if err != nil || report.Unchanged != 2 {
+		t.Fatalf("expected the export to reconcile without changes, got %+v (%v)", report, err)
+	}
+}
+
+func TestDomainSync_File(t *testing.T) {
+	st := newTestBulkStorage(t)
+	if _, err := st.Register(DomainRegistration{Domain: "old.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	source := filepath.Join(t.TempDir(), "domains.ndjson")
+	if err := os.WriteFile(source, []byte(`{"domain":"new.com","email":"a@b.com"}`+"\n"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	wg := &sync.WaitGroup{}
+	domainSync, err := StartDomainSync(st, models.DomainSync{Source: source, Interval: 3600}, nil, nil, wg)
+	if err != nil {
+		t.Fatalf("start: %v", err)
+	}
+	defer func() {
+		domainSync.Stop()
+		wg.Wait()
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for domainSync.Status().LastSuccess.IsZero() {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the first sync to run, status %+v", domainSync.Status())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, ok := st.Domains().Get("new.com"); !ok {
+		t.Fatalf("expected new.com to be registered")
+	}
+	if _, ok := st.Domains().Get("old.com"); ok {
+		t.Fatalf("expected old.com to be removed")
+	}
+	if status := domainSync.Status(); status.Report.Created != 1 || status.Report.Removed != 1 || status.Interval != 3600 {
+		t.Fatalf("unexpected status: %+v", status)
+	}
+}
+
+func TestDomainSync_HTTP(t *testing.T) {
+	var mu sync.Mutex
+	body := `[{"domain":"example.com","email":"a@b.com"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	defer server.Close()
+
+	st := newTestBulkStorage(t)
+	recorder := &eventRecorder{}
+	domainSync := &DomainSync{
+		storage: st,
+		notify:  recorder.notify,
+		source:  server.URL + "/domains",
+		headers: map[string]string{"Authorization": "Bearer token"},
+		client:  server.Client(),
+	}
+
+	report, err := domainSync.Sync(true)
+	if err != nil || report.Created != 1 {
+		t.Fatalf("unexpected dry run: %+v (%v)", report, err)
+	}
+	if _, ok := st.Domains().Get("example.com"); ok {
+		t.Fatalf("expected a dry run not to register the domain")
+	}
+	if report, err = domainSync.Sync(false); err != nil || report.Created != 1 {
+		t.Fatalf("unexpected sync: %+v (%v)", report, err)
+	}
+
+	// An empty list must not remove every domain.
+	mu.Lock()
+	body = `[]`
+	mu.Unlock()
+	if _, err := domainSync.Sync(false); err == nil {
+		t.Fatalf("expected an empty list to be refused")
+	}
+	if _, ok := st.Domains().Get("example.com"); !ok {
+		t.Fatalf("expected example.com to be kept")
+	}
+	if status := domainSync.Status(); status.Error == "" || status.Report.Created != 1 {
+		t.Fatalf("unexpected status after a failed sync: %+v", status)
+	}
+	if events := recorder.list(); len(events) != 1 || events[0].name != EventDomainSyncFailed {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+}
+
+func TestStartDomainSync_InvalidConfig(t *testing.T) {
+	st := newTestBulkStorage(t)
+	wg := &sync.WaitGroup{}
+	if domainSync, err := StartDomainSync(st, models.DomainSync{}, nil, nil, wg); domainSync != nil || err != nil {
+		t.Fatalf("expected no sync without a source, got %v (%v)", domainSync, err)
+	}
+	if _, err := StartDomainSync(st, models.DomainSync{Source: "ftp://example.com/domains.json"}, nil, nil, wg); err == nil {
+		t.Fatalf("expected an ftp source to be rejected")
+	}
+	if _, err := StartDomainSync(st, models.DomainSync{Source: "domains.json", Format: "yaml"}, nil, nil, wg); err == nil {
+		t.Fatalf("expected an unknown format to be rejected")
+	}
+}
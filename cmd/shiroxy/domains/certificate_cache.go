@@ -0,0 +1,80 @@
+package domains
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+)
+
+// certificateCache holds parsed certificates by domain name so handshakes do not
+// parse PEM blocks on every connection. Names served by the same domain, e.g. the
+// subdomains of a wildcard, share its entry, so the cache holds at most one
+// certificate per registered domain.
+type certificateCache struct {
+	lock    sync.RWMutex
+	entries map[string]*cachedCertificate
+}
+
+// cachedCertificate is a parsed certificate together with the metadata it was parsed from.
+type cachedCertificate struct {
+	source      *DomainMetadata
+	certificate *tls.Certificate
+}
+
+// CachedCertificate returns the parsed certificate of domainMetadata.
+// The certificate is parsed once, with its Leaf populated and its OCSP response
+// stapled, and served from the cache until the domain is updated, renewed or removed.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain serving the handshake.
+//
+// Returns:
+//   - *tls.Certificate: the parsed certificate.
+//   - error: error if the stored certificate and key cannot be parsed.
+func (s *Storage) CachedCertificate(domainMetadata *DomainMetadata) (*tls.Certificate, error) {
+	key := domainMetadata.Domain
+
+	s.certificates.lock.RLock()
+	entry, ok := s.certificates.entries[key]
+	s.certificates.lock.RUnlock()
+	// The stored metadata is replaced rather than modified when its certificate
+	// changes, so a different source means the entry is stale.
+	if ok && entry.source == domainMetadata {
+		return entry.certificate, nil
+	}
+
+	certificate, err := tls.X509KeyPair(domainMetadata.CertPemBlock, domainMetadata.KeyPemBlock)
+	if err != nil {
+		return nil, err
+	}
+	if certificate.Leaf == nil {
+		certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(domainMetadata.OcspStaple) > 0 {
+		if chain, err := ParseCertificateChain(domainMetadata.CertPemBlock); err == nil {
+			certificate.OCSPStaple = validStaple(domainMetadata, chain)
+		}
+	}
+
+	s.certificates.lock.Lock()
+	if s.certificates.entries == nil {
+		s.certificates.entries = make(map[string]*cachedCertificate)
+	}
+	s.certificates.entries[key] = &cachedCertificate{
+		source:      domainMetadata,
+		certificate: &certificate,
+	}
+	s.certificates.lock.Unlock()
+	return &certificate, nil
+}
+
+// invalidateCertificates drops the cached certificate of domainName.
+// Parameters:
+//   - domainName: string, the domain whose certificate is dropped.
+func (s *Storage) invalidateCertificates(domainName string) {
+	s.certificates.lock.Lock()
+	defer s.certificates.lock.Unlock()
+	delete(s.certificates.entries, domainName)
+}
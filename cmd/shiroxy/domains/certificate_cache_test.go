@@ -0,0 +1,86 @@
+package domains
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestCachedCertificate(t *testing.T) {
+	now := time.Now()
+	st, _, _ := newTestRenewalManager(t, now, activeDomain(t, "example.com", now, now.Add(time.Hour)))
+	domainMetadata := registeredDomain(st, "example.com")
+
+	first, err := st.CachedCertificate(domainMetadata)
+	if err != nil {
+		t.Fatalf("cached certificate: %v", err)
+	}
+	if first.Leaf == nil || first.Leaf.DNSNames[0] != "example.com" {
+		t.Fatalf("expected leaf to be pre-parsed")
+	}
+	second, _ := st.CachedCertificate(domainMetadata)
+	if second != first {
+		t.Fatalf("expected repeated handshakes to be served from the cache")
+	}
+
+	// Renewal replaces the stored metadata, so the next handshake parses the new certificate.
+	if err := st.swapCertificate(domainMetadata, testCertificate(t, "example.com", now, now.Add(90*24*time.Hour)), nil); err != nil {
+		t.Fatalf("swap certificate: %v", err)
+	}
+	if len(st.certificates.entries) != 0 {
+		t.Fatalf("expected renewal to invalidate cached certificates")
+	}
+	renewed, err := st.CachedCertificate(registeredDomain(st, "example.com"))
+	if err != nil {
+		t.Fatalf("cached certificate after renewal: %v", err)
+	}
+	if renewed == first || !renewed.Leaf.NotAfter.After(now.Add(time.Hour)) {
+		t.Fatalf("expected the renewed certificate to be served")
+	}
+
+	if err := st.RemoveDomain("example.com"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if len(st.certificates.entries) != 0 {
+		t.Fatalf("expected removal to invalidate cached certificates")
+	}
+}
+
+func TestCachedCertificate_InvalidatedOnUpdate(t *testing.T) {
+	now := time.Now()
+	st, _, _ := newTestRenewalManager(t, now, activeDomain(t, "example.com", now, now.Add(time.Hour)))
+	if _, err := st.CachedCertificate(registeredDomain(st, "example.com")); err != nil {
+		t.Fatalf("cached certificate: %v", err)
+	}
+
+	if err := st.UpdateDomain("example.com", activeDomain(t, "example.com", now, now.Add(2*time.Hour))); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	if len(st.certificates.entries) != 0 {
+		t.Fatalf("expected update to invalidate cached certificates")
+	}
+}
+
+func TestCachedCertificate_OneEntryPerWildcardDomain(t *testing.T) {
+	now := time.Now()
+	st, _, _ := newTestRenewalManager(t, now, activeDomain(t, "*.example.com", now, now.Add(time.Hour)))
+
+	var served []*tls.Certificate
+	for _, serverName := range []string{"a.example.com", "b.example.com"} {
+		domainMetadata, ok := st.ResolveDomain(serverName)
+		if !ok {
+			t.Fatalf("expected %s to resolve to the wildcard domain", serverName)
+		}
+		certificate, err := st.CachedCertificate(domainMetadata)
+		if err != nil {
+			t.Fatalf("cached certificate for %s: %v", serverName, err)
+		}
+		served = append(served, certificate)
+	}
+	if served[0] != served[1] {
+		t.Fatalf("expected the subdomains to share the wildcard's certificate")
+	}
+	if len(st.certificates.entries) != 1 {
+		t.Fatalf("expected a single cache entry for the wildcard domain, got %d", len(st.certificates.entries))
+	}
+}
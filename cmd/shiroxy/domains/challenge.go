@@ -0,0 +1,244 @@
+package domains
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mholt/acmez"
+	"github.com/mholt/acmez/acme"
+)
+
+// Supported ACME challenge types.
+const (
+	ChallengeHTTP01    = "http-01"
+	ChallengeTLSALPN01 = "tls-alpn-01"
+	ChallengeDNS01     = "dns-01"
+)
+
+// ACMETLSALPNProtocol is the ALPN protocol a CA advertises when validating tls-alpn-01.
+const ACMETLSALPNProtocol = "acme-tls/1"
+
+// defaultChallengePreference is the order in which offered challenges are tried
+// when nothing else narrows the choice.
+var defaultChallengePreference = []string{ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01}
+
+// ValidateChallengeType checks that challengeType is empty or a supported challenge.
+func ValidateChallengeType(challengeType string) error {
+	switch challengeType {
+	case "", ChallengeHTTP01, ChallengeTLSALPN01, ChallengeDNS01:
+		return nil
+	default:
+		return fmt.Errorf("unsupported challenge type %q", challengeType)
+	}
+}
+
+// ValidateDomainName checks that name is a plausible DNS name. A single leading
+// "*." label is accepted for wildcard registrations.
+// Parameters:
+//   - name: string, the domain name to validate.
+//
+// Returns:
+//   - error: error describing why the name is invalid.
+func ValidateDomainName(name string) error {
+	if len(name) == 0 {
+		return fmt.Errorf("domainName should not be empty")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("domain %q is too long", name)
+	}
+
+	host := strings.TrimPrefix(name, "*.")
+	if strings.Contains(host, "*") {
+		return fmt.Errorf("domain %q: wildcard is only allowed as the leftmost label", name)
+	}
+
+	labels := strings.Split(host, ".")
+	if len(labels) < 2 {
+		return fmt.Errorf("domain %q must have at least two labels", name)
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return fmt.Errorf("domain %q has an empty or oversized label", name)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("domain %q: labels must not start or end with '-'", name)
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '-') {
+				return fmt.Errorf("domain %q contains invalid character %q", name, ch)
+			}
+		}
+	}
+	return nil
+}
+
+// IsWildcardDomain reports whether name is a wildcard registration such as "*.example.com".
+func IsWildcardDomain(name string) bool {
+	return strings.HasPrefix(name, "*.")
+}
+
+// selectChallenge picks the challenge to solve for an authorization. The domain's
+// preferred challenge is tried first, followed by the default order. Wildcard
+// authorizations can only be proven with dns-01, dns-01 is only considered when a
+// DNS provider is configured and tls-alpn-01 only when a TLS listener can answer it.
+// tls-alpn-01 certificates are not shared, so clusters leave it out.
+// Parameters:
+//   - authz: acme.Authorization, the authorization offered by the CA.
+//   - preferred: string, the challenge type preferred for the domain (may be empty).
+//
+// Returns:
+//   - acme.Challenge: the chosen challenge.
+//   - error: error if none of the offered challenges can be solved.
+func (s *Storage) selectChallenge(authz acme.Authorization, preferred string) (acme.Challenge, error) {
+	preference := defaultChallengePreference
+	if preferred != "" {
+		preference = append([]string{preferred}, defaultChallengePreference...)
+	}
+	if authz.Wildcard {
+		preference = []string{ChallengeDNS01}
+	}
+
+	for _, challengeType := range preference {
+		if challengeType == ChallengeDNS01 && s.DNSProvider == nil {
+			continue
+		}
+		if challengeType == ChallengeTLSALPN01 && (!s.TLSALPNEnabled || s.Cluster != nil) {
+			continue
+		}
+		for _, challenge := range authz.Challenges {
+			if challenge.Type == challengeType {
+				return challenge, nil
+			}
+		}
+	}
+
+	offered := make([]string, 0, len(authz.Challenges))
+	for _, challenge := range authz.Challenges {
+		offered = append(offered, challenge.Type)
+	}
+	if authz.Wildcard && s.DNSProvider == nil {
+		return acme.Challenge{}, fmt.Errorf("wildcard domain %q requires dns-01 but no dns provider is configured", authz.IdentifierValue())
+	}
+	return acme.Challenge{}, fmt.Errorf("no supported challenge offered for %q (offered: %s)", authz.IdentifierValue(), strings.Join(offered, ", "))
+}
+
+// presentChallenge makes the challenge response reachable by the CA.
+// Parameters:
+//   - ctx: context.Context, bounds provider calls.
+//   - challenge: acme.Challenge, the challenge to present.
+//   - domainMetadata: *DomainMetadata, the domain the challenge belongs to.
+//
+// Returns:
+//   - func() error: cleanup function removing whatever was published.
+//   - error: error if the challenge could not be presented.
+func (s *Storage) presentChallenge(ctx context.Context, challenge acme.Challenge, domainMetadata *DomainMetadata) (func() error, error) {
+	switch challenge.Type {
+	case ChallengeHTTP01:
+		s.challengeLock.Lock()
+		if s.httpChallenges == nil {
+			s.httpChallenges = make(map[string]string)
+		}
+		s.httpChallenges[challenge.Token] = challenge.KeyAuthorization
+		s.challengeLock.Unlock()
+		cleanUp := func() error {
+			s.challengeLock.Lock()
+			delete(s.httpChallenges, challenge.Token)
+			s.challengeLock.Unlock()
+			return nil
+		}
+		if s.Cluster != nil {
+			// The CA may reach any instance of the cluster.
+			if err := s.Cluster.presentHTTPChallenge(challenge.Token, challenge.KeyAuthorization); err != nil {
+				cleanUp()
+				return nil, fmt.Errorf("sharing http-01 token: %v", err)
+			}
+			localCleanUp := cleanUp
+			cleanUp = func() error {
+				localCleanUp()
+				s.Cluster.cleanUpHTTPChallenge(challenge.Token)
+				return nil
+			}
+		}
+		domainMetadata.DnsChallengeKey = challenge.KeyAuthorization
+		return cleanUp, nil
+	case ChallengeTLSALPN01:
+		certificate, err := acmez.TLSALPN01ChallengeCert(challenge)
+		if err != nil {
+			return nil, fmt.Errorf("creating tls-alpn-01 certificate: %v", err)
+		}
+		identifier := strings.ToLower(challenge.Identifier.Value)
+		s.challengeLock.Lock()
+		if s.tlsALPNCertificates == nil {
+			s.tlsALPNCertificates = make(map[string]*tls.Certificate)
+		}
+		s.tlsALPNCertificates[identifier] = certificate
+		s.challengeLock.Unlock()
+		return func() error {
+			s.challengeLock.Lock()
+			delete(s.tlsALPNCertificates, identifier)
+			s.challengeLock.Unlock()
+			return nil
+		}, nil
+	case ChallengeDNS01:
+		recordName := challenge.DNS01TXTRecordName()
+		recordValue := challenge.DNS01KeyAuthorization()
+		if err := s.DNSProvider.Present(ctx, recordName, recordValue); err != nil {
+			return nil, fmt.Errorf("presenting dns-01 record %q: %v", recordName, err)
+		}
+		if s.DNSPropagationDelay > 0 {
+			select {
+			case <-time.After(s.DNSPropagationDelay):
+			case <-ctx.Done():
+				// The record was published; remove it from the zone before giving up.
+				if err := s.DNSProvider.CleanUp(context.Background(), recordName, recordValue); err != nil {
+					return nil, errors.Join(ctx.Err(), fmt.Errorf("removing dns-01 record %q: %v", recordName, err))
+				}
+				return nil, ctx.Err()
+			}
+		}
+		return func() error {
+			if err := s.DNSProvider.CleanUp(context.Background(), recordName, recordValue); err != nil {
+				return fmt.Errorf("removing dns-01 record %q: %v", recordName, err)
+			}
+			return nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported challenge type %q", challenge.Type)
+	}
+}
+
+// HTTPChallengeResponse returns the key authorization served for an http-01 challenge
+// token. In cluster mode tokens presented by the other instances are answered too.
+// Parameters:
+//   - token: string, the token requested under /.well-known/acme-challenge/.
+//
+// Returns:
+//   - string: the key authorization.
+//   - bool: false if no http-01 challenge is pending for token.
+func (s *Storage) HTTPChallengeResponse(token string) (string, bool) {
+	s.challengeLock.RLock()
+	keyAuthorization, ok := s.httpChallenges[token]
+	s.challengeLock.RUnlock()
+	if !ok && s.Cluster != nil && token != "" {
+		return s.Cluster.httpChallengeResponse(token)
+	}
+	return keyAuthorization, ok
+}
+
+// TLSALPNChallengeCertificate returns the tls-alpn-01 challenge certificate for serverName.
+// Parameters:
+//   - serverName: string, the SNI sent by the validating CA.
+//
+// Returns:
+//   - *tls.Certificate: the challenge certificate.
+//   - bool: false if no tls-alpn-01 challenge is pending for serverName.
+func (s *Storage) TLSALPNChallengeCertificate(serverName string) (*tls.Certificate, bool) {
+	s.challengeLock.RLock()
+	defer s.challengeLock.RUnlock()
+	certificate, ok := s.tlsALPNCertificates[strings.ToLower(serverName)]
+	return certificate, ok
+}
@@ -0,0 +1,60 @@
+package domains
+
+import (
+	"context"
+	"crypto/x509"
+	"testing"
+
+	"github.com/mholt/acmez/acme"
+)
+
+func TestPresentChallenge_TLSALPN01(t *testing.T) {
+	st := Storage{TLSALPNEnabled: true}
+	challenge := acme.Challenge{
+		Type:             ChallengeTLSALPN01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+		Identifier:       acme.Identifier{Type: "dns", Value: "Example.com"},
+	}
+
+	cleanup, err := st.presentChallenge(context.Background(), challenge, &DomainMetadata{Domain: "example.com"})
+	if err != nil {
+		t.Fatalf("present: %v", err)
+	}
+
+	certificate, ok := st.TLSALPNChallengeCertificate("example.com")
+	if !ok || certificate == nil {
+		t.Fatalf("expected a pending tls-alpn-01 certificate")
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatalf("parse challenge certificate: %v", err)
+	}
+	if len(leaf.DNSNames) != 1 || leaf.DNSNames[0] != "Example.com" {
+		t.Fatalf("unexpected SANs on challenge certificate: %v", leaf.DNSNames)
+	}
+
+	cleanup()
+	if _, ok := st.TLSALPNChallengeCertificate("example.com"); ok {
+		t.Fatalf("expected challenge certificate to be removed on cleanup")
+	}
+}
+
+func TestSelectChallenge_PreferredTLSALPN(t *testing.T) {
+	authz := acme.Authorization{
+		Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+		Challenges: []acme.Challenge{{Type: "http-01"}, {Type: "tls-alpn-01"}},
+	}
+
+	st := Storage{}
+	challenge, _ := st.selectChallenge(authz, ChallengeTLSALPN01)
+	if challenge.Type != ChallengeHTTP01 {
+		t.Fatalf("expected http-01 when no tls listener can answer tls-alpn-01, got %q", challenge.Type)
+	}
+
+	st.TLSALPNEnabled = true
+	challenge, _ = st.selectChallenge(authz, ChallengeTLSALPN01)
+	if challenge.Type != ChallengeTLSALPN01 {
+		t.Fatalf("expected preferred tls-alpn-01, got %q", challenge.Type)
+	}
+}
@@ -0,0 +1,99 @@
+package domains
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// Client certificate modes of a domain. They match the frontend "secureverify" values;
+// an empty mode inherits the setting of the bind.
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequired = "required"
+)
+
+// IsSet reports whether the policy overrides the client certificate settings of the bind.
+func (x *ClientAuthPolicy) IsSet() bool {
+	return x != nil && (x.GetMode() != "" || len(x.GetCaBundle()) > 0)
+}
+
+// ClientCAs returns the pool of CAs trusted for client certificates of the domain.
+// Returns:
+//   - *x509.CertPool: the CA pool, or nil if the policy has no CA bundle.
+//   - error: error if the bundle contains no valid certificate.
+func (x *ClientAuthPolicy) ClientCAs() (*x509.CertPool, error) {
+	if len(x.GetCaBundle()) == 0 {
+		return nil, nil
+	}
+	return ParseCertificatePool(x.GetCaBundle())
+}
+
+// ValidateClientAuthPolicy checks the mode and CA bundle of a client certificate policy.
+// Parameters:
+//   - policy: *ClientAuthPolicy, the policy to validate (may be nil).
+//
+// Returns:
+//   - error: error describing why the policy is invalid.
+func ValidateClientAuthPolicy(policy *ClientAuthPolicy) error {
+	switch policy.GetMode() {
+	case "", ClientAuthNone, ClientAuthOptional, ClientAuthRequired:
+	default:
+		return fmt.Errorf("unsupported client auth mode %q", policy.GetMode())
+	}
+	_, err := policy.ClientCAs()
+	return err
+}
+
+// ParseCertificatePool parses every PEM encoded certificate in bundle into a pool.
+// Parameters:
+//   - bundle: []byte, PEM encoded CA certificates.
+//
+// Returns:
+//   - *x509.CertPool: the pool.
+//   - error: error if a certificate is malformed or the bundle contains none.
+func ParseCertificatePool(bundle []byte) (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	count := 0
+	for rest := bundle; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("ca bundle: %v", err)
+		}
+		pool.AddCert(certificate)
+		count++
+	}
+	if count == 0 {
+		return nil, errors.New("ca bundle contains no certificate")
+	}
+	return pool, nil
+}
+
+// SetClientAuth replaces the client certificate policy of a registered domain.
+// Parameters:
+//   - domainName: string, the domain to update.
+//   - policy: *ClientAuthPolicy, the new policy; nil or empty inherits the bind settings.
+//
+// Returns:
+//   - error: error if the policy is invalid or the domain does not exist.
+func (s *Storage) SetClientAuth(domainName string, policy *ClientAuthPolicy) error {
+	if err := ValidateClientAuthPolicy(policy); err != nil {
+		return err
+	}
+	if !policy.IsSet() {
+		policy = nil
+	}
+	return s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		domainMetadata.ClientAuth = policy
+	})
+}
@@ -0,0 +1,41 @@
+package domains
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetClientAuth(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.Domains().Put(activeDomain(t, "example.com", time.Now(), time.Now().Add(time.Hour)))
+	bundle := testCertificate(t, "ca.example.com", time.Now(), time.Now().Add(time.Hour)).CertPemBlock
+
+	if err := st.SetClientAuth("example.com", &ClientAuthPolicy{Mode: "sometimes"}); err == nil {
+		t.Fatalf("expected an unknown mode to be rejected")
+	}
+	if err := st.SetClientAuth("example.com", &ClientAuthPolicy{Mode: ClientAuthRequired, CaBundle: []byte("not pem")}); err == nil {
+		t.Fatalf("expected an invalid CA bundle to be rejected")
+	}
+
+	if err := st.SetClientAuth("example.com", &ClientAuthPolicy{Mode: ClientAuthRequired, CaBundle: bundle}); err != nil {
+		t.Fatalf("set client auth: %v", err)
+	}
+	policy := registeredDomain(st, "example.com").ClientAuth
+	if policy.GetMode() != ClientAuthRequired {
+		t.Fatalf("expected the policy to be stored, got %+v", policy)
+	}
+	if pool, err := policy.ClientCAs(); err != nil || pool == nil {
+		t.Fatalf("expected the CA bundle to parse, got %v", err)
+	}
+
+	if err := st.SetClientAuth("example.com", &ClientAuthPolicy{}); err != nil {
+		t.Fatalf("clear client auth: %v", err)
+	}
+	if registeredDomain(st, "example.com").ClientAuth != nil {
+		t.Fatalf("expected an empty policy to remove the override")
+	}
+
+	if err := st.SetClientAuth("missing.example.com", nil); err == nil {
+		t.Fatalf("expected an unknown domain to fail")
+	}
+}
@@ -0,0 +1,489 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"shiroxy/pkg/models"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/protobuf/proto"
+)
+
+// Redis keys and channels shared by the instances of a cluster.
+const (
+	clusterLeaderKey              = "shiroxy:cluster:leader"
+	clusterBackendsKey            = "shiroxy:cluster:backends"
+	clusterBackendsChannel        = "shiroxy:cluster:backend-events"
+	clusterWebhooksChannel        = "shiroxy:cluster:webhooks"
+	clusterHTTPChallengeKeyPrefix = "shiroxy:challenge:http:"
+)
+
+// Cluster defaults used when the configuration leaves a value unset.
+const (
+	defaultClusterLeaseTTL     = 15 * time.Second
+	defaultClusterSyncInterval = 60 * time.Second
+	// clusterHTTPChallengeTTL bounds how long a token outlives an instance that
+	// stopped before cleaning it up.
+	clusterHTTPChallengeTTL = 10 * time.Minute
+)
+
+// campaignScript takes the leader lease when it is free and renews it when the
+// instance already holds it, atomically.
+var campaignScript = redis.NewScript(`
+local holder = redis.call("GET", KEYS[1])
+if holder == false then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+	return 1
+end
+if holder == ARGV[1] then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return 1
+end
+return 0`)
+
+// resignScript releases the leader lease if the instance still holds it.
+var resignScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+
+// Cluster coordinates the instances sharing a Redis database. Domains are
+// already shared through the Redis domain store; the cluster adds a leader
+// lease, so only one instance issues and renews certificates and fires
+// webhooks, and shares http-01 challenge tokens and the backends registered
+// through the admin API.
+type Cluster struct {
+	NodeID       string                // Name of this instance in the cluster.
+	storage      *Storage              // Storage whose domains are shared.
+	client       redis.UniversalClient // Client of the shared database.
+	leaseTTL     time.Duration         // Lifetime of the leader lease.
+	syncInterval time.Duration         // Time between full reloads of the domains.
+	leader       atomic.Bool           // Set while this instance holds the lease.
+	lock         sync.Mutex            // Guards onLeadership and deliver.
+	onLeadership []func(leader bool)
+	deliver      func(eventName string, data interface{}) // Fires webhooks relayed by other instances.
+	orders       chan string                              // Domains whose orders were left pending by another instance.
+	stop         chan struct{}
+	stopped      chan struct{} // Closed once the campaign loop returned.
+	stopOnce     sync.Once
+	cancel       context.CancelFunc // Stops the pub/sub subscriptions.
+	unsubscribe  func()             // Stops following the domain registry.
+}
+
+// ClusterStatus describes the cluster as seen by an instance.
+type ClusterStatus struct {
+	NodeID   string `json:"node_id"`   // Name of this instance.
+	Leader   bool   `json:"leader"`    // Set when this instance is the leader.
+	LeaderID string `json:"leader_id"` // Name of the leader, empty while there is none.
+}
+
+// clusterWebhook is a webhook event relayed to the leader.
+type clusterWebhook struct {
+	EventName string          `json:"eventname"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// StartCluster joins the cluster of the instances sharing the Redis storage,
+// attaches the cluster to storage and campaigns for the leader lease, once
+// before returning and then every third of the lease.
+// Parameters:
+//   - storage: *Storage, storage using the redis location.
+//   - config: models.Cluster, cluster configuration.
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *Cluster: the joined cluster, or nil if cluster mode is disabled.
+//   - error: error if the storage is not shared through Redis or the subscriptions fail.
+func StartCluster(storage *Storage, config models.Cluster, wg *sync.WaitGroup) (*Cluster, error) {
+	if !config.Enable {
+		return nil, nil
+	}
+	if storage.RedisClient == nil {
+		return nil, errors.New("cluster mode requires the redis storage location")
+	}
+
+	cluster := &Cluster{
+		NodeID:       config.NodeId,
+		storage:      storage,
+		client:       storage.RedisClient,
+		leaseTTL:     defaultClusterLeaseTTL,
+		syncInterval: defaultClusterSyncInterval,
+		orders:       make(chan string, 256),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	if cluster.NodeID == "" {
+		hostname, _ := os.Hostname()
+		cluster.NodeID = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+	if config.LeaseTTL > 0 {
+		cluster.leaseTTL = time.Duration(config.LeaseTTL) * time.Second
+	}
+	if config.SyncInterval > 0 {
+		cluster.syncInterval = time.Duration(config.SyncInterval) * time.Second
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cluster.cancel = cancel
+	webhooks := cluster.client.Subscribe(ctx, clusterWebhooksChannel)
+	// Wait for the subscription, so no event relayed after StartCluster returns is missed.
+	if _, err := webhooks.Receive(ctx); err != nil {
+		webhooks.Close()
+		cancel()
+		return nil, fmt.Errorf("joining cluster: %v", err)
+	}
+	storage.Cluster = cluster
+	cluster.unsubscribe = storage.Domains().Subscribe(cluster.domainChanged)
+	cluster.campaign()
+
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer webhooks.Close()
+		messages := webhooks.Channel()
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				cluster.relayed(message.Payload)
+			case <-cluster.stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case domainName := <-cluster.orders:
+				if issuance := storage.Issuance; issuance != nil && cluster.IsLeader() {
+					if err := issuance.enqueuePending(domainName); err != nil {
+						fmt.Printf("cluster: queuing the issuance of %s failed: %v\n", domainName, err)
+					}
+				}
+			case <-cluster.stop:
+				return
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer close(cluster.stopped)
+		campaign := time.NewTicker(cluster.leaseTTL / 3)
+		defer campaign.Stop()
+		resync := time.NewTicker(cluster.syncInterval)
+		defer resync.Stop()
+		for {
+			select {
+			case <-campaign.C:
+				cluster.campaign()
+			case <-resync.C:
+				if err := storage.syncDomains(); err != nil {
+					fmt.Printf("cluster: reloading domains failed: %v\n", err)
+				}
+			case <-cluster.stop:
+				return
+			}
+		}
+	}()
+	return cluster, nil
+}
+
+// Stop leaves the cluster, releasing the leader lease so another instance takes
+// over without waiting for it to expire.
+func (c *Cluster) Stop() {
+	c.stopOnce.Do(func() {
+		c.unsubscribe()
+		close(c.stop)
+		// The lease is released once the campaign loop can no longer take it back.
+		<-c.stopped
+		c.resign()
+		c.cancel()
+	})
+}
+
+// IsLeader reports whether this instance holds the leader lease.
+func (c *Cluster) IsLeader() bool {
+	return c.leader.Load()
+}
+
+// OnLeadershipChange calls handle whenever this instance gains or loses the
+// leader lease.
+// Parameters:
+//   - handle: func(bool), called with true when elected and false when the lease is lost.
+func (c *Cluster) OnLeadershipChange(handle func(leader bool)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onLeadership = append(c.onLeadership, handle)
+}
+
+// Status reports this instance and the current leader.
+// Returns:
+//   - ClusterStatus: the status.
+//   - error: error if the leader cannot be read.
+func (c *Cluster) Status() (ClusterStatus, error) {
+	leaderID, err := c.client.Get(context.Background(), clusterLeaderKey).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return ClusterStatus{}, err
+	}
+	return ClusterStatus{NodeID: c.NodeID, Leader: c.IsLeader(), LeaderID: leaderID}, nil
+}
+
+// campaign takes or renews the leader lease. An instance that cannot reach
+// Redis steps down at once, before its lease can expire and be taken over.
+func (c *Cluster) campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), c.leaseTTL/3)
+	defer cancel()
+	held, err := campaignScript.Run(ctx, c.client, []string{clusterLeaderKey}, c.NodeID, c.leaseTTL.Milliseconds()).Int()
+	if err != nil {
+		fmt.Printf("cluster: renewing the leader lease failed: %v\n", err)
+	}
+	c.setLeader(err == nil && held == 1)
+}
+
+// resign steps down and releases the leader lease if this instance holds it.
+func (c *Cluster) resign() {
+	c.setLeader(false)
+	ctx, cancel := context.WithTimeout(context.Background(), c.leaseTTL/3)
+	defer cancel()
+	resignScript.Run(ctx, c.client, []string{clusterLeaderKey}, c.NodeID)
+}
+
+// setLeader records the leadership of this instance and notifies the handlers
+// when it changed.
+func (c *Cluster) setLeader(leader bool) {
+	if c.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		fmt.Printf("cluster: %s is now the leader\n", c.NodeID)
+	} else {
+		fmt.Printf("cluster: %s is no longer the leader\n", c.NodeID)
+	}
+	c.lock.Lock()
+	handlers := append([]func(bool){}, c.onLeadership...)
+	c.lock.Unlock()
+	for _, handle := range handlers {
+		handle(leader)
+	}
+}
+
+// domainChanged hands domains whose orders another instance left pending to
+// the leader's issuance queue. It runs under the registry lock, so the queue is
+// fed from another goroutine.
+func (c *Cluster) domainChanged(event DomainEvent) {
+	if event.Type != DomainEventPut || !c.IsLeader() {
+		return
+	}
+	domainMetadata, ok := c.storage.Domains().Get(event.Domain)
+	if !ok || domainMetadata.GetOrder().GetState() != OrderPending {
+		return
+	}
+	select {
+	case c.orders <- event.Domain:
+	default:
+		// Picked up by ResumePending on the next election.
+	}
+}
+
+// RelayWebhook sends a webhook event to the leader when this instance is a
+// follower. It is meant for webhook.WebhookHandler.Relay.
+// Parameters:
+//   - eventName: string, the name of the event.
+//   - data: interface{}, the data of the event.
+//
+// Returns:
+//   - bool: true if the event was relayed; false if it must be fired by this instance.
+func (c *Cluster) RelayWebhook(eventName string, data interface{}) bool {
+	if c.IsLeader() {
+		return false
+	}
+	body, err := json.Marshal(data)
+	if err != nil {
+		return false
+	}
+	payload, err := json.Marshal(clusterWebhook{EventName: eventName, Data: body})
+	if err != nil {
+		return false
+	}
+	// Firing here when the leader cannot be reached beats losing the event.
+	return c.client.Publish(context.Background(), clusterWebhooksChannel, payload).Err() == nil
+}
+
+// DeliverWebhooks sets the function that fires the webhook events relayed by
+// followers while this instance is the leader.
+// Parameters:
+//   - fire: func(string, interface{}), fires a webhook event.
+func (c *Cluster) DeliverWebhooks(fire func(eventName string, data interface{})) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.deliver = fire
+}
+
+// relayed fires a webhook event relayed by a follower, if this instance leads.
+func (c *Cluster) relayed(payload string) {
+	c.lock.Lock()
+	deliver := c.deliver
+	c.lock.Unlock()
+	if deliver == nil || !c.IsLeader() {
+		return
+	}
+	var webhook clusterWebhook
+	if json.Unmarshal([]byte(payload), &webhook) != nil {
+		return
+	}
+	var data interface{}
+	if json.Unmarshal(webhook.Data, &data) != nil {
+		return
+	}
+	deliver(webhook.EventName, data)
+}
+
+// ShareBackend stores a backend registered through the admin API, so every
+// instance load balances it, and announces it to the running instances.
+// Parameters:
+//   - backend: models.BackendServer, the registered backend.
+//
+// Returns:
+//   - error: error if the backend cannot be stored or announced.
+func (c *Cluster) ShareBackend(backend models.BackendServer) error {
+	body, err := json.Marshal(backend)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if err := c.client.HSet(ctx, clusterBackendsKey, backend.Id, body).Err(); err != nil {
+		return err
+	}
+	return c.client.Publish(ctx, clusterBackendsChannel, backend.Id).Err()
+}
+
+// SharedBackends returns the backends registered through the admin API of any instance.
+// Returns:
+//   - []models.BackendServer: the shared backends.
+//   - error: error if the backends cannot be read.
+func (c *Cluster) SharedBackends() ([]models.BackendServer, error) {
+	stored, err := c.client.HGetAll(context.Background(), clusterBackendsKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	backends := make([]models.BackendServer, 0, len(stored))
+	for id, body := range stored {
+		var backend models.BackendServer
+		if err := json.Unmarshal([]byte(body), &backend); err != nil {
+			return nil, fmt.Errorf("shared backend %s: %v", id, err)
+		}
+		backends = append(backends, backend)
+	}
+	return backends, nil
+}
+
+// WatchBackends calls register with every backend shared by an instance,
+// including this one, until the cluster stops.
+// Parameters:
+//   - register: func(models.BackendServer), registers a shared backend.
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - error: error if the announcements cannot be subscribed to.
+func (c *Cluster) WatchBackends(register func(backend models.BackendServer), wg *sync.WaitGroup) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	pubsub := c.client.Subscribe(ctx, clusterBackendsChannel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		cancel()
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer cancel()
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				body, err := c.client.HGet(ctx, clusterBackendsKey, message.Payload).Bytes()
+				if err != nil {
+					continue
+				}
+				var backend models.BackendServer
+				if json.Unmarshal(body, &backend) == nil {
+					register(backend)
+				}
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// presentHTTPChallenge publishes an http-01 key authorization, so the instance
+// the CA happens to reach can answer the challenge.
+func (c *Cluster) presentHTTPChallenge(token, keyAuthorization string) error {
+	return c.client.Set(context.Background(), clusterHTTPChallengeKeyPrefix+token, keyAuthorization, clusterHTTPChallengeTTL).Err()
+}
+
+// cleanUpHTTPChallenge removes a published http-01 key authorization.
+func (c *Cluster) cleanUpHTTPChallenge(token string) {
+	c.client.Del(context.Background(), clusterHTTPChallengeKeyPrefix+token)
+}
+
+// httpChallengeResponse returns the key authorization published by any instance for token.
+func (c *Cluster) httpChallengeResponse(token string) (string, bool) {
+	keyAuthorization, err := c.client.Get(context.Background(), clusterHTTPChallengeKeyPrefix+token).Result()
+	if err != nil {
+		return "", false
+	}
+	return keyAuthorization, true
+}
+
+// IsLeader reports whether this instance issues and renews certificates and
+// fires webhooks, which is always the case outside cluster mode.
+// Returns:
+//   - bool: true for the leader of the cluster or an instance running alone.
+func (s *Storage) IsLeader() bool {
+	return s.Cluster == nil || s.Cluster.IsLeader()
+}
+
+// syncDomains reloads every domain from the store, registering the changes
+// whose notifications were missed, for example while the pub/sub connection
+// to Redis was being re-established.
+// Returns:
+//   - error: error if the domains cannot be listed.
+func (s *Storage) syncDomains() error {
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+
+	stored, err := s.Store.List(context.Background())
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(stored))
+	for _, domainMetadata := range stored {
+		names[domainMetadata.Domain] = true
+		if registered, ok := s.Domains().Get(domainMetadata.Domain); !ok || !proto.Equal(registered, domainMetadata) {
+			s.Domains().Put(domainMetadata)
+		}
+	}
+	for _, registered := range s.Domains().Snapshot().List() {
+		if !names[registered.Domain] {
+			s.Domains().Delete(registered.Domain)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,260 @@
+package domains
+
+import (
+	"context"
+	"shiroxy/pkg/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/mholt/acmez/acme"
+	"google.golang.org/protobuf/proto"
+)
+
+// newTestClusterNode starts a storage on server that joins its cluster as nodeID.
+func newTestClusterNode(t *testing.T, server *miniredis.Miniredis, nodeID string) *Storage {
+	t.Helper()
+	wg := &sync.WaitGroup{}
+	st, err := InitializeStorage(&models.Storage{Location: "redis", RedisConnectionString: "redis://" + server.Addr()}, "", "yes", nil, wg)
+	if err != nil {
+		t.Fatalf("initialize storage: %v", err)
+	}
+	if _, err := StartCluster(st, models.Cluster{Enable: true, NodeId: nodeID, LeaseTTL: 3}, wg); err != nil {
+		t.Fatalf("start cluster: %v", err)
+	}
+	t.Cleanup(func() {
+		st.Close()
+		wg.Wait()
+	})
+	return st
+}
+
+func TestStartCluster_RequiresRedis(t *testing.T) {
+	st := newTestIssuanceStorage()
+	if _, err := StartCluster(st, models.Cluster{Enable: true}, &sync.WaitGroup{}); err == nil {
+		t.Fatalf("expected memory storage to be refused")
+	}
+	cluster, err := StartCluster(st, models.Cluster{}, &sync.WaitGroup{})
+	if err != nil || cluster != nil || !st.IsLeader() {
+		t.Fatalf("expected a disabled cluster to leave the instance leading alone, got %v, %v", cluster, err)
+	}
+}
+
+func TestCluster_ElectsOneLeader(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestClusterNode(t, server, "first")
+	second := newTestClusterNode(t, server, "second")
+
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected the first node to lead alone, got %v and %v", first.IsLeader(), second.IsLeader())
+	}
+	status, err := second.Cluster.Status()
+	if err != nil || status.LeaderID != "first" || status.NodeID != "second" || status.Leader {
+		t.Fatalf("unexpected status: %+v, %v", status, err)
+	}
+
+	// Renewing keeps the lease past its original expiry.
+	server.FastForward(2 * time.Second)
+	first.Cluster.campaign()
+	server.FastForward(2 * time.Second)
+	second.Cluster.campaign()
+	if !first.IsLeader() || second.IsLeader() {
+		t.Fatalf("expected the renewed lease to keep the first node leading")
+	}
+
+	elected := make(chan bool, 1)
+	second.Cluster.OnLeadershipChange(func(leader bool) { elected <- leader })
+	// Stopping releases the lease, so the next campaign takes over without waiting for it to expire.
+	first.Cluster.Stop()
+	if first.IsLeader() {
+		t.Fatalf("expected a stopped node to step down")
+	}
+	second.Cluster.campaign()
+	if !second.IsLeader() || !<-elected {
+		t.Fatalf("expected the second node to take over")
+	}
+}
+
+func TestCluster_LeaseExpiresWhenLeaderStopsRenewing(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestClusterNode(t, server, "first")
+	second := newTestClusterNode(t, server, "second")
+
+	server.FastForward(4 * time.Second)
+	second.Cluster.campaign()
+	if !second.IsLeader() {
+		t.Fatalf("expected the second node to take over the expired lease")
+	}
+	// The former leader finds the lease taken on its next renewal.
+	first.Cluster.campaign()
+	if first.IsLeader() {
+		t.Fatalf("expected the first node to step down")
+	}
+}
+
+func TestCluster_SharesHTTPChallengeTokens(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestClusterNode(t, server, "first")
+	second := newTestClusterNode(t, server, "second")
+
+	cleanUp, err := first.presentChallenge(context.Background(), acme.Challenge{
+		Type:             ChallengeHTTP01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+	}, &DomainMetadata{Domain: "example.com"})
+	if err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	if keyAuthorization, ok := second.HTTPChallengeResponse("token"); !ok || keyAuthorization != "token.thumbprint" {
+		t.Fatalf("expected the second node to answer the challenge, got %q, %v", keyAuthorization, ok)
+	}
+
+	cleanUp()
+	if _, ok := second.HTTPChallengeResponse("token"); ok {
+		t.Fatalf("expected the token to be removed from every node")
+	}
+}
+
+func TestCluster_FollowerLeavesIssuanceToLeader(t *testing.T) {
+	server := miniredis.RunT(t)
+	leader := newTestClusterNode(t, server, "leader")
+	follower := newTestClusterNode(t, server, "follower")
+
+	var issuedBy sync.Map
+	for name, st := range map[string]*Storage{"leader": leader, "follower": follower} {
+		name := name
+		st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+			issuedBy.Store(name, true)
+			return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+		}
+		StartIssuanceQueue(st, models.Issuance{Workers: 1}, nil, &sync.WaitGroup{})
+	}
+
+	if _, err := follower.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	waitForState(t, follower, "example.com", OrderIssued)
+	if _, ok := issuedBy.Load("follower"); ok {
+		t.Fatalf("expected only the leader to issue")
+	}
+	if _, ok := issuedBy.Load("leader"); !ok {
+		t.Fatalf("expected the leader to issue")
+	}
+}
+
+func TestCluster_NewLeaderResumesPendingOrders(t *testing.T) {
+	server := miniredis.RunT(t)
+	follower := newTestClusterNode(t, server, "follower")
+	// The leader stopped before it picked up the order.
+	server.Set(clusterLeaderKey, "gone")
+	follower.Cluster.campaign()
+
+	var issued atomic.Int32
+	follower.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		issued.Add(1)
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	StartIssuanceQueue(follower, models.Issuance{Workers: 1}, nil, &sync.WaitGroup{})
+	if _, err := follower.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if status, _ := follower.IssuanceStatus("example.com"); status.State != OrderPending {
+		t.Fatalf("expected the order to wait for a leader, got %q", status.State)
+	}
+
+	server.Del(clusterLeaderKey)
+	follower.Cluster.campaign()
+	waitForState(t, follower, "example.com", OrderIssued)
+	if issued.Load() != 1 {
+		t.Fatalf("expected one issuance, got %d", issued.Load())
+	}
+}
+
+func TestCluster_RelaysWebhooksToLeader(t *testing.T) {
+	server := miniredis.RunT(t)
+	leader := newTestClusterNode(t, server, "leader")
+	follower := newTestClusterNode(t, server, "follower")
+
+	fired := make(chan string, 2)
+	deliver := func(eventName string, data interface{}) {
+		fired <- eventName + " " + data.(map[string]interface{})["domain"].(string)
+	}
+	leader.Cluster.DeliverWebhooks(deliver)
+	follower.Cluster.DeliverWebhooks(deliver)
+
+	if leader.Cluster.RelayWebhook(EventDomainSSLSuccess, map[string]string{"domain": "example.com"}) {
+		t.Fatalf("expected the leader to fire its own events")
+	}
+	if !follower.Cluster.RelayWebhook(EventDomainSSLSuccess, map[string]string{"domain": "example.com"}) {
+		t.Fatalf("expected the follower to relay its events")
+	}
+	select {
+	case event := <-fired:
+		if event != EventDomainSSLSuccess+" example.com" {
+			t.Fatalf("unexpected event %q", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the leader to fire the relayed event")
+	}
+	select {
+	case event := <-fired:
+		t.Fatalf("expected the event to be fired once, also got %q", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestCluster_SharesBackends(t *testing.T) {
+	server := miniredis.RunT(t)
+	first := newTestClusterNode(t, server, "first")
+	second := newTestClusterNode(t, server, "second")
+
+	registered := make(chan string, 1)
+	wg := &sync.WaitGroup{}
+	if err := second.Cluster.WatchBackends(func(backend models.BackendServer) { registered <- backend.Id + "@" + backend.Host }, wg); err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if err := first.Cluster.ShareBackend(models.BackendServer{Id: "api", Host: "10.0.0.1", Port: "8080"}); err != nil {
+		t.Fatalf("share: %v", err)
+	}
+	select {
+	case backend := <-registered:
+		if backend != "api@10.0.0.1" {
+			t.Fatalf("unexpected backend %q", backend)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the shared backend")
+	}
+
+	backends, err := second.Cluster.SharedBackends()
+	if err != nil || len(backends) != 1 || backends[0].Port != "8080" {
+		t.Fatalf("unexpected shared backends: %+v, %v", backends, err)
+	}
+}
+
+func TestStorage_SyncDomainsCatchesMissedChanges(t *testing.T) {
+	server := miniredis.RunT(t)
+	st := newTestClusterNode(t, server, "first")
+
+	st.domainLock.Lock()
+	err := st.storeDomainMetadata(&DomainMetadata{Domain: "stale.example.com", Status: "active"})
+	st.domainLock.Unlock()
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	// Changes written without a notification, as if it was lost.
+	server.Del(redisDomainKeyPrefix + "stale.example.com")
+	body, _ := proto.Marshal(&DomainMetadata{Domain: "missed.example.com", Status: "active"})
+	server.Set(redisDomainKeyPrefix+"missed.example.com", string(body))
+
+	if err := st.syncDomains(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if _, ok := st.Domains().Get("missed.example.com"); !ok {
+		t.Fatalf("expected the missed domain to be registered")
+	}
+	if _, ok := st.Domains().Get("stale.example.com"); ok {
+		t.Fatalf("expected the deleted domain to be removed")
+	}
+}
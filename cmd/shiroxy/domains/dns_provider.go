@@ -0,0 +1,108 @@
+package domains
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"shiroxy/pkg/models"
+	"time"
+)
+
+// DNSProvider publishes and removes the TXT records used to solve DNS-01 challenges.
+type DNSProvider interface {
+	// Present creates a TXT record named fqdn holding value.
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record previously created by Present.
+	CleanUp(ctx context.Context, fqdn, value string) error
+}
+
+// NewDNSProvider builds the DNS provider selected in the configuration.
+// Parameters:
+//   - config: models.DnsProvider, DNS provider configuration.
+//
+// Returns:
+//   - DNSProvider: the configured provider, or nil when no provider is configured.
+//   - error: error if the provider name is unknown or its settings are incomplete.
+func NewDNSProvider(config models.DnsProvider) (DNSProvider, error) {
+	switch config.Name {
+	case "":
+		return nil, nil
+	case "rfc2136":
+		return NewRFC2136Provider(config.RFC2136)
+	case "webhook":
+		if config.Webhook.Url == "" {
+			return nil, errors.New("dnsprovider.webhook.url is required")
+		}
+		return &WebhookDNSProvider{
+			Url:    config.Webhook.Url,
+			Secret: config.Webhook.Secret,
+			Client: &http.Client{Timeout: 30 * time.Second},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown dns provider %q", config.Name)
+	}
+}
+
+// WebhookDNSProvider delegates TXT record management to an external HTTP endpoint.
+// Every call POSTs a JSON body of the form {"action", "fqdn", "value"}; when a secret
+// is configured the body is signed with HMAC-SHA256 in the X-Shiroxy-Signature header.
+type WebhookDNSProvider struct {
+	Url    string
+	Secret string
+	Client *http.Client
+}
+
+type webhookDNSRequest struct {
+	Action string `json:"action"`
+	Fqdn   string `json:"fqdn"`
+	Value  string `json:"value"`
+}
+
+// Present asks the webhook to create the TXT record.
+func (w *WebhookDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	return w.call(ctx, "present", fqdn, value)
+}
+
+// CleanUp asks the webhook to delete the TXT record.
+func (w *WebhookDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return w.call(ctx, "cleanup", fqdn, value)
+}
+
+func (w *WebhookDNSProvider) call(ctx context.Context, action, fqdn, value string) error {
+	body, err := json.Marshal(webhookDNSRequest{Action: action, Fqdn: fqdn, Value: value})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Shiroxy-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dns webhook %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("dns webhook %s: unexpected status %s", action, resp.Status)
+	}
+	return nil
+}
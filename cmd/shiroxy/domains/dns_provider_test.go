@@ -0,0 +1,510 @@
+package domains
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// fakeDNSServer is a stand-in authoritative server for zone that applies RFC 2136
+// TXT updates and signs its responses with responseSecret.
+type fakeDNSServer struct {
+	conn           net.PacketConn
+	listener       net.Listener
+	zone           string
+	tsigSecret     []byte
+	mu             sync.Mutex
+	records        map[string]string
+	zones          []string
+	badMAC         bool
+	truncate       bool
+	responseSecret []byte
+	tcpMessages    int
+}
+
+func startFakeDNSServer(t *testing.T, tsigSecret []byte) *fakeDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	listener, err := net.Listen("tcp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := &fakeDNSServer{
+		conn:           conn,
+		listener:       listener,
+		zone:           "example.com.",
+		tsigSecret:     tsigSecret,
+		records:        map[string]string{},
+		responseSecret: tsigSecret,
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		listener.Close()
+	})
+	go server.serve()
+	go server.serveTCP()
+	return server
+}
+
+func readName(msg []byte, offset int) (string, int) {
+	var labels []string
+	for msg[offset] != 0 {
+		length := int(msg[offset])
+		labels = append(labels, string(msg[offset+1:offset+1+length]))
+		offset += length + 1
+	}
+	return strings.Join(labels, ".") + ".", offset + 1
+}
+
+func (f *fakeDNSServer) serve() {
+	buf := make([]byte, 4096)
+	for {
+		n, addr, err := f.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		response := f.handle(append([]byte{}, buf[:n]...))
+
+		f.mu.Lock()
+		truncate := f.truncate
+		f.mu.Unlock()
+		if truncate {
+			response = append([]byte{}, response[:4]...)
+			response = append(response, 0, 0, 0, 0, 0, 0, 0, 0)
+			binary.BigEndian.PutUint16(response[2:4], binary.BigEndian.Uint16(response[2:4])|dnsFlagTruncated)
+		}
+		_, _ = f.conn.WriteTo(response, addr)
+	}
+}
+
+func (f *fakeDNSServer) serveTCP() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err == nil {
+			msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+			if _, err := io.ReadFull(conn, msg); err == nil {
+				f.mu.Lock()
+				f.tcpMessages++
+				f.mu.Unlock()
+				response := f.handle(msg)
+				_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(response))), response...))
+			}
+		}
+		conn.Close()
+	}
+}
+
+// handle answers SOA queries with the zone and applies updates.
+func (f *fakeDNSServer) handle(msg []byte) []byte {
+	if binary.BigEndian.Uint16(msg[2:4])>>11&0xf != dnsOpcodeUpdate {
+		_, end := readName(msg, 12)
+		f.mu.Lock()
+		zone := f.zone
+		f.mu.Unlock()
+		response := append([]byte{}, msg[:end+4]...)
+		binary.BigEndian.PutUint16(response[2:4], 0x8000|0x0400|dnsRcodeNameError)
+		binary.BigEndian.PutUint16(response[8:10], 1)
+		response = appendDNSName(response, zone)
+		response = binary.BigEndian.AppendUint16(response, dnsTypeSOA)
+		response = binary.BigEndian.AppendUint16(response, dnsClassIN)
+		response = binary.BigEndian.AppendUint32(response, 3600)
+		response = binary.BigEndian.AppendUint16(response, 22)
+		response = append(response, 0, 0)
+		return append(response, make([]byte, 20)...)
+	}
+
+	rcode := uint16(0)
+	zone, offset := readName(msg, 12)
+	offset += 4
+	name, offset := readName(msg, offset)
+	class := binary.BigEndian.Uint16(msg[offset+2 : offset+4])
+	rdlen := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+	value := string(msg[offset+11 : offset+10+rdlen])
+	end := offset + 10 + rdlen
+
+	var requestMAC []byte
+	if f.tsigSecret != nil {
+		var ok bool
+		if binary.BigEndian.Uint16(msg[10:12]) == 1 {
+			requestMAC, ok = f.verifyTSIG(msg, end)
+		}
+		if !ok {
+			f.mu.Lock()
+			f.badMAC = true
+			f.mu.Unlock()
+			rcode = 9 // NOTAUTH
+		}
+	}
+
+	if rcode == 0 {
+		f.mu.Lock()
+		f.zones = append(f.zones, zone)
+		if class == dnsClassNONE {
+			delete(f.records, name)
+		} else {
+			f.records[name] = value
+		}
+		f.mu.Unlock()
+	}
+
+	response := append([]byte{}, msg[:2]...)
+	response = binary.BigEndian.AppendUint16(response, 0x8000|dnsOpcodeUpdate<<11|rcode)
+	response = append(response, 0, 0, 0, 0, 0, 0, 0, 0)
+	if rcode != 0 || f.tsigSecret == nil {
+		return response
+	}
+	f.mu.Lock()
+	secret := f.responseSecret
+	f.mu.Unlock()
+	signer := &RFC2136Provider{TSIGKeyName: "shiroxy-key.", TSIGSecret: secret, TSIGAlgorithm: "hmac-sha256."}
+	response, _, _ = signer.signTSIG(response, requestMAC, time.Now())
+	return response
+}
+
+func (f *fakeDNSServer) verifyTSIG(msg []byte, tsigStart int) ([]byte, bool) {
+	keyName, offset := readName(msg, tsigStart)
+	offset += 10 // type, class, ttl, rdlength
+	algorithm, offset := readName(msg, offset)
+	timeSigned := msg[offset : offset+6]
+	fudge := msg[offset+6 : offset+8]
+	macSize := int(binary.BigEndian.Uint16(msg[offset+8 : offset+10]))
+	mac := msg[offset+10 : offset+10+macSize]
+
+	unsigned := append([]byte{}, msg[:tsigStart]...)
+	binary.BigEndian.PutUint16(unsigned[10:12], 0)
+
+	variables := appendDNSName(nil, keyName)
+	variables = binary.BigEndian.AppendUint16(variables, dnsClassANY)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = appendDNSName(variables, algorithm)
+	variables = append(variables, timeSigned...)
+	variables = append(variables, fudge...)
+	variables = append(variables, 0, 0, 0, 0)
+
+	expected := hmac.New(sha256.New, f.tsigSecret)
+	expected.Write(unsigned)
+	expected.Write(variables)
+	return mac, hmac.Equal(mac, expected.Sum(nil))
+}
+
+func (f *fakeDNSServer) record(name string) (string, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.records[name]
+	return value, ok
+}
+
+func TestRFC2136Provider_PresentAndCleanUp(t *testing.T) {
+	secret := []byte("super-secret-tsig-key")
+	server := startFakeDNSServer(t, secret)
+
+	provider, err := NewDNSProvider(models.DnsProvider{
+		Name: "rfc2136",
+		RFC2136: models.DnsProviderRFC2136{
+			Nameserver:  server.conn.LocalAddr().String(),
+			Zone:        "example.com",
+			TSIGKeyName: "shiroxy-key",
+			TSIGSecret:  base64.StdEncoding.EncodeToString(secret),
+		},
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := provider.Present(ctx, "_acme-challenge.example.com", "token-digest"); err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	if value, ok := server.record("_acme-challenge.example.com."); !ok || value != "token-digest" {
+		t.Fatalf("expected txt record to be published, got %q (%v)", value, ok)
+	}
+
+	if err := provider.CleanUp(ctx, "_acme-challenge.example.com", "token-digest"); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+	if _, ok := server.record("_acme-challenge.example.com."); ok {
+		t.Fatalf("expected txt record to be removed")
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.badMAC {
+		t.Fatalf("server rejected the tsig signature")
+	}
+}
+
+func TestRFC2136Provider_RejectedUpdate(t *testing.T) {
+	server := startFakeDNSServer(t, []byte("server-key"))
+
+	provider, err := NewRFC2136Provider(models.DnsProviderRFC2136{
+		Nameserver:  server.conn.LocalAddr().String(),
+		TSIGKeyName: "shiroxy-key",
+		TSIGSecret:  base64.StdEncoding.EncodeToString([]byte("wrong-key")),
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	err = provider.Present(context.Background(), "_acme-challenge.example.com", "value")
+	if err == nil || !strings.Contains(err.Error(), "rcode 9") {
+		t.Fatalf("expected NOTAUTH error, got %v", err)
+	}
+}
+
+func TestRFC2136Provider_FindsZoneAndRetriesOverTCP(t *testing.T) {
+	secret := []byte("super-secret-tsig-key")
+	server := startFakeDNSServer(t, secret)
+	server.mu.Lock()
+	server.zone = "example.co.uk."
+	server.truncate = true
+	server.mu.Unlock()
+
+	provider, err := NewRFC2136Provider(models.DnsProviderRFC2136{
+		Nameserver:  server.conn.LocalAddr().String(),
+		TSIGKeyName: "shiroxy-key",
+		TSIGSecret:  base64.StdEncoding.EncodeToString(secret),
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	if err := provider.Present(context.Background(), "_acme-challenge.shop.example.co.uk", "token-digest"); err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	if value, ok := server.record("_acme-challenge.shop.example.co.uk."); !ok || value != "token-digest" {
+		t.Fatalf("expected txt record to be published, got %q (%v)", value, ok)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.zones) == 0 || server.zones[len(server.zones)-1] != "example.co.uk." {
+		t.Fatalf("expected the update to name the zone from the SOA record, got %v", server.zones)
+	}
+	if server.tcpMessages != 2 {
+		t.Fatalf("expected the truncated zone lookup and update to be retried over tcp, got %d tcp messages", server.tcpMessages)
+	}
+}
+
+func TestRFC2136Provider_RejectsUnverifiedResponse(t *testing.T) {
+	secret := []byte("super-secret-tsig-key")
+	server := startFakeDNSServer(t, secret)
+	server.mu.Lock()
+	server.responseSecret = []byte("forged-key")
+	server.mu.Unlock()
+
+	provider, err := NewRFC2136Provider(models.DnsProviderRFC2136{
+		Nameserver:  server.conn.LocalAddr().String(),
+		Zone:        "example.com",
+		TSIGKeyName: "shiroxy-key",
+		TSIGSecret:  base64.StdEncoding.EncodeToString(secret),
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	err = provider.Present(context.Background(), "_acme-challenge.example.com", "value")
+	if err == nil || !strings.Contains(err.Error(), "does not verify") {
+		t.Fatalf("expected the forged response to be rejected, got %v", err)
+	}
+}
+
+func TestWebhookDNSProvider(t *testing.T) {
+	var mu sync.Mutex
+	var received []webhookDNSRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("hook-secret"))
+		mac.Write(body)
+		if r.Header.Get("X-Shiroxy-Signature") != hex.EncodeToString(mac.Sum(nil)) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var request webhookDNSRequest
+		_ = json.Unmarshal(body, &request)
+		mu.Lock()
+		received = append(received, request)
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	provider, err := NewDNSProvider(models.DnsProvider{
+		Name:    "webhook",
+		Webhook: models.DnsProviderWebhook{Url: server.URL, Secret: "hook-secret"},
+	})
+	if err != nil {
+		t.Fatalf("new provider: %v", err)
+	}
+
+	ctx := context.Background()
+	if err := provider.Present(ctx, "_acme-challenge.example.com", "v1"); err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	if err := provider.CleanUp(ctx, "_acme-challenge.example.com", "v1"); err != nil {
+		t.Fatalf("cleanup: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 || received[0].Action != "present" || received[1].Action != "cleanup" {
+		t.Fatalf("unexpected webhook calls: %+v", received)
+	}
+}
+
+func TestSelectChallenge(t *testing.T) {
+	authz := acme.Authorization{
+		Identifier: acme.Identifier{Type: "dns", Value: "example.com"},
+		Challenges: []acme.Challenge{{Type: "dns-01"}, {Type: "http-01"}},
+	}
+
+	st := Storage{}
+	challenge, err := st.selectChallenge(authz, "")
+	if err != nil || challenge.Type != ChallengeHTTP01 {
+		t.Fatalf("expected http-01 without a dns provider, got %q (%v)", challenge.Type, err)
+	}
+
+	authz.Wildcard = true
+	if _, err := st.selectChallenge(authz, ""); err == nil {
+		t.Fatalf("expected wildcard without dns provider to fail")
+	}
+
+	st.DNSProvider = &WebhookDNSProvider{Url: "http://127.0.0.1"}
+	challenge, err = st.selectChallenge(authz, "")
+	if err != nil || challenge.Type != ChallengeDNS01 {
+		t.Fatalf("expected dns-01 for wildcard, got %q (%v)", challenge.Type, err)
+	}
+
+	authz.Challenges = []acme.Challenge{{Type: "tls-alpn-01"}}
+	if _, err := st.selectChallenge(authz, ""); err == nil {
+		t.Fatalf("expected an error when no supported challenge is offered")
+	}
+}
+
+func TestValidateDomainName(t *testing.T) {
+	valid := []string{"example.com", "*.example.com", "a-b.example.co.uk"}
+	for _, name := range valid {
+		if err := ValidateDomainName(name); err != nil {
+			t.Errorf("expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	invalid := []string{"", "localhost", "*.*.example.com", "foo.*.example.com", "-bad.example.com", "bad_name.example.com"}
+	for _, name := range invalid {
+		if err := ValidateDomainName(name); err == nil {
+			t.Errorf("expected %q to be rejected", name)
+		}
+	}
+}
+
+func TestPresentChallenge_HTTP01(t *testing.T) {
+	st := Storage{}
+	challenge := acme.Challenge{Type: ChallengeHTTP01, Token: "token", KeyAuthorization: "token.thumbprint"}
+
+	cleanup, err := st.presentChallenge(context.Background(), challenge, &DomainMetadata{Domain: "example.com"})
+	if err != nil {
+		t.Fatalf("present: %v", err)
+	}
+	if keyAuthorization, ok := st.HTTPChallengeResponse("token"); !ok || keyAuthorization != "token.thumbprint" {
+		t.Fatalf("expected the key authorization to be served, got %q", keyAuthorization)
+	}
+
+	cleanup()
+	if _, ok := st.HTTPChallengeResponse("token"); ok {
+		t.Fatalf("expected the challenge to be removed on cleanup")
+	}
+}
+
+// recordingDNSProvider records the TXT records it holds.
+type recordingDNSProvider struct {
+	mu         sync.Mutex
+	records    map[string]string
+	cleanUpErr error
+}
+
+func (r *recordingDNSProvider) Present(ctx context.Context, fqdn, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[fqdn] = value
+	return nil
+}
+
+func (r *recordingDNSProvider) CleanUp(ctx context.Context, fqdn, value string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cleanUpErr != nil {
+		return r.cleanUpErr
+	}
+	delete(r.records, fqdn)
+	return nil
+}
+
+func TestPresentChallenge_DNS01CleansUpWhenCancelled(t *testing.T) {
+	provider := &recordingDNSProvider{records: map[string]string{}}
+	st := Storage{DNSProvider: provider, DNSPropagationDelay: time.Hour}
+	challenge := acme.Challenge{
+		Type:             ChallengeDNS01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+	cleanup, err := st.presentChallenge(ctx, challenge, &DomainMetadata{Domain: "example.com"})
+	if err == nil || cleanup != nil {
+		t.Fatalf("expected the cancelled challenge to fail without a cleanup func")
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+	if len(provider.records) != 0 {
+		t.Fatalf("expected the TXT record to be removed, still have %v", provider.records)
+	}
+}
+
+func TestPresentChallenge_DNS01ReturnsCleanUpError(t *testing.T) {
+	provider := &recordingDNSProvider{records: map[string]string{}, cleanUpErr: errors.New("server refused update")}
+	st := Storage{DNSProvider: provider}
+	challenge := acme.Challenge{
+		Type:             ChallengeDNS01,
+		Token:            "token",
+		KeyAuthorization: "token.thumbprint",
+		Identifier:       acme.Identifier{Type: "dns", Value: "example.com"},
+	}
+
+	cleanup, err := st.presentChallenge(context.Background(), challenge, &DomainMetadata{Domain: "example.com"})
+	if err != nil {
+		t.Fatalf("present challenge: %v", err)
+	}
+	if err := cleanup(); err == nil || !strings.Contains(err.Error(), "server refused update") {
+		t.Fatalf("expected the failed cleanup to be returned, got %v", err)
+	}
+
+	st.DNSPropagationDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = st.presentChallenge(ctx, challenge, &DomainMetadata{Domain: "example.com"})
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "server refused update") {
+		t.Fatalf("expected the cancellation and the failed cleanup to be returned, got %v", err)
+	}
+}
@@ -13,9 +13,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
-	"os"
+	"shiroxy/pkg/logger"
 	"shiroxy/pkg/models"
 	"sync"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/mholt/acmez/acme"
@@ -25,35 +26,64 @@ import (
 
 // Storage is responsible for handling domain data storage, ACME certificates, and DNS challenge tokens.
 type Storage struct {
-	WebhookSecret        string                     // Secret for webhook verification.
-	ACME_SERVER_URL      string                     // URL for the ACME server.
-	INSECURE_SKIP_VERIFY bool                       // Flag to skip SSL verification; used for testing only.
-	Storage              *models.Storage            // Storage configuration (e.g., memory, Redis).
-	RedisClient          *redis.Client              // Redis client for interacting with Redis storage.
-	DnsChallengeToken    map[string]string          // Map to store DNS challenge tokens for domains.
-	DomainMetadata       map[string]*DomainMetadata // Metadata for each registered domain.
+	WebhookSecret        string                      // Secret for webhook verification.
+	ACME_SERVER_URL      string                      // URL for the ACME server.
+	Issuers              []*ACMEIssuer               // ACME issuers in fallback order; empty uses ACME_SERVER_URL.
+	INSECURE_SKIP_VERIFY bool                        // Flag to skip SSL verification; used for testing only.
+	Storage              *models.Storage             // Storage configuration (e.g., memory, Redis).
+	Store                DomainStore                 // Backend domains are persisted in; nil keeps them in the registry only.
+	RedisClient          redis.UniversalClient       // Redis client for interacting with Redis storage.
+	Encryption           *Envelope                   // Encrypts private keys and persistence files; nil when disabled.
+	AcmeAccounts         map[string]*AcmeAccount     // ACME accounts by issuer and email (memory storage).
+	DNSProvider          DNSProvider                 // Provider used to publish dns-01 TXT records; nil disables dns-01.
+	DNSPropagationDelay  time.Duration               // Time to wait after publishing a dns-01 record.
+	TLSALPNEnabled       bool                        // Set when a TLS listener on port 443 can answer tls-alpn-01 challenges.
+	httpChallenges       map[string]string           // http-01 key authorizations by challenge token.
+	tlsALPNCertificates  map[string]*tls.Certificate // tls-alpn-01 challenge certificates by domain.
+	challengeLock        sync.RWMutex                // Guards httpChallenges and tlsALPNCertificates.
+	Renewals             *RenewalManager             // Certificate renewal scheduler; nil when renewal is disabled.
+	Issuance             *IssuanceQueue              // Background issuance queue; nil issues certificates synchronously.
+	OCSP                 *OCSPManager                // OCSP stapling manager; nil when stapling is disabled.
+	OnDemand             *OnDemandTLS                // Issues certificates for unknown hostnames; nil when disabled.
+	Sync                 *DomainSync                 // Reconciles the domains with an external domain list; nil when disabled.
+	Cluster              *Cluster                    // Coordinates the instances sharing Redis; nil outside cluster mode.
+	Logger               *logger.Logger              // Logs Redis connection changes; nil discards them.
+	MustStaple           bool                        // Request certificates with the OCSP must-staple extension.
+	domains              *DomainRegistry             // Served domains, loaded from Store. Created by Domains.
+	domainsOnce          sync.Once                   // Creates domains.
+	domainLock           sync.RWMutex                // Serializes changes to Store and domains.
+	certificates         certificateCache            // Parsed certificates by server name.
+	accountLock          sync.Mutex                  // Guards AcmeAccounts and serializes account registration.
+	stopWatch            context.CancelFunc          // Stops following the changes of Store.
+	redisMonitor         *redisMonitor               // Health of RedisClient; nil without Redis.
+	stopMonitor          context.CancelFunc          // Stops probing RedisClient.
+
+	// obtain overrides obtainCertificate for issuance jobs; used by tests.
+	obtain func(domainMetadata *DomainMetadata) (*issuedCertificate, error)
 }
 
-// InitializeStorage initializes the storage system for managing domain metadata.
+// InitializeStorage opens the configured domain store, registers its domains and
+// keeps the registry in sync with changes to the store.
 // Parameters:
-//   - storage: *models.Storage, configuration for storage (memory or Redis).
+//   - storage: *models.Storage, configuration for storage (memory, redis, file or sql).
 //   - acmeServerUrl: string, URL for the ACME server.
 //   - insecureSkipVerify: string, determines whether to skip SSL verification ("yes" or "no").
+//   - logHandler: *logger.Logger, logs Redis connection changes; nil discards them.
 //   - wg: *sync.WaitGroup, used for synchronization.
 //
 // Returns:
 //   - *Storage: a pointer to the initialized Storage instance.
 //   - error: error if the storage could not be initialized.
-func InitializeStorage(storage *models.Storage, acmeServerUrl string, insecureSkipVerify string, wg *sync.WaitGroup) (*Storage, error) {
+func InitializeStorage(storage *models.Storage, acmeServerUrl string, insecureSkipVerify string, logHandler *logger.Logger, wg *sync.WaitGroup) (*Storage, error) {
 	if acmeServerUrl == "" {
 		acmeServerUrl = "https://127.0.0.1:14000/dir"
 	}
 
-	storageSystem := Storage{
+	storageSystem := &Storage{
 		Storage:              storage,
-		DnsChallengeToken:    make(map[string]string),
 		ACME_SERVER_URL:      acmeServerUrl,
 		INSECURE_SKIP_VERIFY: true,
+		Logger:               logHandler,
 	}
 
 	// Set INSECURE_SKIP_VERIFY based on input.
@@ -61,69 +91,144 @@ func InitializeStorage(storage *models.Storage, acmeServerUrl string, insecureSk
 		storageSystem.INSECURE_SKIP_VERIFY = false
 	}
 
-	// Initialize storage based on the specified storage location (memory or Redis).
-	switch storage.Location {
-	case "redis":
-		redisClient, err := storageSystem.ConnectRedis()
-		if err != nil {
-			return nil, err
-		}
-		storageSystem.RedisClient = redisClient
-		storageSystem.DomainMetadata = make(map[string]*DomainMetadata)
-	case "memory":
-		memoryStorage, err := storageSystem.initiazeMemoryStorage()
-		if err != nil {
-			return nil, err
-		}
-		storageSystem.DomainMetadata = memoryStorage
+	var err error
+	storageSystem.Encryption, err = NewEncryption(storage.Encryption)
+	if err != nil {
+		return nil, err
+	}
+	store, err := NewDomainStore(storage, logHandler)
+	if err != nil {
+		return nil, err
+	}
+	if redisStore, ok := store.(*RedisDomainStore); ok {
+		// ACME accounts are shared through the same database.
+		storageSystem.RedisClient = redisStore.Client
+	}
+	if _, memory := store.(*MemoryDomainStore); !memory {
+		// Private keys are encrypted before they reach disk or the network.
+		store = &sealedDomainStore{DomainStore: store, envelope: storageSystem.Encryption}
+	}
+	storageSystem.Store = store
+
+	if err := storageSystem.loadDomains(); err != nil {
+		store.Close()
+		return nil, err
+	}
+	if err := storageSystem.watchDomains(wg); err != nil {
+		store.Close()
+		return nil, err
 	}
-	return &storageSystem, nil
+	if storageSystem.RedisClient != nil {
+		storageSystem.monitorRedis(wg)
+	}
+	return storageSystem, nil
 }
 
 // RegisterDomain registers a new domain with metadata and generates an ACME account key.
 // Parameters:
 //   - domainName: string, the domain to register.
 //   - user_email: string, the user's email associated with the domain.
-//   - metadata: map[string]string, additional metadata for the domain.
+//   - metadata: map[string]string, user-defined labels for the domain.
 //
 // Returns:
 //   - string: the DNS challenge key.
 //   - error: error if registration fails.
 func (s *Storage) RegisterDomain(domainName, user_email string, metadata map[string]string) (string, error) {
+	return s.Register(DomainRegistration{
+		Domain:   domainName,
+		Email:    user_email,
+		Metadata: metadata,
+	})
+}
+
+// DomainRegistration describes a domain registration request.
+type DomainRegistration struct {
+	Domain             string            // Domain to register.
+	Email              string            // Contact email for the ACME account.
+	Metadata           map[string]string // User-defined labels of the domain.
+	Routing            *DomainRouting    // Tags and backend requests for the domain are routed by (optional).
+	PreferredChallenge string            // Challenge type to try first (http-01, tls-alpn-01 or dns-01).
+	Aliases            []string          // Additional hostnames (www, apex, wildcards) covered by the same certificate.
+	ClientAuth         *ClientAuthPolicy // Client certificate settings overriding the bind's (optional).
+	Issuer             string            // Name of the ACME issuer to order from first (optional).
+	OnDemand           bool              // Set when the domain is registered by on-demand TLS.
+}
+
+// Register registers a domain described by registration and requests its certificate.
+// Parameters:
+//   - registration: DomainRegistration, the domain, email, metadata and issuance preferences.
+//
+// Returns:
+//   - string: the key authorization of the challenge solved for the certificate;
+//     empty while the order is queued.
+//   - error: error if registration fails.
+func (s *Storage) Register(registration DomainRegistration) (string, error) {
+	domainName := registration.Domain
 	if len(domainName) == 0 {
 		return "", errors.New("domainName should not be empty")
 	}
+	if err := ValidateDomainName(domainName); err != nil {
+		return "", err
+	}
+	if err := ValidateChallengeType(registration.PreferredChallenge); err != nil {
+		return "", err
+	}
+	aliases, err := normalizeAliases(domainName, registration.Aliases)
+	if err != nil {
+		return "", err
+	}
+	if err := ValidateClientAuthPolicy(registration.ClientAuth); err != nil {
+		return "", err
+	}
+	if err := s.ValidateIssuer(registration.Issuer); err != nil {
+		return "", err
+	}
 
-	// Generate ACME account keys for the domain.
-	domainMetadata, err := s.generateAcmeAccountKeys(domainName, user_email, metadata)
+	// Orders are placed with the ACME account shared by every domain of the email.
+	domainMetadata, err := s.prepareDomainMetadata(domainName, registration.Email, registration.Metadata)
 	if err != nil {
 		return "", err
 	}
+	domainMetadata = proto.Clone(domainMetadata).(*DomainMetadata)
+	domainMetadata.PreferredChallenge = registration.PreferredChallenge
+	// Registering hands a domain with an uploaded certificate back to ACME.
+	domainMetadata.ManualCertificate = false
+	domainMetadata.Aliases = aliases
+	domainMetadata.Issuer = registration.Issuer
+	domainMetadata.OnDemand = registration.OnDemand
+	if registration.Routing != nil {
+		domainMetadata.Routing = registration.Routing
+	}
+	// Clients written for older versions still pass the routing tags as metadata.
+	MigrateDomainMetadata(domainMetadata)
+	if registration.ClientAuth.IsSet() {
+		domainMetadata.ClientAuth = registration.ClientAuth
+	}
 
 	// Store the domain metadata in the appropriate storage (memory or Redis).
-	switch s.Storage.Location {
-	case "memory":
-		s.DomainMetadata[domainName] = domainMetadata
-	case "redis":
-		marshaledBody, err := proto.Marshal(domainMetadata)
-		if err != nil {
-			return "", err
-		}
-
-		ctx := context.Background()
-		result := s.RedisClient.Set(ctx, domainName, marshaledBody, 0)
-		if result.Err() != nil {
-			return "", result.Err()
-		}
+	s.domainLock.Lock()
+	err = s.checkAliasConflicts(domainName, domainMetadata.Names())
+	if err == nil {
+		err = s.storeDomainMetadata(domainMetadata)
+	}
+	s.domainLock.Unlock()
+	if err != nil {
+		return "", err
 	}
 
-	// Generate the certificate for the domain.
-	err = s.generateCertificate(domainMetadata)
+	// Issue the certificate for the domain; with an issuance queue running this
+	// only schedules the order and its progress is reported by the order state.
+	err = s.requestCertificate(domainName)
 	if err != nil {
 		return "", err
 	}
 
-	return domainMetadata.DnsChallengeKey, nil
+	// The order stores its challenge on the registered domain, which replaced domainMetadata.
+	registered, ok := s.Domains().Get(domainName)
+	if !ok {
+		return "", nil
+	}
+	return registered.DnsChallengeKey, nil
 }
 
 // UpdateDomain updates the metadata for an existing domain.
@@ -138,40 +243,15 @@ func (s *Storage) UpdateDomain(domainName string, updateBody *DomainMetadata) er
 		return errors.New("domainName should not be empty")
 	}
 
-	// Update the metadata in the appropriate storage (memory or Redis).
-	switch s.Storage.Location {
-	case "memory":
-		oldData := s.DomainMetadata[domainName]
-		if oldData == nil {
-			return errors.New("no data found for domainName")
-		} else {
-			s.DomainMetadata[domainName] = updateBody
-		}
-	case "redis":
-		ctx := context.Background()
-		result := s.RedisClient.Get(ctx, domainName)
-		if result.Err() != nil {
-			return result.Err()
-		}
-
-		oldData, err := result.Result()
-		if err != nil {
-			return err
-		}
-
-		if oldData == "" {
-			return errors.New("no data found for domainName")
-		}
-		marshaledUpdateBody, err := proto.Marshal(updateBody)
-		if err != nil {
-			return err
-		}
-		updateResult := s.RedisClient.Set(ctx, domainName, marshaledUpdateBody, 0)
-		if updateResult.Err() != nil {
-			return updateResult.Err()
-		}
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+	if _, err := s.loadDomainMetadata(domainName); err != nil {
+		return err
 	}
-	return nil
+	updateBody = proto.Clone(updateBody).(*DomainMetadata)
+	updateBody.Domain = domainName
+	MigrateDomainMetadata(updateBody)
+	return s.storeDomainMetadata(updateBody)
 }
 
 // RemoveDomain removes a domain's metadata from the storage.
@@ -185,245 +265,230 @@ func (s *Storage) RemoveDomain(domainName string) error {
 		return errors.New("domainName should not be empty")
 	}
 
-	// Remove domain metadata from memory or Redis.
-	switch s.Storage.Location {
-	case "memory":
-		oldData := s.DomainMetadata[domainName]
-		if oldData == nil {
-			return errors.New("no data found for domainName")
-		} else {
-			delete(s.DomainMetadata, domainName)
-		}
-	case "redis":
-		ctx := context.Background()
-		result := s.RedisClient.Get(ctx, domainName)
-		if result.Err() != nil {
-			return result.Err()
-		}
-
-		oldData, err := result.Result()
-		if err != nil {
-			return err
-		}
-
-		if oldData == "" {
-			return errors.New("no data found for domainName")
-		}
-		deleteResult := s.RedisClient.Del(ctx, domainName)
-		if deleteResult.Err() != nil {
-			return deleteResult.Err()
-		}
-	}
-	return nil
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+	return s.deleteDomainMetadata(domainName)
 }
 
-// ForceSSL is a placeholder function to enforce SSL for a domain.
+// ForceSSL requests a new certificate for an already registered domain, for example
+// after a failed issuance.
 // Parameters:
 //   - domainName: string, the domain to enforce SSL on.
 //
 // Returns:
-//   - error: currently, this function returns nil as it's a placeholder.
+//   - error: error if the domain does not exist or the issuance could not be requested.
 func (s *Storage) ForceSSL(domainName string) error {
-	return nil
-}
-
-// ConnectRedis establishes a connection to the Redis database using the provided configuration.
-// Returns:
-//   - *redis.Client: the initialized Redis client.
-//   - error: error if the connection fails.
-func (s *Storage) ConnectRedis() (*redis.Client, error) {
-	var rdb redis.Client
-
-	if s.Storage.RedisConnectionString != "" {
-		opt, err := redis.ParseURL(s.Storage.RedisConnectionString)
-		if err != nil {
-			panic(err)
-		}
-		rdb = *redis.NewClient(opt)
-	} else {
-		rdb = *redis.NewClient(&redis.Options{
-			Addr:     s.Storage.RedisHost + ":" + s.Storage.RedisHost,
-			Password: s.Storage.RedisPassword,
-			DB:       0,
-		})
+	if len(domainName) == 0 {
+		return errors.New("domainName should not be empty")
 	}
-
-	var ctx context.Context = context.Background()
-
-	_, err := rdb.Ping(ctx).Result()
-	if err != nil {
-		return nil, err
-	} else {
-		return &rdb, nil
+	if _, err := s.getDomainMetadata(domainName); err != nil {
+		return err
 	}
+	return s.requestCertificate(domainName)
 }
 
-// initiazeMemoryStorage initializes an in-memory storage map for domain metadata.
+// ConnectRedis establishes a connection to the Redis database using the provided configuration.
 // Returns:
-//   - map[string]*DomainMetadata: the initialized in-memory storage map.
-//   - error: currently, this function returns nil as it always succeeds.
-func (s *Storage) initiazeMemoryStorage() (map[string]*DomainMetadata, error) {
-	memoryMap := map[string]*DomainMetadata{}
-	return memoryMap, nil
+//   - redis.UniversalClient: the initialized Redis client.
+//   - error: error if the connection fails.
+func (s *Storage) ConnectRedis() (redis.UniversalClient, error) {
+	return connectRedis(s.Storage, s.Logger)
 }
 
-// generateAcmeAccountKeys generates an ACME account private key for a domain.
+// prepareDomainMetadata returns the stored metadata of a domain, or new inactive
+// metadata when the domain is not registered yet.
 // Parameters:
-//   - domainName: string, the domain to generate keys for.
+//   - domainName: string, the domain to prepare.
 //   - email: string, the user's email.
-//   - metadata: map[string]string, additional metadata for the domain.
+//   - metadata: map[string]string, additional metadata for a new domain.
 //
 // Returns:
-//   - *DomainMetadata: the generated domain metadata containing the keys.
-//   - error: error if key generation fails.
-func (s *Storage) generateAcmeAccountKeys(domainName, email string, metadata map[string]string) (*DomainMetadata, error) {
-	var domainMetadata *DomainMetadata
-
-	domainMetadata = s.DomainMetadata[domainName]
-	if domainMetadata == nil {
-		accountPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
-		if err != nil {
-			return nil, fmt.Errorf("generating account key: %v", err)
-		}
+//   - *DomainMetadata: the domain metadata; stored metadata must be cloned before it is modified.
+//   - error: currently, this function returns nil as it always succeeds.
+func (s *Storage) prepareDomainMetadata(domainName, email string, metadata map[string]string) (*DomainMetadata, error) {
+	domainMetadata, err := s.getDomainMetadata(domainName)
+	if err != nil {
+		return &DomainMetadata{
+			Status:   "inactive",
+			Domain:   domainName,
+			Email:    email,
+			Metadata: metadata,
+		}, nil
+	}
+	if domainMetadata.Email == "" {
+		// Domains created by a certificate upload have no contact email yet.
+		domainMetadata = proto.Clone(domainMetadata).(*DomainMetadata)
+		domainMetadata.Email = email
+	}
+	return domainMetadata, nil
+}
 
-		privateKeyBytes, err := x509.MarshalECPrivateKey(accountPrivateKey)
-		if err != nil {
-			return nil, err
-		}
+// issuedCertificate holds the result of a completed ACME order.
+type issuedCertificate struct {
+	CertPemBlock []byte // Full certificate chain in PEM format.
+	KeyPemBlock  []byte // Certificate private key in PEM format.
+	URL          string // URL the certificate was downloaded from.
+	CA           string // CA the certificate was issued by.
+	Issuer       string // Name of the issuer the certificate was ordered from.
+}
 
-		domainMetadata = &DomainMetadata{
-			Status:                "inactive",
-			Domain:                domainName,
-			Email:                 email,
-			Metadata:              metadata,
-			AcmeAccountPrivateKey: privateKeyBytes,
-		}
+// apply stores the issued certificate, its key and its details in domainMetadata.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the metadata to update.
+func (i *issuedCertificate) apply(domainMetadata *DomainMetadata) {
+	domainMetadata.CertPemBlock = i.CertPemBlock
+	domainMetadata.KeyPemBlock = i.KeyPemBlock
+	domainMetadata.OcspStaple = nil // Belongs to the replaced certificate.
+	certificate := &CertificateInfo{}
+	if chain, err := ParseCertificateChain(i.CertPemBlock); err == nil {
+		certificate = newCertificateInfo(chain[0])
 	}
-
-	return domainMetadata, nil
+	certificate.Url = i.URL
+	certificate.Ca = i.CA
+	certificate.Issuer = i.Issuer
+	domainMetadata.Certificate = certificate
 }
 
-// generateCertificate generates an SSL certificate for the domain using the ACME protocol.
+// newACMEClient creates a low-level ACME client for the directory of issuer.
 // Parameters:
-//   - domainMetadata: *DomainMetadata, the metadata of the domain to generate a certificate for.
+//   - issuer: *ACMEIssuer, the issuer to talk to.
 //
 // Returns:
-//   - error: error if certificate generation fails.
-func (s *Storage) generateCertificate(domainMetadata *DomainMetadata) error {
-	accountPrivateKey, err := x509.ParseECPrivateKey(domainMetadata.AcmeAccountPrivateKey)
-	if err != nil {
-		return err
-	}
-	savedAccount := acme.Account{
-		Contact:              []string{fmt.Sprintf("mailto:%s", domainMetadata.Email)},
-		TermsOfServiceAgreed: true,
-		PrivateKey:           accountPrivateKey,
-	}
-
-	ctx := context.Background()
-
+//   - *acme.Client: the ACME client.
+//   - error: error if the client logger cannot be created.
+func (s *Storage) newACMEClient(issuer *ACMEIssuer) (*acme.Client, error) {
 	logger, err := zap.NewDevelopment()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	tlcClientConfig := &tls.Config{
-		InsecureSkipVerify: true,
-	}
-	if os.Getenv("SHIROXY_ENVIRONMENT") == "stage" || os.Getenv("SHIROXY_ENVIRONMENT") == "prod" {
-		tlcClientConfig.InsecureSkipVerify = false
+		InsecureSkipVerify: issuer.InsecureSkipVerify,
 	}
 
-	// Create a low-level ACME client.
-	client := &acme.Client{
-		Directory: s.ACME_SERVER_URL,
+	return &acme.Client{
+		Directory: issuer.DirectoryURL,
 		HTTPClient: &http.Client{
 			Transport: &http.Transport{
 				TLSClientConfig: tlcClientConfig,
 			},
 		},
 		Logger: logger,
-	}
+	}, nil
+}
 
-	var account acme.Account
+// orderCertificate runs an ACME order for the domain with issuer and returns the issued
+// certificate without modifying the stored certificate, so callers decide how to install it.
+// Parameters:
+//   - issuer: *ACMEIssuer, the CA to order from.
+//   - domainMetadata: *DomainMetadata, the metadata of the domain to obtain a certificate for.
+//
+// Returns:
+//   - *issuedCertificate: the issued certificate chain and key.
+//   - error: error if the order fails.
+func (s *Storage) orderCertificate(issuer *ACMEIssuer, domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+	ctx := context.Background()
 
-	// Retrieve or create an ACME account.
-	account, err = client.GetAccount(ctx, savedAccount)
+	// Create a low-level ACME client.
+	client, err := s.newACMEClient(issuer)
 	if err != nil {
-		account, err = client.NewAccount(ctx, savedAccount)
-		if err != nil {
-			return fmt.Errorf("new account: %v", err)
-		}
+		return nil, err
+	}
+
+	// Retrieve the account shared by the domains of the email, registering it on first use.
+	account, err := s.acmeAccount(ctx, client, issuer, domainMetadata.Email, domainMetadata.AcmeAccountPrivateKey)
+	if err != nil {
+		return nil, err
 	}
 
 	// Create a new ACME order for the certificate.
 	var ids []acme.Identifier
-	ids = append(ids, acme.Identifier{Type: "dns", Value: domainMetadata.Domain})
+	for _, name := range domainMetadata.Names() {
+		ids = append(ids, acme.Identifier{Type: "dns", Value: name})
+	}
 	order := acme.Order{Identifiers: ids}
 	order, err = client.NewOrder(ctx, account, order)
 	if err != nil {
-		return fmt.Errorf("creating new order: %v", err)
+		if accountRejected(err) {
+			// Deactivated or unknown at the CA; the next order registers a new account.
+			s.forgetAccount(issuer.Name, domainMetadata.Email)
+		}
+		return nil, fmt.Errorf("creating new order: %w", err)
 	}
 
 	// Solve the challenges for the domain to authorize certificate issuance.
 	for _, authzURL := range order.Authorizations {
 		authz, err := client.GetAuthorization(ctx, account, authzURL)
 		if err != nil {
-			return fmt.Errorf("getting authorization %q: %v", authzURL, err)
+			return nil, fmt.Errorf("getting authorization %q: %v", authzURL, err)
 		}
 
-		var preferredChallenge acme.Challenge
-		for _, challenges := range authz.Challenges {
-			if challenges.Type == "http-01" {
-				preferredChallenge = challenges
-				break
-			}
+		// Authorizations reused from earlier orders need no further work.
+		if authz.Status == "valid" {
+			continue
 		}
 
-		s.DnsChallengeToken[preferredChallenge.Token] = domainMetadata.Domain
-		domainMetadata.DnsChallengeKey = preferredChallenge.KeyAuthorization
+		preferredChallenge, err := s.selectChallenge(authz, domainMetadata.PreferredChallenge)
+		if err != nil {
+			return nil, err
+		}
+
+		cleanup, err := s.presentChallenge(ctx, preferredChallenge, domainMetadata)
+		if err != nil {
+			return nil, err
+		}
 
 		// Initiate the challenge to start solving it.
 		preferredChallenge, err = client.InitiateChallenge(ctx, account, preferredChallenge)
 		if err != nil {
-			return fmt.Errorf("initiating challenge %q: %v", preferredChallenge.URL, err)
+			return nil, errors.Join(fmt.Errorf("initiating challenge %q: %v", preferredChallenge.URL, err), cleanup())
 		}
 
 		// Poll the authorization until it is valid.
-		authz, err = client.PollAuthorization(ctx, account, authz)
+		_, err = client.PollAuthorization(ctx, account, authz)
+		cleanupErr := cleanup()
 		if err != nil {
-			return fmt.Errorf("solving challenge: %v", err)
+			return nil, errors.Join(fmt.Errorf("solving challenge: %v", err), cleanupErr)
+		}
+		if cleanupErr != nil {
+			return nil, cleanupErr
 		}
 	}
 
 	// Generate a private key for the certificate.
 	certPrivateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return fmt.Errorf("generating certificate key: %v", err)
+		return nil, fmt.Errorf("generating certificate key: %v", err)
 	}
 
 	// Create a certificate signing request (CSR).
-	csrTemplate := &x509.CertificateRequest{DNSNames: []string{domainMetadata.Domain}}
+	csrTemplate := &x509.CertificateRequest{DNSNames: domainMetadata.Names()}
+	if s.MustStaple {
+		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, mustStapleExtension)
+	}
 	csrDER, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, certPrivateKey)
 	if err != nil {
-		return fmt.Errorf("generating CSR: %v", err)
+		return nil, fmt.Errorf("generating CSR: %v", err)
 	}
 
 	csr, err := x509.ParseCertificateRequest(csrDER)
 	if err != nil {
-		return fmt.Errorf("parsing generated CSR: %v", err)
+		return nil, fmt.Errorf("parsing generated CSR: %v", err)
 	}
 
 	// Finalize the ACME order with the CSR to obtain the certificate.
 	order, err = client.FinalizeOrder(ctx, account, order, csr.Raw)
 	if err != nil {
-		return fmt.Errorf("finalizing order: %v", err)
+		return nil, fmt.Errorf("finalizing order: %w", err)
 	}
 
 	// Download the certificate chain from the ACME server.
 	certChains, err := client.GetCertificateChain(ctx, account, order.Certificate)
 	if err != nil {
-		return fmt.Errorf("downloading certs: %v", err)
+		return nil, fmt.Errorf("downloading certs: %v", err)
+	}
+	if len(certChains) == 0 {
+		return nil, fmt.Errorf("downloading certs: no certificate chain returned")
 	}
 
 	// Store the certificate and private key in the domain metadata.
@@ -435,24 +500,18 @@ func (s *Storage) generateCertificate(domainMetadata *DomainMetadata) error {
 	// Marshal the private key to DER format.
 	certPrivateKeyBytes, err := x509.MarshalECPrivateKey(certPrivateKey)
 	if err != nil {
-		return fmt.Errorf("marshaling private key: %v", err)
+		return nil, fmt.Errorf("marshaling private key: %v", err)
 	}
 
 	// Encode the private key to PEM format.
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "EC PRIVATE KEY",
-		Bytes: certPrivateKeyBytes,
-	})
-
-	// Update the domain metadata with the certificate and key.
-	domainMetadata.CertPemBlock = fullChain
-	domainMetadata.KeyPemBlock = privateKeyPEM
-	domainMetadata.Metadata = make(map[string]string)
-	domainMetadata.Metadata["cert_url"] = certChains[0].URL
-	domainMetadata.Metadata["cert_ca"] = certChains[0].CA
-	domainMetadata.Status = "active"
-
-	fmt.Printf("Certificate Generated Successfully For Domain : %s", domainMetadata.Domain)
-
-	return nil
+	return &issuedCertificate{
+		CertPemBlock: fullChain,
+		KeyPemBlock: pem.EncodeToMemory(&pem.Block{
+			Type:  "EC PRIVATE KEY",
+			Bytes: certPrivateKeyBytes,
+		}),
+		URL:    certChains[0].URL,
+		CA:     certChains[0].CA,
+		Issuer: issuer.Name,
+	}, nil
 }
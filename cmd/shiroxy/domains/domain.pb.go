@@ -27,17 +27,30 @@ type DomainMetadata struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	Status                string            `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
-	Date                  string            `protobuf:"bytes,2,opt,name=date,proto3" json:"date,omitempty"`
-	Domain                string            `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
-	Email                 string            `protobuf:"bytes,4,opt,name=email,proto3" json:"email,omitempty"`
-	AcmeAccountPrivateKey []byte            `protobuf:"bytes,5,opt,name=acme_account_private_key,json=acmeAccountPrivateKey,proto3" json:"acme_account_private_key,omitempty"`
-	CsrDer                []byte            `protobuf:"bytes,6,opt,name=csr_der,json=csrDer,proto3" json:"csr_der,omitempty"`
-	CombinedCert          []byte            `protobuf:"bytes,7,opt,name=combined_cert,json=combinedCert,proto3" json:"combined_cert,omitempty"`
-	CertPemBlock          []byte            `protobuf:"bytes,8,opt,name=cert_pem_block,json=certPemBlock,proto3" json:"cert_pem_block,omitempty"`
-	KeyPemBlock           []byte            `protobuf:"bytes,9,opt,name=key_pem_block,json=keyPemBlock,proto3" json:"key_pem_block,omitempty"`
-	DnsChallengeKey       string            `protobuf:"bytes,10,opt,name=dns_challenge_key,json=dnsChallengeKey,proto3" json:"dns_challenge_key,omitempty"`
-	Metadata              map[string]string `protobuf:"bytes,11,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Status                string             `protobuf:"bytes,1,opt,name=status,proto3" json:"status,omitempty"`
+	Date                  string             `protobuf:"bytes,2,opt,name=date,proto3" json:"date,omitempty"`
+	Domain                string             `protobuf:"bytes,3,opt,name=domain,proto3" json:"domain,omitempty"`
+	Email                 string             `protobuf:"bytes,4,opt,name=email,proto3" json:"email,omitempty"`
+	AcmeAccountPrivateKey []byte             `protobuf:"bytes,5,opt,name=acme_account_private_key,json=acmeAccountPrivateKey,proto3" json:"acme_account_private_key,omitempty"`
+	CsrDer                []byte             `protobuf:"bytes,6,opt,name=csr_der,json=csrDer,proto3" json:"csr_der,omitempty"`
+	CombinedCert          []byte             `protobuf:"bytes,7,opt,name=combined_cert,json=combinedCert,proto3" json:"combined_cert,omitempty"`
+	CertPemBlock          []byte             `protobuf:"bytes,8,opt,name=cert_pem_block,json=certPemBlock,proto3" json:"cert_pem_block,omitempty"`
+	KeyPemBlock           []byte             `protobuf:"bytes,9,opt,name=key_pem_block,json=keyPemBlock,proto3" json:"key_pem_block,omitempty"`
+	DnsChallengeKey       string             `protobuf:"bytes,10,opt,name=dns_challenge_key,json=dnsChallengeKey,proto3" json:"dns_challenge_key,omitempty"`
+	Metadata              map[string]string  `protobuf:"bytes,11,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	PreferredChallenge    string             `protobuf:"bytes,12,opt,name=preferred_challenge,json=preferredChallenge,proto3" json:"preferred_challenge,omitempty"`
+	Order                 *IssuanceOrder     `protobuf:"bytes,13,opt,name=order,proto3" json:"order,omitempty"`
+	Aliases               []string           `protobuf:"bytes,14,rep,name=aliases,proto3" json:"aliases,omitempty"`
+	OcspStaple            []byte             `protobuf:"bytes,15,opt,name=ocsp_staple,json=ocspStaple,proto3" json:"ocsp_staple,omitempty"`
+	ClientAuth            *ClientAuthPolicy  `protobuf:"bytes,16,opt,name=client_auth,json=clientAuth,proto3" json:"client_auth,omitempty"`
+	ManualCertificate     bool               `protobuf:"varint,17,opt,name=manual_certificate,json=manualCertificate,proto3" json:"manual_certificate,omitempty"`
+	Issuer                string             `protobuf:"bytes,18,opt,name=issuer,proto3" json:"issuer,omitempty"`
+	OnDemand              bool               `protobuf:"varint,19,opt,name=on_demand,json=onDemand,proto3" json:"on_demand,omitempty"`
+	Routing               *DomainRouting     `protobuf:"bytes,20,opt,name=routing,proto3" json:"routing,omitempty"`
+	Certificate           *CertificateInfo   `protobuf:"bytes,21,opt,name=certificate,proto3" json:"certificate,omitempty"`
+	CreatedAt             int64              `protobuf:"varint,22,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt             int64              `protobuf:"varint,23,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+	History               []*IssuanceAttempt `protobuf:"bytes,24,rep,name=history,proto3" json:"history,omitempty"`
 }
 
 func (x *DomainMetadata) Reset() {
@@ -149,6 +162,555 @@ func (x *DomainMetadata) GetMetadata() map[string]string {
 	return nil
 }
 
+func (x *DomainMetadata) GetPreferredChallenge() string {
+	if x != nil {
+		return x.PreferredChallenge
+	}
+	return ""
+}
+
+func (x *DomainMetadata) GetOrder() *IssuanceOrder {
+	if x != nil {
+		return x.Order
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetAliases() []string {
+	if x != nil {
+		return x.Aliases
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetOcspStaple() []byte {
+	if x != nil {
+		return x.OcspStaple
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetClientAuth() *ClientAuthPolicy {
+	if x != nil {
+		return x.ClientAuth
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetManualCertificate() bool {
+	if x != nil {
+		return x.ManualCertificate
+	}
+	return false
+}
+
+func (x *DomainMetadata) GetIssuer() string {
+	if x != nil {
+		return x.Issuer
+	}
+	return ""
+}
+
+func (x *DomainMetadata) GetOnDemand() bool {
+	if x != nil {
+		return x.OnDemand
+	}
+	return false
+}
+
+func (x *DomainMetadata) GetRouting() *DomainRouting {
+	if x != nil {
+		return x.Routing
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetCertificate() *CertificateInfo {
+	if x != nil {
+		return x.Certificate
+	}
+	return nil
+}
+
+func (x *DomainMetadata) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *DomainMetadata) GetUpdatedAt() int64 {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return 0
+}
+
+func (x *DomainMetadata) GetHistory() []*IssuanceAttempt {
+	if x != nil {
+		return x.History
+	}
+	return nil
+}
+
+type DomainRouting struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Tags    []string `protobuf:"bytes,1,rep,name=tags,proto3" json:"tags,omitempty"`
+	Backend string   `protobuf:"bytes,2,opt,name=backend,proto3" json:"backend,omitempty"`
+}
+
+func (x *DomainRouting) Reset() {
+	*x = DomainRouting{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[1]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *DomainRouting) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DomainRouting) ProtoMessage() {}
+
+func (x *DomainRouting) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[1]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DomainRouting.ProtoReflect.Descriptor instead.
+func (*DomainRouting) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *DomainRouting) GetTags() []string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *DomainRouting) GetBackend() string {
+	if x != nil {
+		return x.Backend
+	}
+	return ""
+}
+
+type CertificateInfo struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Url       string   `protobuf:"bytes,1,opt,name=url,proto3" json:"url,omitempty"`
+	Ca        string   `protobuf:"bytes,2,opt,name=ca,proto3" json:"ca,omitempty"`
+	Issuer    string   `protobuf:"bytes,3,opt,name=issuer,proto3" json:"issuer,omitempty"`
+	Serial    string   `protobuf:"bytes,4,opt,name=serial,proto3" json:"serial,omitempty"`
+	NotBefore int64    `protobuf:"varint,5,opt,name=not_before,json=notBefore,proto3" json:"not_before,omitempty"`
+	NotAfter  int64    `protobuf:"varint,6,opt,name=not_after,json=notAfter,proto3" json:"not_after,omitempty"`
+	Sans      []string `protobuf:"bytes,7,rep,name=sans,proto3" json:"sans,omitempty"`
+}
+
+func (x *CertificateInfo) Reset() {
+	*x = CertificateInfo{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[2]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *CertificateInfo) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*CertificateInfo) ProtoMessage() {}
+
+func (x *CertificateInfo) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[2]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use CertificateInfo.ProtoReflect.Descriptor instead.
+func (*CertificateInfo) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *CertificateInfo) GetUrl() string {
+	if x != nil {
+		return x.Url
+	}
+	return ""
+}
+
+func (x *CertificateInfo) GetCa() string {
+	if x != nil {
+		return x.Ca
+	}
+	return ""
+}
+
+func (x *CertificateInfo) GetIssuer() string {
+	if x != nil {
+		return x.Issuer
+	}
+	return ""
+}
+
+func (x *CertificateInfo) GetSerial() string {
+	if x != nil {
+		return x.Serial
+	}
+	return ""
+}
+
+func (x *CertificateInfo) GetNotBefore() int64 {
+	if x != nil {
+		return x.NotBefore
+	}
+	return 0
+}
+
+func (x *CertificateInfo) GetNotAfter() int64 {
+	if x != nil {
+		return x.NotAfter
+	}
+	return 0
+}
+
+func (x *CertificateInfo) GetSans() []string {
+	if x != nil {
+		return x.Sans
+	}
+	return nil
+}
+
+type IssuanceAttempt struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Kind       string `protobuf:"bytes,1,opt,name=kind,proto3" json:"kind,omitempty"`
+	Issuer     string `protobuf:"bytes,2,opt,name=issuer,proto3" json:"issuer,omitempty"`
+	Error      string `protobuf:"bytes,3,opt,name=error,proto3" json:"error,omitempty"`
+	StartedAt  int64  `protobuf:"varint,4,opt,name=started_at,json=startedAt,proto3" json:"started_at,omitempty"`
+	FinishedAt int64  `protobuf:"varint,5,opt,name=finished_at,json=finishedAt,proto3" json:"finished_at,omitempty"`
+}
+
+func (x *IssuanceAttempt) Reset() {
+	*x = IssuanceAttempt{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[3]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *IssuanceAttempt) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IssuanceAttempt) ProtoMessage() {}
+
+func (x *IssuanceAttempt) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[3]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IssuanceAttempt.ProtoReflect.Descriptor instead.
+func (*IssuanceAttempt) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *IssuanceAttempt) GetKind() string {
+	if x != nil {
+		return x.Kind
+	}
+	return ""
+}
+
+func (x *IssuanceAttempt) GetIssuer() string {
+	if x != nil {
+		return x.Issuer
+	}
+	return ""
+}
+
+func (x *IssuanceAttempt) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *IssuanceAttempt) GetStartedAt() int64 {
+	if x != nil {
+		return x.StartedAt
+	}
+	return 0
+}
+
+func (x *IssuanceAttempt) GetFinishedAt() int64 {
+	if x != nil {
+		return x.FinishedAt
+	}
+	return 0
+}
+
+type ClientAuthPolicy struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Mode     string `protobuf:"bytes,1,opt,name=mode,proto3" json:"mode,omitempty"`
+	CaBundle []byte `protobuf:"bytes,2,opt,name=ca_bundle,json=caBundle,proto3" json:"ca_bundle,omitempty"`
+}
+
+func (x *ClientAuthPolicy) Reset() {
+	*x = ClientAuthPolicy{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[4]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *ClientAuthPolicy) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ClientAuthPolicy) ProtoMessage() {}
+
+func (x *ClientAuthPolicy) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[4]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ClientAuthPolicy.ProtoReflect.Descriptor instead.
+func (*ClientAuthPolicy) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *ClientAuthPolicy) GetMode() string {
+	if x != nil {
+		return x.Mode
+	}
+	return ""
+}
+
+func (x *ClientAuthPolicy) GetCaBundle() []byte {
+	if x != nil {
+		return x.CaBundle
+	}
+	return nil
+}
+
+type IssuanceOrder struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	State     string `protobuf:"bytes,1,opt,name=state,proto3" json:"state,omitempty"`
+	Error     string `protobuf:"bytes,2,opt,name=error,proto3" json:"error,omitempty"`
+	Attempts  int32  `protobuf:"varint,3,opt,name=attempts,proto3" json:"attempts,omitempty"`
+	CreatedAt int64  `protobuf:"varint,4,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	UpdatedAt int64  `protobuf:"varint,5,opt,name=updated_at,json=updatedAt,proto3" json:"updated_at,omitempty"`
+}
+
+func (x *IssuanceOrder) Reset() {
+	*x = IssuanceOrder{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[5]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *IssuanceOrder) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*IssuanceOrder) ProtoMessage() {}
+
+func (x *IssuanceOrder) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[5]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use IssuanceOrder.ProtoReflect.Descriptor instead.
+func (*IssuanceOrder) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *IssuanceOrder) GetState() string {
+	if x != nil {
+		return x.State
+	}
+	return ""
+}
+
+func (x *IssuanceOrder) GetError() string {
+	if x != nil {
+		return x.Error
+	}
+	return ""
+}
+
+func (x *IssuanceOrder) GetAttempts() int32 {
+	if x != nil {
+		return x.Attempts
+	}
+	return 0
+}
+
+func (x *IssuanceOrder) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *IssuanceOrder) GetUpdatedAt() int64 {
+	if x != nil {
+		return x.UpdatedAt
+	}
+	return 0
+}
+
+type AcmeAccount struct {
+	state         protoimpl.MessageState
+	sizeCache     protoimpl.SizeCache
+	unknownFields protoimpl.UnknownFields
+
+	Issuer      string `protobuf:"bytes,1,opt,name=issuer,proto3" json:"issuer,omitempty"`
+	Email       string `protobuf:"bytes,2,opt,name=email,proto3" json:"email,omitempty"`
+	PrivateKey  []byte `protobuf:"bytes,3,opt,name=private_key,json=privateKey,proto3" json:"private_key,omitempty"`
+	Location    string `protobuf:"bytes,4,opt,name=location,proto3" json:"location,omitempty"`
+	Status      string `protobuf:"bytes,5,opt,name=status,proto3" json:"status,omitempty"`
+	CreatedAt   int64  `protobuf:"varint,6,opt,name=created_at,json=createdAt,proto3" json:"created_at,omitempty"`
+	KeyRolledAt int64  `protobuf:"varint,7,opt,name=key_rolled_at,json=keyRolledAt,proto3" json:"key_rolled_at,omitempty"`
+}
+
+func (x *AcmeAccount) Reset() {
+	*x = AcmeAccount{}
+	if protoimpl.UnsafeEnabled {
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[6]
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		ms.StoreMessageInfo(mi)
+	}
+}
+
+func (x *AcmeAccount) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*AcmeAccount) ProtoMessage() {}
+
+func (x *AcmeAccount) ProtoReflect() protoreflect.Message {
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[6]
+	if protoimpl.UnsafeEnabled && x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use AcmeAccount.ProtoReflect.Descriptor instead.
+func (*AcmeAccount) Descriptor() ([]byte, []int) {
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *AcmeAccount) GetIssuer() string {
+	if x != nil {
+		return x.Issuer
+	}
+	return ""
+}
+
+func (x *AcmeAccount) GetEmail() string {
+	if x != nil {
+		return x.Email
+	}
+	return ""
+}
+
+func (x *AcmeAccount) GetPrivateKey() []byte {
+	if x != nil {
+		return x.PrivateKey
+	}
+	return nil
+}
+
+func (x *AcmeAccount) GetLocation() string {
+	if x != nil {
+		return x.Location
+	}
+	return ""
+}
+
+func (x *AcmeAccount) GetStatus() string {
+	if x != nil {
+		return x.Status
+	}
+	return ""
+}
+
+func (x *AcmeAccount) GetCreatedAt() int64 {
+	if x != nil {
+		return x.CreatedAt
+	}
+	return 0
+}
+
+func (x *AcmeAccount) GetKeyRolledAt() int64 {
+	if x != nil {
+		return x.KeyRolledAt
+	}
+	return 0
+}
+
 type DataPersistance struct {
 	state         protoimpl.MessageState
 	sizeCache     protoimpl.SizeCache
@@ -157,12 +719,13 @@ type DataPersistance struct {
 	Datetime string            `protobuf:"bytes,1,opt,name=datetime,proto3" json:"datetime,omitempty"`
 	User     string            `protobuf:"bytes,2,opt,name=user,proto3" json:"user,omitempty"`
 	Domains  []*DomainMetadata `protobuf:"bytes,3,rep,name=domains,proto3" json:"domains,omitempty"`
+	Accounts []*AcmeAccount    `protobuf:"bytes,4,rep,name=accounts,proto3" json:"accounts,omitempty"`
 }
 
 func (x *DataPersistance) Reset() {
 	*x = DataPersistance{}
 	if protoimpl.UnsafeEnabled {
-		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[1]
+		mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[7]
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		ms.StoreMessageInfo(mi)
 	}
@@ -175,7 +738,7 @@ func (x *DataPersistance) String() string {
 func (*DataPersistance) ProtoMessage() {}
 
 func (x *DataPersistance) ProtoReflect() protoreflect.Message {
-	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[1]
+	mi := &file_cmd_shiroxy_domains_domain_proto_msgTypes[7]
 	if protoimpl.UnsafeEnabled && x != nil {
 		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
 		if ms.LoadMessageInfo() == nil {
@@ -188,7 +751,7 @@ func (x *DataPersistance) ProtoReflect() protoreflect.Message {
 
 // Deprecated: Use DataPersistance.ProtoReflect.Descriptor instead.
 func (*DataPersistance) Descriptor() ([]byte, []int) {
-	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{1}
+	return file_cmd_shiroxy_domains_domain_proto_rawDescGZIP(), []int{7}
 }
 
 func (x *DataPersistance) GetDatetime() string {
@@ -212,12 +775,19 @@ func (x *DataPersistance) GetDomains() []*DomainMetadata {
 	return nil
 }
 
+func (x *DataPersistance) GetAccounts() []*AcmeAccount {
+	if x != nil {
+		return x.Accounts
+	}
+	return nil
+}
+
 var File_cmd_shiroxy_domains_domain_proto protoreflect.FileDescriptor
 
 var file_cmd_shiroxy_domains_domain_proto_rawDesc = []byte{
 	0x0a, 0x20, 0x63, 0x6d, 0x64, 0x2f, 0x73, 0x68, 0x69, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x64, 0x6f,
 	0x6d, 0x61, 0x69, 0x6e, 0x73, 0x2f, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x12, 0x04, 0x6d, 0x61, 0x69, 0x6e, 0x22, 0xd4, 0x03, 0x0a, 0x0e, 0x44, 0x6f, 0x6d,
+	0x74, 0x6f, 0x12, 0x04, 0x6d, 0x61, 0x69, 0x6e, 0x22, 0xdf, 0x07, 0x0a, 0x0e, 0x44, 0x6f, 0x6d,
 	0x61, 0x69, 0x6e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x12, 0x16, 0x0a, 0x06, 0x73,
 	0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x74, 0x61,
 	0x74, 0x75, 0x73, 0x12, 0x12, 0x0a, 0x04, 0x64, 0x61, 0x74, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28,
@@ -243,20 +813,107 @@ var file_cmd_shiroxy_domains_domain_proto_rawDesc = []byte{
 	0x20, 0x03, 0x28, 0x0b, 0x32, 0x22, 0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x44, 0x6f, 0x6d, 0x61,
 	0x69, 0x6e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x2e, 0x4d, 0x65, 0x74, 0x61, 0x64,
 	0x61, 0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x52, 0x08, 0x6d, 0x65, 0x74, 0x61, 0x64, 0x61,
-	0x74, 0x61, 0x1a, 0x3b, 0x0a, 0x0d, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x45, 0x6e,
-	0x74, 0x72, 0x79, 0x12, 0x10, 0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09,
-	0x52, 0x03, 0x6b, 0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22,
-	0x71, 0x0a, 0x0f, 0x44, 0x61, 0x74, 0x61, 0x50, 0x65, 0x72, 0x73, 0x69, 0x73, 0x74, 0x61, 0x6e,
-	0x63, 0x65, 0x12, 0x1a, 0x0a, 0x08, 0x64, 0x61, 0x74, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x01,
-	0x20, 0x01, 0x28, 0x09, 0x52, 0x08, 0x64, 0x61, 0x74, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x12,
-	0x0a, 0x04, 0x75, 0x73, 0x65, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x73,
-	0x65, 0x72, 0x12, 0x2e, 0x0a, 0x07, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x18, 0x03, 0x20,
-	0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x44, 0x6f, 0x6d, 0x61, 0x69,
-	0x6e, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x52, 0x07, 0x64, 0x6f, 0x6d, 0x61, 0x69,
-	0x6e, 0x73, 0x42, 0x17, 0x5a, 0x15, 0x2e, 0x2f, 0x63, 0x6d, 0x64, 0x2f, 0x73, 0x68, 0x69, 0x72,
-	0x6f, 0x78, 0x79, 0x2f, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f,
-	0x74, 0x6f, 0x33,
+	0x74, 0x61, 0x12, 0x2f, 0x0a, 0x13, 0x70, 0x72, 0x65, 0x66, 0x65, 0x72, 0x72, 0x65, 0x64, 0x5f,
+	0x63, 0x68, 0x61, 0x6c, 0x6c, 0x65, 0x6e, 0x67, 0x65, 0x18, 0x0c, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x12, 0x70, 0x72, 0x65, 0x66, 0x65, 0x72, 0x72, 0x65, 0x64, 0x43, 0x68, 0x61, 0x6c, 0x6c, 0x65,
+	0x6e, 0x67, 0x65, 0x12, 0x29, 0x0a, 0x05, 0x6f, 0x72, 0x64, 0x65, 0x72, 0x18, 0x0d, 0x20, 0x01,
+	0x28, 0x0b, 0x32, 0x13, 0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x49, 0x73, 0x73, 0x75, 0x61, 0x6e,
+	0x63, 0x65, 0x4f, 0x72, 0x64, 0x65, 0x72, 0x52, 0x05, 0x6f, 0x72, 0x64, 0x65, 0x72, 0x12, 0x18,
+	0x0a, 0x07, 0x61, 0x6c, 0x69, 0x61, 0x73, 0x65, 0x73, 0x18, 0x0e, 0x20, 0x03, 0x28, 0x09, 0x52,
+	0x07, 0x61, 0x6c, 0x69, 0x61, 0x73, 0x65, 0x73, 0x12, 0x1f, 0x0a, 0x0b, 0x6f, 0x63, 0x73, 0x70,
+	0x5f, 0x73, 0x74, 0x61, 0x70, 0x6c, 0x65, 0x18, 0x0f, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x6f,
+	0x63, 0x73, 0x70, 0x53, 0x74, 0x61, 0x70, 0x6c, 0x65, 0x12, 0x37, 0x0a, 0x0b, 0x63, 0x6c, 0x69,
+	0x65, 0x6e, 0x74, 0x5f, 0x61, 0x75, 0x74, 0x68, 0x18, 0x10, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x16,
+	0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x41, 0x75, 0x74, 0x68,
+	0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x52, 0x0a, 0x63, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x41, 0x75,
+	0x74, 0x68, 0x12, 0x2d, 0x0a, 0x12, 0x6d, 0x61, 0x6e, 0x75, 0x61, 0x6c, 0x5f, 0x63, 0x65, 0x72,
+	0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x18, 0x11, 0x20, 0x01, 0x28, 0x08, 0x52, 0x11,
+	0x6d, 0x61, 0x6e, 0x75, 0x61, 0x6c, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74,
+	0x65, 0x12, 0x16, 0x0a, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x18, 0x12, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x12, 0x1b, 0x0a, 0x09, 0x6f, 0x6e, 0x5f,
+	0x64, 0x65, 0x6d, 0x61, 0x6e, 0x64, 0x18, 0x13, 0x20, 0x01, 0x28, 0x08, 0x52, 0x08, 0x6f, 0x6e,
+	0x44, 0x65, 0x6d, 0x61, 0x6e, 0x64, 0x12, 0x2d, 0x0a, 0x07, 0x72, 0x6f, 0x75, 0x74, 0x69, 0x6e,
+	0x67, 0x18, 0x14, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x13, 0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x44,
+	0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x52, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x52, 0x07, 0x72, 0x6f,
+	0x75, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x37, 0x0a, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69,
+	0x63, 0x61, 0x74, 0x65, 0x18, 0x15, 0x20, 0x01, 0x28, 0x0b, 0x32, 0x15, 0x2e, 0x6d, 0x61, 0x69,
+	0x6e, 0x2e, 0x43, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x66,
+	0x6f, 0x52, 0x0b, 0x63, 0x65, 0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x12, 0x1d,
+	0x0a, 0x0a, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x16, 0x20, 0x01,
+	0x28, 0x03, 0x52, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x1d, 0x0a,
+	0x0a, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x17, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x09, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x41, 0x74, 0x12, 0x2f, 0x0a, 0x07,
+	0x68, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x18, 0x18, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x15, 0x2e,
+	0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x49, 0x73, 0x73, 0x75, 0x61, 0x6e, 0x63, 0x65, 0x41, 0x74, 0x74,
+	0x65, 0x6d, 0x70, 0x74, 0x52, 0x07, 0x68, 0x69, 0x73, 0x74, 0x6f, 0x72, 0x79, 0x1a, 0x3b, 0x0a,
+	0x0d, 0x4d, 0x65, 0x74, 0x61, 0x64, 0x61, 0x74, 0x61, 0x45, 0x6e, 0x74, 0x72, 0x79, 0x12, 0x10,
+	0x0a, 0x03, 0x6b, 0x65, 0x79, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x6b, 0x65, 0x79,
+	0x12, 0x14, 0x0a, 0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x05, 0x76, 0x61, 0x6c, 0x75, 0x65, 0x3a, 0x02, 0x38, 0x01, 0x22, 0x3d, 0x0a, 0x0d, 0x44, 0x6f,
+	0x6d, 0x61, 0x69, 0x6e, 0x52, 0x6f, 0x75, 0x74, 0x69, 0x6e, 0x67, 0x12, 0x12, 0x0a, 0x04, 0x74,
+	0x61, 0x67, 0x73, 0x18, 0x01, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x74, 0x61, 0x67, 0x73, 0x12,
+	0x18, 0x0a, 0x07, 0x62, 0x61, 0x63, 0x6b, 0x65, 0x6e, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09,
+	0x52, 0x07, 0x62, 0x61, 0x63, 0x6b, 0x65, 0x6e, 0x64, 0x22, 0xb3, 0x01, 0x0a, 0x0f, 0x43, 0x65,
+	0x72, 0x74, 0x69, 0x66, 0x69, 0x63, 0x61, 0x74, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x10, 0x0a,
+	0x03, 0x75, 0x72, 0x6c, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x03, 0x75, 0x72, 0x6c, 0x12,
+	0x0e, 0x0a, 0x02, 0x63, 0x61, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x02, 0x63, 0x61, 0x12,
+	0x16, 0x0a, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52,
+	0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x73, 0x65, 0x72, 0x69, 0x61,
+	0x6c, 0x18, 0x04, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73, 0x65, 0x72, 0x69, 0x61, 0x6c, 0x12,
+	0x1d, 0x0a, 0x0a, 0x6e, 0x6f, 0x74, 0x5f, 0x62, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x18, 0x05, 0x20,
+	0x01, 0x28, 0x03, 0x52, 0x09, 0x6e, 0x6f, 0x74, 0x42, 0x65, 0x66, 0x6f, 0x72, 0x65, 0x12, 0x1b,
+	0x0a, 0x09, 0x6e, 0x6f, 0x74, 0x5f, 0x61, 0x66, 0x74, 0x65, 0x72, 0x18, 0x06, 0x20, 0x01, 0x28,
+	0x03, 0x52, 0x08, 0x6e, 0x6f, 0x74, 0x41, 0x66, 0x74, 0x65, 0x72, 0x12, 0x12, 0x0a, 0x04, 0x73,
+	0x61, 0x6e, 0x73, 0x18, 0x07, 0x20, 0x03, 0x28, 0x09, 0x52, 0x04, 0x73, 0x61, 0x6e, 0x73, 0x22,
+	0x93, 0x01, 0x0a, 0x0f, 0x49, 0x73, 0x73, 0x75, 0x61, 0x6e, 0x63, 0x65, 0x41, 0x74, 0x74, 0x65,
+	0x6d, 0x70, 0x74, 0x12, 0x12, 0x0a, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x18, 0x01, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x04, 0x6b, 0x69, 0x6e, 0x64, 0x12, 0x16, 0x0a, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65,
+	0x72, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x12,
+	0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x03, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05,
+	0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x1d, 0x0a, 0x0a, 0x73, 0x74, 0x61, 0x72, 0x74, 0x65, 0x64,
+	0x5f, 0x61, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x73, 0x74, 0x61, 0x72, 0x74,
+	0x65, 0x64, 0x41, 0x74, 0x12, 0x1f, 0x0a, 0x0b, 0x66, 0x69, 0x6e, 0x69, 0x73, 0x68, 0x65, 0x64,
+	0x5f, 0x61, 0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0a, 0x66, 0x69, 0x6e, 0x69, 0x73,
+	0x68, 0x65, 0x64, 0x41, 0x74, 0x22, 0x43, 0x0a, 0x10, 0x43, 0x6c, 0x69, 0x65, 0x6e, 0x74, 0x41,
+	0x75, 0x74, 0x68, 0x50, 0x6f, 0x6c, 0x69, 0x63, 0x79, 0x12, 0x12, 0x0a, 0x04, 0x6d, 0x6f, 0x64,
+	0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x6d, 0x6f, 0x64, 0x65, 0x12, 0x1b, 0x0a,
+	0x09, 0x63, 0x61, 0x5f, 0x62, 0x75, 0x6e, 0x64, 0x6c, 0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0c,
+	0x52, 0x08, 0x63, 0x61, 0x42, 0x75, 0x6e, 0x64, 0x6c, 0x65, 0x22, 0x95, 0x01, 0x0a, 0x0d, 0x49,
+	0x73, 0x73, 0x75, 0x61, 0x6e, 0x63, 0x65, 0x4f, 0x72, 0x64, 0x65, 0x72, 0x12, 0x14, 0x0a, 0x05,
+	0x73, 0x74, 0x61, 0x74, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x73, 0x74, 0x61,
+	0x74, 0x65, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x02, 0x20, 0x01, 0x28,
+	0x09, 0x52, 0x05, 0x65, 0x72, 0x72, 0x6f, 0x72, 0x12, 0x1a, 0x0a, 0x08, 0x61, 0x74, 0x74, 0x65,
+	0x6d, 0x70, 0x74, 0x73, 0x18, 0x03, 0x20, 0x01, 0x28, 0x05, 0x52, 0x08, 0x61, 0x74, 0x74, 0x65,
+	0x6d, 0x70, 0x74, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64, 0x5f,
+	0x61, 0x74, 0x18, 0x04, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65,
+	0x64, 0x41, 0x74, 0x12, 0x1d, 0x0a, 0x0a, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64, 0x5f, 0x61,
+	0x74, 0x18, 0x05, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x75, 0x70, 0x64, 0x61, 0x74, 0x65, 0x64,
+	0x41, 0x74, 0x22, 0xd3, 0x01, 0x0a, 0x0b, 0x41, 0x63, 0x6d, 0x65, 0x41, 0x63, 0x63, 0x6f, 0x75,
+	0x6e, 0x74, 0x12, 0x16, 0x0a, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01,
+	0x28, 0x09, 0x52, 0x06, 0x69, 0x73, 0x73, 0x75, 0x65, 0x72, 0x12, 0x14, 0x0a, 0x05, 0x65, 0x6d,
+	0x61, 0x69, 0x6c, 0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x05, 0x65, 0x6d, 0x61, 0x69, 0x6c,
+	0x12, 0x1f, 0x0a, 0x0b, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x5f, 0x6b, 0x65, 0x79, 0x18,
+	0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x0a, 0x70, 0x72, 0x69, 0x76, 0x61, 0x74, 0x65, 0x4b, 0x65,
+	0x79, 0x12, 0x1a, 0x0a, 0x08, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x18, 0x04, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x08, 0x6c, 0x6f, 0x63, 0x61, 0x74, 0x69, 0x6f, 0x6e, 0x12, 0x16, 0x0a,
+	0x06, 0x73, 0x74, 0x61, 0x74, 0x75, 0x73, 0x18, 0x05, 0x20, 0x01, 0x28, 0x09, 0x52, 0x06, 0x73,
+	0x74, 0x61, 0x74, 0x75, 0x73, 0x12, 0x1d, 0x0a, 0x0a, 0x63, 0x72, 0x65, 0x61, 0x74, 0x65, 0x64,
+	0x5f, 0x61, 0x74, 0x18, 0x06, 0x20, 0x01, 0x28, 0x03, 0x52, 0x09, 0x63, 0x72, 0x65, 0x61, 0x74,
+	0x65, 0x64, 0x41, 0x74, 0x12, 0x22, 0x0a, 0x0d, 0x6b, 0x65, 0x79, 0x5f, 0x72, 0x6f, 0x6c, 0x6c,
+	0x65, 0x64, 0x5f, 0x61, 0x74, 0x18, 0x07, 0x20, 0x01, 0x28, 0x03, 0x52, 0x0b, 0x6b, 0x65, 0x79,
+	0x52, 0x6f, 0x6c, 0x6c, 0x65, 0x64, 0x41, 0x74, 0x22, 0xa0, 0x01, 0x0a, 0x0f, 0x44, 0x61, 0x74,
+	0x61, 0x50, 0x65, 0x72, 0x73, 0x69, 0x73, 0x74, 0x61, 0x6e, 0x63, 0x65, 0x12, 0x1a, 0x0a, 0x08,
+	0x64, 0x61, 0x74, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x08,
+	0x64, 0x61, 0x74, 0x65, 0x74, 0x69, 0x6d, 0x65, 0x12, 0x12, 0x0a, 0x04, 0x75, 0x73, 0x65, 0x72,
+	0x18, 0x02, 0x20, 0x01, 0x28, 0x09, 0x52, 0x04, 0x75, 0x73, 0x65, 0x72, 0x12, 0x2e, 0x0a, 0x07,
+	0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x18, 0x03, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x14, 0x2e,
+	0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x44, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x4d, 0x65, 0x74, 0x61, 0x64,
+	0x61, 0x74, 0x61, 0x52, 0x07, 0x64, 0x6f, 0x6d, 0x61, 0x69, 0x6e, 0x73, 0x12, 0x2d, 0x0a, 0x08,
+	0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x18, 0x04, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x11,
+	0x2e, 0x6d, 0x61, 0x69, 0x6e, 0x2e, 0x41, 0x63, 0x6d, 0x65, 0x41, 0x63, 0x63, 0x6f, 0x75, 0x6e,
+	0x74, 0x52, 0x08, 0x61, 0x63, 0x63, 0x6f, 0x75, 0x6e, 0x74, 0x73, 0x42, 0x17, 0x5a, 0x15, 0x2e,
+	0x2f, 0x63, 0x6d, 0x64, 0x2f, 0x73, 0x68, 0x69, 0x72, 0x6f, 0x78, 0x79, 0x2f, 0x64, 0x6f, 0x6d,
+	0x61, 0x69, 0x6e, 0x73, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -271,20 +928,32 @@ func file_cmd_shiroxy_domains_domain_proto_rawDescGZIP() []byte {
 	return file_cmd_shiroxy_domains_domain_proto_rawDescData
 }
 
-var file_cmd_shiroxy_domains_domain_proto_msgTypes = make([]protoimpl.MessageInfo, 3)
+var file_cmd_shiroxy_domains_domain_proto_msgTypes = make([]protoimpl.MessageInfo, 9)
 var file_cmd_shiroxy_domains_domain_proto_goTypes = []any{
-	(*DomainMetadata)(nil),  // 0: main.DomainMetadata
-	(*DataPersistance)(nil), // 1: main.DataPersistance
-	nil,                     // 2: main.DomainMetadata.MetadataEntry
+	(*DomainMetadata)(nil),   // 0: main.DomainMetadata
+	(*DomainRouting)(nil),    // 1: main.DomainRouting
+	(*CertificateInfo)(nil),  // 2: main.CertificateInfo
+	(*IssuanceAttempt)(nil),  // 3: main.IssuanceAttempt
+	(*ClientAuthPolicy)(nil), // 4: main.ClientAuthPolicy
+	(*IssuanceOrder)(nil),    // 5: main.IssuanceOrder
+	(*AcmeAccount)(nil),      // 6: main.AcmeAccount
+	(*DataPersistance)(nil),  // 7: main.DataPersistance
+	nil,                      // 8: main.DomainMetadata.MetadataEntry
 }
 var file_cmd_shiroxy_domains_domain_proto_depIdxs = []int32{
-	2, // 0: main.DomainMetadata.metadata:type_name -> main.DomainMetadata.MetadataEntry
-	0, // 1: main.DataPersistance.domains:type_name -> main.DomainMetadata
-	2, // [2:2] is the sub-list for method output_type
-	2, // [2:2] is the sub-list for method input_type
-	2, // [2:2] is the sub-list for extension type_name
-	2, // [2:2] is the sub-list for extension extendee
-	0, // [0:2] is the sub-list for field type_name
+	8, // 0: main.DomainMetadata.metadata:type_name -> main.DomainMetadata.MetadataEntry
+	5, // 1: main.DomainMetadata.order:type_name -> main.IssuanceOrder
+	4, // 2: main.DomainMetadata.client_auth:type_name -> main.ClientAuthPolicy
+	1, // 3: main.DomainMetadata.routing:type_name -> main.DomainRouting
+	2, // 4: main.DomainMetadata.certificate:type_name -> main.CertificateInfo
+	3, // 5: main.DomainMetadata.history:type_name -> main.IssuanceAttempt
+	0, // 6: main.DataPersistance.domains:type_name -> main.DomainMetadata
+	6, // 7: main.DataPersistance.accounts:type_name -> main.AcmeAccount
+	8, // [8:8] is the sub-list for method output_type
+	8, // [8:8] is the sub-list for method input_type
+	8, // [8:8] is the sub-list for extension type_name
+	8, // [8:8] is the sub-list for extension extendee
+	0, // [0:8] is the sub-list for field type_name
 }
 
 func init() { file_cmd_shiroxy_domains_domain_proto_init() }
@@ -306,6 +975,78 @@ func file_cmd_shiroxy_domains_domain_proto_init() {
 			}
 		}
 		file_cmd_shiroxy_domains_domain_proto_msgTypes[1].Exporter = func(v any, i int) any {
+			switch v := v.(*DomainRouting); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[2].Exporter = func(v any, i int) any {
+			switch v := v.(*CertificateInfo); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[3].Exporter = func(v any, i int) any {
+			switch v := v.(*IssuanceAttempt); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[4].Exporter = func(v any, i int) any {
+			switch v := v.(*ClientAuthPolicy); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[5].Exporter = func(v any, i int) any {
+			switch v := v.(*IssuanceOrder); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[6].Exporter = func(v any, i int) any {
+			switch v := v.(*AcmeAccount); i {
+			case 0:
+				return &v.state
+			case 1:
+				return &v.sizeCache
+			case 2:
+				return &v.unknownFields
+			default:
+				return nil
+			}
+		}
+		file_cmd_shiroxy_domains_domain_proto_msgTypes[7].Exporter = func(v any, i int) any {
 			switch v := v.(*DataPersistance); i {
 			case 0:
 				return &v.state
@@ -324,7 +1065,7 @@ func file_cmd_shiroxy_domains_domain_proto_init() {
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_cmd_shiroxy_domains_domain_proto_rawDesc,
 			NumEnums:      0,
-			NumMessages:   3,
+			NumMessages:   9,
 			NumExtensions: 0,
 			NumServices:   0,
 		},
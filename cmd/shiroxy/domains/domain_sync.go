@@ -0,0 +1,248 @@
+package domains
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventDomainSyncFailed is fired when the domain list of a sync cannot be read or applied.
+const EventDomainSyncFailed = "domain.sync_failed"
+
+// Domain sync defaults used when the configuration leaves a value unset.
+const (
+	defaultDomainSyncInterval = 5 * time.Minute
+	domainSyncFetchTimeout    = 30 * time.Second
+)
+
+// ErrNotLeader is returned for work left to the leader of the cluster.
+var ErrNotLeader = errors.New("this instance is not the cluster leader")
+
+// DomainSync periodically reconciles the registered domains with a domain list
+// read from a file or an http(s) URL.
+type DomainSync struct {
+	storage  *Storage
+	notify   func(eventName string, data interface{})
+	validate func(record DomainRecord) error
+	source   string
+	format   string
+	headers  map[string]string
+	interval time.Duration
+	dryRun   bool
+	client   *http.Client
+
+	lock     sync.Mutex // Serializes syncs and guards status.
+	status   DomainSyncStatus
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// DomainSyncStatus reports the outcome of the last domain sync.
+type DomainSyncStatus struct {
+	Source      string      `json:"source"`
+	Interval    int         `json:"interval"` // Seconds between syncs.
+	DryRun      bool        `json:"dry_run"`
+	LastRun     time.Time   `json:"last_run,omitempty"`
+	LastSuccess time.Time   `json:"last_success,omitempty"`
+	Error       string      `json:"error,omitempty"`  // Reason the last sync failed.
+	Report      *BulkReport `json:"report,omitempty"` // Result of the last successful sync.
+}
+
+// StartDomainSync starts syncing the domains with the configured source.
+// Parameters:
+//   - storage: *Storage, the storage the domains are registered in.
+//   - config: models.DomainSync, domain sync configuration.
+//   - validate: func(DomainRecord) error, additional checks of each record (may be nil).
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *DomainSync: the running domain sync, or nil if no source is configured.
+//   - error: error if the source or format is invalid.
+func StartDomainSync(storage *Storage, config models.DomainSync, validate func(record DomainRecord) error, notify func(eventName string, data interface{}), wg *sync.WaitGroup) (*DomainSync, error) {
+	if config.Source == "" {
+		return nil, nil
+	}
+	if config.Format != "" && config.Format != FormatJSON && config.Format != FormatCSV && config.Format != FormatNDJSON {
+		return nil, fmt.Errorf("domain sync: unknown format %q; use json, csv or ndjson", config.Format)
+	}
+	if strings.Contains(config.Source, "://") {
+		source, err := url.Parse(config.Source)
+		if err != nil || (source.Scheme != "http" && source.Scheme != "https") || source.Host == "" {
+			return nil, fmt.Errorf("domain sync: invalid source %q", config.Source)
+		}
+	}
+
+	domainSync := &DomainSync{
+		storage:  storage,
+		notify:   notify,
+		validate: validate,
+		source:   config.Source,
+		format:   config.Format,
+		headers:  config.Headers,
+		interval: time.Duration(config.Interval) * time.Second,
+		dryRun:   config.DryRun,
+		client:   &http.Client{Timeout: domainSyncFetchTimeout},
+		stop:     make(chan struct{}),
+	}
+	if domainSync.interval <= 0 {
+		domainSync.interval = defaultDomainSyncInterval
+	}
+	domainSync.status = DomainSyncStatus{Source: config.Source, Interval: int(domainSync.interval / time.Second), DryRun: config.DryRun}
+	storage.Sync = domainSync
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(domainSync.interval)
+		defer ticker.Stop()
+		for {
+			// Followers leave syncing to the leader, whose changes reach them through the store.
+			if storage.IsLeader() {
+				if _, err := domainSync.Sync(domainSync.dryRun); err != nil {
+					fmt.Printf("domain sync: %v\n", err)
+				}
+			}
+			select {
+			case <-ticker.C:
+			case <-domainSync.stop:
+				return
+			}
+		}
+	}()
+	return domainSync, nil
+}
+
+// Stop stops the periodic syncs.
+func (d *DomainSync) Stop() {
+	d.stopOnce.Do(func() { close(d.stop) })
+}
+
+// Status returns the outcome of the last sync.
+// Returns:
+//   - DomainSyncStatus: the sync status.
+func (d *DomainSync) Status() DomainSyncStatus {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.status
+}
+
+// Sync reads the domain list from the source and reconciles the domains with it.
+// Parameters:
+//   - dryRun: bool, report the changes without making them.
+//
+// Returns:
+//   - *BulkReport: the result for every domain.
+//   - error: error if the list cannot be read or applied, or this instance is not the leader.
+func (d *DomainSync) Sync(dryRun bool) (*BulkReport, error) {
+	if !d.storage.IsLeader() {
+		return nil, ErrNotLeader
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.status.LastRun = time.Now()
+	records, err := ReadDomainList(d.client, d.source, d.format, d.headers)
+	var report *BulkReport
+	if err == nil {
+		report, err = d.storage.ApplyDomainRecords(records, BulkOptions{DryRun: dryRun, Prune: true, Validate: d.validate})
+	}
+	if err != nil {
+		d.status.Error = err.Error()
+		if d.notify != nil {
+			d.notify(EventDomainSyncFailed, map[string]string{
+				"source": d.source,
+				"error":  err.Error(),
+			})
+		}
+		return nil, err
+	}
+
+	d.status.Error = ""
+	d.status.LastSuccess = d.status.LastRun
+	d.status.Report = report
+	logReport(report)
+	return report, nil
+}
+
+// logReport prints the changes of a sync.
+func logReport(report *BulkReport) {
+	if report.Created+report.Updated+report.Removed+report.Failed == 0 {
+		return
+	}
+	prefix := "domain sync"
+	if report.DryRun {
+		prefix = "domain sync (dry run)"
+	}
+	for _, result := range report.Results {
+		switch result.Action {
+		case BulkUnchanged:
+		case BulkFailed:
+			fmt.Printf("%s: %s %s: %s\n", prefix, result.Action, result.Domain, result.Error)
+		default:
+			fmt.Printf("%s: %s %s %s\n", prefix, result.Action, result.Domain, strings.Join(result.Changes, ","))
+		}
+	}
+	fmt.Printf("%s: %d created, %d updated, %d removed, %d failed\n", prefix, report.Created, report.Updated, report.Removed, report.Failed)
+}
+
+// ReadDomainList reads a domain list from a file, or from an http(s) URL with a GET request.
+// Parameters:
+//   - client: *http.Client, the client URLs are fetched with.
+//   - source: string, the file path or URL.
+//   - format: string, the list format; empty detects it from the extension or the response content type.
+//   - headers: map[string]string, headers sent with the request for a URL (may be nil).
+//
+// Returns:
+//   - []DomainRecord: the domain records.
+//   - error: error if the list cannot be read, decoded, or its format is unknown.
+func ReadDomainList(client *http.Client, source, format string, headers map[string]string) ([]DomainRecord, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if format == "" {
+			format = DetectFormat(source)
+		}
+		if format == "" {
+			return nil, fmt.Errorf("cannot tell the format of %s from its extension; set the format", source)
+		}
+		return DecodeDomainRecords(file, format)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, source, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, response.Body)
+		return nil, fmt.Errorf("%s responded with %s", source, response.Status)
+	}
+	if format == "" {
+		format = DetectFormat(response.Header.Get("Content-Type"))
+	}
+	if format == "" {
+		format = DetectFormat(request.URL.Path)
+	}
+	if format == "" {
+		return nil, fmt.Errorf("cannot tell the format of %s from its content type; set the format", source)
+	}
+	return DecodeDomainRecords(response.Body, format)
+}
@@ -14,7 +14,7 @@ func TestInitializeStorage_Memory(t *testing.T) {
 	}
 
 	var wg sync.WaitGroup
-	store, err := domains.InitializeStorage(storage, "", "yes", &wg)
+	store, err := domains.InitializeStorage(storage, "", "yes", nil, &wg)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -27,8 +27,8 @@ func TestInitializeStorage_Memory(t *testing.T) {
 		t.Errorf("unexpected ACME_SERVER_URL: got %s", store.ACME_SERVER_URL)
 	}
 
-	if len(store.DomainMetadata) != 0 {
-		t.Errorf("expected DomainMetadata to be empty, got %v", store.DomainMetadata)
+	if store.Domains().Snapshot().Len() != 0 {
+		t.Errorf("expected no registered domains, got %v", store.Domains().Snapshot().List())
 	}
 }
 
@@ -40,7 +40,7 @@ func TestInitializeStorage_Redis(t *testing.T) {
 	}
 
 	var wg sync.WaitGroup
-	store, err := domains.InitializeStorage(storage, "https://acme-staging-v02.api.letsencrypt.org/directory", "no", &wg)
+	store, err := domains.InitializeStorage(storage, "https://acme-staging-v02.api.letsencrypt.org/directory", "no", nil, &wg)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
@@ -63,7 +63,6 @@ func TestRegisterDomain_EmptyDomain(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: make(map[string]*domains.DomainMetadata),
 	}
 
 	_, err := storage.RegisterDomain("", "user@example.com", nil)
@@ -78,7 +77,6 @@ func TestRegisterDomain_Memory(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: make(map[string]*domains.DomainMetadata),
 	}
 
 	dnsChallengeKey, err := storage.RegisterDomain("example.com", "user@example.com", nil)
@@ -90,7 +88,7 @@ func TestRegisterDomain_Memory(t *testing.T) {
 		t.Errorf("expected DNS challenge key to be generated")
 	}
 
-	if storage.DomainMetadata["example.com"] == nil {
+	if _, ok := storage.Domains().Get("example.com"); !ok {
 		t.Errorf("expected domain metadata to be stored in memory")
 	}
 }
@@ -102,7 +100,6 @@ func TestRegisterDomain_Redis(t *testing.T) {
 			Location:              "redis",
 			RedisConnectionString: "redis://localhost:6379/0",
 		},
-		DomainMetadata: make(map[string]*domains.DomainMetadata),
 	}
 
 	redisClient, err := storage.ConnectRedis()
@@ -110,6 +107,10 @@ func TestRegisterDomain_Redis(t *testing.T) {
 		t.Fatalf("unable to connect to redis: %v", err)
 	}
 	storage.RedisClient = redisClient
+	storage.Store, err = domains.NewRedisDomainStore(context.Background(), redisClient)
+	if err != nil {
+		t.Fatalf("unable to create redis domain store: %v", err)
+	}
 
 	dnsChallengeKey, err := storage.RegisterDomain("example.com", "user@example.com", nil)
 	if err != nil {
@@ -121,7 +122,7 @@ func TestRegisterDomain_Redis(t *testing.T) {
 	}
 
 	ctx := context.Background()
-	result := redisClient.Get(ctx, "example.com")
+	result := redisClient.Get(ctx, "shiroxy:domain:example.com")
 	if result.Err() != nil {
 		t.Errorf("expected domain metadata to be stored in Redis")
 	}
@@ -132,7 +133,6 @@ func TestUpdateDomain_EmptyDomain(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: make(map[string]*domains.DomainMetadata),
 	}
 
 	err := storage.UpdateDomain("", &domains.DomainMetadata{})
@@ -146,10 +146,8 @@ func TestUpdateDomain_Memory(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: map[string]*domains.DomainMetadata{
-			"example.com": {Domain: "example.com", Status: "inactive"},
-		},
 	}
+	storage.Domains().Put(&domains.DomainMetadata{Domain: "example.com", Status: "inactive"})
 
 	updateBody := &domains.DomainMetadata{Domain: "example.com", Status: "active"}
 	err := storage.UpdateDomain("example.com", updateBody)
@@ -157,7 +155,7 @@ func TestUpdateDomain_Memory(t *testing.T) {
 		t.Fatalf("expected no error, got %v", err)
 	}
 
-	if storage.DomainMetadata["example.com"].Status != "active" {
+	if domainMetadata, _ := storage.Domains().Get("example.com"); domainMetadata.Status != "active" {
 		t.Errorf("expected domain status to be updated to 'active'")
 	}
 }
@@ -167,7 +165,6 @@ func TestRemoveDomain_EmptyDomain(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: make(map[string]*domains.DomainMetadata),
 	}
 
 	err := storage.RemoveDomain("")
@@ -181,17 +178,15 @@ func TestRemoveDomain_Memory(t *testing.T) {
 		Storage: &models.Storage{
 			Location: "memory",
 		},
-		DomainMetadata: map[string]*domains.DomainMetadata{
-			"example.com": {Domain: "example.com", Status: "inactive"},
-		},
 	}
+	storage.Domains().Put(&domains.DomainMetadata{Domain: "example.com", Status: "inactive"})
 
 	err := storage.RemoveDomain("example.com")
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 
-	if storage.DomainMetadata["example.com"] != nil {
+	if _, ok := storage.Domains().Get("example.com"); ok {
 		t.Errorf("expected domain metadata to be removed from memory")
 	}
 }
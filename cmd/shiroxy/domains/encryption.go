@@ -0,0 +1,454 @@
+package domains
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMasterKeyEnv holds the master keys when no other key source is configured.
+	defaultMasterKeyEnv = "SHIROXY_MASTER_KEY"
+	// masterKeySize is the size of master and data keys (AES-256).
+	masterKeySize = 32
+	// sealedVersion is the version of the sealed value format.
+	sealedVersion           = 1
+	defaultKeyPluginTimeout = 10 * time.Second
+	// maxCachedDataKeys bounds the cache of unwrapped data keys, which saves a
+	// plugin call each time a value is opened again.
+	maxCachedDataKeys = 4096
+)
+
+// sealedMagic starts every sealed value. PEM blocks and protobuf messages never
+// start with a zero byte, so sealed and plaintext values can be told apart.
+var sealedMagic = []byte("\x00SXE")
+
+// ErrSealedWithoutKey is returned for sealed data when encryption is not configured.
+var ErrSealedWithoutKey = errors.New("data is encrypted but storage.encryption is not enabled")
+
+// KeyWrapper protects the data keys of sealed values with a master key.
+type KeyWrapper interface {
+	// KeyID identifies the master key new data keys are wrapped with.
+	KeyID() string
+	// Wrap encrypts a data key with the active master key.
+	Wrap(dataKey []byte) ([]byte, error)
+	// Unwrap decrypts a data key wrapped with the master key keyID.
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// Envelope seals values with envelope encryption: every value is encrypted with
+// a fresh AES-256-GCM data key, and the data key is wrapped with the master key.
+// Sealed values record the ID of their master key, so master keys can be
+// rotated while values sealed with older keys can still be opened.
+type Envelope struct {
+	wrapper KeyWrapper
+
+	lock     sync.Mutex
+	dataKeys map[string][]byte // Unwrapped data keys by master key ID and wrapped key.
+}
+
+// NewEnvelope creates an envelope wrapping its data keys with wrapper.
+// Parameters:
+//   - wrapper: KeyWrapper, protects the data keys.
+//
+// Returns:
+//   - *Envelope: the envelope.
+func NewEnvelope(wrapper KeyWrapper) *Envelope {
+	return &Envelope{wrapper: wrapper, dataKeys: make(map[string][]byte)}
+}
+
+// NewEncryption creates the envelope configured in the storage encryption settings.
+// Parameters:
+//   - config: models.Encryption, the encryption settings.
+//
+// Returns:
+//   - *Envelope: the envelope; nil when encryption is disabled.
+//   - error: error if the master keys cannot be loaded.
+func NewEncryption(config models.Encryption) (*Envelope, error) {
+	if !config.Enable {
+		return nil, nil
+	}
+	if config.KeyPlugin != "" && config.KeyFile != "" {
+		return nil, errors.New("encryption: keyfile and keyplugin are mutually exclusive")
+	}
+
+	if config.KeyPlugin != "" {
+		timeout := defaultKeyPluginTimeout
+		if config.KeyPluginTimeout > 0 {
+			timeout = time.Duration(config.KeyPluginTimeout) * time.Second
+		}
+		plugin, err := NewKeyPlugin(config.KeyPlugin, timeout)
+		if err != nil {
+			return nil, err
+		}
+		return NewEnvelope(plugin), nil
+	}
+
+	var keys string
+	if config.KeyFile != "" {
+		info, err := os.Stat(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %v", err)
+		}
+		if info.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("encryption: key file %s must not be accessible by group or others (chmod 600)", config.KeyFile)
+		}
+		body, err := os.ReadFile(config.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: %v", err)
+		}
+		keys = string(body)
+	} else {
+		name := config.KeyEnv
+		if name == "" {
+			name = defaultMasterKeyEnv
+		}
+		keys = os.Getenv(name)
+		if keys == "" {
+			return nil, fmt.Errorf("encryption: no master key in keyfile, keyplugin or the %s environment variable", name)
+		}
+	}
+
+	keyring, err := ParseMasterKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvelope(keyring), nil
+}
+
+// KeyID returns the ID of the master key new values are sealed with.
+func (e *Envelope) KeyID() string {
+	return e.wrapper.KeyID()
+}
+
+// Seal encrypts plaintext. The associated data is authenticated but not stored:
+// the same associated data must be passed to Open, which binds a sealed value to
+// the record it belongs to.
+// Parameters:
+//   - plaintext: []byte, the value to encrypt.
+//   - associatedData: []byte, context the value is bound to.
+//
+// Returns:
+//   - []byte: the sealed value.
+//   - error: error if the data key cannot be generated or wrapped.
+func (e *Envelope) Seal(plaintext, associatedData []byte) ([]byte, error) {
+	dataKey := make([]byte, masterKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	keyID := e.wrapper.KeyID()
+	wrapped, err := e.wrapper.Wrap(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: wrapping data key: %v", err)
+	}
+	if len(keyID) > 255 || len(wrapped) > 65535 {
+		return nil, errors.New("encryption: key id or wrapped data key too long")
+	}
+
+	header := append([]byte{}, sealedMagic...)
+	header = append(header, sealedVersion, byte(len(keyID)))
+	header = append(header, keyID...)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(wrapped)))
+	header = append(header, wrapped...)
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, plaintext, sealedAssociatedData(header, associatedData)), nil
+}
+
+// Open decrypts a value sealed by Seal with the same associated data.
+// Parameters:
+//   - sealed: []byte, the sealed value.
+//   - associatedData: []byte, the associated data passed to Seal.
+//
+// Returns:
+//   - []byte: the plaintext.
+//   - error: error if the value is malformed, its master key is unknown or it was tampered with.
+func (e *Envelope) Open(sealed, associatedData []byte) ([]byte, error) {
+	keyID, wrapped, body, err := parseSealed(sealed)
+	if err != nil {
+		return nil, err
+	}
+	header := sealed[:len(sealed)-len(body)]
+
+	cacheKey := keyID + "\x00" + string(wrapped)
+	e.lock.Lock()
+	dataKey, ok := e.dataKeys[cacheKey]
+	e.lock.Unlock()
+	if !ok {
+		dataKey, err = e.wrapper.Unwrap(keyID, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("encryption: unwrapping data key: %v", err)
+		}
+		e.lock.Lock()
+		if len(e.dataKeys) >= maxCachedDataKeys {
+			e.dataKeys = make(map[string][]byte)
+		}
+		e.dataKeys[cacheKey] = dataKey
+		e.lock.Unlock()
+	}
+
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("encryption: sealed value is truncated")
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], sealedAssociatedData(header, associatedData))
+	if err != nil {
+		return nil, errors.New("encryption: sealed value cannot be authenticated")
+	}
+	return plaintext, nil
+}
+
+// IsSealed reports whether data is a value sealed by an Envelope.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, sealedMagic)
+}
+
+// SealedKeyID returns the ID of the master key data was sealed with.
+// Returns:
+//   - string: the master key ID.
+//   - bool: false if data is not a sealed value.
+func SealedKeyID(data []byte) (string, bool) {
+	keyID, _, _, err := parseSealed(data)
+	return keyID, err == nil
+}
+
+// parseSealed splits a sealed value into its master key ID, wrapped data key and
+// the nonce followed by the ciphertext.
+func parseSealed(sealed []byte) (keyID string, wrapped, body []byte, err error) {
+	malformed := errors.New("encryption: malformed sealed value")
+	if !IsSealed(sealed) {
+		return "", nil, nil, malformed
+	}
+	rest := sealed[len(sealedMagic):]
+	if len(rest) < 2 || rest[0] != sealedVersion {
+		return "", nil, nil, malformed
+	}
+	keyIDLength := int(rest[1])
+	rest = rest[2:]
+	if len(rest) < keyIDLength+2 {
+		return "", nil, nil, malformed
+	}
+	keyID, rest = string(rest[:keyIDLength]), rest[keyIDLength:]
+	wrappedLength := int(binary.BigEndian.Uint16(rest))
+	rest = rest[2:]
+	if len(rest) < wrappedLength {
+		return "", nil, nil, malformed
+	}
+	return keyID, rest[:wrappedLength], rest[wrappedLength:], nil
+}
+
+// sealedAssociatedData authenticates the header of a sealed value together with
+// the caller's associated data.
+func sealedAssociatedData(header, associatedData []byte) []byte {
+	data := make([]byte, 0, len(header)+len(associatedData))
+	data = append(data, header...)
+	return append(data, associatedData...)
+}
+
+// newGCM creates an AES-GCM cipher for key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("encryption: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// MasterKeys wraps data keys with local AES-256 master keys.
+type MasterKeys struct {
+	ids  []string          // Key IDs; the first is the active key.
+	keys map[string][]byte // Master keys by ID.
+}
+
+// ParseMasterKeys parses master keys, one "<id>:<base64 key>" per line. The first
+// key wraps new data keys; the others are kept to open values sealed before a
+// rotation. A line holding only a base64 key is named after its fingerprint.
+// Parameters:
+//   - text: string, the master keys.
+//
+// Returns:
+//   - *MasterKeys: the master keys.
+//   - error: error if no key is given or a key is not 32 bytes.
+func ParseMasterKeys(text string) (*MasterKeys, error) {
+	masterKeys := &MasterKeys{keys: make(map[string][]byte)}
+	for number, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		keyID, encoded, found := strings.Cut(line, ":")
+		if !found {
+			keyID, encoded = "", line
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil || len(key) != masterKeySize {
+			return nil, fmt.Errorf("encryption: master key on line %d must be %d base64 encoded bytes", number+1, masterKeySize)
+		}
+		keyID = strings.TrimSpace(keyID)
+		if keyID == "" {
+			fingerprint := sha256.Sum256(key)
+			keyID = hex.EncodeToString(fingerprint[:4])
+		}
+		if _, exists := masterKeys.keys[keyID]; exists {
+			return nil, fmt.Errorf("encryption: duplicate master key id %q", keyID)
+		}
+		masterKeys.ids = append(masterKeys.ids, keyID)
+		masterKeys.keys[keyID] = key
+	}
+	if len(masterKeys.ids) == 0 {
+		return nil, errors.New("encryption: no master key given")
+	}
+	return masterKeys, nil
+}
+
+// GenerateMasterKey returns a new random master key line for a key file or
+// environment variable, named after the current time.
+// Returns:
+//   - string: the "<id>:<base64 key>" line.
+//   - error: error if no random key can be generated.
+func GenerateMasterKey() (string, error) {
+	key := make([]byte, masterKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return time.Now().UTC().Format("20060102150405") + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// KeyID returns the ID of the active master key.
+func (m *MasterKeys) KeyID() string {
+	return m.ids[0]
+}
+
+// Wrap encrypts a data key with the active master key.
+func (m *MasterKeys) Wrap(dataKey []byte) ([]byte, error) {
+	aead, err := newGCM(m.keys[m.ids[0]])
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dataKey, []byte(m.ids[0])), nil
+}
+
+// Unwrap decrypts a data key wrapped with the master key keyID.
+func (m *MasterKeys) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := m.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key is truncated")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+// KeyPlugin wraps data keys by running an external program, such as a bridge to
+// a KMS or HSM, so the master key never enters shiroxy. The program is called as:
+//
+//	<plugin> key-id          prints the ID of the active master key
+//	<plugin> wrap            reads a base64 data key on stdin, prints it wrapped in base64
+//	<plugin> unwrap <key-id> reads a base64 wrapped data key on stdin, prints the data key in base64
+type KeyPlugin struct {
+	command []string
+	timeout time.Duration
+	keyID   string
+}
+
+// NewKeyPlugin creates a key plugin and asks it for its active key ID.
+// Parameters:
+//   - command: string, the program and its leading arguments, separated by spaces.
+//   - timeout: time.Duration, the time limit of each call.
+//
+// Returns:
+//   - *KeyPlugin: the key plugin.
+//   - error: error if the plugin cannot be run.
+func NewKeyPlugin(command string, timeout time.Duration) (*KeyPlugin, error) {
+	plugin := &KeyPlugin{command: strings.Fields(command), timeout: timeout}
+	if len(plugin.command) == 0 {
+		return nil, errors.New("encryption: key plugin command is empty")
+	}
+	keyID, err := plugin.run(nil, "key-id")
+	if err != nil {
+		return nil, fmt.Errorf("encryption: key plugin: %v", err)
+	}
+	plugin.keyID = strings.TrimSpace(string(keyID))
+	if plugin.keyID == "" {
+		return nil, errors.New("encryption: key plugin returned an empty key id")
+	}
+	return plugin, nil
+}
+
+// KeyID returns the ID of the plugin's active master key.
+func (p *KeyPlugin) KeyID() string {
+	return p.keyID
+}
+
+// Wrap asks the plugin to wrap a data key.
+func (p *KeyPlugin) Wrap(dataKey []byte) ([]byte, error) {
+	return p.call(dataKey, "wrap")
+}
+
+// Unwrap asks the plugin to unwrap a data key wrapped with keyID.
+func (p *KeyPlugin) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	return p.call(wrapped, "unwrap", keyID)
+}
+
+// call runs the plugin with input base64 encoded on stdin and decodes its output.
+func (p *KeyPlugin) call(input []byte, args ...string) ([]byte, error) {
+	output, err := p.run([]byte(base64.StdEncoding.EncodeToString(input)), args...)
+	if err != nil {
+		return nil, err
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(output)))
+	if err != nil {
+		return nil, fmt.Errorf("key plugin %s: invalid base64 output", args[0])
+	}
+	return decoded, nil
+}
+
+// run runs the plugin with args and returns its standard output.
+func (p *KeyPlugin) run(stdin []byte, args ...string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, p.command[0], append(p.command[1:], args...)...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("key plugin %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return output, nil
+}
@@ -0,0 +1,445 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shiroxy/pkg/models"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Issuance order states.
+const (
+	OrderPending    = "pending"
+	OrderValidating = "validating"
+	OrderIssued     = "issued"
+	OrderFailed     = "failed"
+)
+
+// Webhook events fired by the issuance queue.
+const (
+	EventDomainSSLSuccess = "domain-ssl-success"
+	EventDomainSSLFailed  = "domain-ssl-failed"
+)
+
+// Issuance defaults used when the configuration leaves a value unset.
+const (
+	defaultIssuanceWorkers   = 2
+	defaultIssuanceQueueSize = 100
+)
+
+// ErrIssuanceQueueFull is returned when no more issuance jobs can be queued.
+var ErrIssuanceQueueFull = errors.New("issuance queue is full")
+
+// IssuanceQueue issues certificates in the background with a bounded number of workers.
+type IssuanceQueue struct {
+	storage *Storage
+	notify  func(eventName string, data interface{})
+	workers int
+	jobs    chan string
+	lock    sync.Mutex
+	queued  map[string]bool // Domains waiting in or being processed by the queue.
+}
+
+// StartIssuanceQueue creates an issuance queue, attaches it to storage and starts its workers.
+// Parameters:
+//   - storage: *Storage, the storage whose domains are issued certificates.
+//   - config: models.Issuance, worker and queue size configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *IssuanceQueue: the running issuance queue.
+func StartIssuanceQueue(storage *Storage, config models.Issuance, notify func(eventName string, data interface{}), wg *sync.WaitGroup) *IssuanceQueue {
+	workers := config.Workers
+	if workers <= 0 {
+		workers = defaultIssuanceWorkers
+	}
+	queueSize := config.QueueSize
+	if queueSize <= 0 {
+		queueSize = defaultIssuanceQueueSize
+	}
+
+	queue := &IssuanceQueue{
+		storage: storage,
+		notify:  notify,
+		workers: workers,
+		jobs:    make(chan string, queueSize),
+		queued:  make(map[string]bool),
+	}
+	storage.Issuance = queue
+	if storage.Cluster != nil {
+		// A new leader takes over the orders the previous one left unfinished.
+		storage.Cluster.OnLeadershipChange(func(leader bool) {
+			if !leader {
+				return
+			}
+			if err := queue.ResumePending(); err != nil {
+				fmt.Printf("issuance: %v\n", err)
+			}
+		})
+	}
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for domainName := range queue.jobs {
+				queue.process(domainName)
+			}
+		}()
+	}
+	return queue
+}
+
+// Enqueue marks the domain's order as pending and schedules its issuance. A domain
+// that is already queued or being validated is not queued twice. In cluster mode
+// only the leader queues the order; other instances leave it pending for the leader.
+// Parameters:
+//   - domainName: string, the domain to issue a certificate for.
+//
+// Returns:
+//   - error: error if the domain does not exist or the queue is full.
+func (q *IssuanceQueue) Enqueue(domainName string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.enqueue(domainName)
+}
+
+// enqueuePending queues a domain whose order another instance left pending,
+// unless it was queued or issued since. Orders only leave the pending state
+// while queued, so the state read under lock is current.
+// Parameters:
+//   - domainName: string, the domain to issue a certificate for.
+//
+// Returns:
+//   - error: error if the queue is full.
+func (q *IssuanceQueue) enqueuePending(domainName string) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	domainMetadata, ok := q.storage.Domains().Get(domainName)
+	if !ok || q.queued[domainName] || domainMetadata.GetOrder().GetState() != OrderPending {
+		return nil
+	}
+	return q.enqueue(domainName)
+}
+
+// enqueue implements Enqueue. Callers hold lock.
+func (q *IssuanceQueue) enqueue(domainName string) error {
+	if q.queued[domainName] {
+		return nil
+	}
+	if len(q.jobs) == cap(q.jobs) {
+		return ErrIssuanceQueueFull
+	}
+
+	now := time.Now().Unix()
+	err := q.storage.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		attempts := domainMetadata.GetOrder().GetAttempts()
+		domainMetadata.Order = &IssuanceOrder{
+			State:     OrderPending,
+			Attempts:  attempts,
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !q.storage.IsLeader() {
+		return nil
+	}
+
+	q.queued[domainName] = true
+	q.jobs <- domainName
+	return nil
+}
+
+// ResumePending re-queues domains whose orders were pending or validating when
+// shiroxy last stopped, or when the previous leader of the cluster stepped down.
+// Returns:
+//   - error: error if the stored domains cannot be listed.
+func (q *IssuanceQueue) ResumePending() error {
+	if !q.storage.IsLeader() {
+		return nil
+	}
+	domains, err := q.storage.listDomainMetadata()
+	if err != nil {
+		return err
+	}
+	for _, domainMetadata := range domains {
+		state := domainMetadata.GetOrder().GetState()
+		if state == OrderPending || state == OrderValidating {
+			if err := q.Enqueue(domainMetadata.Domain); err != nil {
+				return fmt.Errorf("resuming issuance for %s: %v", domainMetadata.Domain, err)
+			}
+		}
+	}
+	return nil
+}
+
+// process runs a single issuance job and fires the matching webhook.
+// Parameters:
+//   - domainName: string, the domain to issue a certificate for.
+func (q *IssuanceQueue) process(domainName string) {
+	if !q.storage.IsLeader() {
+		// The order stays pending for the new leader.
+		q.lock.Lock()
+		delete(q.queued, domainName)
+		q.lock.Unlock()
+		return
+	}
+	err := q.storage.issueCertificate(domainName)
+
+	q.lock.Lock()
+	delete(q.queued, domainName)
+	q.lock.Unlock()
+
+	if q.notify == nil || errors.Is(err, ErrManualCertificate) {
+		return
+	}
+	if err != nil {
+		q.notify(EventDomainSSLFailed, map[string]string{
+			"domain": domainName,
+			"error":  err.Error(),
+		})
+		return
+	}
+	q.notify(EventDomainSSLSuccess, map[string]string{
+		"domain": domainName,
+	})
+}
+
+// IssuanceStatus reports the issuance order state of a domain.
+type IssuanceStatus struct {
+	Domain    string    `json:"domain"`
+	Status    string    `json:"status"`
+	State     string    `json:"state"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int32     `json:"attempts"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// IssuanceStatus returns the issuance order state of a domain.
+// Parameters:
+//   - domainName: string, the domain to look up.
+//
+// Returns:
+//   - *IssuanceStatus: the domain's routing status and order state.
+//   - error: error if the domain does not exist.
+func (s *Storage) IssuanceStatus(domainName string) (*IssuanceStatus, error) {
+	domainMetadata, err := s.getDomainMetadata(domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &IssuanceStatus{
+		Domain: domainMetadata.Domain,
+		Status: domainMetadata.Status,
+	}
+	if order := domainMetadata.GetOrder(); order != nil {
+		status.State = order.State
+		status.Error = order.Error
+		status.Attempts = order.Attempts
+		status.CreatedAt = time.Unix(order.CreatedAt, 0).UTC()
+		status.UpdatedAt = time.Unix(order.UpdatedAt, 0).UTC()
+	}
+	return status, nil
+}
+
+// requestCertificate issues a certificate for the domain through the issuance queue,
+// or synchronously when no queue is running.
+// Parameters:
+//   - domainName: string, the domain to issue a certificate for.
+//
+// Returns:
+//   - error: error if the job cannot be queued or, without a queue, if issuance fails.
+func (s *Storage) requestCertificate(domainName string) error {
+	if s.manualCertificate(domainName) {
+		return ErrManualCertificate
+	}
+	if s.Issuance != nil {
+		return s.Issuance.Enqueue(domainName)
+	}
+	return s.issueCertificate(domainName)
+}
+
+// issueCertificate runs the ACME order for a domain and records every state
+// transition of its issuance order in storage.
+// Parameters:
+//   - domainName: string, the domain to issue a certificate for.
+//
+// Returns:
+//   - error: error if issuance fails; the reason is also stored on the order.
+//     ErrManualCertificate if a certificate was uploaded before or during the order,
+//     in which case the issued certificate is discarded.
+func (s *Storage) issueCertificate(domainName string) error {
+	// A certificate may have been uploaded while the job was queued.
+	if s.manualCertificate(domainName) {
+		return ErrManualCertificate
+	}
+
+	started := time.Now()
+	err := s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		order := s.order(domainMetadata)
+		order.State = OrderValidating
+		order.Error = ""
+		order.Attempts++
+		order.UpdatedAt = time.Now().Unix()
+	})
+	if err != nil {
+		return err
+	}
+
+	stored, err := s.getDomainMetadata(domainName)
+	if err != nil {
+		return err
+	}
+	// The order records its challenge on the domain, which must not change the registered one.
+	domainMetadata := proto.Clone(stored).(*DomainMetadata)
+
+	obtain := s.obtainCertificate
+	if s.obtain != nil {
+		obtain = s.obtain
+	}
+	issued, err := obtain(domainMetadata)
+	challengeKey := domainMetadata.DnsChallengeKey
+	if err == nil {
+		discarded := false
+		err = s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+			if challengeKey != "" {
+				domainMetadata.DnsChallengeKey = challengeKey
+			}
+			recordAttempt(domainMetadata, newAttempt(AttemptIssue, issued.Issuer, started, nil))
+			if domainMetadata.ManualCertificate {
+				// Uploaded during the order; the uploaded certificate wins.
+				discarded = true
+				return
+			}
+			issued.apply(domainMetadata)
+			domainMetadata.Status = "active"
+			order := s.order(domainMetadata)
+			order.State = OrderIssued
+			order.UpdatedAt = time.Now().Unix()
+		})
+		if err == nil && discarded {
+			return ErrManualCertificate
+		}
+		if err == nil {
+			fmt.Printf("Certificate Generated Successfully For Domain : %s", domainName)
+			return nil
+		}
+	}
+
+	reason := err.Error()
+	failure := err
+	if updateErr := s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		if challengeKey != "" {
+			domainMetadata.DnsChallengeKey = challengeKey
+		}
+		recordAttempt(domainMetadata, newAttempt(AttemptIssue, "", started, failure))
+		order := s.order(domainMetadata)
+		order.State = OrderFailed
+		order.Error = reason
+		order.UpdatedAt = time.Now().Unix()
+	}); updateErr != nil {
+		return fmt.Errorf("%s (recording failure: %v)", reason, updateErr)
+	}
+	return err
+}
+
+// order returns the issuance order of domainMetadata, creating it if needed.
+func (s *Storage) order(domainMetadata *DomainMetadata) *IssuanceOrder {
+	if domainMetadata.Order == nil {
+		now := time.Now().Unix()
+		domainMetadata.Order = &IssuanceOrder{CreatedAt: now, UpdatedAt: now}
+	}
+	return domainMetadata.Order
+}
+
+// updateDomainMetadata applies update to a copy of the stored domain metadata and
+// stores the copy, so readers never observe a partially updated domain.
+// Parameters:
+//   - domainName: string, the domain to update.
+//   - update: func(*DomainMetadata), modifies the copy.
+//
+// Returns:
+//   - error: error if the domain does not exist or cannot be persisted.
+func (s *Storage) updateDomainMetadata(domainName string, update func(domainMetadata *DomainMetadata)) error {
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+
+	current, err := s.loadDomainMetadata(domainName)
+	if err != nil {
+		return err
+	}
+	updated := proto.Clone(current).(*DomainMetadata)
+	update(updated)
+	return s.storeDomainMetadata(updated)
+}
+
+// getDomainMetadata loads the metadata of a single domain.
+// Parameters:
+//   - domainName: string, the domain to load.
+//
+// Returns:
+//   - *DomainMetadata: the domain metadata.
+//   - error: error if the domain does not exist.
+func (s *Storage) getDomainMetadata(domainName string) (*DomainMetadata, error) {
+	s.domainLock.RLock()
+	defer s.domainLock.RUnlock()
+	return s.loadDomainMetadata(domainName)
+}
+
+// loadDomainMetadata reads a domain from the store, or from memory when storage has
+// no store; callers hold domainLock.
+func (s *Storage) loadDomainMetadata(domainName string) (*DomainMetadata, error) {
+	if s.Store != nil {
+		return s.Store.Get(context.Background(), domainName)
+	}
+
+	domainMetadata, ok := s.Domains().Get(domainName)
+	if !ok {
+		return nil, ErrDomainNotFound
+	}
+	return domainMetadata, nil
+}
+
+// storeDomainMetadata stamps a changed domain and writes it to the store and the
+// registry; callers hold domainLock.
+func (s *Storage) storeDomainMetadata(domainMetadata *DomainMetadata) error {
+	now := time.Now().Unix()
+	if domainMetadata.CreatedAt == 0 {
+		domainMetadata.CreatedAt = now
+	}
+	domainMetadata.UpdatedAt = now
+	return s.putDomainMetadata(domainMetadata)
+}
+
+// putDomainMetadata writes a domain to the store and the registry as it is; callers hold domainLock.
+func (s *Storage) putDomainMetadata(domainMetadata *DomainMetadata) error {
+	if s.Store != nil {
+		if err := s.Store.Put(context.Background(), domainMetadata); err != nil {
+			return err
+		}
+	}
+	s.Domains().Put(domainMetadata)
+	return nil
+}
+
+// deleteDomainMetadata removes a domain from the store and the registry; callers hold domainLock.
+func (s *Storage) deleteDomainMetadata(domainName string) error {
+	if s.Store != nil {
+		if err := s.Store.Delete(context.Background(), domainName); err != nil {
+			return err
+		}
+		s.Domains().Delete(domainName)
+	} else if !s.Domains().Delete(domainName) {
+		return ErrDomainNotFound
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package domains
+
+import (
+	"errors"
+	"fmt"
+	"shiroxy/pkg/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []firedEvent
+}
+
+func (e *eventRecorder) notify(eventName string, data interface{}) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.events = append(e.events, firedEvent{name: eventName, data: data.(map[string]string)})
+}
+
+func (e *eventRecorder) list() []firedEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]firedEvent{}, e.events...)
+}
+
+func newTestIssuanceStorage() *Storage {
+	return &Storage{
+		Storage: &models.Storage{Location: "memory"},
+	}
+}
+
+// waitForState polls the issuance status of domainName until it reaches state.
+func waitForState(t *testing.T, st *Storage, domainName, state string) *IssuanceStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err := st.IssuanceStatus(domainName)
+		if err != nil {
+			t.Fatalf("issuance status: %v", err)
+		}
+		if status.State == state {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to reach %q, still %q", domainName, state, status.State)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIssuanceQueue_RegisterIssuesInBackground(t *testing.T) {
+	st := newTestIssuanceStorage()
+	release := make(chan struct{})
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		<-release
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	recorder := &eventRecorder{}
+	wg := &sync.WaitGroup{}
+	StartIssuanceQueue(st, models.Issuance{Workers: 1}, recorder.notify, wg)
+
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	status := waitForState(t, st, "example.com", OrderValidating)
+	if status.Status != "inactive" || status.Attempts != 1 {
+		t.Fatalf("unexpected status while validating: %+v", status)
+	}
+
+	close(release)
+	status = waitForState(t, st, "example.com", OrderIssued)
+	if status.Status != "active" || status.Error != "" {
+		t.Fatalf("unexpected status after issuance: %+v", status)
+	}
+
+	domainMetadata, _ := st.getDomainMetadata("example.com")
+	if len(domainMetadata.CertPemBlock) == 0 || len(domainMetadata.KeyPemBlock) == 0 {
+		t.Fatalf("expected certificate to be stored")
+	}
+
+	waitForEvents(t, recorder, 1)
+	if events := recorder.list(); events[0].name != EventDomainSSLSuccess || events[0].data["domain"] != "example.com" {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+}
+
+func TestIssuanceQueue_FailureAndForceSSL(t *testing.T) {
+	st := newTestIssuanceStorage()
+	var mu sync.Mutex
+	fail := true
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if fail {
+			return nil, errors.New("authorization failed: connection refused")
+		}
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	recorder := &eventRecorder{}
+	StartIssuanceQueue(st, models.Issuance{Workers: 1}, recorder.notify, &sync.WaitGroup{})
+
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	status := waitForState(t, st, "example.com", OrderFailed)
+	if status.Error != "authorization failed: connection refused" || status.Status != "inactive" {
+		t.Fatalf("unexpected failed status: %+v", status)
+	}
+	waitForEvents(t, recorder, 1)
+
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+
+	if err := st.ForceSSL("example.com"); err != nil {
+		t.Fatalf("force ssl: %v", err)
+	}
+	status = waitForState(t, st, "example.com", OrderIssued)
+	if status.Attempts != 2 || status.Status != "active" {
+		t.Fatalf("unexpected status after retry: %+v", status)
+	}
+	domainMetadata, _ := st.getDomainMetadata("example.com")
+	if history := domainMetadata.History; len(history) != 2 || history[0].Error != "authorization failed: connection refused" || history[1].Error != "" || history[1].Kind != AttemptIssue {
+		t.Fatalf("expected both attempts to be recorded, got %v", history)
+	}
+
+	waitForEvents(t, recorder, 2)
+	events := recorder.list()
+	if events[0].name != EventDomainSSLFailed || events[1].name != EventDomainSSLSuccess {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+
+	if err := st.ForceSSL("missing.example.com"); err == nil {
+		t.Fatalf("expected force ssl on an unknown domain to fail")
+	}
+}
+
+func TestIssuanceQueue_NoSuccessWebhookForDiscardedCertificate(t *testing.T) {
+	st := newTestIssuanceStorage()
+	release := make(chan struct{})
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		if domainMetadata.Domain == "example.com" {
+			<-release
+		}
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	recorder := &eventRecorder{}
+	StartIssuanceQueue(st, models.Issuance{Workers: 1}, recorder.notify, &sync.WaitGroup{})
+
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	waitForState(t, st, "example.com", OrderValidating)
+
+	// A certificate uploaded mid-order wins over the one the order obtains.
+	chain := newTestChain(t, "example.com")
+	if _, err := st.UploadCertificate("example.com", chain.full(), chain.key); err != nil {
+		t.Fatalf("upload certificate: %v", err)
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "other.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	close(release)
+
+	// The single worker processes other.com only after example.com.
+	waitForEvents(t, recorder, 1)
+	if events := recorder.list(); len(events) != 1 || events[0].name != EventDomainSSLSuccess || events[0].data["domain"] != "other.com" {
+		t.Fatalf("expected no webhook for the discarded certificate, got %+v", events)
+	}
+	if string(registeredDomain(st, "example.com").CertPemBlock) != string(chain.full()) {
+		t.Fatalf("expected the uploaded certificate to be kept")
+	}
+}
+
+func TestIssuanceQueue_BoundedConcurrency(t *testing.T) {
+	st := newTestIssuanceStorage()
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(time.Hour)), nil
+	}
+	StartIssuanceQueue(st, models.Issuance{Workers: 2}, nil, &sync.WaitGroup{})
+
+	for i := 0; i < 6; i++ {
+		domainName := fmt.Sprintf("d%d.example.com", i)
+		if _, err := st.Register(DomainRegistration{Domain: domainName, Email: "a@b.com"}); err != nil {
+			t.Fatalf("register %s: %v", domainName, err)
+		}
+	}
+	for i := 0; i < 6; i++ {
+		waitForState(t, st, fmt.Sprintf("d%d.example.com", i), OrderIssued)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if maxRunning > 2 {
+		t.Fatalf("expected at most 2 concurrent issuances, saw %d", maxRunning)
+	}
+}
+
+func TestIssuanceQueue_FullAndResume(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.Domains().Put(&DomainMetadata{Domain: "a.example.com", Status: "inactive", Order: &IssuanceOrder{State: OrderValidating}})
+	st.Domains().Put(&DomainMetadata{Domain: "b.example.com", Status: "inactive", Order: &IssuanceOrder{State: OrderFailed}})
+	st.Domains().Put(&DomainMetadata{Domain: "c.example.com", Status: "inactive"})
+
+	// A queue without workers keeps jobs waiting so its capacity can be observed.
+	queue := &IssuanceQueue{storage: st, jobs: make(chan string, 1), queued: map[string]bool{}}
+	st.Issuance = queue
+
+	if err := queue.ResumePending(); err != nil {
+		t.Fatalf("resume: %v", err)
+	}
+	if len(queue.jobs) != 1 || !queue.queued["a.example.com"] {
+		t.Fatalf("expected only the interrupted order to be resumed, queued %v", queue.queued)
+	}
+	if status, _ := st.IssuanceStatus("a.example.com"); status.State != OrderPending {
+		t.Fatalf("expected resumed order to be pending, got %q", status.State)
+	}
+
+	if err := queue.Enqueue("a.example.com"); err != nil {
+		t.Fatalf("expected re-queueing a queued domain to be a no-op, got %v", err)
+	}
+	if err := queue.Enqueue("c.example.com"); !errors.Is(err, ErrIssuanceQueueFull) {
+		t.Fatalf("expected queue full error, got %v", err)
+	}
+}
+
+func waitForEvents(t *testing.T, recorder *eventRecorder, count int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.list()) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d webhook events, got %+v", count, recorder.list())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestIssueCertificate_DoesNotModifyRegisteredDomain(t *testing.T) {
+	st := newTestIssuanceStorage()
+	var registeredKey string
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		domainMetadata.DnsChallengeKey = "key-authorization"
+		registered, _ := st.Domains().Get(domainMetadata.Domain)
+		registeredKey = registered.DnsChallengeKey
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if registeredKey != "" {
+		t.Fatalf("expected the order not to modify the registered domain")
+	}
+	domainMetadata, _ := st.Domains().Get("example.com")
+	if domainMetadata.DnsChallengeKey != "key-authorization" || domainMetadata.Status != "active" {
+		t.Fatalf("expected the challenge key and certificate to be stored, got %+v", domainMetadata)
+	}
+}
+
+func TestRegister_ReturnsChallengeKeyWhenIssuedSynchronously(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		domainMetadata.DnsChallengeKey = "key-authorization"
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+
+	dnsKey, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com"})
+	if err != nil || dnsKey != "key-authorization" {
+		t.Fatalf("expected the challenge key, got %q (%v)", dnsKey, err)
+	}
+}
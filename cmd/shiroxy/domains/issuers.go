@@ -0,0 +1,250 @@
+package domains
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// DefaultIssuerName names the issuer built from the ACME server URL when no issuers are configured.
+const DefaultIssuerName = "default"
+
+// issuerRateLimitCooldown is how long an issuer that rate-limited an order is only
+// tried after every other issuer.
+const issuerRateLimitCooldown = time.Hour
+
+// ACMEIssuer is a named certificate authority certificates are ordered from: an
+// ACME directory, or the built-in local CA when Local is set.
+type ACMEIssuer struct {
+	Name               string    // Name domains select the issuer by.
+	DirectoryURL       string    // URL of the ACME directory.
+	InsecureSkipVerify bool      // Skip verification of the directory's TLS certificate.
+	EAB                *acme.EAB // External Account Binding credentials; nil when the CA does not need them.
+	Local              *LocalCA  // Local CA signing certificates without ACME; nil for ACME issuers.
+
+	lock             sync.Mutex
+	rateLimitedUntil time.Time
+}
+
+// NewACMEIssuers creates the issuers described by configs, in fallback order.
+// Parameters:
+//   - configs: []models.ACMEIssuer, the issuer configurations.
+//
+// Returns:
+//   - []*ACMEIssuer: the issuers; nil when none are configured.
+//   - error: error if an issuer is unnamed, duplicated, has an invalid directory or EAB,
+//     or its local CA cannot be loaded.
+func NewACMEIssuers(configs []models.ACMEIssuer) ([]*ACMEIssuer, error) {
+	var issuers []*ACMEIssuer
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		if config.Name == "" {
+			return nil, errors.New("acme issuer: name is required")
+		}
+		if seen[config.Name] {
+			return nil, fmt.Errorf("acme issuer %s: duplicate name", config.Name)
+		}
+		seen[config.Name] = true
+
+		switch config.Type {
+		case "", IssuerTypeACME:
+		case IssuerTypeLocal:
+			if config.CAPath == "" {
+				return nil, fmt.Errorf("acme issuer %s: capath is required for a local issuer", config.Name)
+			}
+			ca, err := LoadOrCreateLocalCA(config.CAPath, time.Duration(config.LeafValidityDays)*24*time.Hour)
+			if err != nil {
+				return nil, fmt.Errorf("acme issuer %s: %v", config.Name, err)
+			}
+			issuers = append(issuers, &ACMEIssuer{Name: config.Name, Local: ca})
+			continue
+		default:
+			return nil, fmt.Errorf("acme issuer %s: unknown type %q", config.Name, config.Type)
+		}
+
+		directory, err := url.Parse(config.DirectoryUrl)
+		if err != nil || (directory.Scheme != "https" && directory.Scheme != "http") || directory.Host == "" {
+			return nil, fmt.Errorf("acme issuer %s: invalid directoryurl %q", config.Name, config.DirectoryUrl)
+		}
+
+		issuer := &ACMEIssuer{
+			Name:               config.Name,
+			DirectoryURL:       config.DirectoryUrl,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		}
+		if config.EABKeyId != "" || config.EABHMACKey != "" {
+			if config.EABKeyId == "" || config.EABHMACKey == "" {
+				return nil, fmt.Errorf("acme issuer %s: both eabkeyid and eabhmackey are required", config.Name)
+			}
+			// CAs hand out the key base64url encoded, sometimes padded.
+			macKey := strings.TrimRight(config.EABHMACKey, "=")
+			if _, err := base64.RawURLEncoding.DecodeString(macKey); err != nil {
+				return nil, fmt.Errorf("acme issuer %s: eabhmackey is not base64url encoded: %v", config.Name, err)
+			}
+			issuer.EAB = &acme.EAB{KeyID: config.EABKeyId, MACKey: macKey}
+		}
+		issuers = append(issuers, issuer)
+	}
+	return issuers, nil
+}
+
+// acmeIssuers returns the configured issuers, or a single default issuer for
+// ACME_SERVER_URL when none are configured.
+func (s *Storage) acmeIssuers() []*ACMEIssuer {
+	if len(s.Issuers) > 0 {
+		return s.Issuers
+	}
+	// The default issuer only verifies the CA's certificate in stage and prod, so
+	// a local pebble works out of the box.
+	environment := os.Getenv("SHIROXY_ENVIRONMENT")
+	return []*ACMEIssuer{{
+		Name:               DefaultIssuerName,
+		DirectoryURL:       s.ACME_SERVER_URL,
+		InsecureSkipVerify: environment != "stage" && environment != "prod",
+	}}
+}
+
+// issuer returns the issuer named name, or the first issuer when name is empty or unknown.
+func (s *Storage) issuer(name string) *ACMEIssuer {
+	issuers := s.acmeIssuers()
+	for _, issuer := range issuers {
+		if issuer.Name == name {
+			return issuer
+		}
+	}
+	return issuers[0]
+}
+
+// ValidateIssuer checks that name is empty or names a configured issuer.
+// Parameters:
+//   - name: string, the issuer name.
+//
+// Returns:
+//   - error: error if no issuer has that name.
+func (s *Storage) ValidateIssuer(name string) error {
+	if name == "" {
+		return nil
+	}
+	for _, issuer := range s.acmeIssuers() {
+		if issuer.Name == name {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown acme issuer %q", name)
+}
+
+// SetIssuer selects the issuer the certificates of a domain are ordered from. The
+// current certificate is kept; the issuer is used from the next order on.
+// Parameters:
+//   - domainName: string, the domain to update.
+//   - issuer: string, the issuer name; empty selects the first configured issuer.
+//
+// Returns:
+//   - error: error if the issuer is unknown or the domain does not exist.
+func (s *Storage) SetIssuer(domainName, issuer string) error {
+	if err := s.ValidateIssuer(issuer); err != nil {
+		return err
+	}
+	return s.updateDomainMetadata(domainName, func(domainMetadata *DomainMetadata) {
+		domainMetadata.Issuer = issuer
+	})
+}
+
+// issuerOrder returns the issuers to try for a domain: its selected issuer first,
+// then the others in configured order. Issuers that recently rate-limited an
+// order are moved to the end.
+// Parameters:
+//   - preferred: string, the issuer selected for the domain (may be empty).
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - []*ACMEIssuer: the issuers in the order they should be tried.
+func (s *Storage) issuerOrder(preferred string, now time.Time) []*ACMEIssuer {
+	var ordered, limited []*ACMEIssuer
+	add := func(issuer *ACMEIssuer) {
+		if issuer.rateLimited(now) {
+			limited = append(limited, issuer)
+		} else {
+			ordered = append(ordered, issuer)
+		}
+	}
+
+	issuers := s.acmeIssuers()
+	for _, issuer := range issuers {
+		if issuer.Name == preferred {
+			add(issuer)
+		}
+	}
+	for _, issuer := range issuers {
+		if issuer.Name != preferred {
+			add(issuer)
+		}
+	}
+	return append(ordered, limited...)
+}
+
+// rateLimited reports whether the issuer rate-limited an order less than
+// issuerRateLimitCooldown before now.
+func (i *ACMEIssuer) rateLimited(now time.Time) bool {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return now.Before(i.rateLimitedUntil)
+}
+
+// markRateLimited records that the issuer rejected an order at now because of a rate limit.
+func (i *ACMEIssuer) markRateLimited(now time.Time) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.rateLimitedUntil = now.Add(issuerRateLimitCooldown)
+}
+
+// isRateLimited reports whether err is an ACME rateLimited problem.
+func isRateLimited(err error) bool {
+	var problem acme.Problem
+	return errors.As(err, &problem) && problem.Type == acme.ProblemTypeRateLimited
+}
+
+// obtainCertificate orders a certificate for the domain from its issuer, falling
+// back to the other issuers in order when an order fails.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the metadata of the domain to obtain a certificate for.
+//
+// Returns:
+//   - *issuedCertificate: the issued certificate chain and key.
+//   - error: error listing the failure of every issuer tried.
+func (s *Storage) obtainCertificate(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+	issuers := s.issuerOrder(domainMetadata.Issuer, time.Now())
+
+	var failures []string
+	for _, issuer := range issuers {
+		var issued *issuedCertificate
+		var err error
+		if issuer.Local != nil {
+			issued, err = issuer.Local.issue(domainMetadata.Names(), time.Now())
+			if issued != nil {
+				issued.Issuer = issuer.Name
+			}
+		} else {
+			issued, err = s.orderCertificate(issuer, domainMetadata)
+		}
+		if err == nil {
+			return issued, nil
+		}
+		if isRateLimited(err) {
+			issuer.markRateLimited(time.Now())
+		}
+		if len(issuers) == 1 {
+			return nil, err
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", issuer.Name, err))
+	}
+	return nil, errors.New(strings.Join(failures, "; "))
+}
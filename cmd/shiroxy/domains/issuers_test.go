@@ -0,0 +1,345 @@
+package domains
+
+import (
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// fakeACMEServer is a minimal ACME CA: orders are ready without authorizations
+// and finalized immediately.
+type fakeACMEServer struct {
+	*httptest.Server
+	eab             *acme.EAB // Binding new accounts must carry; nil accepts any account.
+	rateLimited     bool      // Reject new orders with a rateLimited problem.
+	rejectAccounts  bool      // Reject new orders with an accountDoesNotExist problem.
+	existingAccount bool      // Report an existing account for any key.
+
+	caCertificate *x509.Certificate
+	caKey         *ecdsa.PrivateKey
+
+	mu          sync.Mutex
+	nonce       int
+	accounts    int
+	orders      int
+	keyChanges  int
+	deactivated int
+	eabVerified bool
+	certificate []byte
+}
+
+func startFakeACMEServer(t *testing.T) *fakeACMEServer {
+	t.Helper()
+	caCertificate, caKey := createTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Fake ACME CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	f := &fakeACMEServer{caCertificate: caCertificate, caKey: caKey}
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeACMEServer) issuer(name string) *ACMEIssuer {
+	return &ACMEIssuer{Name: name, DirectoryURL: f.URL + "/dir", InsecureSkipVerify: true, EAB: f.eab}
+}
+
+func (f *fakeACMEServer) orderCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.orders
+}
+
+func (f *fakeACMEServer) accountCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.accounts
+}
+
+func (f *fakeACMEServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nonce++
+	w.Header().Set("Replay-Nonce", fmt.Sprintf("nonce-%d", f.nonce))
+	w.Header().Set("Content-Type", "application/json")
+
+	if r.URL.Path == "/dir" {
+		json.NewEncoder(w).Encode(map[string]string{
+			"newNonce":   f.URL + "/nonce",
+			"newAccount": f.URL + "/account",
+			"newOrder":   f.URL + "/order",
+			"keyChange":  f.URL + "/key-change",
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+
+	var jws struct{ Payload string }
+	body, _ := io.ReadAll(r.Body)
+	json.Unmarshal(body, &jws)
+	payload, _ := base64.RawURLEncoding.DecodeString(jws.Payload)
+
+	switch r.URL.Path {
+	case "/account":
+		var account struct {
+			OnlyReturnExisting     bool            `json:"onlyReturnExisting"`
+			ExternalAccountBinding json.RawMessage `json:"externalAccountBinding"`
+		}
+		json.Unmarshal(payload, &account)
+		if account.OnlyReturnExisting {
+			if !f.existingAccount {
+				writeProblem(w, http.StatusBadRequest, acme.ProblemTypeAccountDoesNotExist)
+				return
+			}
+			w.Header().Set("Location", f.URL+"/account/1")
+			json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+			return
+		}
+		if f.eab != nil {
+			if !f.verifyEAB(account.ExternalAccountBinding) {
+				writeProblem(w, http.StatusUnauthorized, acme.ProblemTypeExternalAccountRequired)
+				return
+			}
+			f.eabVerified = true
+		}
+		f.accounts++
+		w.Header().Set("Location", f.URL+"/account/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid"})
+	case "/account/1":
+		var update struct{ Status string }
+		json.Unmarshal(payload, &update)
+		if update.Status == acme.StatusDeactivated {
+			f.deactivated++
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": update.Status})
+	case "/key-change":
+		f.keyChanges++
+	case "/order":
+		f.orders++
+		if f.rateLimited {
+			writeProblem(w, http.StatusTooManyRequests, acme.ProblemTypeRateLimited)
+			return
+		}
+		if f.rejectAccounts {
+			writeProblem(w, http.StatusBadRequest, acme.ProblemTypeAccountDoesNotExist)
+			return
+		}
+		var order map[string]any
+		json.Unmarshal(payload, &order)
+		order["status"] = "ready"
+		order["authorizations"] = []string{}
+		order["finalize"] = f.URL + "/finalize"
+		w.Header().Set("Location", f.URL+"/order/1")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(order)
+	case "/finalize":
+		var finalize struct{ CSR string }
+		json.Unmarshal(payload, &finalize)
+		der, _ := base64.RawURLEncoding.DecodeString(finalize.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, acme.ProblemTypeBadCSR)
+			return
+		}
+		leaf, _ := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(24 * time.Hour),
+		}, f.caCertificate, csr.PublicKey, f.caKey)
+		f.certificate = append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf}),
+			pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCertificate.Raw})...)
+		json.NewEncoder(w).Encode(map[string]string{"status": "valid", "certificate": f.URL + "/certificate"})
+	case "/certificate":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		w.Write(f.certificate)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// verifyEAB checks that binding is signed with the configured EAB key.
+func (f *fakeACMEServer) verifyEAB(binding json.RawMessage) bool {
+	var jws struct{ Protected, Payload, Signature string }
+	if json.Unmarshal(binding, &jws) != nil {
+		return false
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+	var header struct{ Kid string }
+	if json.Unmarshal(protected, &header) != nil || header.Kid != f.eab.KeyID {
+		return false
+	}
+	key, _ := base64.RawURLEncoding.DecodeString(f.eab.MACKey)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(jws.Protected + "." + jws.Payload))
+	signature, _ := base64.RawURLEncoding.DecodeString(jws.Signature)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+func writeProblem(w http.ResponseWriter, status int, problemType string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"type": problemType, "detail": problemType})
+}
+
+// newIssuerTestDomain creates an unregistered domain.
+func newIssuerTestDomain(t *testing.T, st *Storage, domainName string) *DomainMetadata {
+	t.Helper()
+	domainMetadata, err := st.prepareDomainMetadata(domainName, "ops@example.com", nil)
+	if err != nil {
+		t.Fatalf("prepare domain: %v", err)
+	}
+	return domainMetadata
+}
+
+func TestNewACMEIssuers(t *testing.T) {
+	issuers, err := NewACMEIssuers([]models.ACMEIssuer{
+		{Name: "zerossl", DirectoryUrl: "https://acme.zerossl.com/v2/DV90", EABKeyId: "kid-1", EABHMACKey: "c2VjcmV0LWtleQ=="},
+		{Name: "letsencrypt", DirectoryUrl: "https://acme-v02.api.letsencrypt.org/directory"},
+	})
+	if err != nil {
+		t.Fatalf("new issuers: %v", err)
+	}
+	if len(issuers) != 2 || issuers[0].EAB == nil || issuers[0].EAB.MACKey != "c2VjcmV0LWtleQ" || issuers[1].EAB != nil {
+		t.Fatalf("unexpected issuers: %+v", issuers)
+	}
+
+	invalid := [][]models.ACMEIssuer{
+		{{DirectoryUrl: "https://ca.example.com/dir"}},
+		{{Name: "a", DirectoryUrl: "https://ca.example.com/dir"}, {Name: "a", DirectoryUrl: "https://ca.example.com/dir"}},
+		{{Name: "a", DirectoryUrl: "ca.example.com"}},
+		{{Name: "a", DirectoryUrl: "https://ca.example.com/dir", EABKeyId: "kid"}},
+		{{Name: "a", DirectoryUrl: "https://ca.example.com/dir", EABKeyId: "kid", EABHMACKey: "not base64!"}},
+	}
+	for _, configs := range invalid {
+		if _, err := NewACMEIssuers(configs); err == nil {
+			t.Fatalf("expected %+v to be rejected", configs)
+		}
+	}
+}
+
+func TestIssuerOrder(t *testing.T) {
+	now := time.Now()
+	st := &Storage{Issuers: []*ACMEIssuer{{Name: "a"}, {Name: "b"}, {Name: "c"}}}
+	names := func(issuers []*ACMEIssuer) string {
+		var names []string
+		for _, issuer := range issuers {
+			names = append(names, issuer.Name)
+		}
+		return strings.Join(names, ",")
+	}
+
+	if got := names(st.issuerOrder("", now)); got != "a,b,c" {
+		t.Fatalf("expected configured order, got %s", got)
+	}
+	if got := names(st.issuerOrder("b", now)); got != "b,a,c" {
+		t.Fatalf("expected the domain's issuer first, got %s", got)
+	}
+	st.Issuers[1].markRateLimited(now)
+	if got := names(st.issuerOrder("b", now)); got != "a,c,b" {
+		t.Fatalf("expected a rate-limited issuer last, got %s", got)
+	}
+	if got := names(st.issuerOrder("b", now.Add(issuerRateLimitCooldown))); got != "b,a,c" {
+		t.Fatalf("expected the issuer back after the cooldown, got %s", got)
+	}
+
+	if st.ValidateIssuer("c") != nil || st.ValidateIssuer("") != nil || st.ValidateIssuer("d") == nil {
+		t.Fatalf("unexpected issuer validation")
+	}
+	if st := (&Storage{ACME_SERVER_URL: "https://ca.example.com/dir"}); st.issuer("").DirectoryURL != "https://ca.example.com/dir" {
+		t.Fatalf("expected the acme server url as default issuer")
+	}
+}
+
+func TestObtainCertificate_EABAndFallback(t *testing.T) {
+	primary := startFakeACMEServer(t)
+	primary.eab = &acme.EAB{KeyID: "kid-1", MACKey: base64.RawURLEncoding.EncodeToString([]byte("eab-secret"))}
+	primary.rateLimited = true
+	secondary := startFakeACMEServer(t)
+
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{primary.issuer("primary"), secondary.issuer("secondary")}
+	domainMetadata := newIssuerTestDomain(t, st, "example.com")
+
+	issued, err := st.obtainCertificate(domainMetadata)
+	if err != nil {
+		t.Fatalf("expected the secondary issuer to issue the certificate: %v", err)
+	}
+	if issued.Issuer != "secondary" {
+		t.Fatalf("expected the certificate to come from the secondary issuer, got %q", issued.Issuer)
+	}
+	if chain, err := ParseCertificateChain(issued.CertPemBlock); err != nil || chain[0].DNSNames[0] != "example.com" {
+		t.Fatalf("unexpected certificate: %v", err)
+	}
+	if !primary.eabVerified {
+		t.Fatalf("expected the primary account to be created with a valid external account binding")
+	}
+
+	// The rate-limited primary is tried last until its cooldown ends.
+	if _, err := st.obtainCertificate(domainMetadata); err != nil {
+		t.Fatalf("obtain: %v", err)
+	}
+	if primary.orderCount() != 1 || secondary.orderCount() != 2 {
+		t.Fatalf("expected the rate-limited issuer to be skipped, orders %d/%d", primary.orderCount(), secondary.orderCount())
+	}
+
+	// A domain can pin its issuer; other issuers remain fallbacks.
+	secondary.mu.Lock()
+	secondary.rateLimited = true
+	secondary.mu.Unlock()
+	domainMetadata.Issuer = "secondary"
+	_, err = st.obtainCertificate(domainMetadata)
+	if err == nil || !strings.Contains(err.Error(), "primary: ") || !strings.Contains(err.Error(), "secondary: ") {
+		t.Fatalf("expected the failure of every issuer to be reported, got %v", err)
+	}
+	if primary.orderCount() != 2 || secondary.orderCount() != 3 {
+		t.Fatalf("expected both issuers to be tried, orders %d/%d", primary.orderCount(), secondary.orderCount())
+	}
+}
+
+func TestRegister_UnknownIssuer(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.Issuers = []*ACMEIssuer{{Name: "letsencrypt"}}
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(time.Hour)), nil
+	}
+
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com", Issuer: "zerossl"}); err == nil {
+		t.Fatalf("expected an unknown issuer to be rejected")
+	}
+	if _, err := st.Register(DomainRegistration{Domain: "example.com", Email: "a@b.com", Issuer: "letsencrypt"}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if registeredDomain(st, "example.com").Issuer != "letsencrypt" {
+		t.Fatalf("expected the issuer to be stored with the domain")
+	}
+	if err := st.SetIssuer("example.com", "zerossl"); err == nil {
+		t.Fatalf("expected an unknown issuer to be rejected")
+	}
+}
@@ -0,0 +1,265 @@
+package domains
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Sort orders of ListDomains. Prefixing an order with "-" reverses it.
+const (
+	SortByDomain    = "domain"
+	SortByCreatedAt = "created_at"
+	SortByUpdatedAt = "updated_at"
+	SortByExpiry    = "expiry"
+)
+
+// Page sizes of ListDomains.
+const (
+	defaultDomainPageSize = 50
+	maxDomainPageSize     = 500
+)
+
+// DomainQuery selects, orders and pages the domains returned by ListDomains.
+// Empty fields do not filter.
+type DomainQuery struct {
+	Status         string        // Domain status, e.g. "active" or "inactive".
+	Tag            string        // Routing tag the domain must have.
+	Issuer         string        // Issuer selected for the domain or that issued its certificate.
+	ExpiringWithin time.Duration // Only domains whose certificate expires within this window.
+	Search         string        // Substring of the domain or an alias, or a wildcard pattern using * and ?.
+	Sort           string        // One of the SortBy orders, optionally prefixed with "-"; defaults to SortByDomain.
+	Cursor         string        // NextCursor of the previous page, empty for the first page.
+	Limit          int           // Page size; defaults to 50, at most 500.
+}
+
+// DomainSummary describes a domain in a domain list, without its certificate and key.
+type DomainSummary struct {
+	Domain            string            `json:"domain"`
+	Email             string            `json:"email"`
+	Status            string            `json:"status"`
+	Aliases           []string          `json:"aliases,omitempty"`
+	Tags              []string          `json:"tags,omitempty"`
+	Backend           string            `json:"backend,omitempty"`
+	Issuer            string            `json:"issuer,omitempty"`
+	OnDemand          bool              `json:"on_demand"`
+	ManualCertificate bool              `json:"manual_certificate"`
+	NotAfter          time.Time         `json:"not_after,omitempty"` // Expiry of the current certificate.
+	CreatedAt         time.Time         `json:"created_at,omitempty"`
+	UpdatedAt         time.Time         `json:"updated_at,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// DomainPage is a page of the domains matching a DomainQuery.
+type DomainPage struct {
+	Domains    []DomainSummary `json:"domains"`
+	Total      int             `json:"total"`                 // Number of domains matching the filters.
+	NextCursor string          `json:"next_cursor,omitempty"` // Cursor of the next page, empty on the last page.
+}
+
+// domainCursor is the position of the last domain of a page, encoded into DomainPage.NextCursor.
+type domainCursor struct {
+	Sort   string `json:"s"`
+	Key    int64  `json:"k"`
+	Domain string `json:"d"`
+}
+
+// ListDomains returns a page of the registered domains matching query. Pages are
+// keyed by the position of their last domain, so domains registered or removed
+// between requests do not shift the following pages.
+// Parameters:
+//   - query: DomainQuery, the filters, order and page.
+//
+// Returns:
+//   - *DomainPage: the matching domains of the page.
+//   - error: error if the sort, search pattern or cursor is invalid.
+func (s *Storage) ListDomains(query DomainQuery) (*DomainPage, error) {
+	sortBy := strings.TrimPrefix(query.Sort, "-")
+	descending := strings.HasPrefix(query.Sort, "-")
+	if sortBy == "" {
+		sortBy = SortByDomain
+	}
+	if sortBy != SortByDomain && sortBy != SortByCreatedAt && sortBy != SortByUpdatedAt && sortBy != SortByExpiry {
+		return nil, fmt.Errorf("unknown sort %q; use domain, created_at, updated_at or expiry", query.Sort)
+	}
+	sortKey := query.Sort
+	if sortKey == "" {
+		sortKey = SortByDomain
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultDomainPageSize
+	}
+	if limit > maxDomainPageSize {
+		limit = maxDomainPageSize
+	}
+
+	search := strings.ToLower(strings.TrimSpace(query.Search))
+	if strings.ContainsAny(search, "*?[") {
+		if _, err := path.Match(search, ""); err != nil {
+			return nil, fmt.Errorf("invalid search pattern %q", query.Search)
+		}
+	}
+
+	var after *domainCursor
+	if query.Cursor != "" {
+		cursor, err := decodeDomainCursor(query.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		if cursor.Sort != sortKey {
+			return nil, errors.New("cursor belongs to a different sort")
+		}
+		after = cursor
+	}
+
+	now := time.Now()
+	var matches []*DomainMetadata
+	for _, domainMetadata := range s.Domains().Snapshot().List() {
+		if query.Status != "" && domainMetadata.Status != query.Status {
+			continue
+		}
+		if query.Tag != "" && !containsString(domainMetadata.GetRouting().GetTags(), query.Tag) {
+			continue
+		}
+		if query.Issuer != "" && domainMetadata.Issuer != query.Issuer && domainMetadata.GetCertificate().GetIssuer() != query.Issuer {
+			continue
+		}
+		if query.ExpiringWithin > 0 {
+			notAfter := domainMetadata.GetCertificate().GetNotAfter()
+			if notAfter == 0 || time.Unix(notAfter, 0).Sub(now) > query.ExpiringWithin {
+				continue
+			}
+		}
+		if search != "" && !matchesSearch(domainMetadata, search) {
+			continue
+		}
+		matches = append(matches, domainMetadata)
+	}
+
+	// The snapshot is sorted by name, which breaks ties between equal sort keys.
+	keys := make(map[string]int64, len(matches))
+	for _, domainMetadata := range matches {
+		keys[domainMetadata.Domain] = domainSortKey(domainMetadata, sortBy)
+	}
+	before := func(keyA int64, domainA string, keyB int64, domainB string) bool {
+		if keyA != keyB {
+			return keyA < keyB != descending
+		}
+		if domainA == domainB {
+			return false
+		}
+		return domainA < domainB != descending
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return before(keys[matches[i].Domain], matches[i].Domain, keys[matches[j].Domain], matches[j].Domain)
+	})
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matches), func(i int) bool {
+			return before(after.Key, after.Domain, keys[matches[i].Domain], matches[i].Domain)
+		})
+	}
+	end := min(start+limit, len(matches))
+
+	page := &DomainPage{Domains: make([]DomainSummary, 0, end-start), Total: len(matches)}
+	for _, domainMetadata := range matches[start:end] {
+		page.Domains = append(page.Domains, SummarizeDomain(domainMetadata))
+	}
+	if end < len(matches) {
+		last := matches[end-1]
+		page.NextCursor = encodeDomainCursor(domainCursor{Sort: sortKey, Key: keys[last.Domain], Domain: last.Domain})
+	}
+	return page, nil
+}
+
+// matchesSearch reports whether the domain or one of its aliases matches a
+// lowercased search, as a wildcard pattern if it holds one, otherwise as a substring.
+func matchesSearch(domainMetadata *DomainMetadata, search string) bool {
+	for _, name := range domainMetadata.Names() {
+		name = strings.ToLower(name)
+		if strings.ContainsAny(search, "*?[") {
+			if matched, _ := path.Match(search, name); matched {
+				return true
+			}
+		} else if strings.Contains(name, search) {
+			return true
+		}
+	}
+	return false
+}
+
+// domainSortKey returns the value a domain is ordered by; domains are ordered by
+// name when the values are equal. Domains without a certificate expire last.
+func domainSortKey(domainMetadata *DomainMetadata, sortBy string) int64 {
+	switch sortBy {
+	case SortByCreatedAt:
+		return domainMetadata.CreatedAt
+	case SortByUpdatedAt:
+		return domainMetadata.UpdatedAt
+	case SortByExpiry:
+		if notAfter := domainMetadata.GetCertificate().GetNotAfter(); notAfter != 0 {
+			return notAfter
+		}
+		return math.MaxInt64
+	}
+	return 0
+}
+
+// SummarizeDomain describes a domain without its certificate and keys.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain.
+//
+// Returns:
+//   - DomainSummary: the settings, state and certificate expiry of the domain.
+func SummarizeDomain(domainMetadata *DomainMetadata) DomainSummary {
+	summary := DomainSummary{
+		Domain:            domainMetadata.Domain,
+		Email:             domainMetadata.Email,
+		Status:            domainMetadata.Status,
+		Aliases:           domainMetadata.Aliases,
+		Tags:              domainMetadata.GetRouting().GetTags(),
+		Backend:           domainMetadata.GetRouting().GetBackend(),
+		Issuer:            domainMetadata.Issuer,
+		OnDemand:          domainMetadata.OnDemand,
+		ManualCertificate: domainMetadata.ManualCertificate,
+		Metadata:          domainMetadata.Metadata,
+	}
+	if notAfter := domainMetadata.GetCertificate().GetNotAfter(); notAfter != 0 {
+		summary.NotAfter = time.Unix(notAfter, 0).UTC()
+	}
+	if domainMetadata.CreatedAt != 0 {
+		summary.CreatedAt = time.Unix(domainMetadata.CreatedAt, 0).UTC()
+	}
+	if domainMetadata.UpdatedAt != 0 {
+		summary.UpdatedAt = time.Unix(domainMetadata.UpdatedAt, 0).UTC()
+	}
+	return summary
+}
+
+// encodeDomainCursor encodes the position of a domain into an opaque cursor.
+func encodeDomainCursor(cursor domainCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeDomainCursor decodes a cursor returned by encodeDomainCursor.
+func decodeDomainCursor(encoded string) (*domainCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	var cursor domainCursor
+	if err := json.Unmarshal(data, &cursor); err != nil || cursor.Domain == "" {
+		return nil, errors.New("invalid cursor")
+	}
+	return &cursor, nil
+}
@@ -0,0 +1,166 @@
+package domains
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"shiroxy/pkg/models"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newTestListingStorage returns a storage holding domains with varied status,
+// routing, issuers, timestamps and expiries.
+func newTestListingStorage() *Storage {
+	st := newTestIssuanceStorage()
+	now := time.Now()
+	certificate := func(issuer string, expiresIn time.Duration) *CertificateInfo {
+		return &CertificateInfo{Issuer: issuer, NotAfter: now.Add(expiresIn).Unix()}
+	}
+	st.Domains().Put(&DomainMetadata{Domain: "alpha.com", Status: "active", Routing: &DomainRouting{Tags: []string{"eu"}}, Certificate: certificate("letsencrypt", 60*24*time.Hour), CreatedAt: 300, UpdatedAt: 300})
+	st.Domains().Put(&DomainMetadata{Domain: "beta.com", Status: "active", Aliases: []string{"shop.beta.com"}, Issuer: "zerossl", Certificate: certificate("zerossl", 5*24*time.Hour), CreatedAt: 100, UpdatedAt: 500})
+	st.Domains().Put(&DomainMetadata{Domain: "gamma.org", Status: "inactive", Routing: &DomainRouting{Tags: []string{"eu", "us"}}, CreatedAt: 200, UpdatedAt: 200})
+	st.Domains().Put(&DomainMetadata{Domain: "delta.org", Status: "active", Certificate: certificate("letsencrypt", 20*24*time.Hour), CreatedAt: 200, UpdatedAt: 400})
+	return st
+}
+
+// listedNames returns the names of the domains of a page.
+func listedNames(page *DomainPage) string {
+	var names []string
+	for _, domain := range page.Domains {
+		names = append(names, domain.Domain)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestListDomains_Filters(t *testing.T) {
+	st := newTestListingStorage()
+	cases := []struct {
+		name  string
+		query DomainQuery
+		want  string
+	}{
+		{"all", DomainQuery{}, "alpha.com,beta.com,delta.org,gamma.org"},
+		{"status", DomainQuery{Status: "inactive"}, "gamma.org"},
+		{"tag", DomainQuery{Tag: "eu"}, "alpha.com,gamma.org"},
+		{"issuer", DomainQuery{Issuer: "letsencrypt"}, "alpha.com,delta.org"},
+		{"expiring", DomainQuery{ExpiringWithin: 30 * 24 * time.Hour}, "beta.com,delta.org"},
+		{"substring", DomainQuery{Search: "ORG"}, "delta.org,gamma.org"},
+		{"alias", DomainQuery{Search: "shop"}, "beta.com"},
+		{"wildcard", DomainQuery{Search: "*a.com"}, "alpha.com,beta.com"},
+		{"combined", DomainQuery{Status: "active", Search: "*.org"}, "delta.org"},
+		{"expiry", DomainQuery{Sort: SortByExpiry}, "beta.com,delta.org,alpha.com,gamma.org"},
+		{"created", DomainQuery{Sort: SortByCreatedAt}, "beta.com,delta.org,gamma.org,alpha.com"},
+		{"updated descending", DomainQuery{Sort: "-" + SortByUpdatedAt}, "beta.com,delta.org,alpha.com,gamma.org"},
+		{"domain descending", DomainQuery{Sort: "-domain"}, "gamma.org,delta.org,beta.com,alpha.com"},
+	}
+	for _, c := range cases {
+		page, err := st.ListDomains(c.query)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if got := listedNames(page); got != c.want || page.Total != strings.Count(c.want, ",")+1 || page.NextCursor != "" {
+			t.Errorf("%s: got %s (total %d, cursor %q), want %s", c.name, got, page.Total, page.NextCursor, c.want)
+		}
+	}
+
+	page, _ := st.ListDomains(DomainQuery{Search: "beta.com"})
+	if summary := page.Domains[0]; summary.Issuer != "zerossl" || summary.NotAfter.IsZero() || summary.UpdatedAt.Unix() != 500 {
+		t.Fatalf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestListDomains_InvalidQuery(t *testing.T) {
+	st := newTestListingStorage()
+	page, _ := st.ListDomains(DomainQuery{Limit: 1})
+	for name, query := range map[string]DomainQuery{
+		"sort":         {Sort: "email"},
+		"pattern":      {Search: "[a-"},
+		"cursor":       {Cursor: "not a cursor"},
+		"cursor sort":  {Cursor: page.NextCursor, Sort: SortByCreatedAt},
+		"cursor order": {Cursor: page.NextCursor, Sort: "-domain"},
+	} {
+		if _, err := st.ListDomains(query); err == nil {
+			t.Errorf("%s: expected the query to be rejected", name)
+		}
+	}
+}
+
+func TestListDomains_Pagination(t *testing.T) {
+	st := newTestListingStorage()
+	for _, sort := range []string{SortByDomain, "-" + SortByDomain, SortByCreatedAt, "-" + SortByCreatedAt, SortByExpiry, "-" + SortByExpiry} {
+		all, err := st.ListDomains(DomainQuery{Sort: sort})
+		if err != nil {
+			t.Fatalf("%s: %v", sort, err)
+		}
+
+		var paged []string
+		query := DomainQuery{Sort: sort, Limit: 3}
+		for pages := 0; ; pages++ {
+			if pages > 4 {
+				t.Fatalf("%s: pagination does not end", sort)
+			}
+			page, err := st.ListDomains(query)
+			if err != nil {
+				t.Fatalf("%s: %v", sort, err)
+			}
+			if page.Total != 4 {
+				t.Fatalf("%s: expected a total of 4, got %d", sort, page.Total)
+			}
+			paged = append(paged, listedNames(page))
+			if page.NextCursor == "" {
+				break
+			}
+			query.Cursor = page.NextCursor
+		}
+		if strings.Join(paged, ",") != listedNames(all) {
+			t.Fatalf("%s: pages %v differ from the full list %s", sort, paged, listedNames(all))
+		}
+	}
+
+	// Domains registered after a page was returned do not shift the next page.
+	first, _ := st.ListDomains(DomainQuery{Limit: 2})
+	st.Domains().Put(&DomainMetadata{Domain: "aaa.com", Status: "active"})
+	st.Domains().Delete("alpha.com")
+	second, err := st.ListDomains(DomainQuery{Limit: 2, Cursor: first.NextCursor})
+	if err != nil || listedNames(second) != "delta.org,gamma.org" || second.NextCursor != "" {
+		t.Fatalf("unexpected page after changes: %s (%v)", listedNames(second), err)
+	}
+}
+
+func TestListDomains_Redis(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisDomainStore(context.Background(), redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatalf("redis store: %v", err)
+	}
+	for _, name := range []string{"b.com", "a.com", "c.com"} {
+		if err := store.Put(context.Background(), &DomainMetadata{Domain: name, Status: "active"}); err != nil {
+			t.Fatalf("put %s: %v", name, err)
+		}
+	}
+	store.Close()
+	// Keys of other shiroxy data are not domains.
+	server.Set("shiroxy:cluster:leader", "node-1")
+
+	var wg sync.WaitGroup
+	st, err := InitializeStorage(&models.Storage{Location: "redis", RedisConnectionString: "redis://" + server.Addr()}, "", "yes", nil, &wg)
+	if err != nil {
+		t.Fatalf("initialize storage: %v", err)
+	}
+	defer wg.Wait()
+	defer st.Close()
+
+	page, err := st.ListDomains(DomainQuery{Limit: 2})
+	if err != nil || listedNames(page) != "a.com,b.com" || page.Total != 3 {
+		t.Fatalf("unexpected first page: %s (%v)", listedNames(page), err)
+	}
+	page, err = st.ListDomains(DomainQuery{Limit: 2, Cursor: page.NextCursor})
+	if err != nil || listedNames(page) != "c.com" || page.NextCursor != "" {
+		t.Fatalf("unexpected second page: %s (%v)", listedNames(page), err)
+	}
+}
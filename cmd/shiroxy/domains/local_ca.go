@@ -0,0 +1,234 @@
+package domains
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// IssuerTypeACME selects an issuer ordering certificates from an ACME directory.
+	IssuerTypeACME = "acme"
+	// IssuerTypeLocal selects the built-in local CA, which signs certificates itself.
+	IssuerTypeLocal = "local"
+
+	// LocalCACertificateFile and LocalCAKeyFile name the root certificate and key in the CA directory.
+	LocalCACertificateFile = "shiroxy-local-ca.crt"
+	LocalCAKeyFile         = "shiroxy-local-ca.key"
+
+	localCARootValidity          = 10 * 365 * 24 * time.Hour
+	defaultLocalCALeafValidity   = 30 * 24 * time.Hour
+	localCABackdate              = time.Hour
+	localCASerialNumberMaxBitLen = 128
+)
+
+// LocalCA is a private certificate authority that issues leaf certificates
+// instantly and offline, for development and private networks. Clients must
+// trust its root certificate.
+type LocalCA struct {
+	Root         *x509.Certificate // Self-signed root certificate.
+	RootPEM      []byte            // PEM encoding of Root.
+	LeafValidity time.Duration     // Lifetime of issued leaf certificates.
+
+	key *ecdsa.PrivateKey
+}
+
+// LoadOrCreateLocalCA loads the root of the local CA from dir, generating and
+// persisting a new root the first time. The key is written with mode 0600.
+// Parameters:
+//   - dir: string, the directory holding the root certificate and key.
+//   - leafValidity: time.Duration, the lifetime of issued leaf certificates; zero uses 30 days.
+//
+// Returns:
+//   - *LocalCA: the local CA.
+//   - error: error if the root cannot be read, generated or written.
+func LoadOrCreateLocalCA(dir string, leafValidity time.Duration) (*LocalCA, error) {
+	if dir == "" {
+		return nil, errors.New("local ca: directory is required")
+	}
+	if leafValidity <= 0 {
+		leafValidity = defaultLocalCALeafValidity
+	}
+
+	certPath := filepath.Join(dir, LocalCACertificateFile)
+	keyPath := filepath.Join(dir, LocalCAKeyFile)
+
+	certPEM, certErr := os.ReadFile(certPath)
+	keyPEM, keyErr := os.ReadFile(keyPath)
+	switch {
+	case certErr == nil && keyErr == nil:
+	case errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist):
+		var err error
+		certPEM, keyPEM, err = generateLocalCARoot(time.Now())
+		if err != nil {
+			return nil, fmt.Errorf("local ca: generating root: %v", err)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("local ca: %v", err)
+		}
+		// The key is written first so a crash never leaves a root without its key.
+		if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, fmt.Errorf("local ca: %v", err)
+		}
+		if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+			return nil, fmt.Errorf("local ca: %v", err)
+		}
+	case certErr != nil && !errors.Is(certErr, os.ErrNotExist):
+		return nil, fmt.Errorf("local ca: %v", certErr)
+	case keyErr != nil && !errors.Is(keyErr, os.ErrNotExist):
+		return nil, fmt.Errorf("local ca: %v", keyErr)
+	default:
+		return nil, fmt.Errorf("local ca: only one of %s and %s exists in %s", LocalCACertificateFile, LocalCAKeyFile, dir)
+	}
+
+	ca, err := parseLocalCA(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("local ca: %v", err)
+	}
+	ca.LeafValidity = leafValidity
+	return ca, nil
+}
+
+// generateLocalCARoot creates a new self-signed root certificate and key.
+// Parameters:
+//   - now: time.Time, the start of the root's validity.
+//
+// Returns:
+//   - []byte: the PEM encoded root certificate.
+//   - []byte: the PEM encoded root key.
+//   - error: error if the key or certificate cannot be generated.
+func generateLocalCARoot(now time.Time) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"shiroxy local CA"},
+			CommonName:   fmt.Sprintf("shiroxy local CA %s %s", hostname, now.Format("2006-01-02")),
+		},
+		NotBefore:             now.Add(-localCABackdate),
+		NotAfter:              now.Add(localCARootValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+// parseLocalCA parses a persisted root certificate and key.
+// Parameters:
+//   - certPEM: []byte, the PEM encoded root certificate.
+//   - keyPEM: []byte, the PEM encoded root key.
+//
+// Returns:
+//   - *LocalCA: the local CA.
+//   - error: error if either cannot be parsed or they do not belong together.
+func parseLocalCA(certPEM, keyPEM []byte) (*LocalCA, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, errors.New("root certificate is not PEM encoded")
+	}
+	root, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, errors.New("root key is not PEM encoded")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	if !key.PublicKey.Equal(root.PublicKey) {
+		return nil, errors.New("root key does not match the root certificate")
+	}
+	return &LocalCA{Root: root, RootPEM: certPEM, key: key}, nil
+}
+
+// issue signs a new leaf certificate for names with a fresh key.
+// Parameters:
+//   - names: []string, the hostnames the certificate covers; the first is the common name.
+//   - now: time.Time, the start of the certificate's validity.
+//
+// Returns:
+//   - *issuedCertificate: the issued certificate and key; the chain holds the leaf only.
+//   - error: error if no names are given or signing fails.
+func (ca *LocalCA) issue(names []string, now time.Time) (*issuedCertificate, error) {
+	if len(names) == 0 {
+		return nil, errors.New("local ca: no names to issue a certificate for")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating certificate key: %v", err)
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	notAfter := now.Add(ca.LeafValidity)
+	if notAfter.After(ca.Root.NotAfter) {
+		notAfter = ca.Root.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    now.Add(-localCABackdate),
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, ca.Root, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, fmt.Errorf("local ca: signing certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling private key: %v", err)
+	}
+
+	// The root is left out of the chain: clients trust it directly.
+	return &issuedCertificate{
+		CertPemBlock: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		KeyPemBlock:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		CA:           ca.Root.Subject.CommonName,
+	}, nil
+}
+
+// randomSerialNumber returns a random positive certificate serial number.
+func randomSerialNumber() (*big.Int, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), localCASerialNumberMaxBitLen))
+	if err != nil {
+		return nil, fmt.Errorf("generating serial number: %v", err)
+	}
+	return serialNumber, nil
+}
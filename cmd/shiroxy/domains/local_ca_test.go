@@ -0,0 +1,95 @@
+package domains
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"shiroxy/pkg/models"
+	"testing"
+	"time"
+)
+
+func TestLoadOrCreateLocalCA(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "ca")
+	ca, err := LoadOrCreateLocalCA(dir, 0)
+	if err != nil {
+		t.Fatalf("create local ca: %v", err)
+	}
+	if !ca.Root.IsCA || ca.LeafValidity != defaultLocalCALeafValidity {
+		t.Fatalf("unexpected local ca: %+v", ca)
+	}
+	info, err := os.Stat(filepath.Join(dir, LocalCAKeyFile))
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("expected the root key to be written with mode 0600, got %v %v", info, err)
+	}
+
+	reloaded, err := LoadOrCreateLocalCA(dir, 24*time.Hour)
+	if err != nil {
+		t.Fatalf("reload local ca: %v", err)
+	}
+	if !bytes.Equal(reloaded.RootPEM, ca.RootPEM) || reloaded.LeafValidity != 24*time.Hour {
+		t.Fatalf("expected the persisted root to be reused")
+	}
+
+	if err := os.Remove(filepath.Join(dir, LocalCAKeyFile)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadOrCreateLocalCA(dir, 0); err == nil {
+		t.Fatalf("expected a root without its key to be rejected")
+	}
+}
+
+func TestLocalIssuer_IssuesTrustedCertificates(t *testing.T) {
+	dir := t.TempDir()
+	issuers, err := NewACMEIssuers([]models.ACMEIssuer{{Name: "local", Type: IssuerTypeLocal, CAPath: dir, LeafValidityDays: 7}})
+	if err != nil {
+		t.Fatalf("new issuers: %v", err)
+	}
+	st := newTestIssuanceStorage()
+	st.Issuers = issuers
+
+	if _, err := st.Register(DomainRegistration{Domain: "app.test", Email: "dev@example.com", Aliases: []string{"www.app.test"}}); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	domainMetadata, err := st.getDomainMetadata("app.test")
+	if err != nil {
+		t.Fatalf("get domain: %v", err)
+	}
+	if domainMetadata.GetCertificate().GetIssuer() != "local" {
+		t.Fatalf("expected the certificate to come from the local issuer, got %q", domainMetadata.GetCertificate().GetIssuer())
+	}
+
+	block, _ := pem.Decode(domainMetadata.CertPemBlock)
+	leaf, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf("parse leaf: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(issuers[0].Local.Root)
+	for _, name := range []string{"app.test", "www.app.test"} {
+		if _, err := leaf.Verify(x509.VerifyOptions{DNSName: name, Roots: roots}); err != nil {
+			t.Fatalf("verify %s: %v", name, err)
+		}
+	}
+	if lifetime := leaf.NotAfter.Sub(leaf.NotBefore); lifetime != 7*24*time.Hour+localCABackdate {
+		t.Fatalf("unexpected leaf lifetime %s", lifetime)
+	}
+
+	if _, err := st.RolloverAccountKey("local", "dev@example.com"); err == nil {
+		t.Fatalf("expected account operations on a local issuer to be rejected")
+	}
+}
+
+func TestNewACMEIssuers_LocalValidation(t *testing.T) {
+	invalid := [][]models.ACMEIssuer{
+		{{Name: "local", Type: IssuerTypeLocal}},
+		{{Name: "other", Type: "unknown", DirectoryUrl: "https://ca.example.com/dir"}},
+	}
+	for _, configs := range invalid {
+		if _, err := NewACMEIssuers(configs); err == nil {
+			t.Fatalf("expected %+v to be rejected", configs)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package domains
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrManualCertificate is returned when automated issuance is requested for a
+// domain whose certificate was uploaded and is managed manually.
+var ErrManualCertificate = errors.New("certificate is managed manually")
+
+// UploadCertificate stores an uploaded certificate chain and key for a domain and
+// marks the certificate as manually managed, so automated issuance and renewal
+// leave it alone. Unknown domains are created.
+// Parameters:
+//   - domainName: string, the domain the certificate is served for.
+//   - certPEM: []byte, the PEM encoded certificate chain, leaf first.
+//   - keyPEM: []byte, the PEM encoded private key of the leaf.
+//
+// Returns:
+//   - *DomainMetadata: the updated domain.
+//   - error: error if the certificate is invalid or does not cover the domain and its aliases.
+func (s *Storage) UploadCertificate(domainName string, certPEM, keyPEM []byte) (*DomainMetadata, error) {
+	if err := ValidateDomainName(domainName); err != nil {
+		return nil, err
+	}
+
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+
+	domainMetadata := &DomainMetadata{Domain: domainName, Status: "inactive"}
+	if current, err := s.loadDomainMetadata(domainName); err == nil {
+		domainMetadata = proto.Clone(current).(*DomainMetadata)
+	} else if err := s.checkAliasConflicts(domainName, domainMetadata.Names()); err != nil {
+		return nil, err
+	}
+
+	chain, err := ValidateCertificateChain(certPEM, keyPEM, domainMetadata.Names(), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	domainMetadata.CertPemBlock = certPEM
+	domainMetadata.KeyPemBlock = keyPEM
+	domainMetadata.OcspStaple = nil
+	domainMetadata.ManualCertificate = true
+	domainMetadata.Status = "active"
+	domainMetadata.Certificate = newCertificateInfo(chain[0])
+	domainMetadata.Certificate.Ca = chain[0].Issuer.CommonName
+	order := s.order(domainMetadata)
+	order.State = OrderIssued
+	order.Error = ""
+	order.UpdatedAt = time.Now().Unix()
+
+	if err := s.storeDomainMetadata(domainMetadata); err != nil {
+		return nil, err
+	}
+	if s.Renewals != nil {
+		s.Renewals.forget(domainName)
+	}
+	return domainMetadata, nil
+}
+
+// ValidateCertificateChain checks an uploaded certificate chain: the key must match
+// the leaf, every certificate must be issued by the next one, the chain must end
+// in a root (included or trusted by the system), and the leaf must be currently
+// valid and cover every name.
+// Parameters:
+//   - certPEM: []byte, the PEM encoded certificate chain, leaf first.
+//   - keyPEM: []byte, the PEM encoded private key.
+//   - names: []string, the hostnames the certificate must cover.
+//   - now: time.Time, the time to check validity at.
+//
+// Returns:
+//   - []*x509.Certificate: the parsed chain.
+//   - error: error describing the first problem found.
+func ValidateCertificateChain(certPEM, keyPEM []byte, names []string, now time.Time) ([]*x509.Certificate, error) {
+	if _, err := tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		return nil, fmt.Errorf("certificate and private key do not match: %v", err)
+	}
+	chain, err := ParseCertificateChain(certPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf := chain[0]
+	if now.Before(leaf.NotBefore) {
+		return nil, fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.UTC().Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return nil, fmt.Errorf("certificate expired at %s", leaf.NotAfter.UTC().Format(time.RFC3339))
+	}
+
+	for i := 0; i+1 < len(chain); i++ {
+		if err := chain[i].CheckSignatureFrom(chain[i+1]); err != nil {
+			return nil, fmt.Errorf("certificate chain is out of order: %q is not issued by %q", chain[i].Subject.CommonName, chain[i+1].Subject.CommonName)
+		}
+	}
+	if last := chain[len(chain)-1]; !selfSigned(last) {
+		roots, err := x509.SystemCertPool()
+		if err != nil {
+			roots = x509.NewCertPool()
+		}
+		_, err = last.Verify(x509.VerifyOptions{Roots: roots, CurrentTime: now, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}})
+		if err != nil {
+			return nil, fmt.Errorf("certificate chain is incomplete: issuer %q of %q is missing", last.Issuer.CommonName, last.Subject.CommonName)
+		}
+	}
+
+	for _, name := range names {
+		if !certificateCovers(leaf, name) {
+			return nil, fmt.Errorf("certificate does not cover %s", name)
+		}
+	}
+	return chain, nil
+}
+
+// selfSigned reports whether certificate is a self-signed root.
+func selfSigned(certificate *x509.Certificate) bool {
+	return bytes.Equal(certificate.RawIssuer, certificate.RawSubject) && certificate.CheckSignatureFrom(certificate) == nil
+}
+
+// certificateCovers reports whether a SAN of certificate matches name. A wildcard
+// SAN covers a single label; a wildcard name is only covered by the same wildcard.
+func certificateCovers(certificate *x509.Certificate, name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, san := range certificate.DNSNames {
+		san = strings.ToLower(san)
+		if san == name {
+			return true
+		}
+		if strings.HasPrefix(san, "*.") && !strings.HasPrefix(name, "*.") {
+			if dot := strings.IndexByte(name, '.'); dot > 0 && name[dot:] == san[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// manualCertificate reports whether the certificate of domainName is managed manually.
+func (s *Storage) manualCertificate(domainName string) bool {
+	domainMetadata, err := s.getDomainMetadata(domainName)
+	return err == nil && domainMetadata.ManualCertificate
+}
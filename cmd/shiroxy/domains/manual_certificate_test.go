@@ -0,0 +1,171 @@
+package domains
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testChain is a root, an intermediate and a leaf issued by the intermediate.
+type testChain struct {
+	root, intermediate, leaf []byte
+	key                      []byte
+}
+
+func createTestCertificate(t *testing.T, template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return certificate, key
+}
+
+func newTestChain(t *testing.T, dnsNames ...string) *testChain {
+	t.Helper()
+	now := time.Now()
+	ca := func(serial int64, name string) *x509.Certificate {
+		return &x509.Certificate{
+			SerialNumber:          big.NewInt(serial),
+			Subject:               pkix.Name{CommonName: name},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(365 * 24 * time.Hour),
+			IsCA:                  true,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageCertSign,
+		}
+	}
+	root, rootKey := createTestCertificate(t, ca(1, "Corporate Root"), nil, nil)
+	intermediate, intermediateKey := createTestCertificate(t, ca(2, "Corporate Intermediate"), root, rootKey)
+	leaf, leafKey := createTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(10 * 24 * time.Hour),
+	}, intermediate, intermediateKey)
+
+	keyDER, err := x509.MarshalECPrivateKey(leafKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	encode := func(certificate *x509.Certificate) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Raw})
+	}
+	return &testChain{
+		root:         encode(root),
+		intermediate: encode(intermediate),
+		leaf:         encode(leaf),
+		key:          pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testChain) full() []byte {
+	return append(append(append([]byte{}, c.leaf...), c.intermediate...), c.root...)
+}
+
+func TestValidateCertificateChain(t *testing.T) {
+	chain := newTestChain(t, "example.com", "*.example.com")
+	other := newTestChain(t, "example.com")
+	now := time.Now()
+
+	cases := []struct {
+		name    string
+		cert    []byte
+		key     []byte
+		names   []string
+		wantErr string
+	}{
+		{"complete chain", chain.full(), chain.key, []string{"example.com", "www.example.com"}, ""},
+		{"mismatched key", chain.full(), other.key, []string{"example.com"}, "do not match"},
+		{"missing root", append(append([]byte{}, chain.leaf...), chain.intermediate...), chain.key, []string{"example.com"}, "incomplete"},
+		{"out of order", append(append(append([]byte{}, chain.leaf...), chain.root...), chain.intermediate...), chain.key, []string{"example.com"}, "out of order"},
+		{"name not covered", chain.full(), chain.key, []string{"example.org"}, "does not cover example.org"},
+		{"nested wildcard", chain.full(), chain.key, []string{"a.b.example.com"}, "does not cover"},
+	}
+	for _, c := range cases {
+		_, err := ValidateCertificateChain(c.cert, c.key, c.names, now)
+		if c.wantErr == "" && err != nil {
+			t.Fatalf("%s: unexpected error: %v", c.name, err)
+		}
+		if c.wantErr != "" && (err == nil || !strings.Contains(err.Error(), c.wantErr)) {
+			t.Fatalf("%s: expected error containing %q, got %v", c.name, c.wantErr, err)
+		}
+	}
+
+	if _, err := ValidateCertificateChain(chain.full(), chain.key, []string{"example.com"}, now.Add(30*24*time.Hour)); err == nil {
+		t.Fatalf("expected an expired certificate to be rejected")
+	}
+}
+
+func TestUploadCertificate_ManuallyManaged(t *testing.T) {
+	chain := newTestChain(t, "example.com", "www.example.com")
+	now := time.Now()
+	st, manager, events := newTestRenewalManager(t, now)
+	obtained := 0
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		obtained++
+		return testCertificate(t, domainMetadata.Domain, now, now.Add(90*24*time.Hour)), nil
+	}
+
+	if _, err := st.UploadCertificate("example.com", chain.full(), newTestChain(t, "example.com").key); err == nil {
+		t.Fatalf("expected a mismatched key to be rejected")
+	}
+	if _, ok := st.Domains().Get("example.com"); ok {
+		t.Fatalf("expected a rejected upload not to create the domain")
+	}
+
+	domainMetadata, err := st.UploadCertificate("example.com", chain.full(), chain.key)
+	if err != nil {
+		t.Fatalf("upload certificate: %v", err)
+	}
+	if !domainMetadata.ManualCertificate || domainMetadata.Status != "active" {
+		t.Fatalf("expected an active, manually managed domain, got %+v", domainMetadata)
+	}
+	if status, _ := st.IssuanceStatus("example.com"); status.State != OrderIssued {
+		t.Fatalf("expected the order to be issued, got %q", status.State)
+	}
+
+	if err := st.ForceSSL("example.com"); !errors.Is(err, ErrManualCertificate) {
+		t.Fatalf("expected force ssl to be refused, got %v", err)
+	}
+	if err := st.SetAliases("example.com", []string{"api.example.com"}); err == nil {
+		t.Fatalf("expected an alias not covered by the uploaded certificate to be rejected")
+	}
+	if err := st.SetAliases("example.com", []string{"www.example.com"}); err != nil {
+		t.Fatalf("set covered alias: %v", err)
+	}
+
+	// The certificate expires in 10 days: it is due for renewal but must be left
+	// alone, and the 14 day warning fires once.
+	manager.CheckRenewals(now)
+	manager.CheckRenewals(now.Add(time.Hour))
+	if obtained != 0 || string(registeredDomain(st, "example.com").CertPemBlock) != string(chain.full()) {
+		t.Fatalf("expected the uploaded certificate not to be replaced")
+	}
+	if len(*events) != 1 || (*events)[0].name != EventCertificateExpiring || (*events)[0].data["manual"] != "true" || (*events)[0].data["days_remaining"] != "9" {
+		t.Fatalf("unexpected webhook events: %+v", *events)
+	}
+
+	// Crossing the next threshold warns again.
+	manager.CheckRenewals(now.Add(4 * 24 * time.Hour))
+	if len(*events) != 2 || (*events)[1].data["days_remaining"] != "5" {
+		t.Fatalf("expected a second warning at 7 days, got %+v", *events)
+	}
+}
@@ -0,0 +1,148 @@
+package domains
+
+import (
+	"crypto/x509"
+	"strings"
+	"time"
+)
+
+// Keys of DomainMetadata.Metadata used by older versions for values that now have
+// typed fields; Metadata only holds user-defined labels.
+const (
+	legacyTagsKey       = "tags"
+	legacyCertURLKey    = "cert_url"
+	legacyCertCAKey     = "cert_ca"
+	legacyCertIssuerKey = "cert_issuer"
+)
+
+// Kinds of the attempts recorded in the issuance history of a domain.
+const (
+	AttemptIssue = "issue"
+	AttemptRenew = "renew"
+)
+
+// maxIssuanceHistory is the number of attempts kept in the history of a domain.
+const maxIssuanceHistory = 10
+
+// MigrateDomainMetadata moves the routing tags and certificate details older
+// versions kept in the Metadata map into the typed fields, and records the
+// certificate details of domains issued before they were kept.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain to migrate in place.
+//
+// Returns:
+//   - bool: true if domainMetadata was changed.
+func MigrateDomainMetadata(domainMetadata *DomainMetadata) bool {
+	changed := false
+	if tags, ok := domainMetadata.Metadata[legacyTagsKey]; ok {
+		if domainMetadata.Routing == nil {
+			domainMetadata.Routing = &DomainRouting{}
+		}
+		domainMetadata.Routing.Tags = SplitTags(tags)
+		delete(domainMetadata.Metadata, legacyTagsKey)
+		changed = true
+	}
+
+	if domainMetadata.Certificate == nil && len(domainMetadata.CertPemBlock) > 0 {
+		domainMetadata.Certificate = &CertificateInfo{}
+		if chain, err := ParseCertificateChain(domainMetadata.CertPemBlock); err == nil {
+			domainMetadata.Certificate = newCertificateInfo(chain[0])
+		}
+		changed = true
+	}
+	certURL, hasURL := domainMetadata.Metadata[legacyCertURLKey]
+	certCA, hasCA := domainMetadata.Metadata[legacyCertCAKey]
+	certIssuer, hasIssuer := domainMetadata.Metadata[legacyCertIssuerKey]
+	if hasURL || hasCA || hasIssuer {
+		if domainMetadata.Certificate == nil {
+			domainMetadata.Certificate = &CertificateInfo{}
+		}
+		certificate := domainMetadata.Certificate
+		if certificate.Url == "" {
+			certificate.Url = certURL
+		}
+		if certificate.Ca == "" {
+			certificate.Ca = certCA
+		}
+		if certificate.Issuer == "" {
+			certificate.Issuer = certIssuer
+		}
+		delete(domainMetadata.Metadata, legacyCertURLKey)
+		delete(domainMetadata.Metadata, legacyCertCAKey)
+		delete(domainMetadata.Metadata, legacyCertIssuerKey)
+		changed = true
+	}
+
+	if domainMetadata.CreatedAt == 0 && domainMetadata.GetOrder().GetCreatedAt() != 0 {
+		domainMetadata.CreatedAt = domainMetadata.Order.CreatedAt
+		domainMetadata.UpdatedAt = domainMetadata.Order.UpdatedAt
+		changed = true
+	}
+	return changed
+}
+
+// SplitTags splits a comma separated list of routing tags, dropping empty tags.
+// Parameters:
+//   - tags: string, the comma separated tags.
+//
+// Returns:
+//   - []string: the tags.
+func SplitTags(tags string) []string {
+	var split []string
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			split = append(split, tag)
+		}
+	}
+	return split
+}
+
+// newCertificateInfo describes the leaf certificate of a domain.
+// Parameters:
+//   - leaf: *x509.Certificate, the certificate.
+//
+// Returns:
+//   - *CertificateInfo: the serial, validity and names of leaf.
+func newCertificateInfo(leaf *x509.Certificate) *CertificateInfo {
+	return &CertificateInfo{
+		Serial:    leaf.SerialNumber.Text(16),
+		NotBefore: leaf.NotBefore.Unix(),
+		NotAfter:  leaf.NotAfter.Unix(),
+		Sans:      leaf.DNSNames,
+	}
+}
+
+// recordAttempt appends attempt to the issuance history of domainMetadata, dropping
+// the oldest attempts beyond maxIssuanceHistory.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain the attempt was made for.
+//   - attempt: *IssuanceAttempt, the finished attempt.
+func recordAttempt(domainMetadata *DomainMetadata, attempt *IssuanceAttempt) {
+	history := append(domainMetadata.History, attempt)
+	if extra := len(history) - maxIssuanceHistory; extra > 0 {
+		history = append([]*IssuanceAttempt(nil), history[extra:]...)
+	}
+	domainMetadata.History = history
+}
+
+// newAttempt returns a finished attempt of kind started at started.
+// Parameters:
+//   - kind: string, AttemptIssue or AttemptRenew.
+//   - issuer: string, the issuer the certificate came from, if known.
+//   - started: time.Time, when the attempt started.
+//   - err: error, the reason the attempt failed, nil on success.
+//
+// Returns:
+//   - *IssuanceAttempt: the attempt.
+func newAttempt(kind, issuer string, started time.Time, err error) *IssuanceAttempt {
+	attempt := &IssuanceAttempt{
+		Kind:       kind,
+		Issuer:     issuer,
+		StartedAt:  started.Unix(),
+		FinishedAt: time.Now().Unix(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	return attempt
+}
@@ -0,0 +1,109 @@
+package domains
+
+import (
+	"shiroxy/pkg/models"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMigrateDomainMetadata(t *testing.T) {
+	now := time.Now()
+	certificate := testCertificate(t, "example.com", now, now.Add(90*24*time.Hour))
+	domainMetadata := &DomainMetadata{
+		Domain:       "example.com",
+		CertPemBlock: certificate.CertPemBlock,
+		Metadata: map[string]string{
+			"tags":        "api, web",
+			"cert_url":    "https://acme.example.com/cert/1",
+			"cert_ca":     "https://acme.example.com/directory",
+			"cert_issuer": "letsencrypt",
+			"team":        "payments",
+		},
+		Order: &IssuanceOrder{CreatedAt: 100, UpdatedAt: 200},
+	}
+
+	if !MigrateDomainMetadata(domainMetadata) {
+		t.Fatalf("expected the legacy metadata to be migrated")
+	}
+	if len(domainMetadata.Metadata) != 1 || domainMetadata.Metadata["team"] != "payments" {
+		t.Fatalf("expected only the user labels to be kept, got %v", domainMetadata.Metadata)
+	}
+	if tags := domainMetadata.GetRouting().GetTags(); len(tags) != 2 || tags[0] != "api" || tags[1] != "web" {
+		t.Fatalf("unexpected routing tags %v", tags)
+	}
+	info := domainMetadata.Certificate
+	if info.Url != "https://acme.example.com/cert/1" || info.Ca != "https://acme.example.com/directory" || info.Issuer != "letsencrypt" {
+		t.Fatalf("unexpected certificate origin %v", info)
+	}
+	if info.Serial == "" || info.NotAfter != now.Add(90*24*time.Hour).Unix() || len(info.Sans) != 1 || info.Sans[0] != "example.com" {
+		t.Fatalf("expected the certificate to be described, got %v", info)
+	}
+	if domainMetadata.CreatedAt != 100 || domainMetadata.UpdatedAt != 200 {
+		t.Fatalf("expected the timestamps to be taken from the order, got %d and %d", domainMetadata.CreatedAt, domainMetadata.UpdatedAt)
+	}
+
+	if MigrateDomainMetadata(domainMetadata) {
+		t.Fatalf("expected migrated metadata to be left alone")
+	}
+}
+
+func TestInitializeStorage_MigratesStoredDomains(t *testing.T) {
+	server := miniredis.RunT(t)
+	body, _ := proto.Marshal(&DomainMetadata{Domain: "legacy.example.com", Status: "active", Metadata: map[string]string{"tags": "api", "cert_issuer": "zerossl"}})
+	server.Set(redisDomainKeyPrefix+"legacy.example.com", string(body))
+
+	wg := &sync.WaitGroup{}
+	st, err := InitializeStorage(&models.Storage{Location: "redis", RedisConnectionString: "redis://" + server.Addr()}, "", "yes", nil, wg)
+	if err != nil {
+		t.Fatalf("initialize storage: %v", err)
+	}
+	defer wg.Wait()
+	defer st.Close()
+
+	domainMetadata, ok := st.Domains().Get("legacy.example.com")
+	if !ok || domainMetadata.GetRouting().GetTags()[0] != "api" || domainMetadata.GetCertificate().GetIssuer() != "zerossl" || len(domainMetadata.Metadata) != 0 {
+		t.Fatalf("expected the registered domain to be migrated, got %v", domainMetadata)
+	}
+	stored, _ := server.Get(redisDomainKeyPrefix + "legacy.example.com")
+	migrated := &DomainMetadata{}
+	if err := proto.Unmarshal([]byte(stored), migrated); err != nil || migrated.Metadata["tags"] != "" || migrated.GetRouting().GetTags()[0] != "api" {
+		t.Fatalf("expected the stored domain to be migrated, got %v, %v", migrated, err)
+	}
+}
+
+func TestStoreDomainMetadata_Timestamps(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.domainLock.Lock()
+	defer st.domainLock.Unlock()
+
+	domainMetadata := &DomainMetadata{Domain: "example.com"}
+	if err := st.storeDomainMetadata(domainMetadata); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if domainMetadata.CreatedAt == 0 || domainMetadata.UpdatedAt != domainMetadata.CreatedAt {
+		t.Fatalf("expected a new domain to be stamped, got %d and %d", domainMetadata.CreatedAt, domainMetadata.UpdatedAt)
+	}
+
+	updated := proto.Clone(domainMetadata).(*DomainMetadata)
+	updated.CreatedAt = 100
+	if err := st.storeDomainMetadata(updated); err != nil {
+		t.Fatalf("store: %v", err)
+	}
+	if updated.CreatedAt != 100 || updated.UpdatedAt < domainMetadata.UpdatedAt {
+		t.Fatalf("expected only the update time to change, got %d and %d", updated.CreatedAt, updated.UpdatedAt)
+	}
+}
+
+func TestRecordAttempt_KeepsLatest(t *testing.T) {
+	domainMetadata := &DomainMetadata{}
+	for i := 0; i < maxIssuanceHistory+3; i++ {
+		recordAttempt(domainMetadata, &IssuanceAttempt{Kind: AttemptIssue, StartedAt: int64(i)})
+	}
+	if len(domainMetadata.History) != maxIssuanceHistory || domainMetadata.History[0].StartedAt != 3 {
+		t.Fatalf("expected the latest %d attempts, got %v", maxIssuanceHistory, domainMetadata.History)
+	}
+}
@@ -0,0 +1,323 @@
+package domains
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shiroxy/pkg/models"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// EventCertificateRevoked is fired when an OCSP responder reports a certificate as revoked.
+const EventCertificateRevoked = "certificate.revoked"
+
+// OCSP defaults used when the configuration leaves a value unset.
+const (
+	defaultOCSPCheckInterval = time.Hour
+	ocspRequestTimeout       = 30 * time.Second
+	maxOCSPResponseSize      = 1 << 20
+)
+
+// mustStapleExtension is the TLS Feature extension (RFC 7633) requesting status_request.
+var mustStapleExtension = pkix.Extension{
+	Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+	Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+}
+
+// OCSPManager keeps fresh OCSP responses for every active certificate and stores
+// them with the domain so they survive restarts.
+type OCSPManager struct {
+	storage       *Storage
+	notify        func(eventName string, data interface{})
+	checkInterval time.Duration
+	client        *http.Client
+	lock          sync.Mutex
+	revoked       map[string]bool // Serial numbers whose replacement was requested or is being requested.
+	notified      map[string]bool // Serial numbers the revocation webhook was fired for.
+	stop          chan struct{}
+	stopOnce      sync.Once
+}
+
+// NewOCSPManager creates an OCSP stapling manager for storage without starting it.
+// Parameters:
+//   - storage: *Storage, the storage whose certificates are stapled.
+//   - config: models.OCSP, OCSP configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//
+// Returns:
+//   - *OCSPManager: the OCSP manager.
+func NewOCSPManager(storage *Storage, config models.OCSP, notify func(eventName string, data interface{})) *OCSPManager {
+	checkInterval := time.Duration(config.CheckInterval) * time.Second
+	if checkInterval <= 0 {
+		checkInterval = defaultOCSPCheckInterval
+	}
+	return &OCSPManager{
+		storage:       storage,
+		notify:        notify,
+		checkInterval: checkInterval,
+		client:        &http.Client{Timeout: ocspRequestTimeout},
+		revoked:       make(map[string]bool),
+		notified:      make(map[string]bool),
+		stop:          make(chan struct{}),
+	}
+}
+
+// StartOCSPManager creates an OCSP manager, attaches it to storage and starts
+// refreshing staples every configured interval.
+// Parameters:
+//   - storage: *Storage, the storage whose certificates are stapled.
+//   - config: models.OCSP, OCSP configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *OCSPManager: the running OCSP manager, or nil if stapling is disabled.
+func StartOCSPManager(storage *Storage, config models.OCSP, notify func(eventName string, data interface{}), wg *sync.WaitGroup) *OCSPManager {
+	storage.MustStaple = config.MustStaple
+	if config.Disable {
+		return nil
+	}
+
+	manager := NewOCSPManager(storage, config, notify)
+	storage.OCSP = manager
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(manager.checkInterval)
+		defer ticker.Stop()
+		for {
+			manager.RefreshStaples(time.Now())
+			select {
+			case <-ticker.C:
+			case <-manager.stop:
+				return
+			}
+		}
+	}()
+	return manager
+}
+
+// Stop stops the periodic OCSP refreshes.
+func (o *OCSPManager) Stop() {
+	o.stopOnce.Do(func() { close(o.stop) })
+}
+
+// RefreshStaples fetches a new OCSP response for every active certificate whose
+// staple is missing or past the middle of its validity period. In cluster mode
+// only the leader refreshes; the staples reach the other instances with the domains.
+// Parameters:
+//   - now: time.Time, the time to evaluate staple freshness against.
+func (o *OCSPManager) RefreshStaples(now time.Time) {
+	if !o.storage.IsLeader() {
+		return
+	}
+	domains, err := o.storage.listDomainMetadata()
+	if err != nil {
+		fmt.Printf("ocsp: listing domains failed: %v\n", err)
+		return
+	}
+
+	for _, domainMetadata := range domains {
+		if domainMetadata.Status != "active" || len(domainMetadata.CertPemBlock) == 0 {
+			continue
+		}
+		if err := o.refresh(domainMetadata, now); err != nil {
+			fmt.Printf("ocsp: %s: %v\n", domainMetadata.Domain, err)
+		}
+	}
+}
+
+// refresh updates the OCSP staple of a single domain when it is due.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain to refresh.
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - error: error if the OCSP response could not be fetched or stored.
+func (o *OCSPManager) refresh(domainMetadata *DomainMetadata, now time.Time) error {
+	chain, err := ParseCertificateChain(domainMetadata.CertPemBlock)
+	if err != nil {
+		return err
+	}
+	if len(chain) < 2 || len(chain[0].OCSPServer) == 0 {
+		// Without an issuer or responder there is nothing to staple.
+		return nil
+	}
+	leaf, issuer := chain[0], chain[1]
+
+	current := parseStaple(domainMetadata.OcspStaple, leaf, issuer)
+	if current != nil && now.Before(stapleRefreshTime(current)) {
+		return nil
+	}
+
+	raw, response, err := o.fetch(leaf, issuer)
+	if err != nil {
+		// Drop a staple that expired while the responder was unreachable.
+		if len(domainMetadata.OcspStaple) > 0 && (current == nil || !stapleValid(current, now)) {
+			_ = o.storage.updateDomainMetadata(domainMetadata.Domain, func(domainMetadata *DomainMetadata) {
+				domainMetadata.OcspStaple = nil
+			})
+		}
+		return err
+	}
+
+	switch response.Status {
+	case ocsp.Good:
+		return o.storage.updateDomainMetadata(domainMetadata.Domain, func(domainMetadata *DomainMetadata) {
+			domainMetadata.OcspStaple = raw
+		})
+	case ocsp.Revoked:
+		return o.handleRevoked(domainMetadata, leaf, response)
+	default:
+		return fmt.Errorf("responder returned status %d", response.Status)
+	}
+}
+
+// handleRevoked reports a revoked certificate and requests a replacement once per
+// certificate. When the replacement cannot be requested, the next refresh retries
+// the request; the revocation is only reported once.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain whose certificate was revoked.
+//   - leaf: *x509.Certificate, the revoked certificate.
+//   - response: *ocsp.Response, the OCSP response reporting the revocation.
+//
+// Returns:
+//   - error: error if the staple could not be cleared or the reissue could not be requested.
+func (o *OCSPManager) handleRevoked(domainMetadata *DomainMetadata, leaf *x509.Certificate, response *ocsp.Response) (err error) {
+	serial := leaf.SerialNumber.Text(16)
+
+	// Marked up front so that concurrent refreshes handle the certificate once.
+	o.lock.Lock()
+	reported := o.revoked[serial]
+	o.revoked[serial] = true
+	o.lock.Unlock()
+	if reported {
+		return nil
+	}
+	defer func() {
+		// Uploaded certificates are never replaced automatically, so they are not retried.
+		if err != nil && !errors.Is(err, ErrManualCertificate) {
+			o.lock.Lock()
+			delete(o.revoked, serial)
+			o.lock.Unlock()
+		}
+	}()
+
+	// Never staple a revoked response.
+	err = o.storage.updateDomainMetadata(domainMetadata.Domain, func(domainMetadata *DomainMetadata) {
+		domainMetadata.OcspStaple = nil
+	})
+	if err != nil {
+		return err
+	}
+
+	o.lock.Lock()
+	notified := o.notified[serial]
+	o.notified[serial] = true
+	o.lock.Unlock()
+	if !notified && o.notify != nil {
+		o.notify(EventCertificateRevoked, map[string]string{
+			"domain":     domainMetadata.Domain,
+			"serial":     serial,
+			"revoked_at": response.RevokedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	return o.storage.requestCertificate(domainMetadata.Domain)
+}
+
+// fetch requests an OCSP response for leaf from its responder.
+// Parameters:
+//   - leaf: *x509.Certificate, the certificate to check.
+//   - issuer: *x509.Certificate, the certificate that issued leaf.
+//
+// Returns:
+//   - []byte: the raw OCSP response, suitable for stapling.
+//   - *ocsp.Response: the parsed response.
+//   - error: error if the request fails or the response does not verify.
+func (o *OCSPManager) fetch(leaf, issuer *x509.Certificate) ([]byte, *ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), ocspRequestTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(request))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/ocsp-request")
+	httpRequest.Header.Set("Accept", "application/ocsp-response")
+
+	httpResponse, err := o.client.Do(httpRequest)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer httpResponse.Body.Close()
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("responder returned HTTP %d", httpResponse.StatusCode)
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(httpResponse.Body, maxOCSPResponseSize))
+	if err != nil {
+		return nil, nil, err
+	}
+	response, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.NextUpdate.IsZero() && response.Status == ocsp.Good {
+		return nil, nil, errors.New("responder returned a response without NextUpdate")
+	}
+	return raw, response, nil
+}
+
+// parseStaple parses a stored OCSP response; it returns nil if there is none or it does not verify.
+func parseStaple(staple []byte, leaf, issuer *x509.Certificate) *ocsp.Response {
+	if len(staple) == 0 {
+		return nil
+	}
+	response, err := ocsp.ParseResponseForCert(staple, leaf, issuer)
+	if err != nil {
+		return nil
+	}
+	return response
+}
+
+// stapleRefreshTime returns the middle of the response's validity period.
+func stapleRefreshTime(response *ocsp.Response) time.Time {
+	return response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2)
+}
+
+// stapleValid reports whether a response can be stapled at now.
+func stapleValid(response *ocsp.Response, now time.Time) bool {
+	return response.Status == ocsp.Good && now.Before(response.NextUpdate)
+}
+
+// validStaple returns the stored staple of domainMetadata if it is good and unexpired.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain whose staple is checked.
+//   - chain: []*x509.Certificate, the domain's parsed certificate chain, leaf first.
+//
+// Returns:
+//   - []byte: the staple, or nil if it must not be served.
+func validStaple(domainMetadata *DomainMetadata, chain []*x509.Certificate) []byte {
+	if len(domainMetadata.OcspStaple) == 0 || len(chain) < 2 {
+		return nil
+	}
+	response := parseStaple(domainMetadata.OcspStaple, chain[0], chain[1])
+	if response == nil || !stapleValid(response, time.Now()) {
+		return nil
+	}
+	return domainMetadata.OcspStaple
+}
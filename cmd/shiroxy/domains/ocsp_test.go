@@ -0,0 +1,229 @@
+package domains
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"shiroxy/pkg/models"
+)
+
+// fakeOCSPResponder signs OCSP responses for certificates issued by a test CA.
+type fakeOCSPResponder struct {
+	server    *httptest.Server
+	issuer    *x509.Certificate
+	issuerKey crypto.Signer
+	mu        sync.Mutex
+	status    int
+	requests  int
+}
+
+func startFakeOCSPResponder(t *testing.T) *fakeOCSPResponder {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	issuer, _ := x509.ParseCertificate(der)
+
+	responder := &fakeOCSPResponder{issuer: issuer, issuerKey: key, status: ocsp.Good}
+	responder.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		responder.mu.Lock()
+		responder.requests++
+		status := responder.status
+		responder.mu.Unlock()
+
+		now := time.Now()
+		response, err := ocsp.CreateResponse(issuer, issuer, ocsp.Response{
+			Status:       status,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   now.Add(-time.Hour),
+			NextUpdate:   now.Add(47 * time.Hour),
+			RevokedAt:    now.Add(-time.Minute),
+		}, key)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		_, _ = w.Write(response)
+	}))
+	t.Cleanup(responder.server.Close)
+	return responder
+}
+
+func (f *fakeOCSPResponder) requestCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// issue creates a leaf for domain signed by the responder's CA, with the chain in PEM.
+func (f *fakeOCSPResponder) issue(t *testing.T, domain string) *DomainMetadata {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+		OCSPServer:   []string{f.server.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.issuer, &key.PublicKey, f.issuerKey)
+	if err != nil {
+		t.Fatalf("create leaf: %v", err)
+	}
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	chain := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	chain = append(chain, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.issuer.Raw})...)
+	return &DomainMetadata{
+		Domain:       domain,
+		Status:       "active",
+		CertPemBlock: chain,
+		KeyPemBlock:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func TestOCSPManager_StaplesGoodResponses(t *testing.T) {
+	responder := startFakeOCSPResponder(t)
+	st := newTestIssuanceStorage()
+	st.Domains().Put(responder.issue(t, "example.com"))
+	manager := NewOCSPManager(st, models.OCSP{}, nil)
+
+	now := time.Now()
+	manager.RefreshStaples(now)
+	if responder.requestCount() != 1 {
+		t.Fatalf("expected one OCSP request, got %d", responder.requestCount())
+	}
+	domainMetadata := registeredDomain(st, "example.com")
+	if len(domainMetadata.OcspStaple) == 0 {
+		t.Fatalf("expected OCSP response to be stored with the domain")
+	}
+
+	certificate, err := st.CachedCertificate(domainMetadata)
+	if err != nil {
+		t.Fatalf("cached certificate: %v", err)
+	}
+	if len(certificate.OCSPStaple) == 0 {
+		t.Fatalf("expected the OCSP response to be stapled")
+	}
+
+	manager.RefreshStaples(now.Add(time.Hour))
+	if responder.requestCount() != 1 {
+		t.Fatalf("expected a fresh staple not to be refetched")
+	}
+	manager.RefreshStaples(now.Add(24 * time.Hour))
+	if responder.requestCount() != 2 {
+		t.Fatalf("expected the staple to be refreshed halfway to NextUpdate")
+	}
+}
+
+func TestOCSPManager_RevokedCertificateIsReissued(t *testing.T) {
+	responder := startFakeOCSPResponder(t)
+	responder.status = ocsp.Revoked
+
+	st := newTestIssuanceStorage()
+	st.Domains().Put(responder.issue(t, "example.com"))
+	reissued := 0
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		reissued++
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	recorder := &eventRecorder{}
+	manager := NewOCSPManager(st, models.OCSP{}, recorder.notify)
+
+	manager.RefreshStaples(time.Now())
+	if reissued != 1 {
+		t.Fatalf("expected a revoked certificate to be reissued, got %d issuances", reissued)
+	}
+	events := recorder.list()
+	if len(events) != 1 || events[0].name != EventCertificateRevoked || events[0].data["domain"] != "example.com" {
+		t.Fatalf("unexpected webhook events: %+v", events)
+	}
+	if len(registeredDomain(st, "example.com").OcspStaple) != 0 {
+		t.Fatalf("expected no staple to be kept for a revoked certificate")
+	}
+}
+
+func TestMustStapleExtension(t *testing.T) {
+	var features []int
+	if _, err := asn1.Unmarshal(mustStapleExtension.Value, &features); err != nil {
+		t.Fatalf("unmarshal tls feature: %v", err)
+	}
+	if len(features) != 1 || features[0] != 5 {
+		t.Fatalf("expected status_request feature, got %v", features)
+	}
+}
+
+func TestOCSPManager_RevokedCertificateRetriedAfterFailure(t *testing.T) {
+	responder := startFakeOCSPResponder(t)
+	responder.status = ocsp.Revoked
+
+	st := newTestIssuanceStorage()
+	st.Domains().Put(responder.issue(t, "example.com"))
+	attempts := 0
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		attempts++
+		if attempts == 1 {
+			return nil, errors.New("ca unavailable")
+		}
+		return testCertificate(t, domainMetadata.Domain, time.Now(), time.Now().Add(90*24*time.Hour)), nil
+	}
+	var events []string
+	manager := NewOCSPManager(st, models.OCSP{}, func(eventName string, data interface{}) {
+		events = append(events, eventName)
+	})
+
+	now := time.Now()
+	manager.RefreshStaples(now)
+	if attempts != 1 {
+		t.Fatalf("expected a reissue to be attempted, got %d attempts", attempts)
+	}
+	manager.RefreshStaples(now.Add(time.Minute))
+	if attempts != 2 {
+		t.Fatalf("expected the failed reissue to be retried, got %d attempts", attempts)
+	}
+	if len(events) != 1 || events[0] != EventCertificateRevoked {
+		t.Fatalf("expected the revocation to be reported once, got %v", events)
+	}
+	if domainMetadata := registeredDomain(st, "example.com"); domainMetadata.Status != "active" || len(domainMetadata.History) != 2 {
+		t.Fatalf("expected the certificate to be replaced, got %+v", domainMetadata.History)
+	}
+}
@@ -0,0 +1,376 @@
+package domains
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventDomainOnDemand is fired when on-demand TLS registers an approved hostname.
+const EventDomainOnDemand = "domain.on_demand"
+
+// On-demand TLS defaults used when the configuration leaves a value unset.
+const (
+	defaultOnDemandRateLimit     = 10
+	defaultOnDemandAskRateLimit  = 60
+	defaultOnDemandRetryInterval = 10 * time.Minute
+	onDemandRateLimitWindow      = time.Minute
+	onDemandAskTimeout           = 10 * time.Second
+)
+
+var (
+	// ErrOnDemandDenied is returned for hostnames neither allowlisted nor approved by the ask URL.
+	ErrOnDemandDenied = errors.New("on-demand tls: hostname not approved")
+	// ErrOnDemandRateLimited is returned when too many hostnames were approved, or sent to
+	// the ask URL, in the last minute.
+	ErrOnDemandRateLimited = errors.New("on-demand tls: rate limit exceeded")
+)
+
+// OnDemandTLS registers unknown hostnames the first time they are seen in a TLS
+// handshake, once they are approved by the allowlist or the ask URL. Handshakes
+// are answered with a default certificate until the certificate is issued.
+type OnDemandTLS struct {
+	storage            *Storage
+	notify             func(eventName string, data interface{})
+	askURL             *url.URL
+	allowlist          []string
+	email              string
+	issuer             string
+	rateLimit          int
+	askRateLimit       int
+	retryInterval      time.Duration
+	client             *http.Client
+	defaultCertificate *tls.Certificate
+
+	lock     sync.Mutex
+	pending  map[string]bool      // Hostnames being approved, registered or retried.
+	denied   map[string]time.Time // Hostnames not approved, until they may be asked about again.
+	admitted []time.Time          // Approvals within the last rate limit window.
+	asked    []time.Time          // Ask URL requests within the last rate limit window.
+}
+
+// NewOnDemandTLS creates an on-demand TLS manager for storage without attaching it.
+// Parameters:
+//   - storage: *Storage, the storage hostnames are registered in.
+//   - config: models.OnDemandTLS, on-demand TLS configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//
+// Returns:
+//   - *OnDemandTLS: the on-demand TLS manager.
+//   - error: error if neither an ask URL nor an allowlist is configured, or the default certificate cannot be loaded.
+func NewOnDemandTLS(storage *Storage, config models.OnDemandTLS, notify func(eventName string, data interface{})) (*OnDemandTLS, error) {
+	if config.AskUrl == "" && len(config.Allowlist) == 0 {
+		// Without a gate every SNI would trigger an order.
+		return nil, errors.New("on-demand tls: askurl or allowlist is required")
+	}
+	if err := storage.ValidateIssuer(config.Issuer); err != nil {
+		return nil, fmt.Errorf("on-demand tls: %v", err)
+	}
+
+	manager := &OnDemandTLS{
+		storage:       storage,
+		notify:        notify,
+		email:         config.Email,
+		issuer:        config.Issuer,
+		rateLimit:     config.RateLimit,
+		askRateLimit:  config.AskRateLimit,
+		retryInterval: time.Duration(config.RetryInterval) * time.Second,
+		client:        &http.Client{Timeout: onDemandAskTimeout},
+		pending:       make(map[string]bool),
+		denied:        make(map[string]time.Time),
+	}
+	if manager.rateLimit <= 0 {
+		manager.rateLimit = defaultOnDemandRateLimit
+	}
+	if manager.askRateLimit <= 0 {
+		manager.askRateLimit = defaultOnDemandAskRateLimit
+	}
+	if manager.retryInterval <= 0 {
+		manager.retryInterval = defaultOnDemandRetryInterval
+	}
+	for _, pattern := range config.Allowlist {
+		manager.allowlist = append(manager.allowlist, strings.ToLower(strings.TrimSpace(pattern)))
+	}
+	if config.AskUrl != "" {
+		askURL, err := url.Parse(config.AskUrl)
+		if err != nil || (askURL.Scheme != "http" && askURL.Scheme != "https") || askURL.Host == "" {
+			return nil, fmt.Errorf("on-demand tls: invalid askurl %q", config.AskUrl)
+		}
+		manager.askURL = askURL
+	}
+
+	var err error
+	if config.DefaultCert != "" || config.DefaultKey != "" {
+		var certificate tls.Certificate
+		certificate, err = tls.LoadX509KeyPair(config.DefaultCert, config.DefaultKey)
+		manager.defaultCertificate = &certificate
+	} else {
+		manager.defaultCertificate, err = selfSignedCertificate("shiroxy default certificate", time.Now())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("on-demand tls: default certificate: %v", err)
+	}
+	return manager, nil
+}
+
+// StartOnDemandTLS creates an on-demand TLS manager and attaches it to storage.
+// Parameters:
+//   - storage: *Storage, the storage hostnames are registered in.
+//   - config: models.OnDemandTLS, on-demand TLS configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//
+// Returns:
+//   - *OnDemandTLS: the on-demand TLS manager, or nil if on-demand TLS is disabled.
+//   - error: error if the configuration is invalid.
+func StartOnDemandTLS(storage *Storage, config models.OnDemandTLS, notify func(eventName string, data interface{})) (*OnDemandTLS, error) {
+	if !config.Enable {
+		return nil, nil
+	}
+	manager, err := NewOnDemandTLS(storage, config, notify)
+	if err != nil {
+		return nil, err
+	}
+	storage.OnDemand = manager
+	return manager, nil
+}
+
+// Certificate returns the certificate for a hostname that has no active domain.
+// Unknown hostnames are approved and registered in the background, and every
+// handshake gets the default certificate until the certificate is issued.
+// Parameters:
+//   - serverName: string, the SNI of the handshake.
+//
+// Returns:
+//   - *tls.Certificate: the domain's certificate, or the default certificate while issuance is pending.
+//   - error: error if the hostname is invalid, deactivated, not approved or rate limited.
+func (o *OnDemandTLS) Certificate(serverName string) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(serverName), "."))
+	if name == "" {
+		return nil, errors.New("on-demand tls: no server name")
+	}
+
+	if domainMetadata, ok := o.storage.ResolveDomain(name); ok {
+		if domainMetadata.Status == "active" {
+			return o.storage.CachedCertificate(domainMetadata)
+		}
+		if !domainMetadata.OnDemand {
+			return nil, errors.New("routing deactivated")
+		}
+		if order := domainMetadata.GetOrder(); order != nil && order.State == OrderFailed &&
+			time.Since(time.Unix(order.UpdatedAt, 0)) >= o.retryInterval {
+			o.retry(domainMetadata.Domain)
+		}
+		return o.defaultCertificate, nil
+	}
+
+	if strings.HasPrefix(name, "*") || ValidateDomainName(name) != nil {
+		return nil, fmt.Errorf("on-demand tls: invalid server name %q", name)
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	// Concurrent handshakes for the same name share a single approval and order.
+	if o.pending[name] {
+		return o.defaultCertificate, nil
+	}
+	if _, ok := o.storage.ResolveDomain(name); ok {
+		// Registered by a handshake that finished since the lookup above.
+		return o.defaultCertificate, nil
+	}
+	now := time.Now()
+	if until, ok := o.denied[name]; ok {
+		if now.Before(until) {
+			return nil, ErrOnDemandDenied
+		}
+		delete(o.denied, name)
+	}
+	// Only approved hostnames count against the rate limit, so names the ask URL
+	// rejects cannot use up the orders of legitimate ones. Asking has a separate,
+	// larger budget.
+	allowlisted := o.allowlisted(name)
+	if !allowlisted {
+		if o.askURL == nil {
+			return nil, ErrOnDemandDenied
+		}
+		if !o.admit(&o.asked, o.askRateLimit, now) {
+			return nil, ErrOnDemandRateLimited
+		}
+	} else if !o.admit(&o.admitted, o.rateLimit, now) {
+		return nil, ErrOnDemandRateLimited
+	}
+
+	o.pending[name] = true
+	go o.register(name, !allowlisted)
+	return o.defaultCertificate, nil
+}
+
+// retry requests a new certificate for a domain registered on demand whose order
+// failed, counting against the rate limit.
+func (o *OnDemandTLS) retry(domainName string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	if o.pending[domainName] || !o.admit(&o.admitted, o.rateLimit, time.Now()) {
+		return
+	}
+	o.pending[domainName] = true
+	go func() {
+		// A failure is recorded on the order and retried after the next interval.
+		o.storage.ForceSSL(domainName)
+		o.done(domainName)
+	}()
+}
+
+// register registers a hostname, requesting its certificate. Hostnames that are not
+// allowlisted are first sent to the ask URL: those it rejects are denied for the
+// retry interval, and approved ones are only registered within the rate limit.
+// Parameters:
+//   - name: string, the hostname.
+//   - ask: bool, whether the hostname still needs the approval of the ask URL.
+func (o *OnDemandTLS) register(name string, ask bool) {
+	defer o.done(name)
+
+	if ask {
+		if !o.ask(name) {
+			o.deny(name)
+			return
+		}
+		if !o.admitApproved() {
+			// Asked about again on a later handshake.
+			return
+		}
+	}
+
+	_, err := o.storage.Register(DomainRegistration{
+		Domain:   name,
+		Email:    o.email,
+		Issuer:   o.issuer,
+		OnDemand: true,
+	})
+	if err != nil {
+		if _, getErr := o.storage.getDomainMetadata(name); getErr != nil {
+			// Not stored (for example an alias conflict); a failed order is retried instead.
+			o.deny(name)
+			return
+		}
+	}
+	if o.notify != nil {
+		o.notify(EventDomainOnDemand, map[string]string{
+			"domain": name,
+		})
+	}
+}
+
+// ask reports whether the ask URL approves a hostname.
+func (o *OnDemandTLS) ask(name string) bool {
+	askURL := *o.askURL
+	query := askURL.Query()
+	query.Set("domain", name)
+	askURL.RawQuery = query.Encode()
+
+	response, err := o.client.Get(askURL.String())
+	if err != nil {
+		return false
+	}
+	response.Body.Close()
+	return response.StatusCode == http.StatusOK
+}
+
+// allowlisted reports whether name matches the allowlist; "*.example.com" matches a single label.
+func (o *OnDemandTLS) allowlisted(name string) bool {
+	for _, pattern := range o.allowlist {
+		if pattern == name {
+			return true
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			if dot := strings.IndexByte(name, '.'); dot > 0 && name[dot:] == pattern[1:] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// admit records an event at now in window if fewer than limit happened within the
+// last rate limit window. Callers hold lock.
+func (o *OnDemandTLS) admit(window *[]time.Time, limit int, now time.Time) bool {
+	recent := (*window)[:0]
+	for _, admitted := range *window {
+		if now.Sub(admitted) < onDemandRateLimitWindow {
+			recent = append(recent, admitted)
+		}
+	}
+	*window = recent
+	if len(recent) >= limit {
+		return false
+	}
+	*window = append(recent, now)
+	return true
+}
+
+// admitApproved counts a hostname approved by the ask URL against the rate limit.
+func (o *OnDemandTLS) admitApproved() bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	return o.admit(&o.admitted, o.rateLimit, time.Now())
+}
+
+// deny rejects name until the retry interval has passed.
+func (o *OnDemandTLS) deny(name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	o.denied[name] = time.Now().Add(o.retryInterval)
+}
+
+// done clears the pending state of name.
+func (o *OnDemandTLS) done(name string) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+	delete(o.pending, name)
+}
+
+// selfSignedCertificate creates a self-signed certificate served when no better certificate exists.
+// Parameters:
+//   - commonName: string, the subject common name.
+//   - now: time.Time, the start of the certificate's validity.
+//
+// Returns:
+//   - *tls.Certificate: the certificate and its key.
+//   - error: error if the key or certificate cannot be generated.
+func selfSignedCertificate(commonName string, now time.Time) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{certDER}, PrivateKey: key, Leaf: leaf}, nil
+}
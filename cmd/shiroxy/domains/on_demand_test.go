@@ -0,0 +1,205 @@
+package domains
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"shiroxy/pkg/models"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newOnDemandTestStorage returns a storage whose orders are signed by a local CA
+// once release is closed, counting the orders placed.
+func newOnDemandTestStorage(t *testing.T) (*Storage, chan struct{}, *int32) {
+	t.Helper()
+	ca, err := LoadOrCreateLocalCA(t.TempDir(), 0)
+	if err != nil {
+		t.Fatalf("local ca: %v", err)
+	}
+	st := newTestIssuanceStorage()
+	release := make(chan struct{})
+	var orders int32
+	st.obtain = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		atomic.AddInt32(&orders, 1)
+		<-release
+		return ca.issue(domainMetadata.Names(), time.Now())
+	}
+	return st, release, &orders
+}
+
+// waitForActive polls until domainName has an active certificate.
+func waitForActive(t *testing.T, st *Storage, domainName string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if domainMetadata, err := st.getDomainMetadata(domainName); err == nil && domainMetadata.Status == "active" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s never became active", domainName)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestOnDemandTLS_DeduplicatesHandshakes(t *testing.T) {
+	st, release, orders := newOnDemandTestStorage(t)
+	manager, err := NewOnDemandTLS(st, models.OnDemandTLS{Allowlist: []string{"*.customers.test"}, Email: "ops@example.com"}, nil)
+	if err != nil {
+		t.Fatalf("new on-demand tls: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	certificates := make([]*tls.Certificate, 20)
+	for i := range certificates {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			certificates[i], _ = manager.Certificate("Shop.Customers.test.")
+		}(i)
+	}
+	wg.Wait()
+	for _, certificate := range certificates {
+		if certificate != manager.defaultCertificate {
+			t.Fatalf("expected the default certificate while issuance is pending")
+		}
+	}
+
+	close(release)
+	waitForActive(t, st, "shop.customers.test")
+	if n := atomic.LoadInt32(orders); n != 1 {
+		t.Fatalf("expected a single order, got %d", n)
+	}
+	domainMetadata, _ := st.getDomainMetadata("shop.customers.test")
+	if !domainMetadata.OnDemand || domainMetadata.Email != "ops@example.com" {
+		t.Fatalf("unexpected on-demand domain: %+v", domainMetadata)
+	}
+
+	certificate, err := manager.Certificate("shop.customers.test")
+	if err != nil || certificate == manager.defaultCertificate || certificate.Leaf.DNSNames[0] != "shop.customers.test" {
+		t.Fatalf("expected the issued certificate, got %v", err)
+	}
+
+	for _, name := range []string{"customers.test", "a.b.customers.test", "other.test"} {
+		if _, err := manager.Certificate(name); !errors.Is(err, ErrOnDemandDenied) {
+			t.Fatalf("expected %s to be denied, got %v", name, err)
+		}
+	}
+}
+
+func TestOnDemandTLS_AskURL(t *testing.T) {
+	var asks int32
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&asks, 1)
+		if r.URL.Query().Get("domain") != "approved.test" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ask.Close()
+
+	st, release, orders := newOnDemandTestStorage(t)
+	close(release)
+	manager, err := NewOnDemandTLS(st, models.OnDemandTLS{AskUrl: ask.URL + "/ask?token=secret"}, nil)
+	if err != nil {
+		t.Fatalf("new on-demand tls: %v", err)
+	}
+
+	if _, err := manager.Certificate("approved.test"); err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	waitForActive(t, st, "approved.test")
+
+	if _, err := manager.Certificate("rejected.test"); err != nil {
+		t.Fatalf("expected the default certificate while asking, got %v", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := manager.Certificate("rejected.test"); errors.Is(err, ErrOnDemandDenied) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("rejected.test was never denied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&asks); n != 2 {
+		t.Fatalf("expected denials to be cached, got %d asks", n)
+	}
+	if _, err := st.getDomainMetadata("rejected.test"); err == nil || atomic.LoadInt32(orders) != 1 {
+		t.Fatalf("expected the rejected hostname not to be registered")
+	}
+}
+
+func TestOnDemandTLS_RateLimit(t *testing.T) {
+	st, release, _ := newOnDemandTestStorage(t)
+	defer close(release)
+	manager, err := NewOnDemandTLS(st, models.OnDemandTLS{Allowlist: []string{"*.customers.test"}, RateLimit: 1}, nil)
+	if err != nil {
+		t.Fatalf("new on-demand tls: %v", err)
+	}
+
+	if _, err := manager.Certificate("a.customers.test"); err != nil {
+		t.Fatalf("certificate: %v", err)
+	}
+	if _, err := manager.Certificate("b.customers.test"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Fatalf("expected the second hostname to be rate limited, got %v", err)
+	}
+}
+
+func TestOnDemandTLS_DeniedNamesDoNotUseRateLimit(t *testing.T) {
+	ask := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("domain") != "approved.test" {
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ask.Close()
+
+	st, release, _ := newOnDemandTestStorage(t)
+	close(release)
+	manager, err := NewOnDemandTLS(st, models.OnDemandTLS{AskUrl: ask.URL, RateLimit: 1, AskRateLimit: 11}, nil)
+	if err != nil {
+		t.Fatalf("new on-demand tls: %v", err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if _, err := manager.Certificate(fmt.Sprintf("random-%d.test", i)); err != nil {
+			t.Fatalf("expected the default certificate while asking, got %v", err)
+		}
+	}
+	denied := func() int {
+		manager.lock.Lock()
+		defer manager.lock.Unlock()
+		return len(manager.denied)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for denied() < 10 {
+		if time.Now().After(deadline) {
+			t.Fatalf("the ask URL never rejected the random hostnames")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, err := manager.Certificate("approved.test"); err != nil {
+		t.Fatalf("expected rejected hostnames not to use the issuance budget, got %v", err)
+	}
+	waitForActive(t, st, "approved.test")
+
+	// The ask budget is exhausted now.
+	if _, err := manager.Certificate("another.test"); !errors.Is(err, ErrOnDemandRateLimited) {
+		t.Fatalf("expected asking to be rate limited, got %v", err)
+	}
+}
+
+func TestOnDemandTLS_RequiresGate(t *testing.T) {
+	if _, err := NewOnDemandTLS(newTestIssuanceStorage(), models.OnDemandTLS{Enable: true}, nil); err == nil {
+		t.Fatalf("expected on-demand tls without askurl or allowlist to be rejected")
+	}
+	if _, err := NewOnDemandTLS(newTestIssuanceStorage(), models.OnDemandTLS{AskUrl: "ask.example.com"}, nil); err == nil {
+		t.Fatalf("expected an invalid askurl to be rejected")
+	}
+}
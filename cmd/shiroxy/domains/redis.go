@@ -0,0 +1,422 @@
+package domains
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"shiroxy/pkg/logger"
+	"shiroxy/pkg/models"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Redis connection modes.
+const (
+	RedisStandalone = "standalone"
+	RedisSentinel   = "sentinel"
+	RedisCluster    = "cluster"
+)
+
+// Redis defaults used when the configuration leaves a value unset.
+const (
+	defaultRedisConnectTimeout      = 30 * time.Second
+	defaultRedisHealthCheckInterval = 10 * time.Second
+	// Bounds of the backoff between connection attempts and health probes
+	// while Redis cannot be reached.
+	redisMinReconnectBackoff = 250 * time.Millisecond
+	redisMaxReconnectBackoff = 5 * time.Second
+)
+
+// Redis health states reported by RedisHealth.
+const (
+	RedisUp   = "up"
+	RedisDown = "down"
+	// Redis answers again, but reloading the domains after the outage failed, so
+	// changes made by other instances in between may be missing.
+	RedisDegraded = "degraded"
+)
+
+// RedisHealth reports the state of the Redis connection.
+type RedisHealth struct {
+	Status      string    `json:"status"`          // RedisUp, RedisDown or RedisDegraded.
+	Mode        string    `json:"mode"`            // Connection mode.
+	Latency     float64   `json:"latency_ms"`      // Round trip of the last probe in milliseconds.
+	Error       string    `json:"error,omitempty"` // Error of the last probe while down, or of the reload while degraded.
+	Since       time.Time `json:"since"`           // Time of the last status change.
+	CheckedAt   time.Time `json:"checked_at"`      // Time of the last probe.
+	Connections uint32    `json:"connections"`     // Open pooled connections.
+	Idle        uint32    `json:"idle"`            // Idle pooled connections.
+	Timeouts    uint32    `json:"timeouts"`        // Waits for a pooled connection that timed out.
+}
+
+// redisMonitor probes the Redis connection of a storage.
+type redisMonitor struct {
+	lock   sync.RWMutex
+	health RedisHealth
+}
+
+// connectRedis connects to the Redis deployment described by config, retrying
+// with backoff until it answers or the connect timeout passes.
+// Parameters:
+//   - config: *models.Storage, the storage configuration.
+//   - logHandler: *logger.Logger, logs failed attempts; nil discards them.
+//
+// Returns:
+//   - redis.UniversalClient: the connected client.
+//   - error: error if the configuration is invalid or Redis cannot be reached.
+func connectRedis(config *models.Storage, logHandler *logger.Logger) (redis.UniversalClient, error) {
+	options, err := redisOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	client := newRedisClient(config.Redis.Mode, options)
+
+	timeout := defaultRedisConnectTimeout
+	if config.Redis.ConnectTimeout > 0 {
+		timeout = time.Duration(config.Redis.ConnectTimeout) * time.Second
+	}
+	if err := waitForRedis(client, timeout, logHandler); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("connecting to redis: %v", err)
+	}
+	return client, nil
+}
+
+// redisOptions converts the storage configuration to go-redis options.
+// Parameters:
+//   - config: *models.Storage, the storage configuration.
+//
+// Returns:
+//   - *redis.UniversalOptions: the connection options.
+//   - error: error if the configuration is incomplete or a TLS file cannot be read.
+func redisOptions(config *models.Storage) (*redis.UniversalOptions, error) {
+	settings := config.Redis
+	options := &redis.UniversalOptions{
+		Addrs:            settings.Addrs,
+		DB:               settings.DB,
+		Username:         settings.Username,
+		Password:         config.RedisPassword,
+		MasterName:       settings.MasterName,
+		SentinelUsername: settings.SentinelUsername,
+		SentinelPassword: settings.SentinelPassword,
+		PoolSize:         settings.PoolSize,
+		MinIdleConns:     settings.MinIdleConns,
+		MaxRetries:       settings.MaxRetries,
+		MinRetryBackoff:  time.Duration(settings.MinRetryBackoff) * time.Millisecond,
+		MaxRetryBackoff:  time.Duration(settings.MaxRetryBackoff) * time.Millisecond,
+		DialTimeout:      time.Duration(settings.DialTimeout) * time.Second,
+		ReadTimeout:      time.Duration(settings.ReadTimeout) * time.Second,
+		WriteTimeout:     time.Duration(settings.WriteTimeout) * time.Second,
+		PoolTimeout:      time.Duration(settings.PoolTimeout) * time.Second,
+	}
+
+	switch settings.Mode {
+	case "", RedisStandalone:
+		if config.RedisConnectionString != "" {
+			parsed, err := redis.ParseURL(config.RedisConnectionString)
+			if err != nil {
+				return nil, fmt.Errorf("parsing redisconnectionstring: %v", err)
+			}
+			options.Addrs = []string{parsed.Addr}
+			options.TLSConfig = parsed.TLSConfig
+			// Settings of the connection string apply unless configured separately.
+			if options.Username == "" {
+				options.Username = parsed.Username
+			}
+			if options.Password == "" {
+				options.Password = parsed.Password
+			}
+			if options.DB == 0 {
+				options.DB = parsed.DB
+			}
+		} else if len(options.Addrs) == 0 {
+			host, port := config.RedisHost, config.RedisPort
+			if host == "" {
+				host = "127.0.0.1"
+			}
+			if port == "" {
+				port = "6379"
+			}
+			options.Addrs = []string{net.JoinHostPort(host, port)}
+		}
+		if len(options.Addrs) != 1 {
+			return nil, errors.New("standalone redis takes a single address; use the sentinel or cluster mode for several")
+		}
+	case RedisSentinel:
+		if options.MasterName == "" || len(options.Addrs) == 0 {
+			return nil, errors.New("sentinel redis requires mastername and the addrs of the sentinels")
+		}
+	case RedisCluster:
+		if len(options.Addrs) == 0 {
+			return nil, errors.New("cluster redis requires the addrs of seed nodes")
+		}
+		if options.DB != 0 {
+			return nil, errors.New("cluster redis only has database 0")
+		}
+	default:
+		return nil, fmt.Errorf("unknown redis mode %q", settings.Mode)
+	}
+
+	if settings.TLS.Enable {
+		tlsConfig, err := redisTLSConfig(settings.TLS, options.TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		options.TLSConfig = tlsConfig
+	}
+	return options, nil
+}
+
+// redisTLSConfig builds the client TLS configuration for Redis on top of the
+// one of a rediss:// connection string, which may be nil.
+func redisTLSConfig(settings models.RedisTLS, base *tls.Config) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+	if settings.ServerName != "" {
+		tlsConfig.ServerName = settings.ServerName
+	}
+	tlsConfig.InsecureSkipVerify = settings.InsecureSkipVerify
+
+	if settings.CAFile != "" {
+		bundle, err := os.ReadFile(settings.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if tlsConfig.RootCAs, err = ParseCertificatePool(bundle); err != nil {
+			return nil, fmt.Errorf("%s: %v", settings.CAFile, err)
+		}
+	}
+	if settings.CertFile != "" || settings.KeyFile != "" {
+		if settings.CertFile == "" || settings.KeyFile == "" {
+			return nil, errors.New("both certfile and keyfile are required for a redis client certificate")
+		}
+		certificate, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
+
+// newRedisClient creates the client of a connection mode.
+func newRedisClient(mode string, options *redis.UniversalOptions) redis.UniversalClient {
+	switch mode {
+	case RedisSentinel:
+		return redis.NewFailoverClient(options.Failover())
+	case RedisCluster:
+		return redis.NewClusterClient(options.Cluster())
+	default:
+		return redis.NewClient(options.Simple())
+	}
+}
+
+// waitForRedis pings client until it answers, doubling the wait between
+// attempts up to redisMaxReconnectBackoff.
+// Parameters:
+//   - client: redis.UniversalClient, the client to ping.
+//   - timeout: time.Duration, how long to keep trying.
+//   - logHandler: *logger.Logger, logs failed attempts; nil discards them.
+//
+// Returns:
+//   - error: the error of the last attempt if Redis never answered.
+func waitForRedis(client redis.UniversalClient, timeout time.Duration, logHandler *logger.Logger) error {
+	deadline := time.Now().Add(timeout)
+	backoff := redisMinReconnectBackoff
+	for {
+		err := client.Ping(context.Background()).Err()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		if logHandler != nil {
+			logHandler.LogWarning(fmt.Sprintf("%v; retrying in %s", err, backoff), "Storage", "Redis")
+		}
+		time.Sleep(backoff)
+		backoff = min(backoff*2, redisMaxReconnectBackoff)
+	}
+}
+
+// scanKeys returns the keys matching pattern, scanning every master of a Redis Cluster.
+// Parameters:
+//   - ctx: context.Context, bounds the scan.
+//   - client: redis.UniversalClient, the client to scan with.
+//   - pattern: string, the key pattern.
+//
+// Returns:
+//   - []string: the matching keys.
+//   - error: error if a scan fails.
+func scanKeys(ctx context.Context, client redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return scanNode(ctx, client, pattern)
+	}
+
+	var lock sync.Mutex
+	var keys []string
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		nodeKeys, err := scanNode(ctx, node, pattern)
+		lock.Lock()
+		keys = append(keys, nodeKeys...)
+		lock.Unlock()
+		return err
+	})
+	return keys, err
+}
+
+// scanNode returns the keys of a single node matching pattern.
+func scanNode(ctx context.Context, client redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	iter := client.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	return keys, iter.Err()
+}
+
+// monitorRedis probes the Redis connection every health check interval until
+// Close is called. While Redis is down the probes back off from
+// redisMinReconnectBackoff; once it answers again the domains are reloaded,
+// as the change notifications published in between were lost. Until a reload
+// succeeds the health is degraded and the reload is retried after every probe.
+// Parameters:
+//   - wg: *sync.WaitGroup, used for synchronization.
+func (s *Storage) monitorRedis(wg *sync.WaitGroup) {
+	interval := defaultRedisHealthCheckInterval
+	if s.Storage.Redis.HealthCheckInterval > 0 {
+		interval = time.Duration(s.Storage.Redis.HealthCheckInterval) * time.Second
+	}
+	mode := s.Storage.Redis.Mode
+	if mode == "" {
+		mode = RedisStandalone
+	}
+	now := time.Now()
+	s.redisMonitor = &redisMonitor{health: RedisHealth{Status: RedisUp, Mode: mode, Since: now, CheckedAt: now}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopMonitor = cancel
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		backoff := redisMinReconnectBackoff
+		wait := interval
+		for {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			if s.checkRedis(ctx) {
+				backoff, wait = redisMinReconnectBackoff, interval
+				continue
+			}
+			wait = min(backoff, interval)
+			backoff = min(backoff*2, redisMaxReconnectBackoff)
+		}
+	}()
+}
+
+// checkRedis probes Redis and reloads the domains when it answers after being
+// down or while degraded.
+// Parameters:
+//   - ctx: context.Context, bounds the ping.
+//
+// Returns:
+//   - bool: true if Redis answered.
+func (s *Storage) checkRedis(ctx context.Context) bool {
+	recovered, up := s.probeRedis(ctx)
+	if recovered {
+		s.setRedisDegraded(s.syncDomains())
+	}
+	return up
+}
+
+// probeRedis pings Redis and records the result.
+// Parameters:
+//   - ctx: context.Context, bounds the ping.
+//
+// Returns:
+//   - bool: true if Redis answered after being down or while degraded, so the domains need reloading.
+//   - bool: true if Redis answered.
+func (s *Storage) probeRedis(ctx context.Context) (bool, bool) {
+	started := time.Now()
+	err := s.RedisClient.Ping(ctx).Err()
+	if ctx.Err() != nil {
+		return false, false
+	}
+	latency := time.Since(started)
+	stats := s.RedisClient.PoolStats()
+
+	monitor := s.redisMonitor
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+	health := &monitor.health
+	previous := health.Status
+	health.CheckedAt = time.Now()
+	health.Latency = float64(latency.Microseconds()) / 1000
+	health.Connections, health.Idle, health.Timeouts = stats.TotalConns, stats.IdleConns, stats.Timeouts
+	if err != nil {
+		health.Status, health.Error = RedisDown, err.Error()
+	} else if previous != RedisDegraded {
+		// A degraded health only clears once the domains are reloaded.
+		health.Status, health.Error = RedisUp, ""
+	}
+	if health.Status != previous {
+		health.Since = health.CheckedAt
+		if s.Logger != nil && err != nil {
+			s.Logger.LogError(fmt.Sprintf("connection lost: %v", err), "Storage", "Redis")
+		} else if s.Logger != nil && previous == RedisDown {
+			s.Logger.LogSuccess("connection restored", "Storage", "Redis")
+		}
+	}
+	return previous != RedisUp && err == nil, err == nil
+}
+
+// setRedisDegraded records the result of reloading the domains after Redis
+// came back: the health is degraded while err is not nil.
+// Parameters:
+//   - err: error, the error of the reload, or nil if it succeeded.
+func (s *Storage) setRedisDegraded(err error) {
+	monitor := s.redisMonitor
+	monitor.lock.Lock()
+	defer monitor.lock.Unlock()
+	health := &monitor.health
+	if err != nil {
+		if health.Status != RedisDegraded {
+			health.Since = time.Now()
+		}
+		health.Status, health.Error = RedisDegraded, fmt.Sprintf("reloading domains: %v", err)
+		if s.Logger != nil {
+			s.Logger.LogError(fmt.Sprintf("reloading domains failed: %v", err), "Storage", "Redis")
+		}
+		return
+	}
+	if health.Status == RedisDegraded {
+		health.Status, health.Error, health.Since = RedisUp, "", time.Now()
+		if s.Logger != nil {
+			s.Logger.LogSuccess("domains reloaded", "Storage", "Redis")
+		}
+	}
+}
+
+// RedisHealth reports the state of the Redis connection as of the last probe.
+// Returns:
+//   - RedisHealth: the connection state.
+//   - bool: false if the storage does not use Redis.
+func (s *Storage) RedisHealth() (RedisHealth, bool) {
+	if s.redisMonitor == nil {
+		return RedisHealth{}, false
+	}
+	s.redisMonitor.lock.RLock()
+	defer s.redisMonitor.lock.RUnlock()
+	return s.redisMonitor.health, true
+}
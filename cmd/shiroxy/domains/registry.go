@@ -0,0 +1,291 @@
+package domains
+
+import (
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DomainRegistry holds the domains served by shiroxy. Readers work on immutable
+// snapshots without locking; writers copy the snapshot they change and publish
+// the copy atomically, so readers never observe a partially applied update.
+// Registered domains must be replaced, never modified in place.
+type DomainRegistry struct {
+	lock        sync.Mutex                     // Serializes writers and subscription changes.
+	current     atomic.Pointer[DomainSnapshot] // Latest published snapshot; nil means empty.
+	subscribers []*domainSubscriber            // Notified of every change, in order.
+}
+
+// domainSubscriber is a change callback registered with Subscribe.
+type domainSubscriber struct {
+	notify func(event DomainEvent)
+}
+
+// DomainSnapshot is an immutable view of the registered domains.
+type DomainSnapshot struct {
+	domains map[string]*DomainMetadata // Domains by name.
+	aliases map[string]string          // Lowercased hostname (domain or alias) to the domain serving it.
+}
+
+// emptyDomainSnapshot is returned by registries nothing was registered in yet.
+var emptyDomainSnapshot = &DomainSnapshot{}
+
+// NewDomainRegistry creates a registry holding domains.
+// Parameters:
+//   - domains: ...*DomainMetadata, the initially registered domains.
+//
+// Returns:
+//   - *DomainRegistry: the registry.
+func NewDomainRegistry(domains ...*DomainMetadata) *DomainRegistry {
+	registry := &DomainRegistry{}
+	registry.current.Store(newDomainSnapshot(domains))
+	return registry
+}
+
+// newDomainSnapshot builds a snapshot holding domains, skipping nil entries.
+func newDomainSnapshot(domains []*DomainMetadata) *DomainSnapshot {
+	snapshot := &DomainSnapshot{
+		domains: make(map[string]*DomainMetadata, len(domains)),
+		aliases: make(map[string]string),
+	}
+	for _, domainMetadata := range domains {
+		if domainMetadata != nil {
+			snapshot.index(snapshot.domains[domainMetadata.Domain], domainMetadata)
+			snapshot.domains[domainMetadata.Domain] = domainMetadata
+		}
+	}
+	return snapshot
+}
+
+// Snapshot returns the current domains. The snapshot never changes; later
+// updates are published as new snapshots.
+// Returns:
+//   - *DomainSnapshot: the current snapshot.
+func (r *DomainRegistry) Snapshot() *DomainSnapshot {
+	if snapshot := r.current.Load(); snapshot != nil {
+		return snapshot
+	}
+	return emptyDomainSnapshot
+}
+
+// Get returns a registered domain.
+// Parameters:
+//   - domainName: string, the domain to look up.
+//
+// Returns:
+//   - *DomainMetadata: the domain metadata.
+//   - bool: false if the domain is not registered.
+func (r *DomainRegistry) Get(domainName string) (*DomainMetadata, bool) {
+	return r.Snapshot().Get(domainName)
+}
+
+// Resolve returns the domain serving hostname; see DomainSnapshot.Resolve.
+func (r *DomainRegistry) Resolve(hostname string) (*DomainMetadata, bool) {
+	return r.Snapshot().Resolve(hostname)
+}
+
+// Put registers a domain, replacing any registered version.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain to register.
+func (r *DomainRegistry) Put(domainMetadata *DomainMetadata) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	snapshot := r.Snapshot().clone()
+	snapshot.index(snapshot.domains[domainMetadata.Domain], domainMetadata)
+	snapshot.domains[domainMetadata.Domain] = domainMetadata
+	r.current.Store(snapshot)
+	r.notify(DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+}
+
+// Delete unregisters a domain.
+// Parameters:
+//   - domainName: string, the domain to unregister.
+//
+// Returns:
+//   - bool: false if the domain was not registered.
+func (r *DomainRegistry) Delete(domainName string) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous, ok := r.Snapshot().domains[domainName]
+	if !ok {
+		return false
+	}
+	snapshot := r.Snapshot().clone()
+	snapshot.index(previous, nil)
+	delete(snapshot.domains, domainName)
+	r.current.Store(snapshot)
+	r.notify(DomainEvent{Type: DomainEventDelete, Domain: domainName})
+	return true
+}
+
+// Replace atomically swaps every registered domain for domains, for example
+// after loading them from the store. Subscribers are told about each domain
+// that was added, replaced or removed.
+// Parameters:
+//   - domains: []*DomainMetadata, the domains to register.
+func (r *DomainRegistry) Replace(domains []*DomainMetadata) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	previous := r.Snapshot()
+	snapshot := newDomainSnapshot(domains)
+	r.current.Store(snapshot)
+
+	for domainName := range previous.domains {
+		if _, ok := snapshot.domains[domainName]; !ok {
+			r.notify(DomainEvent{Type: DomainEventDelete, Domain: domainName})
+		}
+	}
+	for domainName, domainMetadata := range snapshot.domains {
+		if previous.domains[domainName] != domainMetadata {
+			r.notify(DomainEvent{Type: DomainEventPut, Domain: domainName})
+		}
+	}
+}
+
+// Subscribe calls notify after every change, in the order the changes were
+// made. notify runs while the registry is locked, so it must be quick and must
+// not change the registry.
+// Parameters:
+//   - notify: func(DomainEvent), called with each change.
+//
+// Returns:
+//   - func(): removes the subscription.
+func (r *DomainRegistry) Subscribe(notify func(event DomainEvent)) func() {
+	subscriber := &domainSubscriber{notify: notify}
+	r.lock.Lock()
+	r.subscribers = append(r.subscribers, subscriber)
+	r.lock.Unlock()
+
+	return func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		for i, existing := range r.subscribers {
+			if existing == subscriber {
+				r.subscribers = append(r.subscribers[:i:i], r.subscribers[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// notify reports event to every subscriber; callers hold lock.
+func (r *DomainRegistry) notify(event DomainEvent) {
+	for _, subscriber := range r.subscribers {
+		subscriber.notify(event)
+	}
+}
+
+// Get returns a domain of the snapshot.
+// Parameters:
+//   - domainName: string, the domain to look up.
+//
+// Returns:
+//   - *DomainMetadata: the domain metadata.
+//   - bool: false if the domain is not registered.
+func (s *DomainSnapshot) Get(domainName string) (*DomainMetadata, bool) {
+	domainMetadata, ok := s.domains[domainName]
+	return domainMetadata, ok
+}
+
+// Len returns the number of domains in the snapshot.
+func (s *DomainSnapshot) Len() int {
+	return len(s.domains)
+}
+
+// List returns the domains of the snapshot sorted by name.
+// Returns:
+//   - []*DomainMetadata: the domains.
+func (s *DomainSnapshot) List() []*DomainMetadata {
+	domains := make([]*DomainMetadata, 0, len(s.domains))
+	for _, domainMetadata := range s.domains {
+		domains = append(domains, domainMetadata)
+	}
+	sort.Slice(domains, func(i, j int) bool { return domains[i].Domain < domains[j].Domain })
+	return domains
+}
+
+// Resolve returns the domain serving a hostname. The hostname may be the
+// domain itself, one of its aliases, or a name covered by a wildcard domain or alias.
+// Parameters:
+//   - hostname: string, the hostname to resolve (SNI or Host header without port).
+//
+// Returns:
+//   - *DomainMetadata: the domain serving the hostname.
+//   - bool: false if no domain covers the hostname.
+func (s *DomainSnapshot) Resolve(hostname string) (*DomainMetadata, bool) {
+	hostname = strings.TrimSuffix(strings.TrimSpace(hostname), ".")
+	if hostname == "" {
+		return nil, false
+	}
+	if domainMetadata, ok := s.lookup(hostname); ok {
+		return domainMetadata, true
+	}
+
+	// A wildcard only covers a single label: "*.example.com" matches
+	// "www.example.com" but neither "example.com" nor "a.b.example.com".
+	if dot := strings.IndexByte(hostname, '.'); dot > 0 {
+		return s.lookup("*" + hostname[dot:])
+	}
+	return nil, false
+}
+
+// lookup finds the domain registered under or aliased as hostname.
+func (s *DomainSnapshot) lookup(hostname string) (*DomainMetadata, bool) {
+	if domainMetadata, ok := s.domains[hostname]; ok {
+		return domainMetadata, true
+	}
+	if domainName, ok := s.aliases[strings.ToLower(hostname)]; ok {
+		if domainMetadata, ok := s.domains[domainName]; ok {
+			return domainMetadata, true
+		}
+	}
+	return nil, false
+}
+
+// owner returns the domain serving name as its domain or one of its aliases.
+func (s *DomainSnapshot) owner(name string) (string, bool) {
+	if domainName, ok := s.aliases[strings.ToLower(name)]; ok {
+		return domainName, true
+	}
+	if domainMetadata, ok := s.domains[name]; ok {
+		return domainMetadata.Domain, true
+	}
+	return "", false
+}
+
+// clone copies the snapshot so a writer can change the copy.
+func (s *DomainSnapshot) clone() *DomainSnapshot {
+	snapshot := &DomainSnapshot{
+		domains: maps.Clone(s.domains),
+		aliases: maps.Clone(s.aliases),
+	}
+	if snapshot.domains == nil {
+		snapshot.domains = make(map[string]*DomainMetadata)
+	}
+	if snapshot.aliases == nil {
+		snapshot.aliases = make(map[string]string)
+	}
+	return snapshot
+}
+
+// index updates the hostname index of an unpublished snapshot when a domain is
+// replaced by updated. Either argument may be nil.
+func (s *DomainSnapshot) index(previous, updated *DomainMetadata) {
+	if previous != nil {
+		for _, name := range previous.Names() {
+			if s.aliases[strings.ToLower(name)] == previous.Domain {
+				delete(s.aliases, strings.ToLower(name))
+			}
+		}
+	}
+	if updated != nil {
+		for _, name := range updated.Names() {
+			s.aliases[strings.ToLower(name)] = updated.Domain
+		}
+	}
+}
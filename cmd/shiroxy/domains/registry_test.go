@@ -0,0 +1,139 @@
+package domains
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// registeredDomain returns the registered metadata of domainName, or nil.
+func registeredDomain(st *Storage, domainName string) *DomainMetadata {
+	domainMetadata, _ := st.Domains().Get(domainName)
+	return domainMetadata
+}
+
+func TestDomainRegistry_SnapshotsAreImmutable(t *testing.T) {
+	registry := NewDomainRegistry(&DomainMetadata{Domain: "a.example.com", Aliases: []string{"www.a.example.com"}})
+	before := registry.Snapshot()
+
+	registry.Put(&DomainMetadata{Domain: "b.example.com"})
+	registry.Put(&DomainMetadata{Domain: "a.example.com"})
+
+	if before.Len() != 1 {
+		t.Fatalf("expected the earlier snapshot to keep 1 domain, got %d", before.Len())
+	}
+	if _, ok := before.Resolve("www.a.example.com"); !ok {
+		t.Fatalf("expected the earlier snapshot to keep resolving the removed alias")
+	}
+	after := registry.Snapshot()
+	if after.Len() != 2 {
+		t.Fatalf("expected 2 domains, got %d", after.Len())
+	}
+	if _, ok := after.Resolve("www.a.example.com"); ok {
+		t.Fatalf("expected the replaced domain's alias to stop resolving")
+	}
+}
+
+func TestDomainRegistry_Replace(t *testing.T) {
+	kept := &DomainMetadata{Domain: "kept.example.com"}
+	registry := NewDomainRegistry(kept, &DomainMetadata{Domain: "removed.example.com"}, &DomainMetadata{Domain: "changed.example.com"})
+
+	var events []DomainEvent
+	registry.Subscribe(func(event DomainEvent) {
+		events = append(events, event)
+	})
+	registry.Replace([]*DomainMetadata{kept, {Domain: "changed.example.com", Status: "active"}, {Domain: "added.example.com"}})
+
+	var names []string
+	for _, domainMetadata := range registry.Snapshot().List() {
+		names = append(names, domainMetadata.Domain)
+	}
+	if !slices.Equal(names, []string{"added.example.com", "changed.example.com", "kept.example.com"}) {
+		t.Fatalf("unexpected domains after replace: %v", names)
+	}
+
+	slices.SortFunc(events, func(a, b DomainEvent) int {
+		if a.Domain < b.Domain {
+			return -1
+		}
+		return 1
+	})
+	expected := []DomainEvent{
+		{Type: DomainEventPut, Domain: "added.example.com"},
+		{Type: DomainEventPut, Domain: "changed.example.com"},
+		{Type: DomainEventDelete, Domain: "removed.example.com"},
+	}
+	if !slices.Equal(events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestDomainRegistry_Subscribe(t *testing.T) {
+	registry := NewDomainRegistry()
+	var events []DomainEvent
+	unsubscribe := registry.Subscribe(func(event DomainEvent) {
+		events = append(events, event)
+	})
+
+	registry.Put(&DomainMetadata{Domain: "example.com"})
+	if registry.Delete("missing.example.com") {
+		t.Fatalf("expected deleting an unknown domain to report false")
+	}
+	registry.Delete("example.com")
+	unsubscribe()
+	registry.Put(&DomainMetadata{Domain: "example.com"})
+
+	expected := []DomainEvent{{Type: DomainEventPut, Domain: "example.com"}, {Type: DomainEventDelete, Domain: "example.com"}}
+	if !slices.Equal(events, expected) {
+		t.Fatalf("expected events %v, got %v", expected, events)
+	}
+}
+
+func TestDomainRegistry_ConcurrentReadersAndWriters(t *testing.T) {
+	registry := NewDomainRegistry()
+	wg := sync.WaitGroup{}
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func(writer int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				domainName := fmt.Sprintf("d%d-%d.example.com", writer, i%10)
+				registry.Put(&DomainMetadata{Domain: domainName, Aliases: []string{"www." + domainName}})
+				registry.Delete(domainName)
+			}
+		}(writer)
+	}
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				snapshot := registry.Snapshot()
+				for _, domainMetadata := range snapshot.List() {
+					if _, ok := snapshot.Resolve("www." + domainMetadata.Domain); !ok {
+						t.Errorf("expected the alias of %s to resolve in the same snapshot", domainMetadata.Domain)
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStorageDomains_InvalidatesCertificates(t *testing.T) {
+	st := newTestIssuanceStorage()
+	st.certificates.entries = map[string]*cachedCertificate{
+		"example.com": {},
+		"other.com":   {},
+	}
+
+	st.Domains().Replace([]*DomainMetadata{{Domain: "example.com"}})
+	if _, ok := st.certificates.entries["example.com"]; ok {
+		t.Fatalf("expected a registry change to drop the cached certificate")
+	}
+	if _, ok := st.certificates.entries["other.com"]; !ok {
+		t.Fatalf("expected certificates of unchanged domains to stay cached")
+	}
+}
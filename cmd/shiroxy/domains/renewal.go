@@ -0,0 +1,623 @@
+package domains
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	mathRand "math/rand"
+	"shiroxy/pkg/models"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+	"google.golang.org/protobuf/proto"
+)
+
+// Webhook events fired by the renewal scheduler.
+const (
+	EventCertificateRenewed       = "certificate.renewed"
+	EventCertificateRenewalFailed = "certificate.renewal_failed"
+	EventCertificateExpiring      = "certificate.expiring"
+)
+
+// Renewal defaults used when the configuration leaves a value unset.
+const (
+	defaultRenewalCheckInterval    = time.Hour
+	defaultRenewalRatio            = 2.0 / 3.0
+	defaultRenewalRetryBackoff     = time.Minute
+	defaultRenewalMaxRetryBackoff  = 6 * time.Hour
+	defaultRenewalInfoPollInterval = 6 * time.Hour
+)
+
+// defaultExpiryWarningDays are the days before expiry at which a warning is fired.
+var defaultExpiryWarningDays = []int{14, 7, 3, 1}
+
+// CertificateExpiry describes the certificate served for a domain and its renewal state.
+type CertificateExpiry struct {
+	Domain        string    `json:"domain"`
+	Names         []string  `json:"names"`
+	Status        string    `json:"status"`
+	Issuer        string    `json:"issuer"`
+	SerialNumber  string    `json:"serial_number"`
+	NotBefore     time.Time `json:"not_before"`
+	NotAfter      time.Time `json:"not_after"`
+	RenewAt       time.Time `json:"renew_at"`
+	DaysRemaining int       `json:"days_remaining"`
+	Expired       bool      `json:"expired"`
+	Manual        bool      `json:"manual"`
+	LastRenewed   time.Time `json:"last_renewed,omitempty"`
+	Failures      int       `json:"failures"`
+	LastError     string    `json:"last_error,omitempty"`
+	NextAttempt   time.Time `json:"next_attempt,omitempty"`
+}
+
+// renewalState tracks renewal attempts for a single domain.
+type renewalState struct {
+	failures    int
+	lastError   string
+	nextAttempt time.Time
+	lastRenewed time.Time
+	ariWindow   *renewalWindow
+	warnedCert  string // Serial number of the certificate last warned about.
+	warnedDays  int    // Smallest warning threshold fired for warnedCert.
+}
+
+// renewalWindow is a renewal window suggested by the CA through ARI.
+type renewalWindow struct {
+	start      time.Time
+	end        time.Time
+	selected   time.Time
+	retryAfter time.Time
+}
+
+// RenewalManager periodically renews certificates before they expire.
+type RenewalManager struct {
+	storage         *Storage
+	notify          func(eventName string, data interface{})
+	checkInterval   time.Duration
+	renewalRatio    float64
+	ari             bool
+	retryBackoff    time.Duration
+	maxRetryBackoff time.Duration
+	warningDays     []int
+	lock            sync.RWMutex
+	states          map[string]*renewalState
+	stop            chan struct{}
+	stopOnce        sync.Once
+
+	// renew issues a replacement certificate; swapped out in tests.
+	renew func(domainMetadata *DomainMetadata) (*issuedCertificate, error)
+	// renewalInfo fetches the ARI window for a domain's chain; swapped out in tests.
+	renewalInfo func(domainName string, chain []*x509.Certificate) (acme.RenewalInfo, error)
+}
+
+// NewRenewalManager creates a renewal manager for storage without starting it.
+// Parameters:
+//   - storage: *Storage, the storage whose certificates are renewed.
+//   - config: models.Renewal, renewal configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//
+// Returns:
+//   - *RenewalManager: the renewal manager.
+func NewRenewalManager(storage *Storage, config models.Renewal, notify func(eventName string, data interface{})) *RenewalManager {
+	manager := &RenewalManager{
+		storage:         storage,
+		notify:          notify,
+		checkInterval:   time.Duration(config.CheckInterval) * time.Second,
+		renewalRatio:    config.RenewalRatio,
+		ari:             config.ARI,
+		retryBackoff:    time.Duration(config.RetryBackoff) * time.Second,
+		maxRetryBackoff: time.Duration(config.MaxRetryBackoff) * time.Second,
+		warningDays:     config.ExpiryWarningDays,
+		states:          make(map[string]*renewalState),
+		stop:            make(chan struct{}),
+		renew:           storage.obtainCertificate,
+	}
+	manager.renewalInfo = manager.fetchRenewalInfo
+
+	if manager.checkInterval <= 0 {
+		manager.checkInterval = defaultRenewalCheckInterval
+	}
+	if manager.renewalRatio <= 0 || manager.renewalRatio >= 1 {
+		manager.renewalRatio = defaultRenewalRatio
+	}
+	if manager.retryBackoff <= 0 {
+		manager.retryBackoff = defaultRenewalRetryBackoff
+	}
+	if manager.maxRetryBackoff <= 0 {
+		manager.maxRetryBackoff = defaultRenewalMaxRetryBackoff
+	}
+	if len(manager.warningDays) == 0 {
+		manager.warningDays = defaultExpiryWarningDays
+	}
+	return manager
+}
+
+// StartRenewalManager creates a renewal manager, attaches it to storage and starts
+// checking certificates every configured interval.
+// Parameters:
+//   - storage: *Storage, the storage whose certificates are renewed.
+//   - config: models.Renewal, renewal configuration.
+//   - notify: func(string, interface{}), called with webhook events (may be nil).
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *RenewalManager: the running renewal manager, or nil if renewal is disabled.
+func StartRenewalManager(storage *Storage, config models.Renewal, notify func(eventName string, data interface{}), wg *sync.WaitGroup) *RenewalManager {
+	if config.Disable {
+		return nil
+	}
+
+	manager := NewRenewalManager(storage, config, notify)
+	storage.Renewals = manager
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(manager.checkInterval)
+		defer ticker.Stop()
+		for {
+			manager.CheckRenewals(time.Now())
+			select {
+			case <-ticker.C:
+			case <-manager.stop:
+				return
+			}
+		}
+	}()
+	return manager
+}
+
+// Stop stops the periodic renewal checks.
+func (r *RenewalManager) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// CheckRenewals renews every active certificate that is due at now and warns
+// about certificates getting close to expiry. Manually managed certificates are
+// never renewed, only warned about. In cluster mode only the leader checks.
+// Parameters:
+//   - now: time.Time, the time to evaluate renewal windows against.
+func (r *RenewalManager) CheckRenewals(now time.Time) {
+	if !r.storage.IsLeader() {
+		return
+	}
+	domains, err := r.storage.listDomainMetadata()
+	if err != nil {
+		fmt.Printf("renewal: listing domains failed: %v\n", err)
+		return
+	}
+
+	for _, domainMetadata := range domains {
+		if domainMetadata.Status != "active" || len(domainMetadata.CertPemBlock) == 0 {
+			continue
+		}
+
+		chain, err := ParseCertificateChain(domainMetadata.CertPemBlock)
+		if err != nil {
+			fmt.Printf("renewal: %s: %v\n", domainMetadata.Domain, err)
+			continue
+		}
+
+		if !domainMetadata.ManualCertificate && r.due(domainMetadata.Domain, chain, now) {
+			if r.renewDomain(domainMetadata, chain[0], now) == nil {
+				continue
+			}
+		}
+		r.warnExpiry(domainMetadata, chain[0], now)
+	}
+}
+
+// warnExpiry fires EventCertificateExpiring once for every warning threshold the
+// certificate crosses.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain the certificate belongs to.
+//   - leaf: *x509.Certificate, the certificate served for the domain.
+//   - now: time.Time, the current time.
+func (r *RenewalManager) warnExpiry(domainMetadata *DomainMetadata, leaf *x509.Certificate, now time.Time) {
+	remaining := leaf.NotAfter.Sub(now)
+	threshold := -1
+	for _, days := range r.warningDays {
+		if remaining <= time.Duration(days)*24*time.Hour && (threshold < 0 || days < threshold) {
+			threshold = days
+		}
+	}
+	if threshold < 0 {
+		return
+	}
+
+	serial := leaf.SerialNumber.Text(16)
+	state := r.state(domainMetadata.Domain)
+	r.lock.Lock()
+	if state.warnedCert == serial && state.warnedDays <= threshold {
+		r.lock.Unlock()
+		return
+	}
+	state.warnedCert, state.warnedDays = serial, threshold
+	r.lock.Unlock()
+
+	r.fire(EventCertificateExpiring, map[string]string{
+		"domain":         domainMetadata.Domain,
+		"serial":         serial,
+		"not_after":      leaf.NotAfter.UTC().Format(time.RFC3339),
+		"days_remaining": fmt.Sprint(int(remaining.Hours() / 24)),
+		"manual":         fmt.Sprint(domainMetadata.ManualCertificate),
+	})
+}
+
+// due reports whether the certificate of domainName should be renewed at now.
+// Parameters:
+//   - domainName: string, the domain the chain belongs to.
+//   - chain: []*x509.Certificate, the parsed certificate chain, leaf first.
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - bool: true if renewal should be attempted now.
+func (r *RenewalManager) due(domainName string, chain []*x509.Certificate, now time.Time) bool {
+	state := r.state(domainName)
+
+	r.lock.RLock()
+	nextAttempt := state.nextAttempt
+	r.lock.RUnlock()
+	if now.Before(nextAttempt) {
+		return false
+	}
+
+	return !now.Before(r.renewalTime(domainName, chain, now))
+}
+
+// renewalTime returns when the certificate should be renewed. An ARI window
+// suggested by the CA takes precedence over the configured lifetime ratio.
+// Parameters:
+//   - domainName: string, the domain the chain belongs to.
+//   - chain: []*x509.Certificate, the parsed certificate chain, leaf first.
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - time.Time: the time at which the certificate should be renewed.
+func (r *RenewalManager) renewalTime(domainName string, chain []*x509.Certificate, now time.Time) time.Time {
+	leaf := chain[0]
+	renewAt := RenewalTime(leaf, r.renewalRatio)
+	if !r.ari || len(chain) < 2 {
+		return renewAt
+	}
+
+	state := r.state(domainName)
+	r.lock.RLock()
+	window := state.ariWindow
+	r.lock.RUnlock()
+
+	if window == nil || now.After(window.retryAfter) {
+		info, err := r.renewalInfo(domainName, chain)
+		if err != nil {
+			// Fall back to the lifetime ratio (or the last known window) when ARI is unavailable.
+			if window != nil {
+				return window.selected
+			}
+			return renewAt
+		}
+		window = newRenewalWindow(info, now)
+		r.lock.Lock()
+		state.ariWindow = window
+		r.lock.Unlock()
+	}
+
+	if window.selected.IsZero() {
+		return renewAt
+	}
+	return window.selected
+}
+
+// newRenewalWindow picks a random renewal time inside the window suggested by the CA.
+// Parameters:
+//   - info: acme.RenewalInfo, the renewal information returned by the CA.
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - *renewalWindow: the selected renewal window.
+func newRenewalWindow(info acme.RenewalInfo, now time.Time) *renewalWindow {
+	window := &renewalWindow{
+		start:      info.SuggestedWindow.Start,
+		end:        info.SuggestedWindow.End,
+		retryAfter: info.RetryAfter,
+	}
+	if window.retryAfter.IsZero() {
+		window.retryAfter = now.Add(defaultRenewalInfoPollInterval)
+	}
+	if window.start.IsZero() || !window.end.After(window.start) {
+		return window
+	}
+	window.selected = window.start.Add(time.Duration(mathRand.Int63n(int64(window.end.Sub(window.start)))))
+	return window
+}
+
+// fetchRenewalInfo asks the issuer of a domain's certificate for its ARI window.
+// Parameters:
+//   - domainName: string, the domain the chain belongs to.
+//   - chain: []*x509.Certificate, the certificate chain, leaf first.
+//
+// Returns:
+//   - acme.RenewalInfo: the renewal information.
+//   - error: error if the CA does not support ARI or the request fails.
+func (r *RenewalManager) fetchRenewalInfo(domainName string, chain []*x509.Certificate) (acme.RenewalInfo, error) {
+	domainMetadata, err := r.storage.getDomainMetadata(domainName)
+	if err != nil {
+		return acme.RenewalInfo{}, err
+	}
+	issuer := r.storage.issuer(domainMetadata.GetCertificate().GetIssuer())
+	if issuer.Local != nil {
+		return acme.RenewalInfo{}, errors.New("the local ca does not support ari")
+	}
+	client, err := r.storage.newACMEClient(issuer)
+	if err != nil {
+		return acme.RenewalInfo{}, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	certID, err := acme.CertIDSequence(ctx, chain, crypto.SHA256, client.HTTPClient)
+	if err != nil {
+		return acme.RenewalInfo{}, err
+	}
+	return client.GetRenewalInfo(ctx, certID)
+}
+
+// renewDomain issues a replacement certificate and installs it with a single swap
+// so that handshakes never observe a certificate paired with the wrong key.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the domain being renewed.
+//   - previous: *x509.Certificate, the certificate being replaced (may be nil).
+//   - now: time.Time, the current time.
+//
+// Returns:
+//   - error: error if renewal fails.
+func (r *RenewalManager) renewDomain(domainMetadata *DomainMetadata, previous *x509.Certificate, now time.Time) error {
+	domainName := domainMetadata.Domain
+	state := r.state(domainName)
+
+	// The order records its challenge on the domain, which must not change the registered one.
+	issued, err := r.renew(proto.Clone(domainMetadata).(*DomainMetadata))
+	if err == nil {
+		err = r.storage.swapCertificate(domainMetadata, issued, newAttempt(AttemptRenew, issued.Issuer, now, nil))
+	}
+	if errors.Is(err, ErrManualCertificate) {
+		// Uploaded during the order; the uploaded certificate wins.
+		r.lock.Lock()
+		*state = renewalState{}
+		r.lock.Unlock()
+		return nil
+	}
+
+	if err != nil {
+		failure := err
+		if recordErr := r.storage.updateDomainMetadata(domainName, func(failed *DomainMetadata) {
+			recordAttempt(failed, newAttempt(AttemptRenew, "", now, failure))
+		}); recordErr != nil {
+			fmt.Printf("recording the failed renewal of %s: %v\n", domainName, recordErr)
+		}
+
+		r.lock.Lock()
+		state.failures++
+		state.lastError = err.Error()
+		state.nextAttempt = now.Add(r.backoff(state.failures))
+		failures, nextAttempt := state.failures, state.nextAttempt
+		r.lock.Unlock()
+
+		data := map[string]string{
+			"domain":       domainName,
+			"error":        err.Error(),
+			"attempts":     fmt.Sprint(failures),
+			"next_attempt": nextAttempt.UTC().Format(time.RFC3339),
+		}
+		if previous != nil {
+			data["not_after"] = previous.NotAfter.UTC().Format(time.RFC3339)
+		}
+		r.fire(EventCertificateRenewalFailed, data)
+		return err
+	}
+
+	r.lock.Lock()
+	*state = renewalState{lastRenewed: now}
+	r.lock.Unlock()
+
+	data := map[string]string{"domain": domainName}
+	if chain, err := ParseCertificateChain(issued.CertPemBlock); err == nil {
+		data["not_after"] = chain[0].NotAfter.UTC().Format(time.RFC3339)
+	}
+	if previous != nil {
+		data["previous_not_after"] = previous.NotAfter.UTC().Format(time.RFC3339)
+	}
+	r.fire(EventCertificateRenewed, data)
+	return nil
+}
+
+// backoff returns the delay before the next renewal attempt after failures failed attempts.
+// Parameters:
+//   - failures: int, the number of consecutive failures.
+//
+// Returns:
+//   - time.Duration: the retry delay.
+func (r *RenewalManager) backoff(failures int) time.Duration {
+	delay := r.retryBackoff
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if delay >= r.maxRetryBackoff {
+			return r.maxRetryBackoff
+		}
+	}
+	if delay > r.maxRetryBackoff {
+		return r.maxRetryBackoff
+	}
+	return delay
+}
+
+// state returns the renewal state of domainName, creating it if needed.
+func (r *RenewalManager) state(domainName string) *renewalState {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	state, ok := r.states[domainName]
+	if !ok {
+		state = &renewalState{}
+		r.states[domainName] = state
+	}
+	return state
+}
+
+// forget drops the renewal state of domainName, e.g. after its certificate was replaced by hand.
+func (r *RenewalManager) forget(domainName string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.states, domainName)
+}
+
+// fire sends a webhook event if a notifier is configured.
+func (r *RenewalManager) fire(eventName string, data interface{}) {
+	if r.notify != nil {
+		r.notify(eventName, data)
+	}
+}
+
+// CertificateExpiries lists the certificates of all domains, soonest expiry first.
+// Returns:
+//   - []CertificateExpiry: expiry and renewal information per domain.
+//   - error: error if the domains cannot be listed.
+func (s *Storage) CertificateExpiries() ([]CertificateExpiry, error) {
+	domains, err := s.listDomainMetadata()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiries := make([]CertificateExpiry, 0, len(domains))
+	for _, domainMetadata := range domains {
+		chain, err := ParseCertificateChain(domainMetadata.CertPemBlock)
+		if err != nil {
+			continue
+		}
+		leaf := chain[0]
+
+		expiry := CertificateExpiry{
+			Domain:        domainMetadata.Domain,
+			Names:         leaf.DNSNames,
+			Status:        domainMetadata.Status,
+			Issuer:        leaf.Issuer.CommonName,
+			SerialNumber:  leaf.SerialNumber.Text(16),
+			NotBefore:     leaf.NotBefore,
+			NotAfter:      leaf.NotAfter,
+			RenewAt:       RenewalTime(leaf, defaultRenewalRatio),
+			DaysRemaining: int(leaf.NotAfter.Sub(now).Hours() / 24),
+			Expired:       now.After(leaf.NotAfter),
+			Manual:        domainMetadata.ManualCertificate,
+		}
+
+		if s.Renewals != nil {
+			expiry.RenewAt = RenewalTime(leaf, s.Renewals.renewalRatio)
+			s.Renewals.lock.RLock()
+			if state, ok := s.Renewals.states[domainMetadata.Domain]; ok {
+				if state.ariWindow != nil && !state.ariWindow.selected.IsZero() {
+					expiry.RenewAt = state.ariWindow.selected
+				}
+				expiry.LastRenewed = state.lastRenewed
+				expiry.Failures = state.failures
+				expiry.LastError = state.lastError
+				expiry.NextAttempt = state.nextAttempt
+			}
+			s.Renewals.lock.RUnlock()
+		}
+		expiries = append(expiries, expiry)
+	}
+
+	sort.Slice(expiries, func(i, j int) bool {
+		return expiries[i].NotAfter.Before(expiries[j].NotAfter)
+	})
+	return expiries, nil
+}
+
+// ParseCertificateChain parses every certificate in a PEM bundle, leaf first.
+// Parameters:
+//   - certPEM: []byte, the PEM encoded certificate chain.
+//
+// Returns:
+//   - []*x509.Certificate: the parsed certificates.
+//   - error: error if the bundle holds no certificate or a certificate is malformed.
+func ParseCertificateChain(certPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		certificate, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate: %v", err)
+		}
+		chain = append(chain, certificate)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no certificate found in PEM block")
+	}
+	return chain, nil
+}
+
+// RenewalTime returns the point in the certificate's lifetime at which it should be renewed.
+// Parameters:
+//   - leaf: *x509.Certificate, the certificate.
+//   - ratio: float64, the fraction of the lifetime after which to renew.
+//
+// Returns:
+//   - time.Time: the renewal time.
+func RenewalTime(leaf *x509.Certificate, ratio float64) time.Time {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * ratio))
+}
+
+// swapCertificate installs an issued certificate for a domain. The stored metadata is
+// replaced by an updated copy instead of being modified in place. A certificate
+// uploaded while the order ran is kept.
+// Parameters:
+//   - domainMetadata: *DomainMetadata, the current metadata of the domain.
+//   - issued: *issuedCertificate, the certificate to install.
+//   - attempt: *IssuanceAttempt, recorded in the issuance history of the domain (optional).
+//
+// Returns:
+//   - error: ErrManualCertificate if a certificate was uploaded for the domain, or
+//     error if the updated metadata cannot be persisted.
+func (s *Storage) swapCertificate(domainMetadata *DomainMetadata, issued *issuedCertificate, attempt *IssuanceAttempt) error {
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+
+	current, err := s.loadDomainMetadata(domainMetadata.Domain)
+	if err != nil {
+		return err
+	}
+	if current.ManualCertificate {
+		return ErrManualCertificate
+	}
+	renewed := proto.Clone(current).(*DomainMetadata)
+	if attempt != nil {
+		recordAttempt(renewed, attempt)
+	}
+	issued.apply(renewed)
+	renewed.Status = "active"
+	return s.storeDomainMetadata(renewed)
+}
+
+// listDomainMetadata returns the metadata of every stored domain.
+// Returns:
+//   - []*DomainMetadata: the stored domains.
+//   - error: error if the storage cannot be read.
+func (s *Storage) listDomainMetadata() ([]*DomainMetadata, error) {
+	if s.Store != nil {
+		return s.Store.List(context.Background())
+	}
+
+	return s.Domains().Snapshot().List(), nil
+}
@@ -0,0 +1,278 @@
+package domains
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"shiroxy/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/mholt/acmez/acme"
+)
+
+// testCertificate creates a self-signed certificate for domain valid between notBefore and notAfter.
+func testCertificate(t *testing.T, domain string, notBefore, notAfter time.Time) *issuedCertificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: domain},
+		Issuer:       pkix.Name{CommonName: "Test CA"},
+		DNSNames:     []string{domain},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return &issuedCertificate{
+		CertPemBlock: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPemBlock:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+type firedEvent struct {
+	name string
+	data map[string]string
+}
+
+func newTestRenewalManager(t *testing.T, now time.Time, domains ...*DomainMetadata) (*Storage, *RenewalManager, *[]firedEvent) {
+	t.Helper()
+	st := &Storage{
+		Storage: &models.Storage{Location: "memory"},
+	}
+	for _, domainMetadata := range domains {
+		st.Domains().Put(domainMetadata)
+	}
+
+	events := &[]firedEvent{}
+	manager := NewRenewalManager(st, models.Renewal{RetryBackoff: 60, MaxRetryBackoff: 300}, func(eventName string, data interface{}) {
+		*events = append(*events, firedEvent{name: eventName, data: data.(map[string]string)})
+	})
+	manager.renew = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		return testCertificate(t, domainMetadata.Domain, now, now.Add(90*24*time.Hour)), nil
+	}
+	st.Renewals = manager
+	return st, manager, events
+}
+
+func activeDomain(t *testing.T, domain string, notBefore, notAfter time.Time) *DomainMetadata {
+	certificate := testCertificate(t, domain, notBefore, notAfter)
+	return &DomainMetadata{
+		Domain:       domain,
+		Status:       "active",
+		CertPemBlock: certificate.CertPemBlock,
+		KeyPemBlock:  certificate.KeyPemBlock,
+		Metadata:     map[string]string{"team": "api"},
+		Routing:      &DomainRouting{Tags: []string{"api"}},
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+	notBefore := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.Add(90 * 24 * time.Hour)}
+
+	if got, want := RenewalTime(leaf, 2.0/3.0), notBefore.Add(60*24*time.Hour); !got.Equal(want) {
+		t.Fatalf("expected renewal at %v, got %v", want, got)
+	}
+}
+
+func TestCheckRenewals_RenewsDueCertificates(t *testing.T) {
+	now := time.Now()
+	due := activeDomain(t, "due.example.com", now.Add(-70*24*time.Hour), now.Add(20*24*time.Hour))
+	fresh := activeDomain(t, "fresh.example.com", now.Add(-10*24*time.Hour), now.Add(80*24*time.Hour))
+	st, manager, events := newTestRenewalManager(t, now, due, fresh)
+
+	manager.CheckRenewals(now)
+
+	renewed := registeredDomain(st, "due.example.com")
+	if renewed == due {
+		t.Fatalf("expected the renewed domain to be swapped for a new copy")
+	}
+	chain, err := ParseCertificateChain(renewed.CertPemBlock)
+	if err != nil {
+		t.Fatalf("parse renewed certificate: %v", err)
+	}
+	if !chain[0].NotAfter.After(now.Add(80 * 24 * time.Hour)) {
+		t.Fatalf("expected a fresh certificate, expires %v", chain[0].NotAfter)
+	}
+	if _, err := tls.X509KeyPair(renewed.CertPemBlock, renewed.KeyPemBlock); err != nil {
+		t.Fatalf("renewed certificate and key do not match: %v", err)
+	}
+	if renewed.Metadata["team"] != "api" || renewed.GetRouting().GetTags()[0] != "api" {
+		t.Fatalf("expected user metadata and routing to survive renewal, got %v, %v", renewed.Metadata, renewed.Routing)
+	}
+	if renewed.GetCertificate().GetNotAfter() != chain[0].NotAfter.Unix() || renewed.Certificate.Serial != chain[0].SerialNumber.Text(16) {
+		t.Fatalf("expected the renewed certificate to be described, got %v", renewed.Certificate)
+	}
+	if len(renewed.History) != 1 || renewed.History[0].Kind != AttemptRenew || renewed.History[0].Error != "" {
+		t.Fatalf("expected the renewal to be recorded, got %v", renewed.History)
+	}
+	if registeredDomain(st, "fresh.example.com") != fresh {
+		t.Fatalf("expected certificate that is not due to be left alone")
+	}
+
+	if len(*events) != 1 || (*events)[0].name != EventCertificateRenewed || (*events)[0].data["domain"] != "due.example.com" {
+		t.Fatalf("unexpected webhook events: %+v", *events)
+	}
+}
+
+func TestCheckRenewals_BacksOffAfterFailure(t *testing.T) {
+	now := time.Now()
+	due := activeDomain(t, "due.example.com", now.Add(-70*24*time.Hour), now.Add(20*24*time.Hour))
+	st, manager, events := newTestRenewalManager(t, now, due)
+
+	attempts := 0
+	manager.renew = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		attempts++
+		return nil, errors.New("acme server unavailable")
+	}
+
+	manager.CheckRenewals(now)
+	manager.CheckRenewals(now.Add(30 * time.Second))
+	if attempts != 1 {
+		t.Fatalf("expected retry to wait for the backoff, got %d attempts", attempts)
+	}
+
+	manager.CheckRenewals(now.Add(61 * time.Second))
+	if attempts != 2 {
+		t.Fatalf("expected a retry after the backoff, got %d attempts", attempts)
+	}
+	current := registeredDomain(st, "due.example.com")
+	if !bytes.Equal(current.CertPemBlock, due.CertPemBlock) || !bytes.Equal(current.KeyPemBlock, due.KeyPemBlock) {
+		t.Fatalf("expected the current certificate to stay in place after failures")
+	}
+	if len(current.History) != 2 || current.History[1].Kind != AttemptRenew || current.History[1].Error != "acme server unavailable" {
+		t.Fatalf("expected the failed attempts to be recorded, got %v", current.History)
+	}
+
+	expiries, err := st.CertificateExpiries()
+	if err != nil {
+		t.Fatalf("certificate expiries: %v", err)
+	}
+	if expiries[0].Failures != 2 || expiries[0].LastError != "acme server unavailable" {
+		t.Fatalf("unexpected renewal state: %+v", expiries[0])
+	}
+	if want := now.Add(61*time.Second + 120*time.Second); !expiries[0].NextAttempt.Equal(want) {
+		t.Fatalf("expected backoff to double to %v, got %v", want, expiries[0].NextAttempt)
+	}
+
+	if len(*events) != 2 || (*events)[1].name != EventCertificateRenewalFailed || (*events)[1].data["attempts"] != "2" {
+		t.Fatalf("unexpected webhook events: %+v", *events)
+	}
+}
+
+func TestRenewalBackoffIsCapped(t *testing.T) {
+	manager := NewRenewalManager(&Storage{}, models.Renewal{RetryBackoff: 60, MaxRetryBackoff: 300}, nil)
+	if got := manager.backoff(10); got != 300*time.Second {
+		t.Fatalf("expected backoff to be capped at 5m, got %v", got)
+	}
+}
+
+func TestCheckRenewals_UsesRenewalInfoWindow(t *testing.T) {
+	now := time.Now()
+	domain := activeDomain(t, "ari.example.com", now.Add(-10*24*time.Hour), now.Add(80*24*time.Hour))
+	issuer := testCertificate(t, "Test CA", now.Add(-365*24*time.Hour), now.Add(365*24*time.Hour))
+	domain.CertPemBlock = append(domain.CertPemBlock, issuer.CertPemBlock...)
+	st, manager, events := newTestRenewalManager(t, now, domain)
+
+	manager.ari = true
+	manager.renewalInfo = func(domainName string, chain []*x509.Certificate) (acme.RenewalInfo, error) {
+		var info acme.RenewalInfo
+		info.SuggestedWindow.Start = now.Add(-2 * time.Hour)
+		info.SuggestedWindow.End = now.Add(-time.Hour)
+		return info, nil
+	}
+
+	manager.CheckRenewals(now)
+
+	if registeredDomain(st, "ari.example.com") == domain {
+		t.Fatalf("expected renewal inside the ARI window before 2/3 of the lifetime")
+	}
+	if len(*events) != 1 || (*events)[0].name != EventCertificateRenewed {
+		t.Fatalf("unexpected webhook events: %+v", *events)
+	}
+}
+
+func TestCertificateExpiries_SortedBySoonestExpiry(t *testing.T) {
+	now := time.Now()
+	later := activeDomain(t, "later.example.com", now, now.Add(60*24*time.Hour))
+	sooner := activeDomain(t, "sooner.example.com", now, now.Add(5*24*time.Hour))
+	st, _, _ := newTestRenewalManager(t, now, later, sooner, &DomainMetadata{Domain: "pending.example.com", Status: "inactive"})
+
+	expiries, err := st.CertificateExpiries()
+	if err != nil {
+		t.Fatalf("certificate expiries: %v", err)
+	}
+	if len(expiries) != 2 {
+		t.Fatalf("expected domains without a certificate to be skipped, got %d entries", len(expiries))
+	}
+	if expiries[0].Domain != "sooner.example.com" || expiries[0].DaysRemaining != 4 {
+		t.Fatalf("unexpected first entry: %+v", expiries[0])
+	}
+	if expiries[0].Issuer != "sooner.example.com" || expiries[0].Expired {
+		t.Fatalf("unexpected certificate details: %+v", expiries[0])
+	}
+}
+
+func TestRenewDomain_DoesNotModifyRegisteredDomain(t *testing.T) {
+	now := time.Now()
+	due := activeDomain(t, "due.example.com", now.Add(-70*24*time.Hour), now.Add(20*24*time.Hour))
+	st, manager, _ := newTestRenewalManager(t, now, due)
+	manager.renew = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		domainMetadata.DnsChallengeKey = "key-authorization"
+		return testCertificate(t, domainMetadata.Domain, now, now.Add(90*24*time.Hour)), nil
+	}
+
+	manager.CheckRenewals(now)
+
+	if due.DnsChallengeKey != "" {
+		t.Fatalf("expected the renewal order not to modify the registered domain")
+	}
+	if registeredDomain(st, "due.example.com") == due {
+		t.Fatalf("expected the certificate to be renewed")
+	}
+}
+
+func TestRenewDomain_KeepsCertificateUploadedDuringOrder(t *testing.T) {
+	now := time.Now()
+	due := activeDomain(t, "due.example.com", now.Add(-70*24*time.Hour), now.Add(20*24*time.Hour))
+	st, manager, events := newTestRenewalManager(t, now, due)
+	uploaded := testCertificate(t, "due.example.com", now, now.Add(30*24*time.Hour))
+	manager.renew = func(domainMetadata *DomainMetadata) (*issuedCertificate, error) {
+		st.Domains().Put(&DomainMetadata{
+			Domain:            domainMetadata.Domain,
+			Status:            "active",
+			CertPemBlock:      uploaded.CertPemBlock,
+			KeyPemBlock:       uploaded.KeyPemBlock,
+			ManualCertificate: true,
+		})
+		return testCertificate(t, domainMetadata.Domain, now, now.Add(90*24*time.Hour)), nil
+	}
+
+	manager.CheckRenewals(now)
+
+	current := registeredDomain(st, "due.example.com")
+	if !bytes.Equal(current.CertPemBlock, uploaded.CertPemBlock) || len(current.History) != 0 {
+		t.Fatalf("expected the uploaded certificate to be kept")
+	}
+	if len(*events) != 0 {
+		t.Fatalf("unexpected webhook events: %+v", *events)
+	}
+}
@@ -0,0 +1,517 @@
+package domains
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"shiroxy/pkg/models"
+	"strings"
+	"time"
+)
+
+// DNS wire constants used to build RFC 2136 UPDATE messages and read the responses.
+const (
+	dnsOpcodeUpdate = 5
+	dnsTypeSOA      = 6
+	dnsTypeTXT      = 16
+	dnsTypeTSIG     = 250
+	dnsClassIN      = 1
+	dnsClassNONE    = 254
+	dnsClassANY     = 255
+	tsigFudge       = 300
+
+	dnsFlagTruncated  = 1 << 9
+	dnsRcodeNameError = 3
+)
+
+// RFC2136Provider solves DNS-01 challenges by sending dynamic updates (nsupdate)
+// to an authoritative name server, optionally signed with a TSIG key.
+type RFC2136Provider struct {
+	Nameserver    string
+	Zone          string
+	TTL           uint32
+	TSIGKeyName   string
+	TSIGSecret    []byte
+	TSIGAlgorithm string
+	Timeout       time.Duration
+}
+
+// NewRFC2136Provider validates the RFC 2136 settings and returns a provider.
+// Parameters:
+//   - config: models.DnsProviderRFC2136, name server, zone and TSIG settings.
+//
+// Returns:
+//   - *RFC2136Provider: the configured provider.
+//   - error: error if the name server is missing or the TSIG settings are invalid.
+func NewRFC2136Provider(config models.DnsProviderRFC2136) (*RFC2136Provider, error) {
+	if config.Nameserver == "" {
+		return nil, errors.New("dnsprovider.rfc2136.nameserver is required")
+	}
+
+	nameserver := config.Nameserver
+	if _, _, err := net.SplitHostPort(nameserver); err != nil {
+		nameserver = net.JoinHostPort(nameserver, "53")
+	}
+
+	provider := &RFC2136Provider{
+		Nameserver: nameserver,
+		Zone:       config.Zone,
+		TTL:        120,
+		Timeout:    10 * time.Second,
+	}
+	if config.TTL > 0 {
+		provider.TTL = uint32(config.TTL)
+	}
+
+	if config.TSIGKeyName != "" {
+		secret, err := base64.StdEncoding.DecodeString(config.TSIGSecret)
+		if err != nil {
+			return nil, fmt.Errorf("decoding tsig secret: %v", err)
+		}
+		algorithm := strings.ToLower(config.TSIGAlgorithm)
+		if algorithm == "" {
+			algorithm = "hmac-sha256."
+		}
+		algorithm = fqdnOf(algorithm)
+		if tsigHash(algorithm) == nil {
+			return nil, fmt.Errorf("unsupported tsig algorithm %q", config.TSIGAlgorithm)
+		}
+		provider.TSIGKeyName = fqdnOf(strings.ToLower(config.TSIGKeyName))
+		provider.TSIGSecret = secret
+		provider.TSIGAlgorithm = algorithm
+	}
+
+	return provider, nil
+}
+
+// Present adds the TXT record to the zone.
+func (p *RFC2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassIN, p.TTL)
+}
+
+// CleanUp deletes the exact TXT record (name and value) from the zone.
+func (p *RFC2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, dnsClassNONE, 0)
+}
+
+func (p *RFC2136Provider) update(ctx context.Context, fqdn, value string, class uint16, ttl uint32) error {
+	fqdn = fqdnOf(fqdn)
+	zone := p.Zone
+	if zone == "" {
+		var err error
+		if zone, err = p.findZone(ctx, fqdn); err != nil {
+			return err
+		}
+	}
+
+	msg, requestMAC, err := p.buildUpdate(fqdnOf(zone), fqdn, value, class, ttl, time.Now())
+	if err != nil {
+		return err
+	}
+
+	response, err := p.exchange(ctx, msg)
+	if err != nil {
+		return err
+	}
+	if rcode := binary.BigEndian.Uint16(response[2:4]) & 0x000f; rcode != 0 {
+		return fmt.Errorf("rfc2136: server refused update, rcode %d", rcode)
+	}
+	if p.TSIGKeyName != "" {
+		if err := p.verifyTSIG(response, requestMAC, time.Now()); err != nil {
+			return fmt.Errorf("rfc2136: %v", err)
+		}
+	}
+	return nil
+}
+
+// findZone asks the name server for the SOA record of fqdn. An authoritative
+// server answers with the SOA of the zone holding fqdn, in the answer section
+// when fqdn is the zone apex and in the authority section otherwise.
+func (p *RFC2136Provider) findZone(ctx context.Context, fqdn string) (string, error) {
+	id, err := newDNSID()
+	if err != nil {
+		return "", err
+	}
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0)
+	msg = appendDNSName(msg, fqdn)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	response, err := p.exchange(ctx, msg)
+	if err != nil {
+		return "", err
+	}
+	if rcode := binary.BigEndian.Uint16(response[2:4]) & 0x000f; rcode != 0 && rcode != dnsRcodeNameError {
+		return "", fmt.Errorf("rfc2136: looking up the zone of %s: rcode %d", fqdn, rcode)
+	}
+	records, err := parseDNSRecords(response)
+	if err != nil {
+		return "", fmt.Errorf("rfc2136: looking up the zone of %s: %v", fqdn, err)
+	}
+	for _, record := range records {
+		if record.rtype == dnsTypeSOA {
+			return record.name, nil
+		}
+	}
+	return "", fmt.Errorf("rfc2136: %s did not return the zone of %s, set dnsprovider.rfc2136.zone", p.Nameserver, fqdn)
+}
+
+// exchange sends msg to the name server over UDP and sends it again over TCP
+// when the response is truncated.
+func (p *RFC2136Provider) exchange(ctx context.Context, msg []byte) ([]byte, error) {
+	response, err := p.exchangeOver(ctx, "udp", msg)
+	if err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint16(response[2:4])&dnsFlagTruncated != 0 {
+		return p.exchangeOver(ctx, "tcp", msg)
+	}
+	return response, nil
+}
+
+func (p *RFC2136Provider) exchangeOver(ctx context.Context, network string, msg []byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: p.Timeout}
+	conn, err := dialer.DialContext(ctx, network, p.Nameserver)
+	if err != nil {
+		return nil, fmt.Errorf("rfc2136: %v", err)
+	}
+	defer conn.Close()
+
+	deadline := time.Now().Add(p.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	var response []byte
+	if network == "tcp" {
+		// Messages over TCP are prefixed with their length.
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(msg)))
+		if _, err := conn.Write(append(framed, msg...)); err != nil {
+			return nil, fmt.Errorf("rfc2136: sending message: %v", err)
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, fmt.Errorf("rfc2136: reading response: %v", err)
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, response); err != nil {
+			return nil, fmt.Errorf("rfc2136: reading response: %v", err)
+		}
+	} else {
+		if _, err := conn.Write(msg); err != nil {
+			return nil, fmt.Errorf("rfc2136: sending message: %v", err)
+		}
+		response = make([]byte, 65535)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, fmt.Errorf("rfc2136: reading response: %v", err)
+		}
+		response = response[:n]
+	}
+
+	if len(response) < 12 {
+		return nil, errors.New("rfc2136: short response")
+	}
+	if binary.BigEndian.Uint16(response[0:2]) != binary.BigEndian.Uint16(msg[0:2]) {
+		return nil, errors.New("rfc2136: response id mismatch")
+	}
+	return response, nil
+}
+
+// buildUpdate encodes a single-record UPDATE message for zone, signing it when a TSIG key is set.
+// It returns the message and, when signed, its TSIG MAC.
+func (p *RFC2136Provider) buildUpdate(zone, fqdn, value string, class uint16, ttl uint32, now time.Time) ([]byte, []byte, error) {
+	if len(value) > 255 {
+		return nil, nil, errors.New("rfc2136: txt value longer than 255 bytes")
+	}
+
+	id, err := newDNSID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg := make([]byte, 0, 512)
+	// Header: id, opcode UPDATE, one zone record and one update record.
+	msg = binary.BigEndian.AppendUint16(msg, id)
+	msg = binary.BigEndian.AppendUint16(msg, dnsOpcodeUpdate<<11)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+	msg = binary.BigEndian.AppendUint16(msg, 1)
+	msg = binary.BigEndian.AppendUint16(msg, 0)
+
+	// Zone section.
+	msg = appendDNSName(msg, zone)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeSOA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+
+	// Update section.
+	msg = appendDNSName(msg, fqdn)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeTXT)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)+1))
+	msg = append(msg, byte(len(value)))
+	msg = append(msg, value...)
+
+	if p.TSIGKeyName == "" {
+		return msg, nil, nil
+	}
+
+	return p.signTSIG(msg, nil, now)
+}
+
+// signTSIG appends a TSIG record (RFC 8945) covering msg and bumps the additional count.
+// requestMAC is the MAC of the request when msg is a response, nil otherwise.
+// It returns the signed message and its MAC.
+func (p *RFC2136Provider) signTSIG(msg, requestMAC []byte, now time.Time) ([]byte, []byte, error) {
+	if tsigHash(p.TSIGAlgorithm) == nil {
+		return nil, nil, fmt.Errorf("unsupported tsig algorithm %q", p.TSIGAlgorithm)
+	}
+	signedAt := uint64(now.Unix())
+	sum := p.tsigMAC(requestMAC, msg, tsigVariables(p.TSIGKeyName, p.TSIGAlgorithm, signedAt, tsigFudge, 0, nil))
+
+	rdata := appendDNSName(nil, p.TSIGAlgorithm)
+	rdata = appendUint48(rdata, signedAt)
+	rdata = binary.BigEndian.AppendUint16(rdata, tsigFudge)
+	rdata = binary.BigEndian.AppendUint16(rdata, uint16(len(sum)))
+	rdata = append(rdata, sum...)
+	rdata = append(rdata, msg[0:2]...)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+	rdata = binary.BigEndian.AppendUint16(rdata, 0)
+
+	signed := append([]byte{}, msg...)
+	signed = appendDNSName(signed, p.TSIGKeyName)
+	signed = binary.BigEndian.AppendUint16(signed, dnsTypeTSIG)
+	signed = binary.BigEndian.AppendUint16(signed, dnsClassANY)
+	signed = binary.BigEndian.AppendUint32(signed, 0)
+	signed = binary.BigEndian.AppendUint16(signed, uint16(len(rdata)))
+	signed = append(signed, rdata...)
+	binary.BigEndian.PutUint16(signed[10:12], binary.BigEndian.Uint16(msg[10:12])+1)
+
+	return signed, sum, nil
+}
+
+// verifyTSIG checks that response is signed with the provider's key and
+// answers the request whose MAC is requestMAC.
+func (p *RFC2136Provider) verifyTSIG(response, requestMAC []byte, now time.Time) error {
+	records, err := parseDNSRecords(response)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 || records[len(records)-1].rtype != dnsTypeTSIG {
+		return errors.New("response is not signed")
+	}
+	tsig := records[len(records)-1]
+	if tsig.name != p.TSIGKeyName {
+		return fmt.Errorf("response is signed with unexpected key %s", tsig.name)
+	}
+
+	algorithm, offset, err := readDNSName(tsig.rdata, 0)
+	if err != nil {
+		return err
+	}
+	if algorithm != p.TSIGAlgorithm {
+		return fmt.Errorf("response is signed with unexpected algorithm %s", algorithm)
+	}
+	if offset+10 > len(tsig.rdata) {
+		return errMalformedDNSMessage
+	}
+	signedAt := uint64(binary.BigEndian.Uint16(tsig.rdata[offset:]))<<32 | uint64(binary.BigEndian.Uint32(tsig.rdata[offset+2:]))
+	fudge := binary.BigEndian.Uint16(tsig.rdata[offset+6:])
+	macEnd := offset + 10 + int(binary.BigEndian.Uint16(tsig.rdata[offset+8:]))
+	if macEnd+6 > len(tsig.rdata) {
+		return errMalformedDNSMessage
+	}
+	mac := tsig.rdata[offset+10 : macEnd]
+	originalID := tsig.rdata[macEnd : macEnd+2]
+	tsigError := binary.BigEndian.Uint16(tsig.rdata[macEnd+2:])
+	otherEnd := macEnd + 6 + int(binary.BigEndian.Uint16(tsig.rdata[macEnd+4:]))
+	if otherEnd > len(tsig.rdata) {
+		return errMalformedDNSMessage
+	}
+	if tsigError != 0 {
+		return fmt.Errorf("server rejected the tsig signature, error %d", tsigError)
+	}
+
+	// The MAC covers the response as it was before the TSIG record was added.
+	unsigned := append([]byte{}, response[:tsig.start]...)
+	copy(unsigned[0:2], originalID)
+	binary.BigEndian.PutUint16(unsigned[10:12], binary.BigEndian.Uint16(unsigned[10:12])-1)
+	variables := tsigVariables(p.TSIGKeyName, p.TSIGAlgorithm, signedAt, fudge, tsigError, tsig.rdata[macEnd+6:otherEnd])
+	if !hmac.Equal(mac, p.tsigMAC(requestMAC, unsigned, variables)) {
+		return errors.New("response tsig signature does not verify")
+	}
+
+	if skew := now.Unix() - int64(signedAt); skew > int64(fudge) || -skew > int64(fudge) {
+		return errors.New("response tsig is outside the allowed time window")
+	}
+	return nil
+}
+
+// tsigVariables encodes the TSIG variables hashed together with a message.
+func tsigVariables(keyName, algorithm string, signedAt uint64, fudge, tsigError uint16, other []byte) []byte {
+	variables := appendDNSName(nil, keyName)
+	variables = binary.BigEndian.AppendUint16(variables, dnsClassANY)
+	variables = binary.BigEndian.AppendUint32(variables, 0)
+	variables = appendDNSName(variables, algorithm)
+	variables = appendUint48(variables, signedAt)
+	variables = binary.BigEndian.AppendUint16(variables, fudge)
+	variables = binary.BigEndian.AppendUint16(variables, tsigError)
+	variables = binary.BigEndian.AppendUint16(variables, uint16(len(other)))
+	return append(variables, other...)
+}
+
+// tsigMAC computes the TSIG MAC of msg. The MAC of a response also covers the
+// MAC of the request it answers.
+func (p *RFC2136Provider) tsigMAC(requestMAC, msg, variables []byte) []byte {
+	mac := hmac.New(tsigHash(p.TSIGAlgorithm), p.TSIGSecret)
+	if requestMAC != nil {
+		mac.Write(binary.BigEndian.AppendUint16(nil, uint16(len(requestMAC))))
+		mac.Write(requestMAC)
+	}
+	mac.Write(msg)
+	mac.Write(variables)
+	return mac.Sum(nil)
+}
+
+func tsigHash(algorithm string) func() hash.Hash {
+	switch algorithm {
+	case "hmac-sha1.":
+		return sha1.New
+	case "hmac-sha256.":
+		return sha256.New
+	case "hmac-sha512.":
+		return sha512.New
+	default:
+		return nil
+	}
+}
+
+// appendDNSName appends name in uncompressed wire format.
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" {
+			continue
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendUint48(b []byte, v uint64) []byte {
+	return append(b, byte(v>>40), byte(v>>32), byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func fqdnOf(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func newDNSID() (uint16, error) {
+	var id [2]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint16(id[:]), nil
+}
+
+var errMalformedDNSMessage = errors.New("malformed dns message")
+
+// dnsRecord is a resource record of a parsed DNS message.
+type dnsRecord struct {
+	name  string
+	rtype uint16
+	start int // offset of the record in the message
+	rdata []byte
+}
+
+// parseDNSRecords returns the answer, authority and additional records of msg, in order.
+func parseDNSRecords(msg []byte) ([]dnsRecord, error) {
+	if len(msg) < 12 {
+		return nil, errMalformedDNSMessage
+	}
+	offset := 12
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:6])); i++ {
+		_, end, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		offset = end + 4
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[6:8])) + int(binary.BigEndian.Uint16(msg[8:10])) + int(binary.BigEndian.Uint16(msg[10:12]))
+	records := make([]dnsRecord, 0, count)
+	for i := 0; i < count; i++ {
+		name, end, err := readDNSName(msg, offset)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(msg) {
+			return nil, errMalformedDNSMessage
+		}
+		rdataEnd := end + 10 + int(binary.BigEndian.Uint16(msg[end+8:end+10]))
+		if rdataEnd > len(msg) {
+			return nil, errMalformedDNSMessage
+		}
+		records = append(records, dnsRecord{
+			name:  name,
+			rtype: binary.BigEndian.Uint16(msg[end : end+2]),
+			start: offset,
+			rdata: msg[end+10 : rdataEnd],
+		})
+		offset = rdataEnd
+	}
+	return records, nil
+}
+
+// readDNSName reads the possibly compressed name at offset of msg. It returns the
+// name in lower case and the offset just past it.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errMalformedDNSMessage
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			return strings.ToLower(strings.Join(labels, ".")) + ".", end, nil
+		case length&0xc0 == 0xc0:
+			jumps++
+			if offset+2 > len(msg) || jumps > 16 {
+				return "", 0, errMalformedDNSMessage
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errMalformedDNSMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
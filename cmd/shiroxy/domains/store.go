@@ -0,0 +1,235 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"shiroxy/pkg/logger"
+	"shiroxy/pkg/models"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrDomainNotFound is returned by domain stores for domains that are not stored.
+var ErrDomainNotFound = errors.New("no data found for domainName")
+
+// Domain event types reported by DomainStore.Watch.
+const (
+	DomainEventPut    = "put"
+	DomainEventDelete = "delete"
+)
+
+// DomainEvent reports that a stored domain changed.
+type DomainEvent struct {
+	Type   string // DomainEventPut or DomainEventDelete.
+	Domain string // Name of the changed domain.
+}
+
+// DomainStore persists domain metadata. Storage keeps the routing state in
+// memory and reads and writes through to its store.
+type DomainStore interface {
+	// Get returns the stored domain, or ErrDomainNotFound.
+	Get(ctx context.Context, domainName string) (*DomainMetadata, error)
+	// Put stores the domain, replacing any stored version.
+	Put(ctx context.Context, domainMetadata *DomainMetadata) error
+	// Delete removes the domain, or returns ErrDomainNotFound.
+	Delete(ctx context.Context, domainName string) error
+	// List returns every stored domain.
+	List(ctx context.Context) ([]*DomainMetadata, error)
+	// Watch reports changes until ctx is done, then closes the channel. Events are
+	// notifications only: the current state must be read with Get.
+	Watch(ctx context.Context) (<-chan DomainEvent, error)
+	// Close releases the resources of the store.
+	Close() error
+}
+
+// NewDomainStore opens the domain store selected in the storage configuration.
+// Parameters:
+//   - config: *models.Storage, storage configuration.
+//   - logHandler: *logger.Logger, logs attempts to reach Redis; nil discards them.
+//
+// Returns:
+//   - DomainStore: the opened store.
+//   - error: error if the location is unknown or the store cannot be opened.
+func NewDomainStore(config *models.Storage, logHandler *logger.Logger) (DomainStore, error) {
+	switch config.Location {
+	case "", "memory":
+		return NewMemoryDomainStore(), nil
+	case "redis":
+		client, err := connectRedis(config, logHandler)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisDomainStore(context.Background(), client)
+	case "file":
+		return NewBoltDomainStore(config.FilePath)
+	case "sql":
+		return NewSQLDomainStore(config.SQLDriver, config.SQLDSN)
+	default:
+		return nil, fmt.Errorf("unknown storage location %q", config.Location)
+	}
+}
+
+// domainWatchers fans out the changes made through a store to its watchers.
+type domainWatchers struct {
+	lock     sync.Mutex
+	watchers map[chan DomainEvent]struct{}
+}
+
+// watch registers a watcher that is removed and closed once ctx is done.
+func (w *domainWatchers) watch(ctx context.Context) <-chan DomainEvent {
+	events := make(chan DomainEvent, 64)
+	w.lock.Lock()
+	if w.watchers == nil {
+		w.watchers = make(map[chan DomainEvent]struct{})
+	}
+	w.watchers[events] = struct{}{}
+	w.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		w.lock.Lock()
+		delete(w.watchers, events)
+		w.lock.Unlock()
+		close(events)
+	}()
+	return events
+}
+
+// notify sends event to every watcher. Watchers that fall behind miss events
+// rather than blocking writers.
+func (w *domainWatchers) notify(event DomainEvent) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for events := range w.watchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Domains returns the registry of the domains served by storage, creating it on
+// first use. Cached certificates are dropped whenever a registered domain changes.
+// Returns:
+//   - *DomainRegistry: the domain registry.
+func (s *Storage) Domains() *DomainRegistry {
+	s.domainsOnce.Do(func() {
+		s.domains = NewDomainRegistry()
+		s.domains.Subscribe(func(event DomainEvent) {
+			s.invalidateCertificates(event.Domain)
+		})
+	})
+	return s.domains
+}
+
+// loadDomains registers the domains of the store.
+// Returns:
+//   - error: error if the domains cannot be listed.
+func (s *Storage) loadDomains() error {
+	domains, err := s.Store.List(context.Background())
+	if err != nil {
+		return fmt.Errorf("loading domains: %v", err)
+	}
+	// Domains written by older versions keep routing and certificate details in their metadata.
+	for i, domainMetadata := range domains {
+		migrated := proto.Clone(domainMetadata).(*DomainMetadata)
+		if !MigrateDomainMetadata(migrated) {
+			continue
+		}
+		if err := s.Store.Put(context.Background(), migrated); err != nil {
+			return fmt.Errorf("migrating domain %s: %v", migrated.Domain, err)
+		}
+		domains[i] = migrated
+	}
+	s.domainLock.Lock()
+	s.Domains().Replace(domains)
+	s.domainLock.Unlock()
+	return nil
+}
+
+// watchDomains keeps the registered domains in sync with the changes reported by the
+// store, including those made by other instances, until Close is called.
+// Parameters:
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - error: error if the store cannot be watched.
+func (s *Storage) watchDomains(wg *sync.WaitGroup) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := s.Store.Watch(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("watching domains: %v", err)
+	}
+	s.stopWatch = cancel
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for event := range events {
+			s.refreshDomain(event.Domain)
+		}
+	}()
+	return nil
+}
+
+// refreshDomain reloads a changed domain from the store into the registry.
+// Parameters:
+//   - domainName: string, the changed domain.
+func (s *Storage) refreshDomain(domainName string) {
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+
+	domainMetadata, err := s.Store.Get(context.Background(), domainName)
+	switch {
+	case errors.Is(err, ErrDomainNotFound):
+		s.Domains().Delete(domainName)
+	case err == nil:
+		// Changes made by this instance are already registered.
+		if registered, ok := s.Domains().Get(domainName); !ok || !proto.Equal(registered, domainMetadata) {
+			s.Domains().Put(domainMetadata)
+		}
+	}
+}
+
+// RestoreDomains stores domains saved by the shutdown persistence. Persistent
+// stores already hold their domains, so domains are only restored into memory storage.
+// Parameters:
+//   - domains: []*DomainMetadata, the saved domains.
+//
+// Returns:
+//   - error: error if a domain cannot be stored.
+func (s *Storage) RestoreDomains(domains []*DomainMetadata) error {
+	if _, memory := s.Store.(*MemoryDomainStore); s.Store != nil && !memory {
+		return nil
+	}
+	s.domainLock.Lock()
+	defer s.domainLock.Unlock()
+	for _, domainMetadata := range domains {
+		if err := s.putDomainMetadata(domainMetadata); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops following the store and closes it.
+// Returns:
+//   - error: error if the store cannot be closed.
+func (s *Storage) Close() error {
+	if s.Cluster != nil {
+		s.Cluster.Stop()
+	}
+	if s.stopWatch != nil {
+		s.stopWatch()
+	}
+	if s.stopMonitor != nil {
+		s.stopMonitor()
+	}
+	if s.Store == nil {
+		return nil
+	}
+	return s.Store.Close()
+}
@@ -0,0 +1,124 @@
+package domains
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/proto"
+)
+
+// boltDomainsBucket is the bucket domains are stored in.
+var boltDomainsBucket = []byte("domains")
+
+// BoltDomainStore stores domains in a bolt database file. The file is locked by
+// the process that opened it, so it cannot be shared between instances.
+type BoltDomainStore struct {
+	db       *bolt.DB
+	watchers domainWatchers
+}
+
+// NewBoltDomainStore opens or creates the bolt database at path.
+// Parameters:
+//   - path: string, the database file.
+//
+// Returns:
+//   - *BoltDomainStore: the store.
+//   - error: error if the path is empty or the database cannot be opened.
+func NewBoltDomainStore(path string) (*BoltDomainStore, error) {
+	if path == "" {
+		return nil, errors.New("storage.filepath is required for file storage")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltDomainsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDomainStore{db: db}, nil
+}
+
+// Get returns the stored domain, or ErrDomainNotFound.
+func (b *BoltDomainStore) Get(ctx context.Context, domainName string) (*DomainMetadata, error) {
+	domainMetadata := &DomainMetadata{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		body := tx.Bucket(boltDomainsBucket).Get([]byte(domainName))
+		if body == nil {
+			return ErrDomainNotFound
+		}
+		return proto.Unmarshal(body, domainMetadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domainMetadata, nil
+}
+
+// Put stores the domain, replacing any stored version.
+func (b *BoltDomainStore) Put(ctx context.Context, domainMetadata *DomainMetadata) error {
+	body, err := proto.Marshal(domainMetadata)
+	if err != nil {
+		return err
+	}
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDomainsBucket).Put([]byte(domainMetadata.Domain), body)
+	})
+	if err != nil {
+		return err
+	}
+	b.watchers.notify(DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+	return nil
+}
+
+// Delete removes the domain, or returns ErrDomainNotFound.
+func (b *BoltDomainStore) Delete(ctx context.Context, domainName string) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltDomainsBucket)
+		if bucket.Get([]byte(domainName)) == nil {
+			return ErrDomainNotFound
+		}
+		return bucket.Delete([]byte(domainName))
+	})
+	if err != nil {
+		return err
+	}
+	b.watchers.notify(DomainEvent{Type: DomainEventDelete, Domain: domainName})
+	return nil
+}
+
+// List returns every stored domain.
+func (b *BoltDomainStore) List(ctx context.Context) ([]*DomainMetadata, error) {
+	var domains []*DomainMetadata
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltDomainsBucket).ForEach(func(key, body []byte) error {
+			domainMetadata := &DomainMetadata{}
+			if err := proto.Unmarshal(body, domainMetadata); err != nil {
+				return fmt.Errorf("domain %s: %v", key, err)
+			}
+			domains = append(domains, domainMetadata)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return domains, nil
+}
+
+// Watch reports the changes made through the store until ctx is done.
+func (b *BoltDomainStore) Watch(ctx context.Context) (<-chan DomainEvent, error) {
+	return b.watchers.watch(ctx), nil
+}
+
+// Close closes the database file.
+func (b *BoltDomainStore) Close() error {
+	return b.db.Close()
+}
@@ -0,0 +1,74 @@
+package domains
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryDomainStore keeps domains in process memory; they are lost on exit
+// unless saved by the shutdown persistence.
+type MemoryDomainStore struct {
+	lock     sync.RWMutex
+	domains  map[string]*DomainMetadata
+	watchers domainWatchers
+}
+
+// NewMemoryDomainStore creates an empty in-memory domain store.
+func NewMemoryDomainStore() *MemoryDomainStore {
+	return &MemoryDomainStore{domains: make(map[string]*DomainMetadata)}
+}
+
+// Get returns the stored domain, or ErrDomainNotFound. The stored value is
+// returned as is and must be cloned before it is modified.
+func (m *MemoryDomainStore) Get(ctx context.Context, domainName string) (*DomainMetadata, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	domainMetadata, ok := m.domains[domainName]
+	if !ok {
+		return nil, ErrDomainNotFound
+	}
+	return domainMetadata, nil
+}
+
+// Put stores the domain, replacing any stored version.
+func (m *MemoryDomainStore) Put(ctx context.Context, domainMetadata *DomainMetadata) error {
+	m.lock.Lock()
+	m.domains[domainMetadata.Domain] = domainMetadata
+	m.lock.Unlock()
+	m.watchers.notify(DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+	return nil
+}
+
+// Delete removes the domain, or returns ErrDomainNotFound.
+func (m *MemoryDomainStore) Delete(ctx context.Context, domainName string) error {
+	m.lock.Lock()
+	_, ok := m.domains[domainName]
+	delete(m.domains, domainName)
+	m.lock.Unlock()
+	if !ok {
+		return ErrDomainNotFound
+	}
+	m.watchers.notify(DomainEvent{Type: DomainEventDelete, Domain: domainName})
+	return nil
+}
+
+// List returns every stored domain.
+func (m *MemoryDomainStore) List(ctx context.Context) ([]*DomainMetadata, error) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	domains := make([]*DomainMetadata, 0, len(m.domains))
+	for _, domainMetadata := range m.domains {
+		domains = append(domains, domainMetadata)
+	}
+	return domains, nil
+}
+
+// Watch reports the changes made through the store until ctx is done.
+func (m *MemoryDomainStore) Watch(ctx context.Context) (<-chan DomainEvent, error) {
+	return m.watchers.watch(ctx), nil
+}
+
+// Close is a no-op for the memory store.
+func (m *MemoryDomainStore) Close() error {
+	return nil
+}
@@ -0,0 +1,198 @@
+package domains
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// redisDomainKeyPrefix prefixes the Redis keys domains are stored under.
+	redisDomainKeyPrefix = "shiroxy:domain:"
+	// redisDomainEventsChannel is the pub/sub channel domain changes are published on.
+	redisDomainEventsChannel = "shiroxy:domain-events"
+	// redisLegacyDomainKeyPattern matches the bare domain names earlier versions stored domains under.
+	redisLegacyDomainKeyPattern = "*.*"
+	// redisLegacyKeysMigratedKey is set once the legacy domain keys have been migrated.
+	redisLegacyKeysMigratedKey = "shiroxy:migrations:legacy-domain-keys"
+)
+
+// RedisDomainStore stores domains in Redis and publishes every change, so all
+// instances sharing the database see the changes made by the others.
+type RedisDomainStore struct {
+	Client redis.UniversalClient
+}
+
+// NewRedisDomainStore creates a domain store on client, moving domains stored by
+// earlier versions under their bare name to prefixed keys.
+// Parameters:
+//   - ctx: context.Context, bounds the migration.
+//   - client: redis.UniversalClient, the connected Redis client.
+//
+// Returns:
+//   - *RedisDomainStore: the store.
+//   - error: error if the legacy domains cannot be migrated.
+func NewRedisDomainStore(ctx context.Context, client redis.UniversalClient) (*RedisDomainStore, error) {
+	store := &RedisDomainStore{Client: client}
+	if err := store.migrateLegacyKeys(ctx); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrateLegacyKeys renames keys holding a domain stored under its bare name.
+// Only keys that look like domain names are read, and keys that do not decode to
+// the domain they are named after are left alone. The migration runs once per
+// database; earlier versions could not connect to a Redis Cluster, so clusters are skipped.
+func (r *RedisDomainStore) migrateLegacyKeys(ctx context.Context) error {
+	if _, ok := r.Client.(*redis.ClusterClient); ok {
+		return nil
+	}
+	migrated, err := r.Client.Exists(ctx, redisLegacyKeysMigratedKey).Result()
+	if err != nil {
+		return err
+	}
+	if migrated > 0 {
+		return nil
+	}
+	keys, err := scanKeys(ctx, r.Client, redisLegacyDomainKeyPattern)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if strings.HasPrefix(key, "shiroxy:") || strings.HasPrefix(key, acmeAccountKeyPrefix) {
+			continue
+		}
+		body, err := r.Client.Get(ctx, key).Bytes()
+		if err != nil {
+			continue // Not a string value.
+		}
+		domainMetadata := &DomainMetadata{}
+		if proto.Unmarshal(body, domainMetadata) != nil || domainMetadata.Domain != key {
+			continue
+		}
+		if err := r.Client.Rename(ctx, key, redisDomainKeyPrefix+key).Err(); err != nil {
+			return err
+		}
+	}
+	return r.Client.Set(ctx, redisLegacyKeysMigratedKey, "1", 0).Err()
+}
+
+// Get returns the stored domain, or ErrDomainNotFound.
+func (r *RedisDomainStore) Get(ctx context.Context, domainName string) (*DomainMetadata, error) {
+	body, err := r.Client.Get(ctx, redisDomainKeyPrefix+domainName).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrDomainNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	domainMetadata := &DomainMetadata{}
+	if err := proto.Unmarshal(body, domainMetadata); err != nil {
+		return nil, err
+	}
+	return domainMetadata, nil
+}
+
+// Put stores the domain and publishes the change.
+func (r *RedisDomainStore) Put(ctx context.Context, domainMetadata *DomainMetadata) error {
+	body, err := proto.Marshal(domainMetadata)
+	if err != nil {
+		return err
+	}
+	if err := r.Client.Set(ctx, redisDomainKeyPrefix+domainMetadata.Domain, body, 0).Err(); err != nil {
+		return err
+	}
+	return r.publish(ctx, DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+}
+
+// Delete removes the domain and publishes the change, or returns ErrDomainNotFound.
+func (r *RedisDomainStore) Delete(ctx context.Context, domainName string) error {
+	deleted, err := r.Client.Del(ctx, redisDomainKeyPrefix+domainName).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrDomainNotFound
+	}
+	return r.publish(ctx, DomainEvent{Type: DomainEventDelete, Domain: domainName})
+}
+
+// List returns every stored domain, scanning the domain key prefix on every node.
+func (r *RedisDomainStore) List(ctx context.Context) ([]*DomainMetadata, error) {
+	keys, err := scanKeys(ctx, r.Client, redisDomainKeyPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	var domains []*DomainMetadata
+	for _, key := range keys {
+		body, err := r.Client.Get(ctx, key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			continue // Deleted while scanning.
+		}
+		if err != nil {
+			return nil, err
+		}
+		domainMetadata := &DomainMetadata{}
+		if err := proto.Unmarshal(body, domainMetadata); err != nil {
+			return nil, err
+		}
+		domains = append(domains, domainMetadata)
+	}
+	return domains, nil
+}
+
+// Watch reports the changes published by every instance until ctx is done.
+func (r *RedisDomainStore) Watch(ctx context.Context) (<-chan DomainEvent, error) {
+	pubsub := r.Client.Subscribe(ctx, redisDomainEventsChannel)
+	// Wait for the subscription, so no change published after Watch returns is missed.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	events := make(chan DomainEvent, 64)
+	go func() {
+		defer close(events)
+		defer pubsub.Close()
+		messages := pubsub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message, ok := <-messages:
+				if !ok {
+					return
+				}
+				var event DomainEvent
+				if json.Unmarshal([]byte(message.Payload), &event) != nil {
+					continue
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Close closes the Redis client.
+func (r *RedisDomainStore) Close() error {
+	return r.Client.Close()
+}
+
+// publish announces a change to the watchers of every instance.
+func (r *RedisDomainStore) publish(ctx context.Context, event DomainEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return r.Client.Publish(ctx, redisDomainEventsChannel, body).Err()
+}
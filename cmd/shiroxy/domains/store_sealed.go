@@ -0,0 +1,161 @@
+package domains
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrEncryptionDisabled is returned when keys are rotated without storage.encryption.
+var ErrEncryptionDisabled = errors.New("storage.encryption is not enabled")
+
+// sealedDomainStore encrypts the private keys of the domains written to a
+// persistent store and decrypts them when they are read back. Keys stored in
+// plaintext by earlier versions are read as they are and encrypted on their next write.
+type sealedDomainStore struct {
+	DomainStore
+	envelope *Envelope // nil stores plaintext and refuses to read encrypted keys.
+}
+
+// domainKeyAssociatedData binds an encrypted field to its domain, so encrypted
+// keys cannot be swapped between domains.
+func domainKeyAssociatedData(domainName, field string) []byte {
+	return []byte("domain/" + domainName + "/" + field)
+}
+
+// sealedFields returns the private key fields of domainMetadata with their names.
+func sealedFields(domainMetadata *DomainMetadata) map[string]*[]byte {
+	return map[string]*[]byte{
+		"key_pem_block":            &domainMetadata.KeyPemBlock,
+		"acme_account_private_key": &domainMetadata.AcmeAccountPrivateKey,
+	}
+}
+
+// Get returns the stored domain with its private keys decrypted.
+func (s *sealedDomainStore) Get(ctx context.Context, domainName string) (*DomainMetadata, error) {
+	domainMetadata, err := s.DomainStore.Get(ctx, domainName)
+	if err != nil {
+		return nil, err
+	}
+	return domainMetadata, s.open(domainMetadata)
+}
+
+// Put stores the domain with its private keys encrypted.
+func (s *sealedDomainStore) Put(ctx context.Context, domainMetadata *DomainMetadata) error {
+	if s.envelope == nil {
+		return s.DomainStore.Put(ctx, domainMetadata)
+	}
+	sealed := proto.Clone(domainMetadata).(*DomainMetadata)
+	for field, value := range sealedFields(sealed) {
+		if len(*value) == 0 {
+			continue
+		}
+		encrypted, err := s.envelope.Seal(*value, domainKeyAssociatedData(sealed.Domain, field))
+		if err != nil {
+			return err
+		}
+		*value = encrypted
+	}
+	return s.DomainStore.Put(ctx, sealed)
+}
+
+// List returns every stored domain with its private keys decrypted.
+func (s *sealedDomainStore) List(ctx context.Context) ([]*DomainMetadata, error) {
+	domains, err := s.DomainStore.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, domainMetadata := range domains {
+		if err := s.open(domainMetadata); err != nil {
+			return nil, err
+		}
+	}
+	return domains, nil
+}
+
+// open decrypts the private keys of a domain decoded from the store in place.
+func (s *sealedDomainStore) open(domainMetadata *DomainMetadata) error {
+	for field, value := range sealedFields(domainMetadata) {
+		if !IsSealed(*value) {
+			continue
+		}
+		if s.envelope == nil {
+			return ErrSealedWithoutKey
+		}
+		plaintext, err := s.envelope.Open(*value, domainKeyAssociatedData(domainMetadata.Domain, field))
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// reseal encrypts again, with the active master key, every domain whose private
+// keys are in plaintext or encrypted with an older master key.
+// Returns:
+//   - int: the number of domains rewritten.
+//   - error: error if a domain cannot be read or written.
+func (s *sealedDomainStore) reseal(ctx context.Context) (int, error) {
+	domains, err := s.DomainStore.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+	resealed := 0
+	for _, domainMetadata := range domains {
+		stale := false
+		for _, value := range sealedFields(domainMetadata) {
+			if keyID, ok := SealedKeyID(*value); len(*value) > 0 && (!ok || keyID != s.envelope.KeyID()) {
+				stale = true
+			}
+		}
+		if !stale {
+			continue
+		}
+		if err := s.open(domainMetadata); err != nil {
+			return resealed, err
+		}
+		if err := s.Put(ctx, domainMetadata); err != nil {
+			return resealed, err
+		}
+		resealed++
+	}
+	return resealed, nil
+}
+
+// EncryptionRotation reports the records encrypted again by RotateEncryption.
+type EncryptionRotation struct {
+	KeyID    string `json:"key_id"`   // ID of the active master key.
+	Domains  int    `json:"domains"`  // Domains whose private keys were encrypted again.
+	Accounts int    `json:"accounts"` // ACME accounts whose private keys were encrypted again.
+}
+
+// RotateEncryption encrypts every stored private key that is in plaintext or
+// encrypted with an older master key with the active master key. After a new key
+// is put first in the key file, rotation lets the old key be removed. The
+// snapshots written from now on are encrypted with the active key; older ones
+// need the old key until the snapshot retention deletes them.
+// Returns:
+//   - *EncryptionRotation: the number of records encrypted again.
+//   - error: error if encryption is disabled or a record cannot be rewritten.
+func (s *Storage) RotateEncryption() (*EncryptionRotation, error) {
+	if s.Encryption == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	rotation := &EncryptionRotation{KeyID: s.Encryption.KeyID()}
+
+	if sealed, ok := s.Store.(*sealedDomainStore); ok {
+		s.domainLock.Lock()
+		resealed, err := sealed.reseal(context.Background())
+		s.domainLock.Unlock()
+		rotation.Domains = resealed
+		if err != nil {
+			return rotation, err
+		}
+	}
+
+	resealed, err := s.resealAccounts()
+	rotation.Accounts = resealed
+	return rotation, err
+}
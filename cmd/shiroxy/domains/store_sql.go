@@ -0,0 +1,215 @@
+package domains
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "github.com/lib/pq" // Registers the "postgres" driver.
+	"google.golang.org/protobuf/proto"
+)
+
+// sqlWatchPollInterval is how often SQL watchers poll for changes made by other instances.
+const sqlWatchPollInterval = 5 * time.Second
+
+// SQLDomainStore stores domains in a table of a SQLite or Postgres database.
+// Every write bumps the row version, which watchers poll to see the changes
+// made by other instances sharing the database.
+type SQLDomainStore struct {
+	db           *sql.DB
+	driver       string
+	pollInterval time.Duration
+	watchers     domainWatchers
+}
+
+// NewSQLDomainStore opens the database and creates the domains table if needed.
+// Parameters:
+//   - driver: string, the database/sql driver: "sqlite3" (cgo builds) or "postgres".
+//   - dsn: string, the data source name.
+//
+// Returns:
+//   - *SQLDomainStore: the store.
+//   - error: error if the database cannot be opened or the table cannot be created.
+func NewSQLDomainStore(driver, dsn string) (*SQLDomainStore, error) {
+	if driver == "" || dsn == "" {
+		return nil, errors.New("storage.sqldriver and storage.sqldsn are required for sql storage")
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := &SQLDomainStore{db: db, driver: driver, pollInterval: sqlWatchPollInterval}
+
+	blobType := "BLOB"
+	if driver == "postgres" {
+		blobType = "BYTEA"
+	}
+	_, err = db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS shiroxy_domains (
+		domain TEXT PRIMARY KEY,
+		metadata %s NOT NULL,
+		version BIGINT NOT NULL
+	)`, blobType))
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating domains table: %v", err)
+	}
+	return store, nil
+}
+
+// placeholder returns the n-th (1-based) query parameter in the driver's syntax.
+func (q *SQLDomainStore) placeholder(n int) string {
+	if q.driver == "postgres" {
+		return fmt.Sprintf("$%d", n)
+	}
+	return "?"
+}
+
+// Get returns the stored domain, or ErrDomainNotFound.
+func (q *SQLDomainStore) Get(ctx context.Context, domainName string) (*DomainMetadata, error) {
+	var body []byte
+	err := q.db.QueryRowContext(ctx, "SELECT metadata FROM shiroxy_domains WHERE domain = "+q.placeholder(1), domainName).Scan(&body)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrDomainNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	domainMetadata := &DomainMetadata{}
+	if err := proto.Unmarshal(body, domainMetadata); err != nil {
+		return nil, err
+	}
+	return domainMetadata, nil
+}
+
+// Put stores the domain, replacing any stored version.
+func (q *SQLDomainStore) Put(ctx context.Context, domainMetadata *DomainMetadata) error {
+	body, err := proto.Marshal(domainMetadata)
+	if err != nil {
+		return err
+	}
+	_, err = q.db.ExecContext(ctx, fmt.Sprintf(`INSERT INTO shiroxy_domains (domain, metadata, version) VALUES (%s, %s, 1)
+		ON CONFLICT (domain) DO UPDATE SET metadata = excluded.metadata, version = shiroxy_domains.version + 1`,
+		q.placeholder(1), q.placeholder(2)), domainMetadata.Domain, body)
+	if err != nil {
+		return err
+	}
+	q.watchers.notify(DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+	return nil
+}
+
+// Delete removes the domain, or returns ErrDomainNotFound.
+func (q *SQLDomainStore) Delete(ctx context.Context, domainName string) error {
+	result, err := q.db.ExecContext(ctx, "DELETE FROM shiroxy_domains WHERE domain = "+q.placeholder(1), domainName)
+	if err != nil {
+		return err
+	}
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return ErrDomainNotFound
+	}
+	q.watchers.notify(DomainEvent{Type: DomainEventDelete, Domain: domainName})
+	return nil
+}
+
+// List returns every stored domain.
+func (q *SQLDomainStore) List(ctx context.Context) ([]*DomainMetadata, error) {
+	rows, err := q.db.QueryContext(ctx, "SELECT domain, metadata FROM shiroxy_domains")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var domains []*DomainMetadata
+	for rows.Next() {
+		var domainName string
+		var body []byte
+		if err := rows.Scan(&domainName, &body); err != nil {
+			return nil, err
+		}
+		domainMetadata := &DomainMetadata{}
+		if err := proto.Unmarshal(body, domainMetadata); err != nil {
+			return nil, fmt.Errorf("domain %s: %v", domainName, err)
+		}
+		domains = append(domains, domainMetadata)
+	}
+	return domains, rows.Err()
+}
+
+// versions returns the row version of every stored domain.
+func (q *SQLDomainStore) versions(ctx context.Context) (map[string]int64, error) {
+	rows, err := q.db.QueryContext(ctx, "SELECT domain, version FROM shiroxy_domains")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[string]int64)
+	for rows.Next() {
+		var domainName string
+		var version int64
+		if err := rows.Scan(&domainName, &version); err != nil {
+			return nil, err
+		}
+		versions[domainName] = version
+	}
+	return versions, rows.Err()
+}
+
+// Watch reports the changes made through the store immediately, and the changes
+// made by other instances when the table is next polled, until ctx is done.
+func (q *SQLDomainStore) Watch(ctx context.Context) (<-chan DomainEvent, error) {
+	versions, err := q.versions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	local := q.watchers.watch(ctx)
+
+	events := make(chan DomainEvent, 64)
+	go func() {
+		defer close(events)
+		ticker := time.NewTicker(q.pollInterval)
+		defer ticker.Stop()
+
+		send := func(event DomainEvent) bool {
+			select {
+			case events <- event:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event, ok := <-local:
+				if !ok || !send(event) {
+					return
+				}
+			case <-ticker.C:
+				current, err := q.versions(ctx)
+				if err != nil {
+					continue // Retried on the next tick.
+				}
+				for domainName, version := range current {
+					if versions[domainName] != version && !send(DomainEvent{Type: DomainEventPut, Domain: domainName}) {
+						return
+					}
+				}
+				for domainName := range versions {
+					if _, ok := current[domainName]; !ok && !send(DomainEvent{Type: DomainEventDelete, Domain: domainName}) {
+						return
+					}
+				}
+				versions = current
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Close closes the database.
+func (q *SQLDomainStore) Close() error {
+	return q.db.Close()
+}
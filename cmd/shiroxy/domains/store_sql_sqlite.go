@@ -0,0 +1,7 @@
+//go:build cgo
+
+package domains
+
+import (
+	_ "github.com/mattn/go-sqlite3" // Registers the "sqlite3" driver; requires cgo.
+)
@@ -0,0 +1,295 @@
+package domains
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"shiroxy/pkg/models"
+	"slices"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"google.golang.org/protobuf/proto"
+)
+
+// testDomainStore runs the behaviour every DomainStore must share against store.
+func testDomainStore(t *testing.T, store DomainStore) {
+	t.Helper()
+	ctx := context.Background()
+	defer store.Close()
+
+	watchCtx, stopWatch := context.WithCancel(ctx)
+	defer stopWatch()
+	events, err := store.Watch(watchCtx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	if _, err := store.Get(ctx, "missing.example.com"); !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("get missing domain: expected ErrDomainNotFound, got %v", err)
+	}
+	if err := store.Delete(ctx, "missing.example.com"); !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("delete missing domain: expected ErrDomainNotFound, got %v", err)
+	}
+
+	first := &DomainMetadata{Domain: "a.example.com", Status: "inactive", Aliases: []string{"www.a.example.com"}, Metadata: map[string]string{"team": "web"}}
+	second := &DomainMetadata{Domain: "b.example.com", Status: "active"}
+	for _, domainMetadata := range []*DomainMetadata{first, second} {
+		if err := store.Put(ctx, domainMetadata); err != nil {
+			t.Fatalf("put %s: %v", domainMetadata.Domain, err)
+		}
+		expectDomainEvent(t, events, DomainEvent{Type: DomainEventPut, Domain: domainMetadata.Domain})
+	}
+
+	stored, err := store.Get(ctx, first.Domain)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	if !proto.Equal(stored, first) {
+		t.Fatalf("expected %v, got %v", first, stored)
+	}
+
+	updated := proto.Clone(first).(*DomainMetadata)
+	updated.Status = "active"
+	if err := store.Put(ctx, updated); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+	expectDomainEvent(t, events, DomainEvent{Type: DomainEventPut, Domain: first.Domain})
+	if stored, err := store.Get(ctx, first.Domain); err != nil || stored.Status != "active" {
+		t.Fatalf("expected the overwritten domain, got %v, %v", stored, err)
+	}
+
+	domains, err := store.List(ctx)
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	var names []string
+	for _, domainMetadata := range domains {
+		names = append(names, domainMetadata.Domain)
+	}
+	sort.Strings(names)
+	if !slices.Equal(names, []string{"a.example.com", "b.example.com"}) {
+		t.Fatalf("unexpected listed domains %v", names)
+	}
+
+	if err := store.Delete(ctx, second.Domain); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	expectDomainEvent(t, events, DomainEvent{Type: DomainEventDelete, Domain: second.Domain})
+	if _, err := store.Get(ctx, second.Domain); !errors.Is(err, ErrDomainNotFound) {
+		t.Fatalf("get deleted domain: expected ErrDomainNotFound, got %v", err)
+	}
+
+	stopWatch()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatalf("watch channel not closed after its context was cancelled")
+		}
+	}
+}
+
+// expectDomainEvent waits for the next event of events and compares it to expected.
+func expectDomainEvent(t *testing.T, events <-chan DomainEvent, expected DomainEvent) {
+	t.Helper()
+	select {
+	case event := <-events:
+		if event != expected {
+			t.Fatalf("expected event %+v, got %+v", expected, event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for event %+v", expected)
+	}
+}
+
+func TestMemoryDomainStore(t *testing.T) {
+	testDomainStore(t, NewMemoryDomainStore())
+}
+
+func TestBoltDomainStore(t *testing.T) {
+	store, err := NewBoltDomainStore(filepath.Join(t.TempDir(), "domains.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testDomainStore(t, store)
+}
+
+func TestBoltDomainStoreRequiresPath(t *testing.T) {
+	if _, err := NewBoltDomainStore(""); err == nil {
+		t.Fatalf("expected an error without a file path")
+	}
+}
+
+func TestSQLDomainStore(t *testing.T) {
+	if !slices.Contains(sql.Drivers(), "sqlite3") {
+		t.Skip("sqlite3 driver requires cgo")
+	}
+	store, err := NewSQLDomainStore("sqlite3", filepath.Join(t.TempDir(), "domains.db"))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testDomainStore(t, store)
+}
+
+func TestSQLDomainStoreSeesOtherInstances(t *testing.T) {
+	if !slices.Contains(sql.Drivers(), "sqlite3") {
+		t.Skip("sqlite3 driver requires cgo")
+	}
+	dsn := filepath.Join(t.TempDir(), "domains.db")
+	watching, err := NewSQLDomainStore("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer watching.Close()
+	watching.pollInterval = 10 * time.Millisecond
+	writing, err := NewSQLDomainStore("sqlite3", dsn)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer writing.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := watching.Watch(ctx)
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	if err := writing.Put(ctx, &DomainMetadata{Domain: "example.com"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	expectDomainEvent(t, events, DomainEvent{Type: DomainEventPut, Domain: "example.com"})
+	if err := writing.Delete(ctx, "example.com"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	expectDomainEvent(t, events, DomainEvent{Type: DomainEventDelete, Domain: "example.com"})
+}
+
+func TestRedisDomainStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	store, err := NewRedisDomainStore(context.Background(), redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	testDomainStore(t, store)
+}
+
+func TestRedisDomainStoreMigratesLegacyKeys(t *testing.T) {
+	server := miniredis.RunT(t)
+	body, err := proto.Marshal(&DomainMetadata{Domain: "example.com", Status: "active"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	server.Set("example.com", string(body))
+	server.Set("unrelated", "value")
+
+	store, err := NewRedisDomainStore(context.Background(), redis.NewClient(&redis.Options{Addr: server.Addr()}))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+
+	if server.Exists("example.com") || !server.Exists(redisDomainKeyPrefix+"example.com") {
+		t.Fatalf("expected the legacy domain key to be renamed, keys: %v", server.Keys())
+	}
+	if !server.Exists("unrelated") {
+		t.Fatalf("expected unrelated keys to be left alone")
+	}
+	if domainMetadata, err := store.Get(context.Background(), "example.com"); err != nil || domainMetadata.Status != "active" {
+		t.Fatalf("expected the migrated domain, got %v, %v", domainMetadata, err)
+	}
+}
+
+func TestRedisDomainStoreMigratesLegacyKeysOnce(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	store, err := NewRedisDomainStore(context.Background(), client)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if !server.Exists(redisLegacyKeysMigratedKey) {
+		t.Fatalf("expected the migration to be marked as done")
+	}
+
+	// Keys written after the migration are never scanned again.
+	body, err := proto.Marshal(&DomainMetadata{Domain: "example.com"})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	server.Set("example.com", string(body))
+	store, err = NewRedisDomainStore(context.Background(), client)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if !server.Exists("example.com") {
+		t.Fatalf("expected the migration to run only once")
+	}
+}
+
+func TestNewDomainStoreUnknownLocation(t *testing.T) {
+	if _, err := NewDomainStore(&models.Storage{Location: "tape"}, nil); err == nil {
+		t.Fatalf("expected an error for an unknown storage location")
+	}
+}
+
+func TestInitializeStorage_RedisSharesDomains(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := &models.Storage{Location: "redis", RedisConnectionString: "redis://" + server.Addr()}
+
+	var wg sync.WaitGroup
+	first, err := InitializeStorage(config, "", "yes", nil, &wg)
+	if err != nil {
+		t.Fatalf("initialize first storage: %v", err)
+	}
+	second, err := InitializeStorage(config, "", "yes", nil, &wg)
+	if err != nil {
+		t.Fatalf("initialize second storage: %v", err)
+	}
+	defer wg.Wait()
+	defer first.Close()
+	defer second.Close()
+
+	first.domainLock.Lock()
+	err = first.storeDomainMetadata(&DomainMetadata{Domain: "example.com", Status: "active", Aliases: []string{"www.example.com"}})
+	first.domainLock.Unlock()
+	if err != nil {
+		t.Fatalf("store: %v", err)
+	}
+
+	// The writing instance routes the domain straight away.
+	if _, ok := first.ResolveDomain("www.example.com"); !ok {
+		t.Fatalf("expected the writing storage to resolve the alias")
+	}
+	waitForResolve(t, second, "www.example.com", true)
+
+	if err := first.RemoveDomain("example.com"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	waitForResolve(t, second, "example.com", false)
+}
+
+// waitForResolve polls until hostname resolves (or stops resolving) on st.
+func waitForResolve(t *testing.T, st *Storage, hostname string, resolves bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := st.ResolveDomain(hostname); ok == resolves {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s to resolve: %v", hostname, resolves)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
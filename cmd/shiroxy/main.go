@@ -40,6 +40,9 @@ func main() {
 	if err != nil {
 		log.Fatal(err) // Terminate if configuration reading fails.
 	}
+	if configuration == nil {
+		return // A subcommand (or the help output) ran instead of the proxy.
+	}
 
 	// Injecting logger with configuration
 	logHandler.InjectLogConfig(&configuration.Logging)
@@ -59,15 +62,48 @@ func main() {
 	}
 
 	logHandler.LogWarning(fmt.Sprintf("Runnig shiroxy in %s MODE", configuration.Runtime.Mode), "STARTUP", "INFO")
-	err = utils.CheckAcmeServer(ACME_SERVER_URL)
-	if err != nil {
-		logHandler.LogError(fmt.Sprintf("amce server error: %s", err.Error()), "Startup", "main")
+	if len(configuration.Runtime.Issuers) == 0 {
+		err = utils.CheckAcmeServer(ACME_SERVER_URL)
+		if err != nil {
+			logHandler.LogError(fmt.Sprintf("amce server error: %s", err.Error()), "Startup", "main")
+		}
 	}
 
 	// Starting storage service for storing domain and user data
-	storageHandler, err := domains.InitializeStorage(&configuration.Default.Storage, ACME_SERVER_URL, configuration.Runtime.ACMEServerInsecureSkipVerify, &wg)
+	storageHandler, err := domains.InitializeStorage(&configuration.Default.Storage, ACME_SERVER_URL, configuration.Runtime.ACMEServerInsecureSkipVerify, logHandler, &wg)
+	if err != nil {
+		logHandler.LogError(err.Error(), "Startup", "main")
+		log.Fatal(err) // Nothing can be served without the domains.
+	}
+
+	// Configuring the named ACME issuers; without them every certificate is ordered from ACME_SERVER_URL
+	storageHandler.Issuers, err = domains.NewACMEIssuers(configuration.Runtime.Issuers)
+	if err != nil {
+		logHandler.LogError(err.Error(), "Startup", "main")
+		log.Fatal(err) // Falling back to ACME_SERVER_URL would order certificates from the wrong CA.
+	}
+	for _, issuer := range storageHandler.Issuers {
+		if issuer.Local != nil {
+			continue // The local CA issues certificates without a server.
+		}
+		err = utils.CheckAcmeServer(issuer.DirectoryURL)
+		if err != nil {
+			logHandler.LogError(fmt.Sprintf("amce issuer %s error: %s", issuer.Name, err.Error()), "Startup", "main")
+		}
+	}
+
+	// Configuring the DNS provider used for dns-01 challenges (required for wildcard domains)
+	storageHandler.DNSProvider, err = domains.NewDNSProvider(configuration.Default.DnsProvider)
 	if err != nil {
 		logHandler.LogError(err.Error(), "Startup", "main")
+		log.Fatal(err) // Wildcard and dns-01 domains could never be issued.
+	}
+	storageHandler.DNSPropagationDelay = time.Duration(configuration.Default.DnsProvider.PropagationDelay) * time.Second
+
+	// Joining the cluster of instances sharing the Redis storage and campaigning for its leadership
+	cluster, err := domains.StartCluster(storageHandler, configuration.Default.Cluster, &wg)
+	if err != nil {
+		log.Fatal(err) // Running alone would issue and renew next to the leader.
 	}
 
 	// Set analytics collection interval; default to 10 if not specified in the configuration.
@@ -85,13 +121,19 @@ func main() {
 	}
 
 	// Loading data that was persisted during the last shutdown or failover
-	shutdown.LoadShutdownPersistence(*logHandler, configuration, storageHandler, analyticsConfiguration)
+	snapshot, err := shutdown.LoadShutdownPersistence(*logHandler, configuration, storageHandler, analyticsConfiguration)
+	if err != nil {
+		log.Fatal(err) // Terminate rather than overwrite the saved state with an empty one.
+	}
+
+	// Starting periodic and on-change snapshots, so a crash only loses the latest changes
+	snapshotter := shutdown.StartSnapshotter(configuration, storageHandler, analyticsConfiguration, logHandler, &wg)
 
 	// Starting service that handles graceful shutdown, performing cleanup and data persistence
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		shutdown.HandleGracefulShutdown(false, nil, configuration, storageHandler, logHandler, analyticsConfiguration, &wg)
+		shutdown.HandleGracefulShutdown(false, nil, configuration, storageHandler, logHandler, analyticsConfiguration, snapshotter, &wg)
 	}()
 
 	// Deferred function to handle any panic that occurs in the main function, enabling graceful shutdown.
@@ -101,7 +143,7 @@ func main() {
 				fmt.Printf("Panic occurred: %v\n", r)
 				debug.PrintStack()
 			}
-			shutdown.HandleGracefulShutdown(true, r, configuration, storageHandler, logHandler, analyticsConfiguration, &wg)
+			shutdown.HandleGracefulShutdown(true, r, configuration, storageHandler, logHandler, analyticsConfiguration, snapshotter, &wg)
 		}
 	}()
 
@@ -110,6 +152,30 @@ func main() {
 	if err != nil {
 		logHandler.LogError(err.Error(), "Webhook", "main")
 	}
+	if cluster != nil {
+		// Only the leader fires webhooks; the other instances relay their events to it.
+		webhookHandler.Relay = cluster.RelayWebhook
+		cluster.DeliverWebhooks(webhookHandler.Fire)
+	}
+
+	// Starting the background certificate issuance queue and resuming orders interrupted by the last shutdown
+	issuanceQueue := domains.StartIssuanceQueue(storageHandler, configuration.Default.Issuance, webhookHandler.Fire, &wg)
+	err = issuanceQueue.ResumePending()
+	if err != nil {
+		logHandler.LogError(err.Error(), "Issuance", "main")
+	}
+
+	// Starting the OCSP stapling manager
+	domains.StartOCSPManager(storageHandler, configuration.Default.OCSP, webhookHandler.Fire, &wg)
+
+	// Enabling on-demand TLS, which registers approved hostnames on their first handshake
+	_, err = domains.StartOnDemandTLS(storageHandler, configuration.Default.OnDemandTLS, webhookHandler.Fire)
+	if err != nil {
+		logHandler.LogError(err.Error(), "OnDemandTLS", "main")
+	}
+
+	// Starting the certificate renewal scheduler
+	domains.StartRenewalManager(storageHandler, configuration.Default.Renewal, webhookHandler.Fire, &wg)
 
 	// Starting the proxy load balancer (Shiroxy handler)
 	laodBalancer, err := proxy.StartShiroxyHandler(configuration, storageHandler, webhookHandler, logHandler, &wg)
@@ -117,6 +183,23 @@ func main() {
 		panic(err) // Panic if the load balancer fails to start.
 	}
 
+	// Registering again the backends registered through the admin API before the last shutdown
+	shutdown.RestoreBackends(snapshot, laodBalancer, configuration, logHandler)
+	snapshotter.SetLoadBalancer(laodBalancer)
+	if cluster != nil {
+		// Load balancing the backends registered through the admin API of every instance
+		err = laodBalancer.JoinCluster(cluster, configuration.Frontend.Mode, logHandler, &wg)
+		if err != nil {
+			logHandler.LogError(err.Error(), "Cluster", "main")
+		}
+	}
+
+	// Keeping the domains in sync with the configured domain list
+	_, err = domains.StartDomainSync(storageHandler, configuration.Default.DomainSync, laodBalancer.ValidateDomainRecord, webhookHandler.Fire, &wg)
+	if err != nil {
+		logHandler.LogError(err.Error(), "DomainSync", "main")
+	}
+
 	// Starting the Shiroxy API service
 	api.StartShiroxyAPI(configuration, laodBalancer, storageHandler, analyticsConfiguration, logHandler, webhookHandler, &wg)
 
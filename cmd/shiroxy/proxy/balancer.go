@@ -6,12 +6,14 @@
 package proxy
 
 import (
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"shiroxy/cmd/shiroxy/domains" // Custom package for domain metadata handling.
 	"shiroxy/cmd/shiroxy/webhook" // Custom package for webhook handling.
+	"shiroxy/pkg/logger"          // Custom package for logging.
 	"shiroxy/pkg/models"          // Custom package for configuration models.
 	"shiroxy/public"              // Custom package for public constants and assets.
 	"sync"
@@ -51,6 +53,8 @@ type Server struct {
 	FireWebhookOnFirstHealthCheck bool     `json:"fire_webhook_on_first_health_check"` // Flag to trigger webhook on first successful health check.
 	Tags                          []string `json:"-"`                                  // Tags for routing purposes.
 	Lock                          *sync.RWMutex
+	Registered                    bool                 `json:"registered"` // Registered through the admin API rather than the config file.
+	Definition                    models.BackendServer `json:"-"`          // Settings the server was created from.
 }
 
 // LoadBalancer implements the main load-balancing logic, supporting various routing mechanisms.
@@ -281,21 +285,27 @@ func (lb *LoadBalancer) serveHTTP(w http.ResponseWriter, r *ShiroxyRequest) {
 				server = lb.selectServerBasedOnRule(clientIP, "")
 			} else {
 				// If it's not an IP, assume it's a domain name.
-				domainData := lb.DomainStorage.DomainMetadata[host]
-				if domainData == nil {
+				domainData, ok := lb.DomainStorage.ResolveDomain(host)
+				if !ok {
 					http.Error(w, "Domain not found", http.StatusNotFound)
 					return
 				}
+				if r.Request.TLS != nil {
+					if reason := misdirectedRequest(lb.DomainStorage, r.Request.TLS, domainData); reason != "" {
+						http.Error(w, reason, http.StatusMisdirectedRequest)
+						return
+					}
+				}
 
-				// Extract tags and apply tag rules.
-				tags := domainData.Metadata["tags"]
-				if tags == "" && lb.configuration.Backend.Tagrule == "strict" {
+				// Apply tag rules; a domain pinned to a backend needs no tags.
+				routing := domainData.GetRouting()
+				if len(routing.GetTags()) == 0 && routing.GetBackend() == "" && lb.configuration.Backend.Tagrule == "strict" {
 					http.Error(w, "No tag found and strict tag rule is enabled", http.StatusServiceUnavailable)
 					return
 				}
 
-				// Select the server based on the tags (or an empty tag if no tags are present).
-				server = lb.selectServerBasedOnRule(clientIP, tags)
+				// Select the server based on the domain's routing (or an empty tag if no tags are present).
+				server = lb.selectServerForDomain(clientIP, routing)
 			}
 		}
 
@@ -374,6 +384,95 @@ func (lb *LoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	lb.serveHTTP(w, shiroxyRequest)
 }
 
+// RegisterServer adds a server registered through the admin API.
+// Parameters:
+//   - server: *Server, the server to add.
+func (lb *LoadBalancer) RegisterServer(server *Server) {
+	lb.Mutex.Lock()
+	defer lb.Mutex.Unlock()
+	server.Registered = true
+	server.FireWebhookOnFirstHealthCheck = true
+	lb.Servers.Servers = append(lb.Servers.Servers, server)
+}
+
+// ServerDefinitions returns the settings of every server, for snapshots.
+// Returns:
+//   - []models.BackendServer: the server settings.
+//   - []bool: whether each server was registered through the admin API.
+func (lb *LoadBalancer) ServerDefinitions() ([]models.BackendServer, []bool) {
+	lb.Mutex.RLock()
+	defer lb.Mutex.RUnlock()
+	definitions := make([]models.BackendServer, 0, len(lb.Servers.Servers))
+	registered := make([]bool, 0, len(lb.Servers.Servers))
+	for _, server := range lb.Servers.Servers {
+		definitions = append(definitions, server.Definition)
+		registered = append(registered, server.Registered)
+	}
+	return definitions, registered
+}
+
+// HasServer reports whether a server with id is load balanced.
+func (lb *LoadBalancer) HasServer(id string) bool {
+	return lb.serverByID(id) != nil
+}
+
+// ValidateDomainRecord checks that the backend a domain record is pinned to is load balanced.
+// Parameters:
+//   - record: domains.DomainRecord, the record to check.
+//
+// Returns:
+//   - error: error if the backend is unknown.
+func (lb *LoadBalancer) ValidateDomainRecord(record domains.DomainRecord) error {
+	if record.Backend != "" && !lb.HasServer(record.Backend) {
+		return fmt.Errorf("backend %q is not registered", record.Backend)
+	}
+	return nil
+}
+
+// JoinCluster load balances the backends registered through the admin API of
+// any instance of the cluster, now and whenever one is registered later.
+// Parameters:
+//   - cluster: *domains.Cluster, the joined cluster.
+//   - frontendMode: string, the default scheme of the backends.
+//   - logHandler: *logger.Logger, logs backends that cannot be created.
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - error: error if the shared backends cannot be read or followed.
+func (lb *LoadBalancer) JoinCluster(cluster *domains.Cluster, frontendMode string, logHandler *logger.Logger, wg *sync.WaitGroup) error {
+	var registering sync.Mutex
+	register := func(backend models.BackendServer) {
+		registering.Lock()
+		defer registering.Unlock()
+		if lb.HasServer(backend.Id) {
+			return
+		}
+		server, err := NewBackendServer(backend, frontendMode, logHandler)
+		if err != nil {
+			logHandler.LogError(err.Error(), "Cluster", "Shared Backends")
+			return
+		}
+		// Unlike RegisterServer, no webhook is fired: the instance the backend
+		// was registered on fires it.
+		server.Registered = true
+		lb.Mutex.Lock()
+		lb.Servers.Servers = append(lb.Servers.Servers, server)
+		lb.Mutex.Unlock()
+	}
+	// Followed first, so no backend registered in between is missed.
+	if err := cluster.WatchBackends(register, wg); err != nil {
+		return err
+	}
+	backends, err := cluster.SharedBackends()
+	if err != nil {
+		return err
+	}
+	for _, backend := range backends {
+		register(backend)
+	}
+	return nil
+}
+
 // updateServerTags reindexes servers based on their tags and updates the caching mechanisms.
 // TODO: Integrate this function when implementing dynamic tag updates.
 //
@@ -432,6 +531,46 @@ func (lb *LoadBalancer) selectServerBasedOnRule(clientIP, tag string) *Server {
 	return lb.selectServerFromList(clientIP, lb.Servers, "")
 }
 
+// selectServerForDomain selects the server for a request to a domain: the backend the
+// domain is pinned to while it is alive, otherwise a server of the first of its tags
+// that has servers.
+// Parameters:
+//   - clientIP: string, the client's IP address for sticky sessions.
+//   - routing: *domains.DomainRouting, the routing of the domain (may be nil).
+//
+// Returns:
+//   - *Server: the selected server.
+func (lb *LoadBalancer) selectServerForDomain(clientIP string, routing *domains.DomainRouting) *Server {
+	if backend := routing.GetBackend(); backend != "" {
+		if server := lb.serverByID(backend); server != nil {
+			server.Lock.RLock()
+			alive := server.Alive
+			server.Lock.RUnlock()
+			if alive {
+				return server
+			}
+		}
+	}
+	for _, tag := range routing.GetTags() {
+		if _, found := lb.TagTrie.Search(tag); found {
+			return lb.selectServerBasedOnRule(clientIP, tag)
+		}
+	}
+	return lb.selectServerBasedOnRule(clientIP, "")
+}
+
+// serverByID returns the server with id, or nil if there is none.
+func (lb *LoadBalancer) serverByID(id string) *Server {
+	lb.Mutex.RLock()
+	defer lb.Mutex.RUnlock()
+	for _, server := range lb.Servers.Servers {
+		if server.Id == id {
+			return server
+		}
+	}
+	return nil
+}
+
 // selectServerFromList chooses a server based on the load balancing method.
 // Parameters:
 //   - clientIP: string, the client's IP address for sticky sessions.
@@ -176,3 +176,32 @@ func TestGetStickySessionServer(t *testing.T) {
 		t.Errorf("Expected sticky session to return the same server, got different servers: %s, %s", selectedServer.Id, selectedServer2.Id)
 	}
 }
+
+func TestRegisterServer(t *testing.T) {
+	configured, err := proxy.NewBackendServer(models.BackendServer{Id: "configured", Host: "127.0.0.1", Port: "8080"}, "http", nil)
+	if err != nil {
+		t.Fatalf("NewBackendServer: %v", err)
+	}
+	registered, err := proxy.NewBackendServer(models.BackendServer{Id: "registered", Host: "127.0.0.1", Port: "8081", Tags: "api"}, "http", nil)
+	if err != nil {
+		t.Fatalf("NewBackendServer: %v", err)
+	}
+	lb := &proxy.LoadBalancer{
+		Servers: &proxy.BackendServers{Servers: []*proxy.Server{configured}},
+	}
+
+	lb.RegisterServer(registered)
+	if !lb.HasServer("registered") || lb.HasServer("missing") {
+		t.Fatalf("expected only registered servers to be found")
+	}
+	definitions, flags := lb.ServerDefinitions()
+	if len(definitions) != 2 || definitions[1].Port != "8081" || definitions[1].Tags != "api" {
+		t.Fatalf("expected the definitions the servers were created from, got %+v", definitions)
+	}
+	if flags[0] || !flags[1] {
+		t.Fatalf("expected only the server registered through the API to be flagged, got %v", flags)
+	}
+	if !registered.FireWebhookOnFirstHealthCheck {
+		t.Fatalf("expected registered servers to fire a webhook on their first health check")
+	}
+}
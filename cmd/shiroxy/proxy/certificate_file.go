@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileCertificate serves a certificate and key loaded from disk. The pair is parsed
+// once and only reloaded when either file changes.
+type FileCertificate struct {
+	certPath string
+	keyPath  string
+
+	mu          sync.RWMutex
+	certificate *tls.Certificate
+	certStamp   fileStamp
+	keyStamp    fileStamp
+}
+
+// fileStamp identifies a version of a file by modification time and size.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// NewFileCertificate creates a FileCertificate for the given certificate and key files.
+func NewFileCertificate(certPath, keyPath string) *FileCertificate {
+	return &FileCertificate{certPath: certPath, keyPath: keyPath}
+}
+
+// GetCertificate returns the parsed certificate, reloading it if the files changed
+// since the last handshake. If a reload fails, the previous certificate keeps being served.
+func (f *FileCertificate) GetCertificate(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certStamp, certErr := statFile(f.certPath)
+	keyStamp, keyErr := statFile(f.keyPath)
+
+	f.mu.RLock()
+	certificate := f.certificate
+	unchanged := certStamp == f.certStamp && keyStamp == f.keyStamp
+	f.mu.RUnlock()
+
+	if certificate != nil && (unchanged || certErr != nil || keyErr != nil) {
+		return certificate, nil
+	}
+	if certErr != nil {
+		return nil, certErr
+	}
+	if keyErr != nil {
+		return nil, keyErr
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// Another handshake may have reloaded the files while waiting for the lock.
+	if f.certificate != nil && certStamp == f.certStamp && keyStamp == f.keyStamp {
+		return f.certificate, nil
+	}
+
+	loaded, err := tls.LoadX509KeyPair(f.certPath, f.keyPath)
+	if err == nil && loaded.Leaf == nil {
+		loaded.Leaf, err = x509.ParseCertificate(loaded.Certificate[0])
+	}
+	if err != nil {
+		if f.certificate != nil {
+			// The files may be half written; keep serving the last good pair and
+			// retry once either file changes again.
+			fmt.Printf("reloading certificate %s failed: %v\n", f.certPath, err)
+			f.certStamp = certStamp
+			f.keyStamp = keyStamp
+			return f.certificate, nil
+		}
+		return nil, err
+	}
+
+	f.certificate = &loaded
+	f.certStamp = certStamp
+	f.keyStamp = keyStamp
+	return f.certificate, nil
+}
+
+// statFile returns the current stamp of the file at path.
+func statFile(path string) (fileStamp, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{modTime: info.ModTime(), size: info.Size()}, nil
+}
@@ -0,0 +1,77 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"shiroxy/cmd/shiroxy/proxy"
+)
+
+func writeCertificateFiles(t *testing.T, certPath, keyPath string, modTime time.Time, names ...string) {
+	t.Helper()
+	certPEM, keyPEM := selfSignedPEM(t, names...)
+	for path, content := range map[string][]byte{certPath: certPEM, keyPath: keyPEM} {
+		if err := os.WriteFile(path, content, 0600); err != nil {
+			t.Fatalf("write %s: %v", path, err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("chtimes %s: %v", path, err)
+		}
+	}
+}
+
+func TestFileCertificate_ReloadsOnChange(t *testing.T) {
+	fmt.Println("TestFileCertificate_ReloadsOnChange")
+
+	dir := t.TempDir()
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+	writeCertificateFiles(t, certPath, keyPath, start, "first.example.com")
+
+	fileCertificate := proxy.NewFileCertificate(certPath, keyPath)
+	hello := &tls.ClientHelloInfo{ServerName: "first.example.com"}
+
+	first, err := fileCertificate.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("get certificate: %v", err)
+	}
+	if first.Leaf == nil || first.Leaf.DNSNames[0] != "first.example.com" {
+		t.Fatalf("expected leaf to be pre-parsed")
+	}
+	if again, _ := fileCertificate.GetCertificate(hello); again != first {
+		t.Fatalf("expected unchanged files to be served from the cache")
+	}
+
+	writeCertificateFiles(t, certPath, keyPath, start.Add(time.Minute), "second.example.com")
+	second, err := fileCertificate.GetCertificate(hello)
+	if err != nil {
+		t.Fatalf("get certificate after change: %v", err)
+	}
+	if second.Leaf.DNSNames[0] != "second.example.com" {
+		t.Fatalf("expected changed files to be reloaded, got %v", second.Leaf.DNSNames)
+	}
+
+	// A broken rewrite keeps the last good certificate in service.
+	if err := os.WriteFile(certPath, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := os.Chtimes(certPath, start.Add(2*time.Minute), start.Add(2*time.Minute)); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if current, err := fileCertificate.GetCertificate(hello); err != nil || current != second {
+		t.Fatalf("expected last good certificate to be served, got %v", err)
+	}
+}
+
+func TestFileCertificate_MissingFiles(t *testing.T) {
+	fmt.Println("TestFileCertificate_MissingFiles")
+
+	fileCertificate := proxy.NewFileCertificate("/nonexistent/cert.pem", "/nonexistent/key.pem")
+	if _, err := fileCertificate.GetCertificate(&tls.ClientHelloInfo{}); err == nil {
+		t.Fatalf("expected an error for missing certificate files")
+	}
+}
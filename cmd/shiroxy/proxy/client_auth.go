@@ -0,0 +1,398 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+)
+
+// Headers carrying the client certificate identity to the upstream servers.
+const (
+	HeaderClientCert            = "X-Client-Cert"
+	HeaderClientCertSubject     = "X-Client-Cert-Subject"
+	HeaderClientCertSANs        = "X-Client-Cert-SANs"
+	HeaderClientCertFingerprint = "X-Client-Cert-Fingerprint"
+	HeaderClientCertVerified    = "X-Client-Cert-Verified"
+)
+
+var clientIdentityHeaders = []string{
+	HeaderClientCert,
+	HeaderClientCertSubject,
+	HeaderClientCertSANs,
+	HeaderClientCertFingerprint,
+	HeaderClientCertVerified,
+}
+
+// ClientAuthenticator applies the client certificate settings of a bind and the
+// per-domain overrides to TLS handshakes.
+type ClientAuthenticator struct {
+	storage   *domains.Storage
+	mode      string
+	clientCAs *x509.CertPool
+	crls      *CRLSet
+
+	lock    sync.Mutex
+	configs map[string]*domainTLSConfig // Per-domain configurations by domain name.
+}
+
+// domainTLSConfig is a bind configuration adjusted to the client certificate policy of a domain.
+type domainTLSConfig struct {
+	base   *tls.Config
+	policy *domains.ClientAuthPolicy
+	config *tls.Config
+}
+
+// NewClientAuthenticator loads the client CA bundle and CRLs configured for a bind.
+// Parameters:
+//   - setting: models.FrontendSecuritySetting, the security settings of the bind.
+//   - storage: *domains.Storage, resolves per-domain overrides (may be nil).
+//
+// Returns:
+//   - *ClientAuthenticator: the authenticator.
+//   - error: error if the CA bundle or a CRL cannot be loaded.
+func NewClientAuthenticator(setting models.FrontendSecuritySetting, storage *domains.Storage) (*ClientAuthenticator, error) {
+	authenticator := &ClientAuthenticator{
+		storage: storage,
+		mode:    setting.SecureVerify,
+		configs: make(map[string]*domainTLSConfig),
+	}
+
+	switch setting.ClientAuth.CertificateHeader {
+	case "", "pem", "urlencoded":
+	default:
+		return nil, fmt.Errorf("unsupported client certificate header format %q", setting.ClientAuth.CertificateHeader)
+	}
+
+	if setting.ClientAuth.CAFile != "" {
+		bundle, err := os.ReadFile(setting.ClientAuth.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if authenticator.clientCAs, err = domains.ParseCertificatePool(bundle); err != nil {
+			return nil, fmt.Errorf("%s: %v", setting.ClientAuth.CAFile, err)
+		}
+	}
+	if len(setting.ClientAuth.CRLFiles) > 0 {
+		crls, err := NewCRLSet(setting.ClientAuth.CRLFiles)
+		if err != nil {
+			return nil, err
+		}
+		authenticator.crls = crls
+	}
+	return authenticator, nil
+}
+
+// apply sets the bind-wide client certificate settings on config.
+func (a *ClientAuthenticator) apply(config *tls.Config) {
+	config.ClientAuth = clientAuthType(a.mode, a.clientCAs != nil)
+	config.ClientCAs = a.clientCAs
+	if a.crls != nil {
+		config.VerifyConnection = a.VerifyConnection
+	}
+}
+
+// ConfigForClient returns the configuration for a handshake: base itself, or a copy
+// of it using the client certificate policy of the domain requested by hello.
+// Parameters:
+//   - base: *tls.Config, the configuration of the bind.
+//   - hello: *tls.ClientHelloInfo, the client hello.
+//
+// Returns:
+//   - *tls.Config: the configuration for the handshake.
+//   - error: error if the domain's CA bundle cannot be parsed.
+func (a *ClientAuthenticator) ConfigForClient(base *tls.Config, hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if a.storage == nil || hello.ServerName == "" {
+		return base, nil
+	}
+	domainMetadata, ok := a.storage.ResolveDomain(hello.ServerName)
+	if !ok || !domainMetadata.ClientAuth.IsSet() {
+		return base, nil
+	}
+	policy := domainMetadata.ClientAuth
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	// Updated domains get a new policy instance, which makes the cached entry stale.
+	if entry, ok := a.configs[domainMetadata.Domain]; ok && entry.base == base && entry.policy == policy {
+		return entry.config, nil
+	}
+
+	clientCAs, err := policy.ClientCAs()
+	if err != nil {
+		return nil, err
+	}
+	if clientCAs == nil {
+		clientCAs = a.clientCAs
+	}
+	mode := policy.Mode
+	if mode == "" {
+		mode = a.mode
+	}
+
+	config := base.Clone()
+	config.ClientAuth = clientAuthType(mode, clientCAs != nil)
+	config.ClientCAs = clientCAs
+	a.configs[domainMetadata.Domain] = &domainTLSConfig{base: base, policy: policy, config: config}
+	return config, nil
+}
+
+// misdirectedRequest reports why a TLS request for domainMetadata must be refused.
+// The client certificate policy is applied during the handshake to the domain named
+// by SNI, so a request whose Host belongs to another domain, e.g. through HTTP/2
+// connection coalescing, could skip the policy of the domain it is routed to.
+// Parameters:
+//   - storage: *domains.Storage, resolves the domain named by SNI.
+//   - state: *tls.ConnectionState, the TLS state of the request's connection.
+//   - domainMetadata: *domains.DomainMetadata, the domain resolved from the Host header.
+//
+// Returns:
+//   - string: the reason to refuse the request, or "" if it may be routed.
+func misdirectedRequest(storage *domains.Storage, state *tls.ConnectionState, domainMetadata *domains.DomainMetadata) string {
+	handshakeDomain, ok := storage.ResolveDomain(state.ServerName)
+	if !ok || handshakeDomain.Domain != domainMetadata.Domain {
+		return "Host does not match the TLS server name"
+	}
+	if domainMetadata.GetClientAuth().GetMode() == domains.ClientAuthRequired && len(state.VerifiedChains) == 0 {
+		return "Client certificate required"
+	}
+	return ""
+}
+
+// VerifyConnection rejects handshakes presenting a client certificate revoked by a configured CRL.
+func (a *ClientAuthenticator) VerifyConnection(state tls.ConnectionState) error {
+	for _, chain := range state.VerifiedChains {
+		for i := 0; i+1 < len(chain); i++ {
+			if a.crls.Revoked(chain[i], chain[i+1]) {
+				return fmt.Errorf("client certificate %s has been revoked", chain[i].SerialNumber.Text(16))
+			}
+		}
+	}
+	return nil
+}
+
+// clientAuthType maps a secureverify mode to a tls.ClientAuthType. Presented
+// certificates are only verified when a CA bundle is configured.
+func clientAuthType(mode string, hasClientCAs bool) tls.ClientAuthType {
+	if !hasClientCAs {
+		return ResolveSecurityPolicy(mode)
+	}
+	switch mode {
+	case domains.ClientAuthOptional:
+		return tls.VerifyClientCertIfGiven
+	case domains.ClientAuthRequired:
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
+}
+
+// CRLSet holds certificate revocation lists loaded from disk. The lists are
+// reloaded when any of the files changes.
+type CRLSet struct {
+	paths []string
+
+	mu     sync.RWMutex
+	lists  []*x509.RevocationList
+	stamps []fileStamp
+}
+
+// NewCRLSet loads the CRLs at paths.
+// Parameters:
+//   - paths: []string, PEM or DER encoded CRL files.
+//
+// Returns:
+//   - *CRLSet: the loaded CRLs.
+//   - error: error if a file cannot be read or parsed.
+func NewCRLSet(paths []string) (*CRLSet, error) {
+	set := &CRLSet{paths: paths}
+	lists, stamps, err := set.load()
+	if err != nil {
+		return nil, err
+	}
+	set.lists, set.stamps = lists, stamps
+	return set, nil
+}
+
+// Revoked reports whether certificate, issued by issuer, is listed in a CRL signed by issuer.
+func (c *CRLSet) Revoked(certificate, issuer *x509.Certificate) bool {
+	c.refresh()
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, list := range c.lists {
+		if !bytes.Equal(list.RawIssuer, certificate.RawIssuer) {
+			continue
+		}
+		for _, entry := range list.RevokedCertificateEntries {
+			if entry.SerialNumber.Cmp(certificate.SerialNumber) != 0 {
+				continue
+			}
+			// Only trust revocations from a CRL signed by the actual issuer.
+			if list.CheckSignatureFrom(issuer) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// refresh reloads the CRLs if a file changed. A failed reload keeps the previous lists.
+func (c *CRLSet) refresh() {
+	c.mu.RLock()
+	changed := false
+	for i, path := range c.paths {
+		stamp, err := statFile(path)
+		if err == nil && stamp != c.stamps[i] {
+			changed = true
+			break
+		}
+	}
+	c.mu.RUnlock()
+	if !changed {
+		return
+	}
+
+	lists, stamps, err := c.load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		fmt.Printf("reloading client certificate CRLs failed: %v\n", err)
+		for i, path := range c.paths {
+			if stamp, err := statFile(path); err == nil {
+				c.stamps[i] = stamp
+			}
+		}
+		return
+	}
+	c.lists, c.stamps = lists, stamps
+}
+
+// load reads and parses every CRL file.
+func (c *CRLSet) load() ([]*x509.RevocationList, []fileStamp, error) {
+	var lists []*x509.RevocationList
+	stamps := make([]fileStamp, len(c.paths))
+	for i, path := range c.paths {
+		stamp, err := statFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		stamps[i] = stamp
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		parsed, err := parseCRLs(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %v", path, err)
+		}
+		lists = append(lists, parsed...)
+	}
+	return lists, stamps, nil
+}
+
+// parseCRLs parses PEM encoded "X509 CRL" blocks, or a single DER encoded CRL.
+func parseCRLs(data []byte) ([]*x509.RevocationList, error) {
+	var lists []*x509.RevocationList
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			continue
+		}
+		list, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		lists = append(lists, list)
+	}
+	if len(lists) > 0 {
+		return lists, nil
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, errors.New("no CRL found")
+	}
+	return []*x509.RevocationList{list}, nil
+}
+
+// ClientIdentityHandler forwards the client certificate identity of TLS requests
+// upstream as X-Client-Cert-* headers. Headers of the same name sent by clients
+// are always removed so they cannot be spoofed.
+// Parameters:
+//   - config: models.FrontendClientAuth, the client certificate settings of the bind.
+//   - next: http.HandlerFunc, the handler receiving the request.
+//
+// Returns:
+//   - http.HandlerFunc: next, wrapped if identity forwarding is enabled.
+func ClientIdentityHandler(config models.FrontendClientAuth, next http.HandlerFunc) http.HandlerFunc {
+	if !config.ForwardIdentity {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range clientIdentityHeaders {
+			r.Header.Del(header)
+		}
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			setClientIdentityHeaders(r.Header, r.TLS, config.CertificateHeader)
+		}
+		next(w, r)
+	}
+}
+
+// setClientIdentityHeaders describes the client's leaf certificate in header.
+func setClientIdentityHeaders(header http.Header, state *tls.ConnectionState, certificateFormat string) {
+	leaf := state.PeerCertificates[0]
+	fingerprint := sha256.Sum256(leaf.Raw)
+
+	header.Set(HeaderClientCertVerified, fmt.Sprint(len(state.VerifiedChains) > 0))
+	header.Set(HeaderClientCertSubject, leaf.Subject.String())
+	header.Set(HeaderClientCertFingerprint, hex.EncodeToString(fingerprint[:]))
+	if sans := certificateSANs(leaf); len(sans) > 0 {
+		header.Set(HeaderClientCertSANs, strings.Join(sans, ","))
+	}
+
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})
+	switch certificateFormat {
+	case "pem":
+		// Header values cannot span lines.
+		header.Set(HeaderClientCert, strings.ReplaceAll(string(encoded), "\n", ""))
+	case "urlencoded":
+		header.Set(HeaderClientCert, url.QueryEscape(string(encoded)))
+	}
+}
+
+// certificateSANs lists the subject alternative names of certificate, prefixed by their type.
+func certificateSANs(certificate *x509.Certificate) []string {
+	var sans []string
+	for _, name := range certificate.DNSNames {
+		sans = append(sans, "DNS:"+name)
+	}
+	for _, email := range certificate.EmailAddresses {
+		sans = append(sans, "email:"+email)
+	}
+	for _, ip := range certificate.IPAddresses {
+		sans = append(sans, "IP:"+ip.String())
+	}
+	for _, uri := range certificate.URIs {
+		sans = append(sans, "URI:"+uri.String())
+	}
+	return sans
+}
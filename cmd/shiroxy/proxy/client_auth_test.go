@@ -0,0 +1,325 @@
+package proxy_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/proxy"
+	"shiroxy/cmd/shiroxy/webhook"
+	"shiroxy/pkg/models"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA issues client certificates for the mTLS tests.
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create ca: %v", err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+func (ca *testCA) issue(t *testing.T, serial int64, commonName string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:   big.NewInt(serial),
+		Subject:        pkix.Name{CommonName: commonName},
+		DNSNames:       []string{commonName},
+		EmailAddresses: []string{"ops@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("create client certificate: %v", err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func (ca *testCA) revoke(t *testing.T, serials ...int64) []byte {
+	t.Helper()
+	template := &x509.RevocationList{Number: big.NewInt(1), ThisUpdate: time.Now(), NextUpdate: time.Now().Add(time.Hour)}
+	for _, serial := range serials {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.certificate, ca.key)
+	if err != nil {
+		t.Fatalf("create crl: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+// serverHandshake serves one TLS connection with config and returns the server side handshake error.
+func serverHandshake(t *testing.T, config *tls.Config, serverName string, clientCertificate *tls.Certificate) error {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	result := make(chan error, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- err
+			return
+		}
+		defer conn.Close()
+		result <- conn.(*tls.Conn).Handshake()
+	}()
+
+	client := &tls.Config{InsecureSkipVerify: true, ServerName: serverName}
+	if clientCertificate != nil {
+		client.Certificates = []tls.Certificate{*clientCertificate}
+	}
+	if conn, err := tls.Dial("tcp", listener.Addr().String(), client); err == nil {
+		defer conn.Close()
+	}
+	return <-result
+}
+
+func TestClientAuth_DomainOverride(t *testing.T) {
+	fmt.Println("TestClientAuth_DomainOverride")
+
+	ca := newTestCA(t)
+	storage := &domains.Storage{}
+	storage.Domains().Replace([]*domains.DomainMetadata{
+		{Domain: "open.example.com", Status: "active"},
+		{Domain: "secure.example.com", Status: "active", ClientAuth: &domains.ClientAuthPolicy{
+			Mode:     domains.ClientAuthRequired,
+			CaBundle: ca.pem,
+		}},
+	})
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{SecureVerify: "none"}, storage, staticCertificate(t), false)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+	clientCertificate := ca.issue(t, 10, "client.example.com")
+	otherCertificate := newTestCA(t).issue(t, 11, "intruder.example.com")
+
+	if err := serverHandshake(t, config, "open.example.com", nil); err != nil {
+		t.Fatalf("expected a domain without override to accept clients without certificate: %v", err)
+	}
+	if err := serverHandshake(t, config, "secure.example.com", nil); err == nil {
+		t.Fatalf("expected the domain to require a client certificate")
+	}
+	if err := serverHandshake(t, config, "secure.example.com", &otherCertificate); err == nil {
+		t.Fatalf("expected a certificate from another CA to be rejected")
+	}
+	if err := serverHandshake(t, config, "secure.example.com", &clientCertificate); err != nil {
+		t.Fatalf("expected a certificate from the domain's CA to be accepted: %v", err)
+	}
+}
+
+func TestClientAuth_BindCAAndCRL(t *testing.T) {
+	fmt.Println("TestClientAuth_BindCAAndCRL")
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	crlFile := filepath.Join(dir, "ca.crl")
+	if err := os.WriteFile(caFile, ca.pem, 0600); err != nil {
+		t.Fatalf("write ca: %v", err)
+	}
+	if err := os.WriteFile(crlFile, ca.revoke(t, 20), 0600); err != nil {
+		t.Fatalf("write crl: %v", err)
+	}
+
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{
+		SecureVerify: "required",
+		ClientAuth:   models.FrontendClientAuth{CAFile: caFile, CRLFiles: []string{crlFile}},
+	}, nil, staticCertificate(t), false)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+
+	revoked := ca.issue(t, 20, "revoked.example.com")
+	valid := ca.issue(t, 21, "valid.example.com")
+	if err := serverHandshake(t, config, "example.com", &revoked); err == nil {
+		t.Fatalf("expected a revoked client certificate to be rejected")
+	}
+	if err := serverHandshake(t, config, "example.com", &valid); err != nil {
+		t.Fatalf("expected a valid client certificate to be accepted: %v", err)
+	}
+
+	// Updated CRLs are picked up without a restart.
+	if err := os.WriteFile(crlFile, ca.revoke(t, 20, 21), 0600); err != nil {
+		t.Fatalf("write crl: %v", err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(crlFile, future, future); err != nil {
+		t.Fatalf("chtimes: %v", err)
+	}
+	if err := serverHandshake(t, config, "example.com", &valid); err == nil {
+		t.Fatalf("expected the reloaded CRL to revoke the certificate")
+	}
+
+	if _, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{
+		ClientAuth: models.FrontendClientAuth{CAFile: filepath.Join(dir, "missing.pem")},
+	}, nil, nil, false); err == nil {
+		t.Fatalf("expected a missing CA file to fail")
+	}
+}
+
+func TestClientIdentityHandler(t *testing.T) {
+	fmt.Println("TestClientIdentityHandler")
+
+	ca := newTestCA(t)
+	clientCertificate := ca.issue(t, 30, "client.example.com")
+
+	var received http.Header
+	handler := proxy.ClientIdentityHandler(models.FrontendClientAuth{ForwardIdentity: true, CertificateHeader: "urlencoded"}, func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+	})
+
+	request := httptest.NewRequest(http.MethodGet, "https://example.com/", nil)
+	request.Header.Set(proxy.HeaderClientCertSubject, "CN=spoofed")
+	request.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{clientCertificate.Leaf},
+		VerifiedChains:   [][]*x509.Certificate{{clientCertificate.Leaf, ca.certificate}},
+	}
+	handler(httptest.NewRecorder(), request)
+
+	fingerprint := sha256.Sum256(clientCertificate.Leaf.Raw)
+	if received.Get(proxy.HeaderClientCertSubject) != "CN=client.example.com" {
+		t.Fatalf("unexpected subject header %q", received.Get(proxy.HeaderClientCertSubject))
+	}
+	if received.Get(proxy.HeaderClientCertSANs) != "DNS:client.example.com,email:ops@example.com" {
+		t.Fatalf("unexpected SANs header %q", received.Get(proxy.HeaderClientCertSANs))
+	}
+	if received.Get(proxy.HeaderClientCertFingerprint) != hex.EncodeToString(fingerprint[:]) {
+		t.Fatalf("unexpected fingerprint header %q", received.Get(proxy.HeaderClientCertFingerprint))
+	}
+	if received.Get(proxy.HeaderClientCertVerified) != "true" {
+		t.Fatalf("expected the certificate to be reported as verified")
+	}
+	certificatePEM, err := url.QueryUnescape(received.Get(proxy.HeaderClientCert))
+	if err != nil {
+		t.Fatalf("unescape certificate: %v", err)
+	}
+	if block, _ := pem.Decode([]byte(certificatePEM)); block == nil || string(block.Bytes) != string(clientCertificate.Leaf.Raw) {
+		t.Fatalf("expected the URL-encoded certificate to be forwarded")
+	}
+
+	// Plain HTTP requests never carry client-supplied identity headers upstream.
+	request = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	request.Header.Set(proxy.HeaderClientCertSubject, "CN=spoofed")
+	handler(httptest.NewRecorder(), request)
+	if received.Get(proxy.HeaderClientCertSubject) != "" {
+		t.Fatalf("expected spoofed identity headers to be removed")
+	}
+}
+
+func TestClientAuth_RejectsHostOfAnotherDomain(t *testing.T) {
+	fmt.Println("TestClientAuth_RejectsHostOfAnotherDomain")
+
+	ca := newTestCA(t)
+	storage := &domains.Storage{}
+	storage.Domains().Replace([]*domains.DomainMetadata{
+		{Domain: "open.example.com", Status: "active"},
+		{Domain: "secure.example.com", Status: "active", ClientAuth: &domains.ClientAuthPolicy{
+			Mode:     domains.ClientAuthRequired,
+			CaBundle: ca.pem,
+		}},
+	})
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{SecureVerify: "none"}, storage, staticCertificate(t), false)
+	if err != nil {
+		t.Fatalf("tls config: %v", err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream-response"))
+	}))
+	defer upstream.Close()
+	upstreamURL, _ := url.Parse(upstream.URL)
+	backend := &proxy.Server{Id: "1", URL: upstreamURL, Alive: true, Lock: &sync.RWMutex{}}
+	backend.Shiroxy = &proxy.Shiroxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = upstreamURL.Scheme
+			req.URL.Host = upstreamURL.Host
+		},
+		Transport:  http.DefaultTransport,
+		BufferPool: proxy.NewSyncBufferPool(32 * 1024),
+	}
+	var wg sync.WaitGroup
+	lb := proxy.NewLoadBalancer(&models.Config{Backend: models.Backend{Balance: "round-robin", HealthCheckTriggerDuration: 60}},
+		&proxy.BackendServers{Servers: []*proxy.Server{backend}}, &webhook.WebhookHandler{}, storage, &wg)
+
+	frontend := httptest.NewUnstartedServer(http.HandlerFunc(lb.ServeHTTP))
+	frontend.TLS = config
+	frontend.StartTLS()
+	defer frontend.Close()
+
+	// The handshake names a domain without mTLS, so no client certificate is requested.
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: "open.example.com"},
+	}}
+	get := func(host string) *http.Response {
+		request, _ := http.NewRequest(http.MethodGet, frontend.URL, nil)
+		request.Host = host
+		response, err := client.Do(request)
+		if err != nil {
+			t.Fatalf("get %s: %v", host, err)
+		}
+		response.Body.Close()
+		return response
+	}
+
+	if response := get("open.example.com"); response.StatusCode != http.StatusOK {
+		t.Fatalf("expected the handshake domain to be served, got %d", response.StatusCode)
+	}
+	if response := get("secure.example.com"); response.StatusCode != http.StatusMisdirectedRequest {
+		t.Fatalf("expected a Host requiring mTLS to be refused, got %d", response.StatusCode)
+	}
+}
@@ -6,9 +6,9 @@ package proxy
 
 import (
 	"fmt"
+	"net"
 	"net/http"
 	"shiroxy/cmd/shiroxy/webhook" // Custom package for handling webhooks.
-	"strings"
 	"sync"
 	"time"
 )
@@ -88,21 +88,20 @@ func (hc *HealthChecker) CheckHealth(server *Server) bool {
 	hc.wg.Add(1)
 	defer hc.wg.Done()       // Decrement WaitGroup counter when done.
 	client := &http.Client{} // Create a new HTTP client for making the health check request.
+	if server.Shiroxy != nil && server.Shiroxy.Transport != nil {
+		// Reach the server like proxied requests do (scheme, CA bundle, client certificate).
+		client.Transport = server.Shiroxy.Transport
+	}
 
 	var url string = ""
 	if server.HealthCheckUrl != "" {
 		url = server.HealthCheckUrl
 	} else {
-		sURL := server.URL.String()
-		hostArray := strings.Split(sURL, ":")
-		host := hostArray[0]
-		port := hostArray[1]
-
-		if host == "" {
-			url = fmt.Sprintf("http://%s:%s", "127.0.0.1", port)
-		} else {
-			url = fmt.Sprintf("http://%s:%s", host, port)
+		healthUrl := *server.URL
+		if healthUrl.Hostname() == "" {
+			healthUrl.Host = net.JoinHostPort("127.0.0.1", healthUrl.Port())
 		}
+		url = healthUrl.String()
 	}
 
 	resp, err := client.Get(url) // Send an HTTP HEAD request to the server's URL.
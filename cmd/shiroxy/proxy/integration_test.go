@@ -9,6 +9,7 @@ import (
 	"sync"
 	"testing"
 
+	"shiroxy/cmd/shiroxy/domains"
 	"shiroxy/pkg/models"
 )
 
@@ -62,3 +63,28 @@ func TestProxy_ForwardsToBackend(t *testing.T) {
 		t.Fatalf("unexpected body: %s", string(b))
 	}
 }
+
+func TestSelectServerForDomain_PinnedBackend(t *testing.T) {
+	first := &Server{Id: "first", Alive: true, Lock: &sync.RWMutex{}}
+	pinned := &Server{Id: "pinned", Alive: true, Lock: &sync.RWMutex{}}
+	lb := &LoadBalancer{
+		Servers:             &BackendServers{Servers: []*Server{first, pinned}},
+		RoutingDetailsByTag: map[string]*TagRoutingDetails{"": {Current: 0}},
+		configuration:       &models.Config{Backend: models.Backend{Balance: "round-robin"}},
+		TagCache:            &TagCache{cache: make(map[string]*BackendServers), capacity: 10},
+		TagTrie:             &TrieNode{Children: make(map[rune]*TrieNode)},
+	}
+
+	routing := &domains.DomainRouting{Backend: "pinned", Tags: []string{"unknown"}}
+	for i := 0; i < 3; i++ {
+		if server := lb.selectServerForDomain("10.0.0.1", routing); server != pinned {
+			t.Fatalf("expected the pinned backend, got %v", server)
+		}
+	}
+
+	// A pinned backend that is down falls back to the other servers.
+	pinned.Alive = false
+	if server := lb.selectServerForDomain("10.0.0.1", routing); server != first {
+		t.Fatalf("expected the fallback server, got %v", server)
+	}
+}
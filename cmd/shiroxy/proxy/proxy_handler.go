@@ -45,67 +45,14 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 
 	// Loop through each server specified in the configuration to set up routing.
 	for _, server := range configuration.Backend.Servers {
-		// Construct the URL for each server using its host and port from the configuration.
-		host := url.URL{
-			// Scheme could be HTTP/HTTPS based on frontend mode.
-			Scheme: configuration.Frontend.Mode,
-			Host:   fmt.Sprintf("%s:%s", server.Host, server.Port),
+		// The upstream scheme defaults to the frontend mode unless the backend sets its own.
+		backendServer, err := NewBackendServer(server, configuration.Frontend.Mode, logHandler)
+		if err != nil {
+			return nil, err
 		}
 
 		// Append the server to the servers slice.
-		servers = append(servers, &Server{
-
-			// Unique identifier for the server.
-			Id: server.Id,
-
-			// URL of the backend server.
-			URL: &host,
-
-			// Indicates if the server is alive (default to false).
-			Alive: false,
-
-			// Shiroxy structure to hold logger and request director for request URL rewriting.
-			Shiroxy: &Shiroxy{
-				// Logger for handling log messages.
-				Logger: logHandler,
-				Director: func(req *http.Request) {
-					// Modifies the request URL for backend routing.
-					RewriteRequestURL(req, &host)
-				},
-				Transport: &http.Transport{
-					Proxy: http.ProxyFromEnvironment,
-					DialContext: (&net.Dialer{
-						Timeout:   30 * time.Second,
-						KeepAlive: 60 * time.Second, // Increased keep-alive for better connection reuse
-						DualStack: true,             // Enable IPv4/IPv6 dual stack
-					}).DialContext,
-					ForceAttemptHTTP2:     true,
-					MaxIdleConns:          300,               // Increased total idle connections
-					IdleConnTimeout:       120 * time.Second, // Increased timeout for better reuse
-					TLSHandshakeTimeout:   10 * time.Second,
-					ExpectContinueTimeout: 1 * time.Second,
-					MaxIdleConnsPerHost:   100,                    // Balanced value for connection pooling
-					MaxConnsPerHost:       200,                    // Setting a reasonable limit to prevent overwhelming backends
-					WriteBufferSize:       int(DefaultBufferSize), // Use our buffer size constant
-					ReadBufferSize:        int(DefaultBufferSize), // Use our buffer size constant
-					TLSClientConfig: &tls.Config{
-						MinVersion:         tls.VersionTLS12, // Ensure modern TLS
-						InsecureSkipVerify: false,            // Always validate certificates in production
-					},
-					// HTTP/2 specific settings
-					// These are new settings that enhance HTTP/2 performance
-					MaxResponseHeaderBytes: 64 * 1024,
-
-					// Disable compression because we'll handle it separately
-					DisableCompression: true,
-				},
-				BufferPool: NewSyncBufferPool(32 * 1024),
-			},
-			// Splits server tags by comma for tag-based routing.
-			Tags:           strings.Split(server.Tags, ","),
-			Lock:           &sync.RWMutex{},
-			HealthCheckUrl: server.HealthUrl,
-		})
+		servers = append(servers, backendServer)
 	}
 
 	// Set the servers to the BackendServers instance.
@@ -153,26 +100,13 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 						http.Error(w, "Filename not found", http.StatusBadRequest)
 						return
 					}
-					domainName, ok := storage.DnsChallengeToken[filename]
-					if !ok {
-						http.Error(w, "no domain found for filename", http.StatusBadRequest)
-						return
-					}
-
-					domainMetadata, ok := storage.DomainMetadata[domainName]
+					keyAuthorization, ok := storage.HTTPChallengeResponse(filename)
 					if !ok {
-						http.Error(w, "record not found for domain", http.StatusBadRequest)
+						http.Error(w, "no pending challenge found for filename", http.StatusBadRequest)
 						return
 					}
 
-					if domainMetadata.DnsChallengeKey == "" {
-						if !ok {
-							http.Error(w, "dns challenge authorization and solving key not found", http.StatusBadRequest)
-							return
-						}
-					}
-
-					fmt.Fprint(w, domainMetadata.DnsChallengeKey)
+					fmt.Fprint(w, keyAuthorization)
 					return
 				}
 
@@ -196,7 +130,7 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 						http.Redirect(w, r, redirectUrl.String(), http.StatusMovedPermanently)
 					} else {
 						domainName := strings.TrimSpace(r.Host)
-						domainMetadata, ok := storage.DomainMetadata[domainName]
+						domainMetadata, ok := storage.ResolveDomain(domainName)
 
 						if !ok || domainMetadata == nil {
 							w.Header().Add("Content-Type", "text/html")
@@ -231,6 +165,11 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 		// Add the frontend handler to the load balancer.
 		loadbalancer.Frontends[bind.Port] = &frontend
 
+		// A secure listener on 443 backed by shiroxy certificates can answer tls-alpn-01 challenges.
+		if bind.Secure && bind.Port == "443" && (bind.Target == "multiple" || bind.SecureSetting.SingleTargetMode == "shiroxyshinglesecure") {
+			storage.TLSALPNEnabled = true
+		}
+
 		// Check for valid target modes ("multiple" or "single").
 		if bind.Target != "multiple" && bind.Target != "single" {
 			logHandler.Log("Invalid target value in frontend configuration", "Proxy", "Error")
@@ -240,13 +179,14 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 		var server *http.Server
 		var secure bool
 		var err error
+		handlerFunc := ClientIdentityHandler(bind.SecureSetting.ClientAuth, frontend.handlerFunc)
 
 		// Create HTTP server based on the target mode.
 		switch bind.Target {
 		case "multiple":
-			server, secure, err = CreateMultipleTargetServer(&bind, storage, frontend.handlerFunc)
+			server, secure, err = CreateMultipleTargetServer(&bind, storage, handlerFunc)
 		case "single":
-			server, secure, err = CreateSingleTargetServer(&bind, storage, frontend.handlerFunc)
+			server, secure, err = CreateSingleTargetServer(&bind, storage, handlerFunc)
 		}
 
 		if err != nil {
@@ -271,6 +211,43 @@ func StartShiroxyHandler(configuration *models.Config, storage *domains.Storage,
 //   - error: error if any issues occur during server creation.
 func CreateMultipleTargetServer(bindData *models.FrontendBind, storage *domains.Storage, handlerFunc http.HandlerFunc) (server *http.Server, secure bool, err error) {
 	if bindData.Secure {
+		tlsConfig, err := NewTLSConfig(bindData.SecureSetting, storage, func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			// Answer tls-alpn-01 validation handshakes with the challenge certificate.
+			if IsACMETLSALPNHello(info) {
+				return TLSALPNChallengeCertificate(storage, info)
+			}
+
+			// Load TLS certificate based on the domain metadata.
+			var cert *tls.Certificate
+			var err error
+			domainName := strings.TrimSpace(info.ServerName)
+			domainMetadata, _ := storage.ResolveDomain(domainName)
+
+			// Unknown hostnames and domains still waiting for an on-demand certificate.
+			if storage.OnDemand != nil && (domainMetadata == nil || domainMetadata.Status != "active") {
+				return storage.OnDemand.Certificate(domainName)
+			}
+
+			if domainMetadata == nil {
+				return nil, fmt.Errorf("domain not found")
+			}
+
+			if domainMetadata.Status == "active" {
+				cert, err = storage.CachedCertificate(domainMetadata)
+				if err != nil {
+					fmt.Println("tls.X509KeyPair ERROR: ", err.Error())
+					return nil, fmt.Errorf("something went wrong")
+				}
+			} else {
+				return nil, fmt.Errorf("routing deactivated")
+			}
+
+			return cert, nil
+		}, true)
+		if err != nil {
+			return nil, false, err
+		}
+
 		// Secure server with TLS configuration.
 		server := &http.Server{
 			Addr:    fmt.Sprintf("%s:%s", bindData.Host, bindData.Port),
@@ -285,35 +262,9 @@ func CreateMultipleTargetServer(bindData *models.FrontendBind, storage *domains.
 			MaxHeaderBytes: 1 << 20,
 
 			// Custom TLS
-			TLSConfig: &tls.Config{
-				// TLS configuration for HTTP/2
-				MinVersion: tls.VersionTLS12,
-				ClientAuth: ResolveSecurityPolicy(bindData.SecureSetting.SecureVerify),
-				GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					// Load TLS certificate based on the domain metadata.
-					var cert tls.Certificate
-					var err error
-					domainName := strings.TrimSpace(info.ServerName)
-					domainMetadata := storage.DomainMetadata[domainName]
-
-					if domainMetadata == nil {
-						return nil, fmt.Errorf("domain not found")
-					}
-
-					if domainMetadata.Status == "active" {
-						cert, err = tls.X509KeyPair(domainMetadata.CertPemBlock, domainMetadata.KeyPemBlock)
-						if err != nil {
-							fmt.Println("tls.X509KeyPair ERROR: ", err.Error())
-							return nil, fmt.Errorf("something went wrong")
-						}
-					} else {
-						return nil, fmt.Errorf("routing deactivated")
-					}
-
-					return &cert, nil
-				},
-			},
+			TLSConfig: tlsConfig,
 		}
+		applyALPNPolicy(server)
 
 		return server, true, nil
 	} else {
@@ -333,44 +284,43 @@ func CreateSingleTargetServer(bindData *models.FrontendBind, storage *domains.St
 	if bindData.Secure {
 		var tlsConfig *tls.Config
 		if bindData.SecureSetting.SingleTargetMode == "certandkey" {
-			tlsConfig = &tls.Config{
-				ClientAuth: ResolveSecurityPolicy(bindData.SecureSetting.SecureVerify),
-				ServerName: bindData.SecureSetting.CertAndKey.Domain,
-				GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					cert, err := tls.LoadX509KeyPair(bindData.SecureSetting.CertAndKey.Cert, bindData.SecureSetting.CertAndKey.Key)
-					if err != nil {
-						return nil, err
-					}
-					return &cert, nil
-				},
-			}
+			tlsConfig, err = NewTLSConfig(bindData.SecureSetting, storage, NewFileCertificate(bindData.SecureSetting.CertAndKey.Cert, bindData.SecureSetting.CertAndKey.Key).GetCertificate, false)
 		} else if bindData.SecureSetting.SingleTargetMode == "shiroxyshinglesecure" {
-			tlsConfig = &tls.Config{
-				ClientAuth: ResolveSecurityPolicy(bindData.SecureSetting.SecureVerify),
-				ServerName: bindData.SecureSetting.CertAndKey.Domain,
-				GetCertificate: func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
-					domainMetadata, ok := storage.DomainMetadata[info.ServerName]
-					if !ok {
-						return nil, errors.New("certificate not found")
-					}
-					if domainMetadata.Status == "active" {
-						cert, err := tls.X509KeyPair(domainMetadata.CertPemBlock, domainMetadata.KeyPemBlock)
-						if err != nil {
-							fmt.Println("tls.X509KeyPair ERROR: ", err.Error())
-							return nil, fmt.Errorf("something went wrong")
-						}
-						return &cert, nil
-					} else {
-						return nil, fmt.Errorf("routing deactivated")
+			tlsConfig, err = NewTLSConfig(bindData.SecureSetting, storage, func(info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+				if IsACMETLSALPNHello(info) {
+					return TLSALPNChallengeCertificate(storage, info)
+				}
+				domainMetadata, ok := storage.ResolveDomain(info.ServerName)
+				if storage.OnDemand != nil && (!ok || domainMetadata.Status != "active") {
+					return storage.OnDemand.Certificate(info.ServerName)
+				}
+				if !ok {
+					return nil, errors.New("certificate not found")
+				}
+				if domainMetadata.Status == "active" {
+					cert, err := storage.CachedCertificate(domainMetadata)
+					if err != nil {
+						fmt.Println("tls.X509KeyPair ERROR: ", err.Error())
+						return nil, fmt.Errorf("something went wrong")
 					}
-				},
-			}
+					return cert, nil
+				} else {
+					return nil, fmt.Errorf("routing deactivated")
+				}
+			}, true)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if tlsConfig != nil {
+			tlsConfig.ServerName = bindData.SecureSetting.CertAndKey.Domain
 		}
 		server := &http.Server{
 			Addr:      fmt.Sprintf("%s:%s", bindData.Host, bindData.Port),
 			Handler:   handlerFunc,
 			TLSConfig: tlsConfig,
 		}
+		applyALPNPolicy(server)
 
 		return server, true, nil
 	} else {
@@ -384,6 +334,27 @@ func CreateSingleTargetServer(bindData *models.FrontendBind, storage *domains.St
 	}
 }
 
+// IsACMETLSALPNHello reports whether the ClientHello comes from a CA validating a
+// tls-alpn-01 challenge, i.e. it advertises the "acme-tls/1" protocol.
+func IsACMETLSALPNHello(info *tls.ClientHelloInfo) bool {
+	for _, protocol := range info.SupportedProtos {
+		if protocol == domains.ACMETLSALPNProtocol {
+			return true
+		}
+	}
+	return false
+}
+
+// TLSALPNChallengeCertificate returns the pending tls-alpn-01 challenge certificate for the
+// requested server name. A validation handshake is never answered with a regular certificate.
+func TLSALPNChallengeCertificate(storage *domains.Storage, info *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, ok := storage.TLSALPNChallengeCertificate(strings.TrimSpace(info.ServerName))
+	if !ok {
+		return nil, fmt.Errorf("no tls-alpn-01 challenge pending for %q", info.ServerName)
+	}
+	return cert, nil
+}
+
 // ResolveSecurityPolicy maps the given policy string to a tls.ClientAuthType value.
 // Returns the appropriate tls.ClientAuthType based on the policy.
 func ResolveSecurityPolicy(policy string) tls.ClientAuthType {
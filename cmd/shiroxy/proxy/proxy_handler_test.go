@@ -1,13 +1,21 @@
 package proxy_test
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"sync"
 	"testing"
+	"time"
 
 	"shiroxy/cmd/shiroxy/domains"
 	"shiroxy/cmd/shiroxy/proxy"
@@ -48,14 +56,12 @@ func TestStartShiroxyHandler(t *testing.T) {
 	}
 
 	// Mock storage
-	storage := &domains.Storage{
-		DomainMetadata: map[string]*domains.DomainMetadata{
-			"localhost": {
-				Status:          "active",
-				DnsChallengeKey: "challenge_key",
-			},
-		},
-	}
+	storage := &domains.Storage{}
+	storage.Domains().Put(&domains.DomainMetadata{
+		Domain:          "localhost",
+		Status:          "active",
+		DnsChallengeKey: "challenge_key",
+	})
 
 	// Mock webhook handler
 	webhookHandler := &webhook.WebhookHandler{}
@@ -86,14 +92,12 @@ func TestCreateMultipleTargetServer(t *testing.T) {
 	}
 
 	// Mock storage
-	storage := &domains.Storage{
-		DomainMetadata: map[string]*domains.DomainMetadata{
-			"localhost": {
-				Status:          "active",
-				DnsChallengeKey: "challenge_key",
-			},
-		},
-	}
+	storage := &domains.Storage{}
+	storage.Domains().Put(&domains.DomainMetadata{
+		Domain:          "localhost",
+		Status:          "active",
+		DnsChallengeKey: "challenge_key",
+	})
 
 	// Mock handler function
 	handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -132,13 +136,8 @@ func TestCreateSingleTargetServer(t *testing.T) {
 	}
 
 	// Mock storage
-	storage := &domains.Storage{
-		DomainMetadata: map[string]*domains.DomainMetadata{
-			"localhost": {
-				Status: "active",
-			},
-		},
-	}
+	storage := &domains.Storage{}
+	storage.Domains().Put(&domains.DomainMetadata{Domain: "localhost", Status: "active"})
 
 	// Mock handler function
 	handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -239,3 +238,98 @@ func TestListenAndServe(t *testing.T) {
 		t.Errorf("expected status code 200, got %v", resp.StatusCode)
 	}
 }
+
+func TestIsACMETLSALPNHello(t *testing.T) {
+	if !proxy.IsACMETLSALPNHello(&tls.ClientHelloInfo{SupportedProtos: []string{"acme-tls/1"}}) {
+		t.Errorf("expected acme-tls/1 hello to be detected")
+	}
+	if proxy.IsACMETLSALPNHello(&tls.ClientHelloInfo{SupportedProtos: []string{"h2", "http/1.1"}}) {
+		t.Errorf("expected regular hello not to be detected")
+	}
+}
+
+func TestMultipleTargetServer_TLSALPNWithoutPendingChallenge(t *testing.T) {
+	bindData := &models.FrontendBind{Host: "localhost", Port: "8443", Secure: true}
+	storage := &domains.Storage{}
+	storage.Domains().Put(&domains.DomainMetadata{Domain: "example.com", Status: "inactive"})
+
+	server, _, err := proxy.CreateMultipleTargetServer(bindData, storage, func(w http.ResponseWriter, r *http.Request) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	_, err = server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:      "example.com",
+		SupportedProtos: []string{"acme-tls/1"},
+	})
+	if err == nil {
+		t.Fatalf("expected validation handshake without pending challenge to fail")
+	}
+
+	found := false
+	for _, protocol := range server.TLSConfig.NextProtos {
+		if protocol == "acme-tls/1" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected acme-tls/1 to be advertised, got %v", server.TLSConfig.NextProtos)
+	}
+}
+
+// selfSignedPEM creates a self-signed certificate and key covering names.
+func selfSignedPEM(t *testing.T, names ...string) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestMultipleTargetServer_ResolvesAliases(t *testing.T) {
+	fmt.Println("TestMultipleTargetServer_ResolvesAliases")
+
+	certPEM, keyPEM := selfSignedPEM(t, "example.com", "www.example.com", "*.example.org")
+	storage := &domains.Storage{}
+	storage.Domains().Put(&domains.DomainMetadata{
+		Domain:       "example.com",
+		Status:       "active",
+		Aliases:      []string{"www.example.com", "*.example.org"},
+		CertPemBlock: certPEM,
+		KeyPemBlock:  keyPEM,
+	})
+
+	bindData := &models.FrontendBind{Host: "localhost", Port: "8443", Secure: true}
+	server, _, err := proxy.CreateMultipleTargetServer(bindData, storage, func(w http.ResponseWriter, r *http.Request) {})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, serverName := range []string{"example.com", "www.example.com", "shop.example.org"} {
+		certificate, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil || certificate == nil {
+			t.Errorf("expected a certificate for %s, got %v", serverName, err)
+		}
+	}
+
+	if _, err := server.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.com"}); err == nil {
+		t.Errorf("expected no certificate for an unknown name")
+	}
+}
@@ -0,0 +1,270 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLS policy presets, following Mozilla's server side TLS recommendations.
+const (
+	TLSPresetModern       = "modern"
+	TLSPresetIntermediate = "intermediate"
+	TLSPresetOld          = "old"
+)
+
+// maxSessionTicketKeys is how many ticket keys are kept, so tickets issued before
+// the last rotations can still be resumed.
+const maxSessionTicketKeys = 3
+
+// tlsPreset holds the handshake parameters of a named preset.
+type tlsPreset struct {
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+var tlsPresets = map[string]tlsPreset{
+	TLSPresetModern: {
+		minVersion: tls.VersionTLS13,
+	},
+	TLSPresetIntermediate: {
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	},
+	TLSPresetOld: {
+		minVersion: tls.VersionTLS10,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+		},
+	},
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"x25519":         tls.X25519,
+	"x25519mlkem768": tls.X25519MLKEM768,
+	"p256":           tls.CurveP256,
+	"p384":           tls.CurveP384,
+	"p521":           tls.CurveP521,
+}
+
+// NewTLSConfig builds the TLS configuration of a secure bind from its TLS policy
+// and client certificate settings.
+// Parameters:
+//   - setting: models.FrontendSecuritySetting, the security settings of the bind.
+//   - storage: *domains.Storage, resolves per-domain client certificate overrides (may be nil).
+//   - getCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error), selects the served certificate.
+//   - acmeChallenges: bool, whether the bind answers tls-alpn-01 validation handshakes.
+//
+// Returns:
+//   - *tls.Config: the TLS configuration.
+//   - error: error if the policy names an unknown preset, version, cipher suite or curve,
+//     or the client CA bundle or CRLs cannot be loaded.
+func NewTLSConfig(setting models.FrontendSecuritySetting, storage *domains.Storage, getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), acmeChallenges bool) (*tls.Config, error) {
+	policy := setting.TLS
+
+	presetName := strings.ToLower(strings.TrimSpace(policy.Preset))
+	if presetName == "" {
+		presetName = TLSPresetIntermediate
+	}
+	preset, ok := tlsPresets[presetName]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls preset %q", policy.Preset)
+	}
+
+	config := &tls.Config{
+		MinVersion:             preset.minVersion,
+		CipherSuites:           preset.cipherSuites,
+		NextProtos:             []string{"h2", "http/1.1"},
+		SessionTicketsDisabled: policy.DisableSessionTickets,
+		GetCertificate:         getCertificate,
+	}
+
+	var err error
+	if policy.MinVersion != "" {
+		if config.MinVersion, err = parseTLSVersion(policy.MinVersion); err != nil {
+			return nil, err
+		}
+	}
+	if policy.MaxVersion != "" {
+		if config.MaxVersion, err = parseTLSVersion(policy.MaxVersion); err != nil {
+			return nil, err
+		}
+		if config.MaxVersion < config.MinVersion {
+			return nil, fmt.Errorf("tls maxversion %s is lower than minversion", policy.MaxVersion)
+		}
+	}
+	if len(policy.CipherSuites) > 0 {
+		if config.CipherSuites, err = parseCipherSuites(policy.CipherSuites); err != nil {
+			return nil, err
+		}
+	}
+	if len(policy.Curves) > 0 {
+		if config.CurvePreferences, err = parseCurves(policy.Curves); err != nil {
+			return nil, err
+		}
+	}
+	if len(policy.ALPN) > 0 {
+		config.NextProtos = append([]string{}, policy.ALPN...)
+	}
+	if acmeChallenges {
+		config.NextProtos = append(config.NextProtos, domains.ACMETLSALPNProtocol)
+	}
+
+	authenticator, err := NewClientAuthenticator(setting, storage)
+	if err != nil {
+		return nil, err
+	}
+	authenticator.apply(config)
+
+	bindConfig := func(*tls.ClientHelloInfo) (*tls.Config, error) { return config, nil }
+	if policy.SessionTicketRotation > 0 && !policy.DisableSessionTickets {
+		rotator := &sessionTicketRotator{
+			base:     config.Clone(),
+			interval: time.Duration(policy.SessionTicketRotation) * time.Second,
+		}
+		bindConfig = rotator.GetConfigForClient
+	}
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		base, err := bindConfig(hello)
+		if err != nil {
+			return nil, err
+		}
+		return authenticator.ConfigForClient(base, hello)
+	}
+	return config, nil
+}
+
+// applyALPNPolicy disables HTTP/2 on server when its TLS configuration does not offer "h2".
+// net/http otherwise adds "h2" to the advertised protocols on its own.
+// Parameters:
+//   - server: *http.Server, the server to configure.
+func applyALPNPolicy(server *http.Server) {
+	if server.TLSConfig == nil {
+		return
+	}
+	for _, protocol := range server.TLSConfig.NextProtos {
+		if protocol == "h2" {
+			return
+		}
+	}
+	server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+}
+
+// sessionTicketRotator serves a copy of the bind's configuration whose session
+// ticket keys are replaced every interval. The previous keys are kept so recently
+// issued tickets can still be resumed.
+type sessionTicketRotator struct {
+	base     *tls.Config
+	interval time.Duration
+
+	lock      sync.Mutex
+	current   *tls.Config
+	keys      [][32]byte
+	rotatedAt time.Time
+}
+
+// GetConfigForClient returns the configuration for a handshake, rotating the ticket keys when due.
+func (r *sessionTicketRotator) GetConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if r.current != nil && now.Sub(r.rotatedAt) < r.interval {
+		return r.current, nil
+	}
+
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	r.keys = append([][32]byte{key}, r.keys...)
+	if len(r.keys) > maxSessionTicketKeys {
+		r.keys = r.keys[:maxSessionTicketKeys]
+	}
+
+	config := r.base.Clone()
+	config.SetSessionTicketKeys(r.keys)
+	r.current = config
+	r.rotatedAt = now
+	return config, nil
+}
+
+// parseTLSVersion parses a version such as "1.2" or "TLS1.2".
+func parseTLSVersion(version string) (uint16, error) {
+	normalized := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(version)), "tls")
+	normalized = strings.TrimSpace(strings.TrimPrefix(normalized, "v"))
+	if id, ok := tlsVersions[normalized]; ok {
+		return id, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", version)
+}
+
+// parseCipherSuites resolves cipher suite names, e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[strings.ToUpper(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// parseCurves resolves curve names such as "X25519" or "P-256".
+func parseCurves(names []string) ([]tls.CurveID, error) {
+	curves := make([]tls.CurveID, 0, len(names))
+	for _, name := range names {
+		normalized := strings.ToLower(strings.TrimSpace(name))
+		normalized = strings.TrimPrefix(strings.ReplaceAll(normalized, "-", ""), "curve")
+		curve, ok := tlsCurves[normalized]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls curve %q", name)
+		}
+		curves = append(curves, curve)
+	}
+	return curves, nil
+}
@@ -0,0 +1,203 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/proxy"
+	"shiroxy/pkg/models"
+	"testing"
+	"time"
+)
+
+// handshake serves one TLS connection with config and returns the client's connection state.
+func handshake(t *testing.T, config *tls.Config, client *tls.Config) (tls.ConnectionState, error) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if err := conn.(*tls.Conn).Handshake(); err == nil {
+			// Give the client a chance to read session tickets.
+			_, _ = conn.Read(make([]byte, 1))
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), client)
+	if err != nil {
+		return tls.ConnectionState{}, err
+	}
+	defer conn.Close()
+	// Reading drives the processing of post-handshake session tickets.
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _ = conn.Read(make([]byte, 1))
+	return conn.ConnectionState(), nil
+}
+
+func staticCertificate(t *testing.T) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certPEM, keyPEM := selfSignedPEM(t, "example.com")
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("key pair: %v", err)
+	}
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &certificate, nil }
+}
+
+func TestNewTLSConfig_Presets(t *testing.T) {
+	fmt.Println("TestNewTLSConfig_Presets")
+
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("default policy: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || len(config.CipherSuites) == 0 {
+		t.Fatalf("expected the intermediate preset by default, got min %x and %d suites", config.MinVersion, len(config.CipherSuites))
+	}
+
+	config, err = proxy.NewTLSConfig(models.FrontendSecuritySetting{TLS: models.FrontendTLSPolicy{Preset: "modern"}}, nil, nil, true)
+	if err != nil {
+		t.Fatalf("modern policy: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS13 {
+		t.Fatalf("expected modern preset to require TLS 1.3, got %x", config.MinVersion)
+	}
+	if config.CurvePreferences != nil {
+		t.Fatalf("expected presets to keep Go's default key exchanges, got %v", config.CurvePreferences)
+	}
+	if protos := config.NextProtos; len(protos) != 3 || protos[2] != domains.ACMETLSALPNProtocol {
+		t.Fatalf("unexpected ALPN protocols: %v", protos)
+	}
+
+	config, err = proxy.NewTLSConfig(models.FrontendSecuritySetting{TLS: models.FrontendTLSPolicy{Preset: "old"}}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("old policy: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS10 {
+		t.Fatalf("expected old preset to allow TLS 1.0, got %x", config.MinVersion)
+	}
+}
+
+func TestNewTLSConfig_Overrides(t *testing.T) {
+	fmt.Println("TestNewTLSConfig_Overrides")
+
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{
+		SecureVerify: "optional",
+		TLS: models.FrontendTLSPolicy{
+			Preset:       "modern",
+			MinVersion:   "1.2",
+			MaxVersion:   "TLS1.2",
+			CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"},
+			Curves:       []string{"P-384", "X25519"},
+			ALPN:         []string{"http/1.1"},
+		},
+	}, nil, nil, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.MaxVersion != tls.VersionTLS12 {
+		t.Fatalf("unexpected versions: %x-%x", config.MinVersion, config.MaxVersion)
+	}
+	if len(config.CipherSuites) != 1 || config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384 {
+		t.Fatalf("unexpected cipher suites: %v", config.CipherSuites)
+	}
+	if len(config.CurvePreferences) != 2 || config.CurvePreferences[0] != tls.CurveP384 {
+		t.Fatalf("unexpected curves: %v", config.CurvePreferences)
+	}
+	if len(config.NextProtos) != 1 || config.NextProtos[0] != "http/1.1" {
+		t.Fatalf("unexpected ALPN protocols: %v", config.NextProtos)
+	}
+	if config.ClientAuth != tls.RequestClientCert {
+		t.Fatalf("expected secureverify to still apply, got %v", config.ClientAuth)
+	}
+
+	invalid := []models.FrontendTLSPolicy{
+		{Preset: "paranoid"},
+		{MinVersion: "1.4"},
+		{MinVersion: "1.3", MaxVersion: "1.2"},
+		{CipherSuites: []string{"TLS_NOT_A_SUITE"}},
+		{Curves: []string{"P-224"}},
+	}
+	for _, policy := range invalid {
+		if _, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{TLS: policy}, nil, nil, false); err == nil {
+			t.Fatalf("expected policy %+v to be rejected", policy)
+		}
+	}
+}
+
+func TestNewTLSConfig_HandshakeHonorsPolicy(t *testing.T) {
+	fmt.Println("TestNewTLSConfig_HandshakeHonorsPolicy")
+
+	config, err := proxy.NewTLSConfig(models.FrontendSecuritySetting{
+		TLS: models.FrontendTLSPolicy{MaxVersion: "1.2", SessionTicketRotation: 3600},
+	}, nil, staticCertificate(t), false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	client := &tls.Config{
+		InsecureSkipVerify: true,
+		ServerName:         "example.com",
+		ClientSessionCache: tls.NewLRUClientSessionCache(4),
+	}
+	state, err := handshake(t, config, client)
+	if err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	if state.Version != tls.VersionTLS12 {
+		t.Fatalf("expected TLS 1.2 to be negotiated, got %x", state.Version)
+	}
+
+	state, err = handshake(t, config, client)
+	if err != nil {
+		t.Fatalf("second handshake: %v", err)
+	}
+	if !state.DidResume {
+		t.Fatalf("expected the session ticket of the rotated key to be resumable")
+	}
+
+	if _, err := handshake(t, config, &tls.Config{InsecureSkipVerify: true, MinVersion: tls.VersionTLS13}); err == nil {
+		t.Fatalf("expected a TLS 1.3 only client to be refused")
+	}
+}
+
+func TestCreateServers_ApplyTLSPolicy(t *testing.T) {
+	fmt.Println("TestCreateServers_ApplyTLSPolicy")
+
+	handlerFunc := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	storage := &domains.Storage{}
+	setting := models.FrontendSecuritySetting{
+		SingleTargetMode: "shiroxyshinglesecure",
+		TLS:              models.FrontendTLSPolicy{Preset: "modern", ALPN: []string{"http/1.1"}},
+	}
+
+	multiple, _, err := proxy.CreateMultipleTargetServer(&models.FrontendBind{Secure: true, SecureSetting: setting}, storage, handlerFunc)
+	if err != nil {
+		t.Fatalf("multiple target server: %v", err)
+	}
+	single, _, err := proxy.CreateSingleTargetServer(&models.FrontendBind{Secure: true, SecureSetting: setting}, storage, handlerFunc)
+	if err != nil {
+		t.Fatalf("single target server: %v", err)
+	}
+	for _, server := range []*http.Server{multiple, single} {
+		if server.TLSConfig.MinVersion != tls.VersionTLS13 {
+			t.Fatalf("expected the modern preset, got min version %x", server.TLSConfig.MinVersion)
+		}
+		if server.TLSNextProto == nil {
+			t.Fatalf("expected HTTP/2 to be disabled when h2 is not offered")
+		}
+	}
+
+	setting.TLS.Preset = "unknown"
+	if _, _, err := proxy.CreateSingleTargetServer(&models.FrontendBind{Secure: true, SecureSetting: setting}, storage, handlerFunc); err == nil {
+		t.Fatalf("expected an invalid policy to fail server creation")
+	}
+}
@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/logger"
+	"shiroxy/pkg/models"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upstream schemes a backend server can be reached with.
+const (
+	UpstreamHTTP  = "http"
+	UpstreamHTTPS = "https"
+	UpstreamH2C   = "h2c" // HTTP/2 without TLS (prior knowledge).
+)
+
+// NewBackendServer creates a load balancer server for a backend server, with a
+// transport honouring its upstream scheme and TLS settings.
+// Parameters:
+//   - backendServer: models.BackendServer, the backend server configuration.
+//   - defaultScheme: string, the scheme used when the backend does not set one.
+//   - logHandler: *logger.Logger, custom logging utility.
+//
+// Returns:
+//   - *Server: the server.
+//   - error: error if the scheme is unknown or the TLS files cannot be loaded.
+func NewBackendServer(backendServer models.BackendServer, defaultScheme string, logHandler *logger.Logger) (*Server, error) {
+	scheme := strings.ToLower(strings.TrimSpace(backendServer.Scheme))
+	if scheme == "" {
+		scheme = defaultScheme
+	}
+	if scheme == "" {
+		scheme = UpstreamHTTP
+	}
+
+	transport, err := NewUpstreamTransport(scheme, backendServer.TLS)
+	if err != nil {
+		return nil, fmt.Errorf("backend server %s: %v", backendServer.Id, err)
+	}
+
+	// h2c speaks HTTP/2 over a plain connection, so requests use the http scheme.
+	urlScheme := scheme
+	if scheme == UpstreamH2C {
+		urlScheme = UpstreamHTTP
+	}
+	host := url.URL{
+		Scheme: urlScheme,
+		Host:   fmt.Sprintf("%s:%s", backendServer.Host, backendServer.Port),
+	}
+
+	return &Server{
+		// Unique identifier for the server.
+		Id: backendServer.Id,
+
+		// URL of the backend server.
+		URL: &host,
+
+		// Indicates if the server is alive (default to false).
+		Alive: false,
+
+		// Shiroxy structure to hold logger and request director for request URL rewriting.
+		Shiroxy: &Shiroxy{
+			// Logger for handling log messages.
+			Logger: logHandler,
+			Director: func(req *http.Request) {
+				// Modifies the request URL for backend routing.
+				RewriteRequestURL(req, &host)
+			},
+			Transport:  transport,
+			BufferPool: NewSyncBufferPool(32 * 1024),
+		},
+		// Splits server tags by comma for tag-based routing.
+		Tags:           strings.Split(backendServer.Tags, ","),
+		Lock:           &sync.RWMutex{},
+		HealthCheckUrl: backendServer.HealthUrl,
+		Definition:     backendServer,
+	}, nil
+}
+
+// NewUpstreamTransport creates the transport used to reach a backend server.
+// Parameters:
+//   - scheme: string, http, https or h2c.
+//   - tlsConfig: models.BackendServerTLS, TLS settings for https backends.
+//
+// Returns:
+//   - *http.Transport: the transport.
+//   - error: error if the scheme is unknown or the CA bundle or client certificate cannot be loaded.
+func NewUpstreamTransport(scheme string, tlsConfig models.BackendServerTLS) (*http.Transport, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 60 * time.Second, // Increased keep-alive for better connection reuse
+		}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          300,               // Increased total idle connections
+		IdleConnTimeout:       120 * time.Second, // Increased timeout for better reuse
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		MaxIdleConnsPerHost:   100,                    // Balanced value for connection pooling
+		MaxConnsPerHost:       200,                    // Setting a reasonable limit to prevent overwhelming backends
+		WriteBufferSize:       int(DefaultBufferSize), // Use our buffer size constant
+		ReadBufferSize:        int(DefaultBufferSize), // Use our buffer size constant
+		// HTTP/2 specific settings
+		// These are new settings that enhance HTTP/2 performance
+		MaxResponseHeaderBytes: 64 * 1024,
+
+		// Disable compression because we'll handle it separately
+		DisableCompression: true,
+	}
+
+	switch scheme {
+	case UpstreamHTTP:
+	case UpstreamH2C:
+		protocols := &http.Protocols{}
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	case UpstreamHTTPS:
+		clientConfig, err := upstreamTLSConfig(tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = clientConfig
+	default:
+		return nil, fmt.Errorf("unsupported upstream scheme %q", scheme)
+	}
+	return transport, nil
+}
+
+// upstreamTLSConfig builds the client TLS configuration for an https backend.
+func upstreamTLSConfig(tlsConfig models.BackendServerTLS) (*tls.Config, error) {
+	clientConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12, // Ensure modern TLS
+		ServerName:         tlsConfig.ServerName,
+		InsecureSkipVerify: tlsConfig.InsecureSkipVerify,
+	}
+
+	if tlsConfig.CAFile != "" {
+		bundle, err := os.ReadFile(tlsConfig.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		if clientConfig.RootCAs, err = domains.ParseCertificatePool(bundle); err != nil {
+			return nil, fmt.Errorf("%s: %v", tlsConfig.CAFile, err)
+		}
+	}
+
+	if tlsConfig.CertFile != "" || tlsConfig.KeyFile != "" {
+		if tlsConfig.CertFile == "" || tlsConfig.KeyFile == "" {
+			return nil, fmt.Errorf("both certfile and keyfile are required for a client certificate")
+		}
+		// The client certificate is reloaded when its files change, like frontend certificates.
+		clientCertificate := NewFileCertificate(tlsConfig.CertFile, tlsConfig.KeyFile)
+		if _, err := clientCertificate.GetCertificate(nil); err != nil {
+			return nil, err
+		}
+		clientConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return clientCertificate.GetCertificate(nil)
+		}
+	}
+	return clientConfig, nil
+}
@@ -0,0 +1,176 @@
+package proxy_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"shiroxy/cmd/shiroxy/proxy"
+	"shiroxy/pkg/models"
+	"testing"
+)
+
+// backendConfig describes the httptest server at rawURL as a backend server.
+func backendConfig(t *testing.T, rawURL string) models.BackendServer {
+	t.Helper()
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	host, port, _ := net.SplitHostPort(parsed.Host)
+	return models.BackendServer{Id: "backend", Host: host, Port: port}
+}
+
+// roundTrip sends a GET request to the backend through its upstream transport.
+func roundTrip(server *proxy.Server) (*http.Response, error) {
+	request, _ := http.NewRequest(http.MethodGet, server.URL.String()+"/", nil)
+	response, err := server.Shiroxy.Transport.RoundTrip(request)
+	if err == nil {
+		response.Body.Close()
+	}
+	return response, err
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestNewBackendServer_PrivateCAAndSNI(t *testing.T) {
+	fmt.Println("TestNewBackendServer_PrivateCAAndSNI")
+
+	serverNames := make(chan string, 4)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverNames <- r.TLS.ServerName
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	caFile := writeFile(t, dir, "ca.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw}))
+
+	config := backendConfig(t, backend.URL)
+	config.Scheme = "https"
+	server, err := proxy.NewBackendServer(config, "http", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if server.URL.Scheme != "https" {
+		t.Fatalf("expected the backend scheme to override the frontend mode, got %q", server.URL.Scheme)
+	}
+	if _, err := roundTrip(server); err == nil {
+		t.Fatalf("expected a private CA to be rejected with system roots")
+	}
+
+	config.TLS = models.BackendServerTLS{CAFile: caFile, ServerName: "example.com"}
+	server, err = proxy.NewBackendServer(config, "http", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if _, err := roundTrip(server); err != nil {
+		t.Fatalf("expected the configured CA to be trusted: %v", err)
+	}
+	if name := <-serverNames; name != "example.com" {
+		t.Fatalf("expected the SNI override to be sent, got %q", name)
+	}
+
+	config.TLS = models.BackendServerTLS{InsecureSkipVerify: true}
+	server, err = proxy.NewBackendServer(config, "http", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if _, err := roundTrip(server); err != nil {
+		t.Fatalf("expected verification to be skipped: %v", err)
+	}
+}
+
+func TestNewBackendServer_ClientCertificate(t *testing.T) {
+	fmt.Println("TestNewBackendServer_ClientCertificate")
+
+	ca := newTestCA(t)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.certificate)
+
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	backend.StartTLS()
+	defer backend.Close()
+
+	clientCertificate := ca.issue(t, 40, "shiroxy.internal")
+	keyDER, err := x509.MarshalPKCS8PrivateKey(clientCertificate.PrivateKey)
+	if err != nil {
+		t.Fatalf("marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	certFile := writeFile(t, dir, "client.pem", pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCertificate.Certificate[0]}))
+	keyFile := writeFile(t, dir, "client.key", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+
+	config := backendConfig(t, backend.URL)
+	config.Scheme = "https"
+	config.TLS = models.BackendServerTLS{InsecureSkipVerify: true}
+	server, err := proxy.NewBackendServer(config, "http", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if _, err := roundTrip(server); err == nil {
+		t.Fatalf("expected the backend to require a client certificate")
+	}
+
+	config.TLS.CertFile, config.TLS.KeyFile = certFile, keyFile
+	server, err = proxy.NewBackendServer(config, "http", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if _, err := roundTrip(server); err != nil {
+		t.Fatalf("expected the client certificate to be accepted: %v", err)
+	}
+
+	config.TLS.KeyFile = ""
+	if _, err := proxy.NewBackendServer(config, "http", nil); err == nil {
+		t.Fatalf("expected a certificate without key to be rejected")
+	}
+}
+
+func TestNewBackendServer_H2C(t *testing.T) {
+	fmt.Println("TestNewBackendServer_H2C")
+
+	protocols := make(chan int, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocols <- r.ProtoMajor
+	}))
+	backend.Config.Protocols = &http.Protocols{}
+	backend.Config.Protocols.SetHTTP1(true)
+	backend.Config.Protocols.SetUnencryptedHTTP2(true)
+	backend.Start()
+	defer backend.Close()
+
+	config := backendConfig(t, backend.URL)
+	config.Scheme = "h2c"
+	server, err := proxy.NewBackendServer(config, "https", nil)
+	if err != nil {
+		t.Fatalf("new backend server: %v", err)
+	}
+	if server.URL.Scheme != "http" {
+		t.Fatalf("expected h2c requests to use the http scheme, got %q", server.URL.Scheme)
+	}
+	if _, err := roundTrip(server); err != nil {
+		t.Fatalf("round trip: %v", err)
+	}
+	if major := <-protocols; major != 2 {
+		t.Fatalf("expected HTTP/2 without TLS, got HTTP/%d", major)
+	}
+
+	config.Scheme = "spdy"
+	if _, err := proxy.NewBackendServer(config, "http", nil); err == nil {
+		t.Fatalf("expected an unknown scheme to be rejected")
+	}
+}
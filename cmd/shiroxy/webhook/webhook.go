@@ -35,6 +35,10 @@ type WebhookHandler struct {
 	WebHookConfig models.Webhook           // Webhook configuration, including the target URL and events.
 	secret        string                   // Secret used for authenticating webhook requests.
 	fire          chan *WebhookFirePayload // Channel to handle webhook payloads asynchronously.
+
+	// Relay, when set, is offered every event before it is fired; events it
+	// accepts are fired by another instance (the leader of a cluster).
+	Relay func(eventName string, data interface{}) bool
 }
 
 // ApiResponse represents the structure of the response received from a webhook call.
@@ -74,12 +78,13 @@ func StartWebhookHandler(config models.Webhook, logHandler *logger.Logger, wg *s
 		fire:          make(chan *WebhookFirePayload, 1), // Channel for handling webhook events.
 	}
 
-	// Start a goroutine to process webhook events.
+	// Start a goroutine that processes webhook events as they are fired.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		payload := <-webhookHandler.fire
-		webhookHandler.fireWebhook(payload)
+		for payload := range webhookHandler.fire {
+			webhookHandler.fireWebhook(payload)
+		}
 	}()
 
 	return webhookHandler, nil
@@ -92,6 +97,9 @@ func StartWebhookHandler(config models.Webhook, logHandler *logger.Logger, wg *s
 func (w *WebhookHandler) Fire(eventName string, data interface{}) {
 
 	if w.WebHookConfig.Enable {
+		if w.Relay != nil && w.Relay(eventName, data) {
+			return
+		}
 		fmt.Println("Fire================")
 		w.fire <- &WebhookFirePayload{
 			EventName: eventName,
@@ -7,16 +7,17 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"shiroxy/pkg/logger"
 	"shiroxy/pkg/models"
 )
 
 func TestWebhook_FireSendsPayload(t *testing.T) {
-	var received string
+	received := make(chan string, 1)
 	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		b, _ := io.ReadAll(r.Body)
-		received = string(b)
+		received <- string(b)
 		w.WriteHeader(200)
 	}))
 	defer server.Close()
@@ -32,15 +33,84 @@ func TestWebhook_FireSendsPayload(t *testing.T) {
 	// Fire event
 	wh.Fire("test-event", map[string]string{"domain": "example.com"})
 
-	// wait briefly for goroutine to fire webhook
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		// allow the single goroutine in StartWebhookHandler to run
-	}()
-	wg.Wait()
+	// wait for the webhook goroutine to deliver the payload
+	select {
+	case payload := <-received:
+		if !strings.Contains(payload, "test-event") {
+			t.Fatalf("expected event in payload, got: %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook was not fired")
+	}
+}
+
+func TestWebhook_FireDeliversEveryEvent(t *testing.T) {
+	received := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	logg, _ := logger.StartLogger(nil)
+	wg := &sync.WaitGroup{}
+	config := models.Webhook{Enable: true, Url: server.URL, Events: []string{"certificate.renewed"}}
+	wh, err := StartWebhookHandler(config, logg, wg, "")
+	if err != nil {
+		t.Fatalf("start webhook handler: %v", err)
+	}
+
+	for _, domain := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		wh.Fire("certificate.renewed", map[string]string{"domain": domain})
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case payload := <-received:
+			if !strings.Contains(payload, "certificate.renewed") {
+				t.Fatalf("unexpected payload: %s", payload)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d of 3 webhooks were fired", i)
+		}
+	}
+}
+
+func TestWebhook_RelayedEventsAreNotFired(t *testing.T) {
+	received := make(chan string, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		received <- string(b)
+		w.WriteHeader(200)
+	}))
+	defer server.Close()
+
+	logg, _ := logger.StartLogger(nil)
+	wg := &sync.WaitGroup{}
+	config := models.Webhook{Enable: true, Url: server.URL, Events: []string{"relayed", "kept"}}
+	wh, err := StartWebhookHandler(config, logg, wg, "")
+	if err != nil {
+		t.Fatalf("start webhook handler: %v", err)
+	}
+	wh.Relay = func(eventName string, data interface{}) bool {
+		return eventName == "relayed"
+	}
 
-	if !strings.Contains(received, "test-event") {
-		t.Fatalf("expected event in payload, got: %s", received)
+	wh.Fire("relayed", map[string]string{"domain": "example.com"})
+	wh.Fire("kept", map[string]string{"domain": "example.com"})
+
+	select {
+	case payload := <-received:
+		if !strings.Contains(payload, "kept") {
+			t.Fatalf("expected only the kept event to be fired, got: %s", payload)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("webhook was not fired")
+	}
+	select {
+	case payload := <-received:
+		t.Fatalf("expected the relayed event not to be fired, got: %s", payload)
+	case <-time.After(100 * time.Millisecond):
 	}
 }
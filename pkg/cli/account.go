@@ -0,0 +1,151 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"shiroxy/pkg/configuration"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	apiVar          string
+	issuerVar       string
+	accountEmailVar string
+)
+
+var accountCmd = &cobra.Command{
+	Use:   "account",
+	Short: "ACME account management",
+	Long:  "Lists, rolls over and deactivates the ACME accounts of a running shiroxy instance through its admin API",
+}
+
+var accountListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List ACME accounts",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodGet, "/v1/acme/accounts", nil)
+	},
+}
+
+var accountRolloverCmd = &cobra.Command{
+	Use:   "rollover",
+	Short: "Replace the key of an ACME account",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodPost, "/v1/acme/accounts/rollover", accountRequest())
+	},
+}
+
+var accountDeactivateCmd = &cobra.Command{
+	Use:   "deactivate",
+	Short: "Deactivate an ACME account",
+	Long:  "Deactivates an ACME account at the CA. The next certificate order for the email registers a new account.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodPost, "/v1/acme/accounts/deactivate", accountRequest())
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(accountCmd)
+	accountCmd.AddCommand(accountListCmd, accountRolloverCmd, accountDeactivateCmd)
+	accountCmd.PersistentFlags().StringVar(&apiVar, "api", "", "admin API URL (default is http://127.0.0.1:<adminapi port from the config>)")
+	for _, command := range []*cobra.Command{accountRolloverCmd, accountDeactivateCmd} {
+		command.Flags().StringVarP(&issuerVar, "issuer", "i", "", "name of the ACME issuer (default is the first configured issuer)")
+		command.Flags().StringVarP(&accountEmailVar, "email", "e", "", "email of the ACME account")
+		command.MarkFlagRequired("email")
+	}
+}
+
+// accountRequest returns the request body identifying the account selected by the flags.
+func accountRequest() map[string]string {
+	return map[string]string{"issuer": issuerVar, "email": accountEmailVar}
+}
+
+// adminAPIRequest sends a request to the admin API of a running instance,
+// authenticating with the user configured in the config file, and prints the response data.
+// Parameters:
+//   - method: string, the HTTP method.
+//   - path: string, the API path.
+//   - body: any, the JSON request body (may be nil).
+//
+// Returns:
+//   - error: error if the request fails or the API reports a failure.
+func adminAPIRequest(method, path string, body any) error {
+	var requestBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		requestBody = bytes.NewReader(data)
+	}
+	response, err := sendAdminAPIRequest(method, path, requestBody)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var apiResponse struct {
+		Success bool           `json:"success"`
+		Error   string         `json:"error"`
+		Data    map[string]any `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&apiResponse); err != nil {
+		return fmt.Errorf("admin API responded with %s", response.Status)
+	}
+	if !apiResponse.Success {
+		return fmt.Errorf("admin API: %s", apiResponse.Error)
+	}
+
+	output, err := json.MarshalIndent(apiResponse.Data, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(output))
+	return nil
+}
+
+// sendAdminAPIRequest sends a request to the admin API of a running instance,
+// authenticating with the user configured in the config file.
+// Parameters:
+//   - method: string, the HTTP method.
+//   - path: string, the API path.
+//   - body: io.Reader, the JSON request body (may be nil).
+//
+// Returns:
+//   - *http.Response: the response; the caller closes its body.
+//   - error: error if the config cannot be read or the request fails.
+func sendAdminAPIRequest(method, path string, body io.Reader) (*http.Response, error) {
+	if configVar == "" {
+		return nil, errors.New("the --config flag is required to authenticate with the admin API")
+	}
+	config, err := configuration.ConfigReader(configVar)
+	if err != nil {
+		return nil, err
+	}
+
+	baseUrl := apiVar
+	if baseUrl == "" {
+		port := config.Default.AdminAPI.Port
+		if port == "" {
+			port = "2210"
+		}
+		baseUrl = fmt.Sprintf("http://127.0.0.1:%s", port)
+	}
+
+	request, err := http.NewRequest(method, strings.TrimSuffix(baseUrl, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.SetBasicAuth(config.Default.User.Email, config.Default.User.Secret)
+
+	client := &http.Client{Timeout: 2 * time.Minute}
+	return client.Do(request)
+}
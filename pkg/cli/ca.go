@@ -0,0 +1,62 @@
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/configuration"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var outputVar string
+
+var caCmd = &cobra.Command{
+	Use:   "ca",
+	Short: "Local certificate authority",
+	Long:  "Manages the built-in local CA that issues certificates for issuers of type \"local\"",
+}
+
+var caExportCmd = &cobra.Command{
+	Use:     "export",
+	Short:   "Export the root certificate of the local CA",
+	Long:    "Prints the root certificate of a local CA issuer, generating the root if it does not exist yet, so it can be added to the trust stores of development machines",
+	Example: "shiroxy ca export -c shiroxy.conf.yaml -o shiroxy-root.crt",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if configVar == "" {
+			return errors.New("the --config flag is required to find the local CA")
+		}
+		config, err := configuration.ConfigReader(configVar)
+		if err != nil {
+			return err
+		}
+
+		for _, issuer := range config.Runtime.Issuers {
+			if issuer.Type != domains.IssuerTypeLocal || (issuerVar != "" && issuer.Name != issuerVar) {
+				continue
+			}
+			ca, err := domains.LoadOrCreateLocalCA(issuer.CAPath, time.Duration(issuer.LeafValidityDays)*24*time.Hour)
+			if err != nil {
+				return err
+			}
+			if outputVar == "" {
+				fmt.Print(string(ca.RootPEM))
+				return nil
+			}
+			return os.WriteFile(outputVar, ca.RootPEM, 0644)
+		}
+		if issuerVar != "" {
+			return fmt.Errorf("no local issuer named %q is configured", issuerVar)
+		}
+		return errors.New("no local issuer is configured")
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(caCmd)
+	caCmd.AddCommand(caExportCmd)
+	caExportCmd.Flags().StringVarP(&issuerVar, "issuer", "i", "", "name of the local issuer (default is the first local issuer)")
+	caExportCmd.Flags().StringVarP(&outputVar, "output", "o", "", "file to write the root certificate to (default is stdout)")
+}
@@ -0,0 +1,133 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"shiroxy/cmd/shiroxy/domains"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	formatVar string
+	dryRunVar bool
+)
+
+var domainsCmd = &cobra.Command{
+	Use:   "domains",
+	Short: "Bulk domain management",
+	Long:  "Imports, exports and reconciles the domains of a running shiroxy instance through its admin API. Domain lists are JSON arrays, NDJSON or CSV files of domain records.",
+}
+
+var domainsExportCmd = &cobra.Command{
+	Use:     "export",
+	Short:   "Export the registered domains",
+	Example: "shiroxy domains export -c shiroxy.conf.yaml --format csv -o domains.csv",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		format := formatVar
+		if format == "" && outputVar != "" {
+			format = domains.DetectFormat(outputVar)
+		}
+		if format == "" {
+			format = domains.FormatJSON
+		}
+
+		response, err := sendAdminAPIRequest(http.MethodGet, "/v1/domains/export?format="+url.QueryEscape(format), nil)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("admin API responded with %s", response.Status)
+		}
+
+		if outputVar == "" {
+			_, err = io.Copy(os.Stdout, response.Body)
+			return err
+		}
+		file, err := os.Create(outputVar)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, response.Body); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	},
+}
+
+var domainsImportCmd = &cobra.Command{
+	Use:     "import <file>",
+	Short:   "Register or update the domains of a domain list",
+	Long:    "Registers the domains of the list that are missing and updates the changed ones. Registered domains missing from the list are kept.",
+	Example: "shiroxy domains import -c shiroxy.conf.yaml domains.csv --dry-run",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return postDomainList("/v1/domains/import", args[0])
+	},
+}
+
+var domainsReconcileCmd = &cobra.Command{
+	Use:     "reconcile <file|url>",
+	Short:   "Make the registered domains match a domain list",
+	Long:    "Registers the domains of the list that are missing, updates the changed ones and removes the domains that are not listed, except those registered by on-demand TLS. Use --dry-run to see the changes first.",
+	Example: "shiroxy domains reconcile -c shiroxy.conf.yaml https://example.com/domains.json --dry-run",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return postDomainList("/v1/domains/reconcile", args[0])
+	},
+}
+
+var domainsSyncCmd = &cobra.Command{
+	Use:   "sync",
+	Short: "Sync the domains with the configured domain source now",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodPost, "/v1/domains/sync?dry_run="+strconv.FormatBool(dryRunVar), nil)
+	},
+}
+
+var domainsSyncStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the outcome of the last domain sync",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodGet, "/v1/domains/sync", nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(domainsCmd)
+	domainsCmd.AddCommand(domainsExportCmd, domainsImportCmd, domainsReconcileCmd, domainsSyncCmd)
+	domainsSyncCmd.AddCommand(domainsSyncStatusCmd)
+	domainsCmd.PersistentFlags().StringVar(&apiVar, "api", "", "admin API URL (default is http://127.0.0.1:<adminapi port from the config>)")
+	for _, command := range []*cobra.Command{domainsExportCmd, domainsImportCmd, domainsReconcileCmd} {
+		command.Flags().StringVar(&formatVar, "format", "", "domain list format: json, csv or ndjson (default is detected from the file extension)")
+	}
+	domainsExportCmd.Flags().StringVarP(&outputVar, "output", "o", "", "file to write the domain list to (default is stdout)")
+	for _, command := range []*cobra.Command{domainsImportCmd, domainsReconcileCmd, domainsSyncCmd} {
+		command.Flags().BoolVar(&dryRunVar, "dry-run", false, "only report the changes")
+	}
+}
+
+// postDomainList reads a domain list from a file or URL and sends it to a bulk domain endpoint.
+// Parameters:
+//   - path: string, the API path of the endpoint.
+//   - source: string, the file path or URL of the domain list.
+//
+// Returns:
+//   - error: error if the list cannot be read or the request fails.
+func postDomainList(path, source string) error {
+	records, err := domains.ReadDomainList(&http.Client{Timeout: time.Minute}, source, formatVar, nil)
+	if err != nil {
+		return err
+	}
+	if records == nil {
+		records = []domains.DomainRecord{}
+	}
+	return adminAPIRequest(http.MethodPost, path+"?format=json&dry_run="+strconv.FormatBool(dryRunVar), records)
+}
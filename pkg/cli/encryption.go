@@ -0,0 +1,44 @@
+package cli
+
+import (
+	"fmt"
+	"net/http"
+	"shiroxy/cmd/shiroxy/domains"
+
+	"github.com/spf13/cobra"
+)
+
+var encryptionCmd = &cobra.Command{
+	Use:   "encryption",
+	Short: "Encryption at rest",
+	Long:  "Manages the master keys private keys and persistence files are encrypted with when storage.encryption is enabled",
+}
+
+var encryptionGenerateKeyCmd = &cobra.Command{
+	Use:   "generate-key",
+	Short: "Generate a master key",
+	Long:  "Prints a new master key line. Put it first in the key file (or environment variable) to make it the active key, keeping the older lines until the stored keys are rotated.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key, err := domains.GenerateMasterKey()
+		if err != nil {
+			return err
+		}
+		fmt.Println(key)
+		return nil
+	},
+}
+
+var encryptionRotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Encrypt stored keys with the active master key",
+	Long:  "Asks a running instance, restarted with the new master key first, to encrypt every stored private key with it. Older master keys can be removed afterwards.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return adminAPIRequest(http.MethodPost, "/v1/encryption/rotate", nil)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(encryptionCmd)
+	encryptionCmd.AddCommand(encryptionGenerateKeyCmd, encryptionRotateCmd)
+	encryptionRotateCmd.Flags().StringVar(&apiVar, "api", "", "admin API URL (default is http://127.0.0.1:<adminapi port from the config>)")
+}
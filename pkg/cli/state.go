@@ -0,0 +1,223 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/pkg/configuration"
+	"shiroxy/pkg/models"
+	"shiroxy/pkg/shutdown"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var stateCmd = &cobra.Command{
+	Use:   "state",
+	Short: "Saved state management",
+	Long:  "Inspects, migrates, exports and imports the snapshots shiroxy saves its domains, ACME accounts, backends, users and settings in. The snapshots of the SHIROXY_ENVIRONMENT environment in datapersistancepath are used unless a file is given.",
+}
+
+var stateInspectCmd = &cobra.Command{
+	Use:     "inspect [snapshot file]",
+	Short:   "Describe a snapshot",
+	Long:    "Prints the versions, checksum and contents of a snapshot (default is the newest one). Encrypted snapshots are only described by their header unless storage.encryption is configured.",
+	Example: "shiroxy state inspect -c shiroxy.conf.yaml",
+	Args:    cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, envelope, err := stateConfig()
+		if err != nil {
+			return err
+		}
+		path, err := snapshotPath(config, args)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		header, err := shutdown.InspectSnapshot(content)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		fmt.Printf("file:            %s\n", path)
+		fmt.Printf("format version:  %d\n", header.Version)
+		if header.Created.IsZero() {
+			fmt.Printf("created:         unknown (written before snapshots had headers)\n")
+		} else {
+			fmt.Printf("created:         %s\n", header.Created.Format(time.RFC3339))
+		}
+		fmt.Printf("sha256:          %s\n", header.Checksum)
+		fmt.Printf("encrypted:       %t\n", header.Sealed)
+		snapshot, err := shutdown.DecodeSnapshot(content, envelope)
+		if err != nil {
+			if header.Version > 0 {
+				fmt.Printf("schema version:  %d\n", header.SchemaVersion)
+			}
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("schema version:  %d (this build writes %d)\n", snapshot.SchemaVersion, shutdown.SnapshotSchemaVersion)
+		fmt.Printf("shiroxy version: %s\n", snapshot.Metadata.ShiroxyVersion)
+		fmt.Printf("instance:        %s\n", snapshot.Metadata.InstanceName)
+		fmt.Printf("domains:         %d\n", len(snapshot.State.Domains))
+		fmt.Printf("acme accounts:   %d\n", len(snapshot.State.Accounts))
+		registered := 0
+		for _, backend := range snapshot.Metadata.Backends {
+			if backend.Registered {
+				registered++
+			}
+		}
+		fmt.Printf("backends:        %d (%d registered through the admin API)\n", len(snapshot.Metadata.Backends), registered)
+		fmt.Printf("users:           %d\n", len(snapshot.Metadata.Users))
+		keys := make([]string, 0, len(snapshot.Metadata.Settings))
+		for key := range snapshot.Metadata.Settings {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("setting:         %s=%s\n", key, snapshot.Metadata.Settings[key])
+		}
+		return nil
+	},
+}
+
+var stateMigrateCmd = &cobra.Command{
+	Use:     "migrate [snapshot file]",
+	Short:   "Upgrade snapshots to the current schema",
+	Long:    "Rewrites snapshots (default is every snapshot of the environment) with the current format and schema versions, keeping their encryption. shiroxy also migrates snapshots when it restores them; migrating ahead of time lets a failed migration be seen before an upgrade.",
+	Example: "shiroxy state migrate -c shiroxy.conf.yaml",
+	Args:    cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, envelope, err := stateConfig()
+		if err != nil {
+			return err
+		}
+		paths := args
+		if len(paths) == 0 {
+			if paths, err = shutdown.SnapshotFiles(config); err != nil {
+				return err
+			}
+		}
+		for _, path := range paths {
+			from, err := shutdown.MigrateSnapshotFile(path, envelope)
+			if err != nil {
+				return fmt.Errorf("%s: %v", path, err)
+			}
+			if from == shutdown.SnapshotSchemaVersion {
+				fmt.Printf("%s: schema version %d\n", path, from)
+			} else {
+				fmt.Printf("%s: migrated from schema version %d to %d\n", path, from, shutdown.SnapshotSchemaVersion)
+			}
+		}
+		return nil
+	},
+}
+
+var stateExportCmd = &cobra.Command{
+	Use:     "export [snapshot file]",
+	Short:   "Export a snapshot as JSON",
+	Long:    "Writes the state of a snapshot (default is the newest one) as a JSON document, migrated to the current schema. The document holds private keys in plaintext and is written with mode 0600.",
+	Example: "shiroxy state export -c shiroxy.conf.yaml -o state.json",
+	Args:    cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, envelope, err := stateConfig()
+		if err != nil {
+			return err
+		}
+		path, err := snapshotPath(config, args)
+		if err != nil {
+			return err
+		}
+		snapshot, err := shutdown.ReadSnapshot(path, envelope)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		document, err := shutdown.NewStateDocument(snapshot)
+		if err != nil {
+			return err
+		}
+		body, err := json.MarshalIndent(document, "", "  ")
+		if err != nil {
+			return err
+		}
+		if outputVar == "" {
+			fmt.Println(string(body))
+			return nil
+		}
+		return os.WriteFile(outputVar, append(body, '\n'), 0600)
+	},
+}
+
+var stateImportCmd = &cobra.Command{
+	Use:     "import <state file>",
+	Short:   "Import a JSON state document",
+	Long:    "Validates a document written by \"shiroxy state export\" and saves it as the newest snapshot, which is restored on the next start. Stop shiroxy first: a running instance overwrites it with its own snapshots. Domains and accounts are only restored into the memory storage location.",
+	Example: "shiroxy state import -c shiroxy.conf.yaml state.json",
+	Args:    cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config, envelope, err := stateConfig()
+		if err != nil {
+			return err
+		}
+		body, err := os.ReadFile(args[0])
+		if err != nil {
+			return err
+		}
+		document := &shutdown.StateDocument{}
+		if err := json.Unmarshal(body, document); err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+		path, err := shutdown.ImportState(config, document, envelope)
+		if err != nil {
+			return fmt.Errorf("%s: %v", args[0], err)
+		}
+		fmt.Printf("imported %d domains into %s\n", len(document.Domains), path)
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(stateCmd)
+	stateCmd.AddCommand(stateInspectCmd, stateMigrateCmd, stateExportCmd, stateImportCmd)
+	stateExportCmd.Flags().StringVarP(&outputVar, "output", "o", "", "file to write the document to (default is stdout)")
+}
+
+// stateConfig reads the config file and the master key snapshots are encrypted with.
+// Returns:
+//   - *models.Config: the configuration.
+//   - *domains.Envelope: the configured encryption, or nil when disabled.
+//   - error: error if the config file or the master key cannot be read.
+func stateConfig() (*models.Config, *domains.Envelope, error) {
+	if configVar == "" {
+		return nil, nil, errors.New("the --config flag is required to find the snapshots")
+	}
+	config, err := configuration.ConfigReader(configVar)
+	if err != nil {
+		return nil, nil, err
+	}
+	envelope, err := domains.NewEncryption(config.Default.Storage.Encryption)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, envelope, nil
+}
+
+// snapshotPath returns the snapshot file given in args, or the newest snapshot.
+func snapshotPath(config *models.Config, args []string) (string, error) {
+	if len(args) > 0 {
+		return args[0], nil
+	}
+	paths, err := shutdown.SnapshotFiles(config)
+	if err != nil {
+		return "", err
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("no snapshot in %q", config.Default.DataPersistancePath)
+	}
+	return paths[0], nil
+}
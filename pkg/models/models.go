@@ -15,14 +15,114 @@ type Runtime struct {
 	InstanceName                 string `json:"instancename"`
 	AcmeServerUrl                string `json:"acmeserverurl"`
 	ACMEServerInsecureSkipVerify string `json:"aCMEserverinsecureskipverify"`
+	// ACME issuers in fallback order; when empty acmeserverurl is the only issuer.
+	Issuers []ACMEIssuer `json:"issuers"`
+}
+
+// ACMEIssuer configures a named ACME certificate authority, or the built-in local CA.
+type ACMEIssuer struct {
+	Name string `json:"name"`
+	// "acme" (default) or "local" for the built-in CA that issues certificates offline.
+	Type         string `json:"type"`
+	DirectoryUrl string `json:"directoryurl"`
+	// Skip verification of the directory's TLS certificate (local test CAs such as pebble).
+	InsecureSkipVerify bool `json:"insecureskipverify"`
+	// External Account Binding credentials, required by CAs such as ZeroSSL.
+	EABKeyId string `json:"eabkeyid"`
+	// Base64url encoded HMAC key of the External Account Binding.
+	EABHMACKey string `json:"eabhmackey"`
+	// Directory the local CA's root certificate and key are persisted in.
+	CAPath string `json:"capath"`
+	// Lifetime of certificates issued by the local CA; defaults to 30 days.
+	LeafValidityDays int `json:"leafvaliditydays"`
 }
 
 type Storage struct {
+	// memory, redis, file or sql
 	Location              string `json:"location"`
 	RedisHost             string `json:"redishost"`
 	RedisPort             string `json:"redisport"`
 	RedisPassword         string `json:"redispassword"`
 	RedisConnectionString string `json:"redisconnectionstring"`
+	// Further settings of the Redis connection (mode, TLS, pool, timeouts).
+	Redis Redis `json:"redis"`
+	// Path of the bolt database file used by file storage.
+	FilePath string `json:"filepath"`
+	// database/sql driver ("sqlite3" or "postgres") and data source name used by sql storage.
+	SQLDriver string `json:"sqldriver"`
+	SQLDSN    string `json:"sqldsn"`
+	// Encryption at rest of private keys and persistence files.
+	Encryption Encryption `json:"encryption"`
+}
+
+// Redis configures the connection of the redis storage location. Standalone
+// servers are addressed by redisconnectionstring, or redishost and redisport;
+// Sentinels and cluster nodes by addrs. redispassword is the password of the
+// server or of the ACL user.
+type Redis struct {
+	// standalone (default), sentinel or cluster
+	Mode string `json:"mode"`
+	// host:port of the Sentinels (sentinel) or of cluster seed nodes (cluster).
+	Addrs []string `json:"addrs"`
+	// Name of the master monitored by the Sentinels.
+	MasterName string `json:"mastername"`
+	// ACL user and password of the Sentinels, when they differ from the master's.
+	SentinelUsername string `json:"sentinelusername"`
+	SentinelPassword string `json:"sentinelpassword"`
+	// Database index; clusters only have database 0.
+	DB int `json:"db"`
+	// ACL user authenticated with redispassword.
+	Username string   `json:"username"`
+	TLS      RedisTLS `json:"tls"`
+	// Connections per node (defaults to 10 per CPU) and idle connections kept open.
+	PoolSize     int `json:"poolsize"`
+	MinIdleConns int `json:"minidleconns"`
+	// Seconds to wait for a connection (defaults to 5), a reply or a write
+	// (default to 3) and a free pooled connection (defaults to the read timeout plus 1).
+	DialTimeout  int `json:"dialtimeout"`
+	ReadTimeout  int `json:"readtimeout"`
+	WriteTimeout int `json:"writetimeout"`
+	PoolTimeout  int `json:"pooltimeout"`
+	// Retries of a failed command (defaults to 3, -1 disables them), backing off
+	// from minretrybackoff to maxretrybackoff milliseconds (default 8 and 512).
+	MaxRetries      int `json:"maxretries"`
+	MinRetryBackoff int `json:"minretrybackoff"`
+	MaxRetryBackoff int `json:"maxretrybackoff"`
+	// Seconds to keep retrying the first connection on startup (defaults to 30).
+	ConnectTimeout int `json:"connecttimeout"`
+	// Seconds between health probes (defaults to 10).
+	HealthCheckInterval int `json:"healthcheckinterval"`
+}
+
+// RedisTLS configures TLS connections to Redis. A rediss:// connection string
+// enables TLS too.
+type RedisTLS struct {
+	Enable bool `json:"enable"`
+	// PEM bundle of CAs trusted for the server certificate; system roots when empty.
+	CAFile string `json:"cafile"`
+	// Client certificate and key presented to Redis (mTLS).
+	CertFile string `json:"certfile"`
+	KeyFile  string `json:"keyfile"`
+	// Name verified in the server certificate; defaults to the host.
+	ServerName         string `json:"servername"`
+	InsecureSkipVerify bool   `json:"insecureskipverify"`
+}
+
+// Encryption configures the master key private keys and persistence files are encrypted with.
+type Encryption struct {
+	Enable bool `json:"enable"`
+	// File holding the master keys, one "<id>:<base64 key>" per line; the first
+	// line is the active key and the others only decrypt. It must not be
+	// readable by group or others.
+	KeyFile string `json:"keyfile"`
+	// Environment variable holding the master keys in the key file format;
+	// defaults to SHIROXY_MASTER_KEY when no other source is set.
+	KeyEnv string `json:"keyenv"`
+	// Executable that wraps and unwraps data keys, so the master key never
+	// leaves it (a local KMS).
+	KeyPlugin string `json:"keyplugin"`
+	// Timeout of key plugin calls in seconds; defaults to 10.
+	KeyPluginTimeout int `json:"keyplugintimeout"`
 }
 
 type Analytics struct {
@@ -34,9 +134,17 @@ type Default struct {
 	DebugMode                string       `json:"debugmode"`
 	LogPath                  string       `json:"logpath"`
 	EnableDnsChallengeSolver bool         `json:"enablednschallengesolver"`
+	DnsProvider              DnsProvider  `json:"dnsprovider"`
+	Renewal                  Renewal      `json:"renewal"`
+	Issuance                 Issuance     `json:"issuance"`
+	OCSP                     OCSP         `json:"ocsp"`
+	OnDemandTLS              OnDemandTLS  `json:"ondemandtls"`
+	DomainSync               DomainSync   `json:"domainsync"`
 	DataPersistancePath      string       `json:"datapersistancepath"`
+	Snapshot                 Snapshot     `json:"snapshot"`
 	Analytics                Analytics    `json:"analytics"`
 	Storage                  Storage      `json:"storage"`
+	Cluster                  Cluster      `json:"cluster"`
 	ErrorResponses           ErrorRespons `json:"errorresponses"`
 	TIMEOUT                  struct {
 		Connect string `json:"connect"`
@@ -53,6 +161,130 @@ type Default struct {
 	} `json:"adminapi"`
 }
 
+// DnsProvider configures how DNS-01 challenge TXT records are published.
+type DnsProvider struct {
+	// rfc2136, webhook
+	Name string `json:"name"`
+	// Seconds to wait after publishing a record before asking the CA to validate it.
+	PropagationDelay int                `json:"propagationdelay"`
+	RFC2136          DnsProviderRFC2136 `json:"rfc2136"`
+	Webhook          DnsProviderWebhook `json:"webhook"`
+}
+
+// Renewal configures the certificate renewal scheduler.
+type Renewal struct {
+	Disable bool `json:"disable"`
+	// Seconds between renewal checks.
+	CheckInterval int `json:"checkinterval"`
+	// Fraction of the certificate lifetime after which it is renewed (defaults to 2/3).
+	RenewalRatio float64 `json:"renewalratio"`
+	// Ask the CA for an ACME Renewal Information (ARI) window when it supports it.
+	ARI bool `json:"ari"`
+	// Seconds to wait before retrying a failed renewal; doubled on every failure.
+	RetryBackoff int `json:"retrybackoff"`
+	// Upper bound in seconds for the retry backoff.
+	MaxRetryBackoff int `json:"maxretrybackoff"`
+	// Days before expiry at which "certificate.expiring" is fired (defaults to 14, 7, 3 and 1).
+	ExpiryWarningDays []int `json:"expirywarningdays"`
+}
+
+// Issuance configures the background certificate issuance queue.
+type Issuance struct {
+	// Number of certificates issued concurrently.
+	Workers int `json:"workers"`
+	// Number of issuance jobs that can wait in the queue.
+	QueueSize int `json:"queuesize"`
+}
+
+// OCSP configures OCSP stapling.
+type OCSP struct {
+	Disable bool `json:"disable"`
+	// Seconds between OCSP checks.
+	CheckInterval int `json:"checkinterval"`
+	// Request certificates with the OCSP must-staple extension.
+	MustStaple bool `json:"muststaple"`
+}
+
+// Snapshot configures the snapshots of domains, accounts and the webhook secret
+// written to datapersistancepath while shiroxy runs.
+type Snapshot struct {
+	// Only write a snapshot on shutdown.
+	Disable bool `json:"disable"`
+	// Seconds between periodic snapshots (defaults to 300).
+	Interval int `json:"interval"`
+	// Seconds to wait after a domain changes before writing a snapshot, so a
+	// burst of changes is written once (defaults to 5).
+	OnChangeDelay int `json:"onchangedelay"`
+	// Number of snapshots kept; older ones are deleted (defaults to 5).
+	Retention int `json:"retention"`
+}
+
+// Cluster configures running several instances against one Redis database. The
+// instances share their domains, certificates, backends and http-01 challenge
+// tokens, and elect a leader that alone issues and renews certificates and
+// fires webhooks.
+type Cluster struct {
+	Enable bool `json:"enable"`
+	// Name of this instance in the cluster (defaults to the hostname and process id).
+	NodeId string `json:"nodeid"`
+	// Seconds the leader lease lasts without being renewed; another instance takes
+	// over this long after the leader stops (defaults to 15).
+	LeaseTTL int `json:"leasettl"`
+	// Seconds between full reloads of the domains from Redis, catching changes
+	// missed while the pub/sub connection was down (defaults to 60).
+	SyncInterval int `json:"syncinterval"`
+}
+
+// OnDemandTLS configures issuing certificates for unknown hostnames on their first TLS handshake.
+type OnDemandTLS struct {
+	Enable bool `json:"enable"`
+	// URL asked to approve a hostname with GET <askurl>?domain=<hostname>; a 200 response approves it.
+	AskUrl string `json:"askurl"`
+	// Hostnames approved without asking; "*.example.com" matches a single label.
+	Allowlist []string `json:"allowlist"`
+	// Contact email of the ACME account certificates are ordered with.
+	Email string `json:"email"`
+	// Issuer certificates are ordered from first (optional).
+	Issuer string `json:"issuer"`
+	// Maximum number of hostnames approved per minute (defaults to 10).
+	RateLimit int `json:"ratelimit"`
+	// Maximum number of hostnames sent to the ask URL per minute (defaults to 60).
+	AskRateLimit int `json:"askratelimit"`
+	// Seconds before a denied or failed hostname is tried again (defaults to 600).
+	RetryInterval int `json:"retryinterval"`
+	// Certificate and key files served while issuance is pending; a self-signed certificate when empty.
+	DefaultCert string `json:"defaultcert"`
+	DefaultKey  string `json:"defaultkey"`
+}
+
+// DomainSync reconciles the registered domains with a domain list kept elsewhere.
+type DomainSync struct {
+	// File path or http(s) URL of the desired domain list; empty disables syncing.
+	Source string `json:"source"`
+	// Format of the list: json, csv or ndjson (defaults to the extension or the response content type).
+	Format string `json:"format"`
+	// Seconds between syncs (defaults to 300).
+	Interval int `json:"interval"`
+	// Log the changes a sync would make without making them.
+	DryRun bool `json:"dryrun"`
+	// Headers sent with requests to an http(s) source, e.g. an Authorization header.
+	Headers map[string]string `json:"headers"`
+}
+
+type DnsProviderRFC2136 struct {
+	Nameserver    string `json:"nameserver"`
+	Zone          string `json:"zone"`
+	TTL           int    `json:"ttl"`
+	TSIGKeyName   string `json:"tsigkeyname"`
+	TSIGSecret    string `json:"tsigsecret"`
+	TSIGAlgorithm string `json:"tsigalgorithm"`
+}
+
+type DnsProviderWebhook struct {
+	Url    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
 type ErrorRespons struct {
 	ErrorPageButtonName string `json:"errorpagebuttonname"`
 	ErrorPageButtonUrl  string `json:"errorpagebuttonurl"`
@@ -73,6 +305,35 @@ type FrontendSecuritySetting struct {
 	SingleTargetMode    string                                     `json:"singletargetmode"`
 	CertAndKey          FrontendSecuritySettingCertAndKey          `json:"certandkey"`
 	ShiroxySingleSecure FrontendSecuritySettingShiroxySingleSecure `json:"shiroxysinglesecure"`
+	TLS                 FrontendTLSPolicy                          `json:"tls"`
+	ClientAuth          FrontendClientAuth                         `json:"clientauth"`
+}
+
+// FrontendClientAuth configures client certificate (mTLS) verification of a bind.
+type FrontendClientAuth struct {
+	// PEM bundle of CAs trusted to issue client certificates
+	CAFile string `json:"cafile"`
+	// PEM or DER encoded CRLs checked against verified client certificates
+	CRLFiles []string `json:"crlfiles"`
+	// Forward the client identity upstream as X-Client-Cert-* headers
+	ForwardIdentity bool `json:"forwardidentity"`
+	// Also forward the certificate itself: "pem" or "urlencoded"
+	CertificateHeader string `json:"certificateheader"`
+}
+
+// FrontendTLSPolicy tunes the TLS handshake of a bind. Explicit values override
+// the ones of the selected preset.
+type FrontendTLSPolicy struct {
+	// modern, intermediate (default) or old
+	Preset       string   `json:"preset"`
+	MinVersion   string   `json:"minversion"`
+	MaxVersion   string   `json:"maxversion"`
+	CipherSuites []string `json:"ciphersuites"`
+	Curves       []string `json:"curves"`
+	ALPN         []string `json:"alpn"`
+	// Session ticket key rotation interval in seconds; 0 keeps Go's default rotation.
+	SessionTicketRotation int  `json:"sessionticketrotation"`
+	DisableSessionTickets bool `json:"disablesessiontickets"`
 }
 
 type FrontendSecuritySettingCertAndKey struct {
@@ -111,6 +372,22 @@ type BackendServer struct {
 	Port      string `json:"port"`
 	HealthUrl string `json:"healthurl"`
 	Tags      string `json:"tags"`
+	// http, https or h2c; defaults to the frontend mode
+	Scheme string           `json:"scheme"`
+	TLS    BackendServerTLS `json:"tls"`
+}
+
+// BackendServerTLS configures TLS connections to an https backend server.
+type BackendServerTLS struct {
+	// PEM bundle of CAs trusted for the server certificate; system roots when empty
+	CAFile string `json:"cafile"`
+	// Client certificate and key presented to the backend (mTLS)
+	CertFile string `json:"certfile"`
+	KeyFile  string `json:"keyfile"`
+	// SNI and verification name, when it differs from the backend host
+	ServerName string `json:"servername"`
+	// Skip certificate verification; for lab use only
+	InsecureSkipVerify bool `json:"insecureskipverify"`
 }
 
 type Logging struct {
@@ -4,8 +4,6 @@
 package shutdown
 
 import (
-	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"os"
 	"os/signal"
@@ -16,8 +14,6 @@ import (
 	"shiroxy/pkg/models"
 	"sync"
 	"syscall"
-
-	"google.golang.org/protobuf/proto"
 )
 
 // HandleGracefulShutdown manages the graceful shutdown process of the application.
@@ -31,19 +27,12 @@ import (
 //   - storage: Storage object containing domain metadata and webhook secrets.
 //   - logHandler: Logger instance for logging shutdown events and errors.
 //   - analyticsConfiguration: Analytics configuration for reading and stopping analytics data.
+//   - snapshotter: Snapshotter writing the final snapshot of domain and analytics data.
 //   - wg: WaitGroup to synchronize goroutines during shutdown.
 //
 // The function listens for OS signals (SIGINT, SIGTERM) unless triggered by a panic,
-// marshals and persists domain and analytics data, and logs the outcome before exiting.
-//
-// cleanup writes the provided data string to the specified file path.
-// Returns an error if file creation or writing fails.
-func HandleGracefulShutdown(fromdefer bool, panicData interface{}, configuration *models.Config, storage *domains.Storage, logHandler *logger.Logger, analyticsConfiguration *analytics.AnalyticsConfiguration, wg *sync.WaitGroup) {
-	shiroxyEnvionment := os.Getenv("SHIROXY_ENVIRONMENT")
-	if shiroxyEnvionment == "" {
-		shiroxyEnvionment = "dev"
-	}
-
+// stops the periodic snapshots, writes a final snapshot and logs the outcome before exiting.
+func HandleGracefulShutdown(fromdefer bool, panicData interface{}, configuration *models.Config, storage *domains.Storage, logHandler *logger.Logger, analyticsConfiguration *analytics.AnalyticsConfiguration, snapshotter *Snapshotter, wg *sync.WaitGroup) {
 	var sigs chan os.Signal
 	if !fromdefer {
 		sigs = make(chan os.Signal, 1)
@@ -69,46 +58,18 @@ func HandleGracefulShutdown(fromdefer bool, panicData interface{}, configuration
 			analyticsData := <-analyticsConfiguration.ReadAnalyticsData
 			analyticsConfiguration.StopAnalytics()
 
-			analyticsJsonMarshaledData, err := json.Marshal(analyticsData)
-			if err != nil {
-				logHandler.LogError(err.Error(), "Shutdown", "")
-			}
-
-			var domainMetadataArray []*domains.DomainMetadata
-			if storage.DomainMetadata != nil {
-				for _, domainMetadata := range storage.DomainMetadata {
-					domainMetadataArray = append(domainMetadataArray, domainMetadata)
-				}
-			}
-
-			dataPersistance := domains.DataPersistance{
-				Datetime: "",
-				Domains:  domainMetadataArray,
-			}
-
-			storageData, err := proto.Marshal(&dataPersistance)
-			if err != nil {
-				logHandler.LogError(err.Error(), "Shutdown", "")
-			}
-
-			shutdownMetadata := ShutdownMetadata{
-				DomainMetadata: storageData,
-				SystemData:     analyticsJsonMarshaledData,
-				WebhookSecret:  storage.WebhookSecret,
-			}
-
-			shutdownMarshaledMetadata, err := proto.Marshal(&shutdownMetadata)
-			if err != nil {
-				logHandler.LogError(err.Error(), "Shutdown", "")
-			}
-
-			base64EncodedData := base64.StdEncoding.EncodeToString(shutdownMarshaledMetadata)
-
-			err = cleanup(fmt.Sprintf("%s/%s-persistence.shiroxy", configuration.Default.DataPersistancePath, shiroxyEnvionment), base64EncodedData)
+			// The final snapshot waits for a periodic one being written.
+			snapshotter.Stop()
+			_, err := snapshotter.Write(analyticsData)
 			if err != nil {
 				logHandler.Log(err.Error(), "Shutdown", "Error")
 			}
 			isShutDownSuccessful := err == nil
+
+			// Flushes and releases the domain store (bolt file lock, database and Redis connections).
+			if closeErr := storage.Close(); closeErr != nil {
+				logHandler.Log(closeErr.Error(), "Shutdown", "Error")
+			}
 			done <- isShutDownSuccessful
 		}()
 	}()
@@ -128,20 +89,3 @@ func HandleGracefulShutdown(fromdefer bool, panicData interface{}, configuration
 
 	os.Exit(0)
 }
-
-// cleanup creates or truncates the file at the specified filePath and writes the provided data string to it.
-// It returns an error if the file cannot be created or written to.
-func cleanup(filePath, data string) error {
-	f, err := os.Create(filePath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	_, err = f.WriteString(data)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
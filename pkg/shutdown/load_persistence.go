@@ -1,53 +1,67 @@
 package shutdown
 
 import (
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
 	"shiroxy/cmd/shiroxy/analytics"
 	"shiroxy/cmd/shiroxy/domains"
 	"shiroxy/pkg/logger"
 	"shiroxy/pkg/models"
-
-	"google.golang.org/protobuf/proto"
+	"strings"
 )
 
-func LoadShutdownPersistence(logHandler logger.Logger, configuration *models.Config, storage *domains.Storage, analyticsConfiguration *analytics.AnalyticsConfiguration) {
-	shiroxyEnvionment := os.Getenv("SHIROXY_ENVIRONMENT")
-	if shiroxyEnvionment == "" {
-		shiroxyEnvionment = "dev"
-	}
-
-	fileContent, err := os.ReadFile(fmt.Sprintf("%s/%s-persistence.shiroxy", configuration.Default.DataPersistancePath, shiroxyEnvionment))
+// LoadShutdownPersistence restores the newest valid snapshot. Snapshots that
+// are truncated or corrupted are skipped in favor of the next older one; a
+// snapshot is only applied once it was read and validated completely.
+// Backends are restored separately by RestoreBackends once the load balancer runs.
+//
+// Returns:
+//   - *Snapshot: the restored snapshot, or nil if there was none.
+//   - error: error if a snapshot is incompatible with this build, is encrypted
+//     without a configured key, or if no snapshot is valid. Starting anyway
+//     would replace the saved state with an empty one.
+func LoadShutdownPersistence(logHandler logger.Logger, configuration *models.Config, storage *domains.Storage, analyticsConfiguration *analytics.AnalyticsConfiguration) (*Snapshot, error) {
+	paths, err := SnapshotFiles(configuration)
 	if err != nil {
-		// logHandler.LogError(err.Error(), "ShutDown", "Load Persistence S1")
-		return
+		return nil, err
 	}
 
-	base64DecodedData, err := base64.StdEncoding.DecodeString(string(fileContent))
-	if err != nil {
-		logHandler.LogError(err.Error(), "STARTUP", "Load Persistence S2")
-		return
+	var snapshot *Snapshot
+	for _, path := range paths {
+		snapshot, err = ReadSnapshot(path, storage.Encryption)
+		if err == nil {
+			break
+		}
+		// Older snapshots would silently lose the newer state, so these are not skipped.
+		if errors.Is(err, ErrIncompatibleSnapshot) || errors.Is(err, domains.ErrSealedWithoutKey) {
+			return nil, fmt.Errorf("snapshot %s: %v", path, err)
+		}
+		logHandler.LogError(fmt.Sprintf("snapshot %s: %v", path, err), "STARTUP", "Load Persistence S2")
 	}
-
-	var shutDown ShutdownMetadata
-	err = proto.Unmarshal(base64DecodedData, &shutDown)
-	if err != nil {
-		logHandler.LogError(err.Error(), "STARTUP", "Load Persistence S3")
-		return
+	if snapshot == nil {
+		if len(paths) > 0 {
+			return nil, fmt.Errorf("no valid snapshot among %s; move them away to start without the saved state, or restore an export with \"shiroxy state import\"", strings.Join(paths, ", "))
+		}
+		return nil, nil
+	}
+	if snapshot.SchemaVersion < SnapshotSchemaVersion {
+		logHandler.LogWarning(fmt.Sprintf("snapshot %s migrated from schema version %d to %d", snapshot.Path, snapshot.SchemaVersion, SnapshotSchemaVersion), "STARTUP", "Load Persistence S3")
+	}
+	if location, ok := snapshot.Metadata.Settings["storage.location"]; ok && location != configuration.Default.Storage.Location {
+		logHandler.LogWarning(fmt.Sprintf("snapshot %s was written with storage.location %q, now %q", snapshot.Path, location, configuration.Default.Storage.Location), "STARTUP", "Load Persistence S3")
 	}
 
-	var domainDataPersistence domains.DataPersistance
-	err = proto.Unmarshal([]byte(shutDown.DomainMetadata), &domainDataPersistence)
+	err = storage.RestoreDomains(snapshot.State.Domains)
 	if err != nil {
 		logHandler.LogError(err.Error(), "STARTUP", "Load Persistence S4")
-		return
 	}
 
-	for _, domainMetadata := range domainDataPersistence.Domains {
-		storage.DomainMetadata[domainMetadata.Domain] = domainMetadata
+	err = storage.ImportAccounts(snapshot.State.Accounts)
+	if err != nil {
+		logHandler.LogError(err.Error(), "STARTUP", "Load Persistence S5")
 	}
 
-	storage.WebhookSecret = shutDown.WebhookSecret
-	logHandler.LogSuccess(fmt.Sprintf("Total %d Retrieved\n", len(domainDataPersistence.Domains)), "STARTUP", "INFO")
+	storage.WebhookSecret = snapshot.Metadata.WebhookSecret
+	logHandler.LogSuccess(fmt.Sprintf("Total %d Retrieved from %s\n", len(snapshot.State.Domains), snapshot.Path), "STARTUP", "INFO")
+	return snapshot, nil
 }
@@ -0,0 +1,78 @@
+package shutdown
+
+import (
+	"errors"
+	"fmt"
+	"shiroxy/cmd/shiroxy/domains"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// SnapshotSchemaVersion is the schema version of the snapshots written by this
+// build. Bump it together with a new entry of snapshotMigrations whenever the
+// meaning of a snapshot field changes.
+const SnapshotSchemaVersion = 2
+
+// ErrIncompatibleSnapshot is returned for snapshots written by a newer shiroxy,
+// which this build cannot read without losing data.
+var ErrIncompatibleSnapshot = errors.New("snapshot is incompatible with this build")
+
+// snapshotMigrations[v] upgrades a snapshot body from schema version v to v+1.
+var snapshotMigrations = []func(metadata *ShutdownMetadata) error{
+	migrateSnapshotV0,
+	migrateSnapshotV1,
+}
+
+// MigrateSnapshot upgrades metadata in place to SnapshotSchemaVersion, one
+// schema version at a time.
+// Parameters:
+//   - metadata: *ShutdownMetadata, the snapshot body.
+//
+// Returns:
+//   - uint32: the schema version the body was written with.
+//   - error: ErrIncompatibleSnapshot if the body is newer than this build, or the error of a failed migration.
+func MigrateSnapshot(metadata *ShutdownMetadata) (uint32, error) {
+	from := metadata.SchemaVersion
+	if from > SnapshotSchemaVersion {
+		return from, fmt.Errorf("%w: schema version %d is newer than version %d read by shiroxy %s; upgrade shiroxy or restore an older snapshot", ErrIncompatibleSnapshot, from, SnapshotSchemaVersion, metadata.ShiroxyVersion)
+	}
+	for version := from; version < SnapshotSchemaVersion; version++ {
+		if err := snapshotMigrations[version](metadata); err != nil {
+			return from, fmt.Errorf("snapshot: migrating schema version %d to %d: %v", version, version+1, err)
+		}
+		metadata.SchemaVersion = version + 1
+	}
+	return from, nil
+}
+
+// migrateSnapshotV0 upgrades the unversioned snapshots written before backends,
+// users and settings were recorded; they only kept the time in the domain data.
+func migrateSnapshotV0(metadata *ShutdownMetadata) error {
+	state := &domains.DataPersistance{}
+	if err := proto.Unmarshal(metadata.DomainMetadata, state); err != nil {
+		return err
+	}
+	metadata.CreatedAt = state.Datetime
+	if metadata.Settings == nil {
+		metadata.Settings = map[string]string{}
+	}
+	return nil
+}
+
+// migrateSnapshotV1 upgrades snapshots whose domains kept their routing tags and
+// certificate details in the metadata map instead of the typed fields.
+func migrateSnapshotV1(metadata *ShutdownMetadata) error {
+	state := &domains.DataPersistance{}
+	if err := proto.Unmarshal(metadata.DomainMetadata, state); err != nil {
+		return err
+	}
+	for _, domainMetadata := range state.Domains {
+		domains.MigrateDomainMetadata(domainMetadata)
+	}
+	body, err := proto.Marshal(state)
+	if err != nil {
+		return err
+	}
+	metadata.DomainMetadata = body
+	return nil
+}
@@ -0,0 +1,541 @@
+package shutdown
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"shiroxy/cmd/shiroxy/analytics"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/proxy"
+	internal "shiroxy/pkg"
+	"shiroxy/pkg/logger"
+	"shiroxy/pkg/models"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// snapshotMagic starts the header line of every snapshot file.
+	snapshotMagic = "SHIROXY-SNAPSHOT"
+	// SnapshotFormatVersion is the version of the snapshot file layout written by this build.
+	SnapshotFormatVersion = 1
+	// snapshotTimeLayout sorts lexically in the order snapshots were written.
+	snapshotTimeLayout = "20060102T150405.000000000Z"
+
+	defaultSnapshotInterval      = 300 * time.Second
+	defaultSnapshotOnChangeDelay = 5 * time.Second
+	defaultSnapshotRetention     = 5
+)
+
+// persistenceAssociatedData binds the encrypted persistence file to its purpose.
+var persistenceAssociatedData = []byte("shiroxy/persistence")
+
+// Snapshot is a snapshot file read and validated by ReadSnapshot.
+type Snapshot struct {
+	Path          string                   // File the snapshot was read from.
+	Version       int                      // Format version of the file; 0 for the headerless files of earlier versions.
+	SchemaVersion uint32                   // Schema version the body was written with; Metadata is migrated to SnapshotSchemaVersion.
+	Created       time.Time                // Time the snapshot was written; zero for headerless files.
+	Checksum      string                   // Hex SHA-256 of the body.
+	Sealed        bool                     // The body is encrypted with storage.encryption.
+	Metadata      *ShutdownMetadata        // Decoded body.
+	State         *domains.DataPersistance // Decoded domains and ACME accounts.
+}
+
+// EncodeSnapshot builds a snapshot file holding metadata. The body is encrypted
+// when envelope is set and is preceded by a header line with the format and
+// schema versions, the creation time, the SHA-256 checksum and the size of the body.
+// Parameters:
+//   - metadata: *ShutdownMetadata, the state to write.
+//   - envelope: *domains.Envelope, encrypts the body (may be nil).
+//   - created: time.Time, the time recorded in the header.
+//
+// Returns:
+//   - []byte: the file content.
+//   - error: error if the metadata cannot be marshaled or encrypted.
+func EncodeSnapshot(metadata *ShutdownMetadata, envelope *domains.Envelope, created time.Time) ([]byte, error) {
+	body, err := proto.Marshal(metadata)
+	if err != nil {
+		return nil, err
+	}
+	// Private keys and the webhook secret are encrypted when storage encryption is enabled.
+	if envelope != nil {
+		body, err = envelope.Seal(body, persistenceAssociatedData)
+		if err != nil {
+			return nil, err
+		}
+	}
+	checksum := sha256.Sum256(body)
+	header := fmt.Sprintf("%s/%d schema=%d created=%s sha256=%s size=%d\n", snapshotMagic, SnapshotFormatVersion, metadata.SchemaVersion, created.UTC().Format(time.RFC3339Nano), hex.EncodeToString(checksum[:]), len(body))
+	return append([]byte(header), body...), nil
+}
+
+// DecodeSnapshot validates a snapshot file, decodes it and migrates it to
+// SnapshotSchemaVersion. Headerless base64 files written by earlier versions are
+// accepted. Nothing is applied: the caller restores the returned state only
+// once the whole file proved valid.
+// Parameters:
+//   - content: []byte, the file content.
+//   - envelope: *domains.Envelope, decrypts an encrypted body (may be nil).
+//
+// Returns:
+//   - *Snapshot: the decoded snapshot, without Path.
+//   - error: ErrIncompatibleSnapshot for snapshots of a newer shiroxy, or error if the file is truncated, corrupted or cannot be decrypted.
+func DecodeSnapshot(content []byte, envelope *domains.Envelope) (*Snapshot, error) {
+	snapshot, body, err := decodeSnapshotFile(content)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Sealed {
+		if envelope == nil {
+			return nil, domains.ErrSealedWithoutKey
+		}
+		body, err = envelope.Open(body, persistenceAssociatedData)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	snapshot.Metadata = &ShutdownMetadata{}
+	if err := proto.Unmarshal(body, snapshot.Metadata); err != nil {
+		return nil, fmt.Errorf("snapshot: %v", err)
+	}
+	snapshot.SchemaVersion, err = MigrateSnapshot(snapshot.Metadata)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.State = &domains.DataPersistance{}
+	if err := proto.Unmarshal(snapshot.Metadata.DomainMetadata, snapshot.State); err != nil {
+		return nil, fmt.Errorf("snapshot: domains: %v", err)
+	}
+	seen := make(map[string]bool, len(snapshot.State.Domains))
+	for _, domainMetadata := range snapshot.State.Domains {
+		if domainMetadata.GetDomain() == "" {
+			return nil, errors.New("snapshot: domain without a name")
+		}
+		if seen[domainMetadata.Domain] {
+			return nil, fmt.Errorf("snapshot: domain %s appears twice", domainMetadata.Domain)
+		}
+		seen[domainMetadata.Domain] = true
+	}
+	return snapshot, nil
+}
+
+// InspectSnapshot validates the header and checksum of a snapshot file without
+// decrypting or decoding its body, so it works without the master key.
+// Parameters:
+//   - content: []byte, the file content.
+//
+// Returns:
+//   - *Snapshot: the snapshot without Metadata and State; SchemaVersion is 0 for headerless files.
+//   - error: error if the file is truncated, corrupted or of an unknown format version.
+func InspectSnapshot(content []byte) (*Snapshot, error) {
+	snapshot, _, err := decodeSnapshotFile(content)
+	return snapshot, err
+}
+
+// decodeSnapshotFile checks the header and checksum of a snapshot file.
+// Returns the snapshot described by the header and the possibly encrypted body.
+func decodeSnapshotFile(content []byte) (*Snapshot, []byte, error) {
+	snapshot := &Snapshot{}
+	var body []byte
+	if bytes.HasPrefix(content, []byte(snapshotMagic+"/")) {
+		newline := bytes.IndexByte(content, '\n')
+		if newline < 0 {
+			return nil, nil, errors.New("snapshot: truncated header")
+		}
+		size, err := parseSnapshotHeader(string(content[:newline]), snapshot)
+		if err != nil {
+			return nil, nil, err
+		}
+		body = content[newline+1:]
+		if len(body) != size {
+			return nil, nil, fmt.Errorf("snapshot: body is %d bytes, header says %d", len(body), size)
+		}
+		checksum := sha256.Sum256(body)
+		if hex.EncodeToString(checksum[:]) != snapshot.Checksum {
+			return nil, nil, errors.New("snapshot: checksum mismatch")
+		}
+	} else {
+		var err error
+		body, err = base64.StdEncoding.DecodeString(string(content))
+		if err != nil {
+			return nil, nil, fmt.Errorf("snapshot: %v", err)
+		}
+		checksum := sha256.Sum256(body)
+		snapshot.Checksum = hex.EncodeToString(checksum[:])
+	}
+	snapshot.Sealed = domains.IsSealed(body)
+	return snapshot, body, nil
+}
+
+// parseSnapshotHeader parses "SHIROXY-SNAPSHOT/<version> schema=<n> created=<time> sha256=<hex> size=<n>"
+// into snapshot and returns the size of the body.
+func parseSnapshotHeader(header string, snapshot *Snapshot) (int, error) {
+	fields := strings.Fields(header)
+	version, err := strconv.Atoi(strings.TrimPrefix(fields[0], snapshotMagic+"/"))
+	if err != nil {
+		return 0, fmt.Errorf("snapshot: malformed header %q", header)
+	}
+	if version > SnapshotFormatVersion {
+		return 0, fmt.Errorf("%w: format version %d is newer than version %d read by this build; upgrade shiroxy", ErrIncompatibleSnapshot, version, SnapshotFormatVersion)
+	}
+	snapshot.Version = version
+	size := -1
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "schema":
+			var schema uint64
+			schema, err = strconv.ParseUint(value, 10, 32)
+			snapshot.SchemaVersion = uint32(schema)
+		case "created":
+			snapshot.Created, err = time.Parse(time.RFC3339Nano, value)
+		case "sha256":
+			snapshot.Checksum = value
+		case "size":
+			size, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("snapshot: malformed header field %q", field)
+		}
+	}
+	if snapshot.Checksum == "" || size < 0 {
+		return 0, fmt.Errorf("snapshot: malformed header %q", header)
+	}
+	// Checked before decrypting, so incompatible snapshots are reported even without the key.
+	if snapshot.SchemaVersion > SnapshotSchemaVersion {
+		return 0, fmt.Errorf("%w: schema version %d is newer than version %d read by this build; upgrade shiroxy or restore an older snapshot", ErrIncompatibleSnapshot, snapshot.SchemaVersion, SnapshotSchemaVersion)
+	}
+	return size, nil
+}
+
+// ReadSnapshot reads and validates a snapshot file; see DecodeSnapshot.
+func ReadSnapshot(path string, envelope *domains.Envelope) (*Snapshot, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot, err := DecodeSnapshot(content, envelope)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Path = path
+	return snapshot, nil
+}
+
+// snapshotPrefix returns the directory snapshots are written to and the prefix
+// of their file names, which depends on SHIROXY_ENVIRONMENT.
+func snapshotPrefix(configuration *models.Config) (string, string) {
+	shiroxyEnvionment := os.Getenv("SHIROXY_ENVIRONMENT")
+	if shiroxyEnvionment == "" {
+		shiroxyEnvionment = "dev"
+	}
+	return configuration.Default.DataPersistancePath, shiroxyEnvionment + "-persistence"
+}
+
+// SnapshotFiles lists the snapshot files of the configured environment, newest
+// first. The single file written by earlier versions comes last.
+// Parameters:
+//   - configuration: *models.Config, the configuration holding datapersistancepath.
+//
+// Returns:
+//   - []string: the snapshot file paths.
+//   - error: error if the directory cannot be listed.
+func SnapshotFiles(configuration *models.Config) ([]string, error) {
+	return snapshotFiles(snapshotPrefix(configuration))
+}
+
+// snapshotFiles lists the snapshot files named prefix in dir; see SnapshotFiles.
+func snapshotFiles(dir, prefix string) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, prefix+"-*.shiroxy"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+	legacy := filepath.Join(dir, prefix+".shiroxy")
+	if _, err := os.Stat(legacy); err == nil {
+		paths = append(paths, legacy)
+	}
+	return paths, nil
+}
+
+// writeFileAtomic replaces path with data. The data is written to a temporary
+// file in the same directory, flushed to disk and renamed over path, so a crash
+// leaves either the old or the new file, never a partial one. The file is only
+// readable by its owner, as it holds private keys.
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	temp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name()) // Fails harmlessly once renamed.
+
+	if err := temp.Chmod(0600); err != nil {
+		temp.Close()
+		return err
+	}
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+
+	// The rename only survives a power loss once the directory is flushed too.
+	directory, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+	return directory.Sync()
+}
+
+// Snapshotter writes snapshots of the domains, ACME accounts, backends, users,
+// settings and webhook secret periodically, shortly after domains change and on
+// shutdown, so a crash only loses the changes made since the last snapshot.
+type Snapshotter struct {
+	configuration          *models.Config
+	storage                *domains.Storage
+	loadBalancer           *proxy.LoadBalancer // Backends are recorded once it is attached.
+	users                  []*UserSnapshot
+	analyticsConfiguration *analytics.AnalyticsConfiguration
+	logHandler             *logger.Logger
+	dir                    string        // Directory snapshots are written to.
+	prefix                 string        // File name prefix of the environment's snapshots.
+	retention              int           // Number of snapshots kept.
+	interval               time.Duration // Time between periodic snapshots.
+	onChangeDelay          time.Duration // Time between a domain change and its snapshot.
+	lock                   sync.Mutex    // Serializes writes and pruning, and guards loadBalancer.
+	changed                chan struct{} // Signaled when a domain changes.
+	stop                   chan struct{}
+	stopOnce               sync.Once
+	unsubscribe            func()
+}
+
+// NewSnapshotter creates a snapshotter writing to datapersistancepath.
+// Parameters:
+//   - configuration: *models.Config, the configuration holding datapersistancepath and the snapshot settings.
+//   - storage: *domains.Storage, the storage whose state is written.
+//   - analyticsConfiguration: *analytics.AnalyticsConfiguration, the analytics recorded with each snapshot (may be nil).
+//   - logHandler: *logger.Logger, logs failed snapshots.
+//
+// Returns:
+//   - *Snapshotter: the snapshotter.
+func NewSnapshotter(configuration *models.Config, storage *domains.Storage, analyticsConfiguration *analytics.AnalyticsConfiguration, logHandler *logger.Logger) *Snapshotter {
+	config := configuration.Default.Snapshot
+	dir, prefix := snapshotPrefix(configuration)
+	snapshotter := &Snapshotter{
+		configuration:          configuration,
+		storage:                storage,
+		users:                  adminUsers(configuration),
+		analyticsConfiguration: analyticsConfiguration,
+		logHandler:             logHandler,
+		dir:                    dir,
+		prefix:                 prefix,
+		retention:              defaultSnapshotRetention,
+		interval:               defaultSnapshotInterval,
+		onChangeDelay:          defaultSnapshotOnChangeDelay,
+		changed:                make(chan struct{}, 1),
+		stop:                   make(chan struct{}),
+	}
+	if config.Retention > 0 {
+		snapshotter.retention = config.Retention
+	}
+	if config.Interval > 0 {
+		snapshotter.interval = time.Duration(config.Interval) * time.Second
+	}
+	if config.OnChangeDelay > 0 {
+		snapshotter.onChangeDelay = time.Duration(config.OnChangeDelay) * time.Second
+	}
+	return snapshotter
+}
+
+// StartSnapshotter creates a snapshotter and, unless snapshots are disabled,
+// starts writing snapshots periodically and after domain changes.
+// Parameters:
+//   - configuration: *models.Config, the configuration holding datapersistancepath and the snapshot settings.
+//   - storage: *domains.Storage, the storage whose state is written.
+//   - analyticsConfiguration: *analytics.AnalyticsConfiguration, the analytics recorded with each snapshot (may be nil).
+//   - logHandler: *logger.Logger, logs failed snapshots.
+//   - wg: *sync.WaitGroup, used for synchronization.
+//
+// Returns:
+//   - *Snapshotter: the snapshotter, which also writes the shutdown snapshot.
+func StartSnapshotter(configuration *models.Config, storage *domains.Storage, analyticsConfiguration *analytics.AnalyticsConfiguration, logHandler *logger.Logger, wg *sync.WaitGroup) *Snapshotter {
+	snapshotter := NewSnapshotter(configuration, storage, analyticsConfiguration, logHandler)
+	if configuration.Default.Snapshot.Disable {
+		return snapshotter
+	}
+
+	// Subscribers run while the registry is locked, so the change is only signaled here.
+	snapshotter.unsubscribe = storage.Domains().Subscribe(func(event domains.DomainEvent) {
+		select {
+		case snapshotter.changed <- struct{}{}:
+		default:
+		}
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(snapshotter.interval)
+		defer ticker.Stop()
+		var pending <-chan time.Time
+		for {
+			select {
+			case <-ticker.C:
+			case <-snapshotter.changed:
+				// The first change of a burst starts the delay; later ones join its snapshot.
+				if pending == nil {
+					pending = time.After(snapshotter.onChangeDelay)
+				}
+				continue
+			case <-pending:
+				pending = nil
+			case <-snapshotter.stop:
+				return
+			}
+			if _, err := snapshotter.Write(snapshotter.latestAnalytics()); err != nil {
+				snapshotter.logHandler.LogError(fmt.Sprintf("writing snapshot failed: %v", err), "Snapshot", "")
+			}
+		}
+	}()
+	return snapshotter
+}
+
+// Stop stops the periodic and on-change snapshots. A snapshot being written is
+// completed by the next Write, which waits for it.
+func (s *Snapshotter) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+		if s.unsubscribe != nil {
+			s.unsubscribe()
+		}
+	})
+}
+
+// SetLoadBalancer records the backends of loadBalancer in the next snapshots.
+// Parameters:
+//   - loadBalancer: *proxy.LoadBalancer, the load balancer whose backends are recorded.
+func (s *Snapshotter) SetLoadBalancer(loadBalancer *proxy.LoadBalancer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.loadBalancer = loadBalancer
+}
+
+// latestAnalytics returns the last collected analytics, or nil.
+func (s *Snapshotter) latestAnalytics() *analytics.ShiroxyAnalytics {
+	if s.analyticsConfiguration == nil {
+		return nil
+	}
+	analyticsData, _ := s.analyticsConfiguration.ReadAnalytics(false)
+	return analyticsData
+}
+
+// Write writes a snapshot of the current state and deletes the snapshots
+// beyond the retention.
+// Parameters:
+//   - analyticsData: *analytics.ShiroxyAnalytics, the analytics recorded with the snapshot (may be nil).
+//
+// Returns:
+//   - string: the path of the snapshot file.
+//   - error: error if the snapshot cannot be encoded or written.
+func (s *Snapshotter) Write(analyticsData *analytics.ShiroxyAnalytics) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().UTC()
+	analyticsJsonMarshaledData, err := json.Marshal(analyticsData)
+	if err != nil {
+		return "", err
+	}
+	dataPersistance := domains.DataPersistance{
+		Datetime: now.Format(time.RFC3339),
+		Domains:  s.storage.Domains().Snapshot().List(),
+		Accounts: s.storage.ExportAccounts(),
+	}
+	storageData, err := proto.Marshal(&dataPersistance)
+	if err != nil {
+		return "", err
+	}
+	metadata := &ShutdownMetadata{
+		DomainMetadata: storageData,
+		SystemData:     analyticsJsonMarshaledData,
+		WebhookSecret:  s.storage.WebhookSecret,
+		SchemaVersion:  SnapshotSchemaVersion,
+		CreatedAt:      now.Format(time.RFC3339),
+		ShiroxyVersion: internal.VERSION,
+		InstanceName:   s.configuration.Runtime.InstanceName,
+		Backends:       backendSnapshots(s.loadBalancer),
+		Users:          s.users,
+		Settings:       snapshotSettings(s.configuration, s.storage.Encryption != nil),
+	}
+	return saveSnapshot(s.dir, s.prefix, s.retention, metadata, s.storage.Encryption, now, s.logHandler)
+}
+
+// saveSnapshot writes metadata to a new snapshot file in dir and deletes the
+// snapshots beyond retention. Failing to delete old snapshots is only logged.
+func saveSnapshot(dir, prefix string, retention int, metadata *ShutdownMetadata, envelope *domains.Envelope, now time.Time, logHandler *logger.Logger) (string, error) {
+	content, err := EncodeSnapshot(metadata, envelope, now)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.shiroxy", prefix, now.UTC().Format(snapshotTimeLayout)))
+	if err := writeFileAtomic(path, content); err != nil {
+		return "", err
+	}
+	if err := pruneSnapshots(dir, prefix, retention); err != nil && logHandler != nil {
+		logHandler.LogError(fmt.Sprintf("deleting old snapshots failed: %v", err), "Snapshot", "")
+	}
+	return path, nil
+}
+
+// pruneSnapshots deletes the snapshots beyond retention, oldest first, and the
+// temporary files left behind by writes interrupted by a crash.
+func pruneSnapshots(dir, prefix string, retention int) error {
+	temps, err := filepath.Glob(filepath.Join(dir, "."+prefix+"*.tmp-*"))
+	if err != nil {
+		return err
+	}
+	for _, temp := range temps {
+		if err := os.Remove(temp); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	paths, err := snapshotFiles(dir, prefix)
+	if err != nil {
+		return err
+	}
+	if len(paths) <= retention {
+		return nil
+	}
+	for _, path := range paths[retention:] {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
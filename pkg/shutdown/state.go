@@ -0,0 +1,321 @@
+package shutdown
+
+import (
+	"encoding/json"
+	"fmt"
+	"shiroxy/cmd/shiroxy/domains"
+	"shiroxy/cmd/shiroxy/proxy"
+	"shiroxy/pkg/logger"
+	"shiroxy/pkg/models"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// adminUsers returns the admin API user of the configuration with its secret
+// hashed, as the users of a snapshot.
+func adminUsers(configuration *models.Config) []*UserSnapshot {
+	if configuration.Default.User.Email == "" {
+		return nil
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(configuration.Default.User.Secret), bcrypt.DefaultCost)
+	if err != nil {
+		return nil
+	}
+	return []*UserSnapshot{{
+		Id:             "admin",
+		Name:           "admin",
+		Email:          configuration.Default.User.Email,
+		HashedPassword: string(hashedPassword),
+	}}
+}
+
+// backendSnapshots returns the backends of loadBalancer, which may be nil.
+func backendSnapshots(loadBalancer *proxy.LoadBalancer) []*BackendSnapshot {
+	if loadBalancer == nil {
+		return nil
+	}
+	definitions, registered := loadBalancer.ServerDefinitions()
+	backends := make([]*BackendSnapshot, 0, len(definitions))
+	for i, definition := range definitions {
+		var tags []string
+		if definition.Tags != "" {
+			tags = strings.Split(definition.Tags, ",")
+		}
+		backends = append(backends, &BackendSnapshot{
+			Id:                    definition.Id,
+			Host:                  definition.Host,
+			Port:                  definition.Port,
+			HealthUrl:             definition.HealthUrl,
+			Tags:                  tags,
+			Scheme:                definition.Scheme,
+			TlsCaFile:             definition.TLS.CAFile,
+			TlsCertFile:           definition.TLS.CertFile,
+			TlsKeyFile:            definition.TLS.KeyFile,
+			TlsServerName:         definition.TLS.ServerName,
+			TlsInsecureSkipVerify: definition.TLS.InsecureSkipVerify,
+			Registered:            registered[i],
+		})
+	}
+	return backends
+}
+
+// snapshotSettings returns the settings a snapshot is written under.
+func snapshotSettings(configuration *models.Config, encrypted bool) map[string]string {
+	return map[string]string{
+		"runtime.mode":       configuration.Runtime.Mode,
+		"frontend.mode":      configuration.Frontend.Mode,
+		"storage.location":   configuration.Default.Storage.Location,
+		"storage.encryption": strconv.FormatBool(encrypted),
+	}
+}
+
+// RestoreBackends registers again the backends of a snapshot that were
+// registered through the admin API. Backends whose id is already load balanced,
+// for example because they were added to the config file, are skipped.
+// Parameters:
+//   - snapshot: *Snapshot, the restored snapshot (may be nil).
+//   - loadBalancer: *proxy.LoadBalancer, the load balancer the backends are registered with.
+//   - configuration: *models.Config, the configuration holding the default upstream scheme.
+//   - logHandler: *logger.Logger, logs backends that cannot be created.
+//
+// Returns:
+//   - int: the number of backends registered.
+func RestoreBackends(snapshot *Snapshot, loadBalancer *proxy.LoadBalancer, configuration *models.Config, logHandler *logger.Logger) int {
+	if snapshot == nil {
+		return 0
+	}
+	restored := 0
+	for _, backend := range snapshot.Metadata.Backends {
+		if !backend.Registered || loadBalancer.HasServer(backend.Id) {
+			continue
+		}
+		server, err := proxy.NewBackendServer(models.BackendServer{
+			Id:        backend.Id,
+			Host:      backend.Host,
+			Port:      backend.Port,
+			HealthUrl: backend.HealthUrl,
+			Tags:      strings.Join(backend.Tags, ","),
+			Scheme:    backend.Scheme,
+			TLS: models.BackendServerTLS{
+				CAFile:             backend.TlsCaFile,
+				CertFile:           backend.TlsCertFile,
+				KeyFile:            backend.TlsKeyFile,
+				ServerName:         backend.TlsServerName,
+				InsecureSkipVerify: backend.TlsInsecureSkipVerify,
+			},
+		}, configuration.Frontend.Mode, logHandler)
+		if err != nil {
+			logHandler.LogError(err.Error(), "STARTUP", "Restore Backends")
+			continue
+		}
+		loadBalancer.RegisterServer(server)
+		restored++
+	}
+	return restored
+}
+
+// StateDocument is the JSON form of a snapshot written by "shiroxy state export"
+// and read by "shiroxy state import". Domains, accounts, backends and users use
+// the protobuf JSON mapping with the field names of the .proto files, so private
+// keys are base64 encoded in plaintext.
+type StateDocument struct {
+	SchemaVersion  uint32            `json:"schema_version"`
+	CreatedAt      string            `json:"created_at"`
+	ShiroxyVersion string            `json:"shiroxy_version"`
+	InstanceName   string            `json:"instance_name"`
+	WebhookSecret  string            `json:"webhook_secret"`
+	Settings       map[string]string `json:"settings"`
+	Domains        []json.RawMessage `json:"domains"`
+	Accounts       []json.RawMessage `json:"accounts"`
+	Backends       []json.RawMessage `json:"backends"`
+	Users          []json.RawMessage `json:"users"`
+	Analytics      json.RawMessage   `json:"analytics,omitempty"`
+}
+
+// NewStateDocument converts a decoded snapshot to its JSON form.
+// Parameters:
+//   - snapshot: *Snapshot, a snapshot returned by ReadSnapshot or DecodeSnapshot.
+//
+// Returns:
+//   - *StateDocument: the document.
+//   - error: error if a record cannot be converted.
+func NewStateDocument(snapshot *Snapshot) (*StateDocument, error) {
+	metadata := snapshot.Metadata
+	document := &StateDocument{
+		SchemaVersion:  metadata.SchemaVersion,
+		CreatedAt:      metadata.CreatedAt,
+		ShiroxyVersion: metadata.ShiroxyVersion,
+		InstanceName:   metadata.InstanceName,
+		WebhookSecret:  metadata.WebhookSecret,
+		Settings:       metadata.Settings,
+	}
+	if json.Valid(metadata.SystemData) {
+		document.Analytics = metadata.SystemData
+	}
+
+	var err error
+	if document.Domains, err = marshalRecords(snapshot.State.Domains); err != nil {
+		return nil, err
+	}
+	if document.Accounts, err = marshalRecords(snapshot.State.Accounts); err != nil {
+		return nil, err
+	}
+	if document.Backends, err = marshalRecords(metadata.Backends); err != nil {
+		return nil, err
+	}
+	if document.Users, err = marshalRecords(metadata.Users); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
+
+// Metadata converts the document back to a snapshot body, migrated to
+// SnapshotSchemaVersion.
+// Returns:
+//   - *ShutdownMetadata: the snapshot body.
+//   - error: ErrIncompatibleSnapshot for documents of a newer shiroxy, or error if a record is malformed.
+func (d *StateDocument) Metadata() (*ShutdownMetadata, error) {
+	// Checked first, as newer documents may hold fields this build cannot parse.
+	if d.SchemaVersion > SnapshotSchemaVersion {
+		return nil, fmt.Errorf("%w: schema version %d is newer than version %d read by this build; upgrade shiroxy", ErrIncompatibleSnapshot, d.SchemaVersion, SnapshotSchemaVersion)
+	}
+
+	state := &domains.DataPersistance{Datetime: d.CreatedAt}
+	var err error
+	if state.Domains, err = unmarshalRecords[domains.DomainMetadata](d.Domains, "domain"); err != nil {
+		return nil, err
+	}
+	if state.Accounts, err = unmarshalRecords[domains.AcmeAccount](d.Accounts, "account"); err != nil {
+		return nil, err
+	}
+	storageData, err := proto.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := &ShutdownMetadata{
+		DomainMetadata: storageData,
+		SystemData:     d.Analytics,
+		WebhookSecret:  d.WebhookSecret,
+		SchemaVersion:  d.SchemaVersion,
+		CreatedAt:      d.CreatedAt,
+		ShiroxyVersion: d.ShiroxyVersion,
+		InstanceName:   d.InstanceName,
+		Settings:       d.Settings,
+	}
+	if metadata.Backends, err = unmarshalRecords[BackendSnapshot](d.Backends, "backend"); err != nil {
+		return nil, err
+	}
+	if metadata.Users, err = unmarshalRecords[UserSnapshot](d.Users, "user"); err != nil {
+		return nil, err
+	}
+	if _, err := MigrateSnapshot(metadata); err != nil {
+		return nil, err
+	}
+	return metadata, nil
+}
+
+// marshalRecords converts protobuf records to JSON.
+func marshalRecords[T proto.Message](records []T) ([]json.RawMessage, error) {
+	encoded := make([]json.RawMessage, 0, len(records))
+	for _, record := range records {
+		body, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(record)
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, body)
+	}
+	return encoded, nil
+}
+
+// unmarshalRecords converts JSON records to protobuf records; kind names the
+// records in errors.
+func unmarshalRecords[T any, P interface {
+	*T
+	proto.Message
+}](encoded []json.RawMessage, kind string) ([]*T, error) {
+	records := make([]*T, 0, len(encoded))
+	for i, body := range encoded {
+		record := P(new(T))
+		if err := protojson.Unmarshal(body, record); err != nil {
+			return nil, fmt.Errorf("%s %d: %v", kind, i+1, err)
+		}
+		records = append(records, (*T)(record))
+	}
+	return records, nil
+}
+
+// ImportState writes the state of document as the newest snapshot of the
+// configured environment, which is restored on the next start. The document is
+// validated like a snapshot before anything is written.
+// Parameters:
+//   - configuration: *models.Config, the configuration holding datapersistancepath and the snapshot settings.
+//   - document: *StateDocument, the state to import.
+//   - envelope: *domains.Envelope, encrypts the snapshot (may be nil).
+//
+// Returns:
+//   - string: the path of the snapshot file.
+//   - error: error if the document is invalid or the snapshot cannot be written.
+func ImportState(configuration *models.Config, document *StateDocument, envelope *domains.Envelope) (string, error) {
+	metadata, err := document.Metadata()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	content, err := EncodeSnapshot(metadata, envelope, now)
+	if err != nil {
+		return "", err
+	}
+	if _, err := DecodeSnapshot(content, envelope); err != nil {
+		return "", err
+	}
+
+	retention := configuration.Default.Snapshot.Retention
+	if retention <= 0 {
+		retention = defaultSnapshotRetention
+	}
+	dir, prefix := snapshotPrefix(configuration)
+	return saveSnapshot(dir, prefix, retention, metadata, envelope, now, nil)
+}
+
+// MigrateSnapshotFile rewrites a snapshot file with the current format and
+// schema versions, keeping its encryption and creation time.
+// Parameters:
+//   - path: string, the snapshot file.
+//   - envelope: *domains.Envelope, decrypts and encrypts an encrypted snapshot (may be nil).
+//
+// Returns:
+//   - uint32: the schema version the file was written with.
+//   - error: error if the file cannot be read, migrated or written.
+func MigrateSnapshotFile(path string, envelope *domains.Envelope) (uint32, error) {
+	snapshot, err := ReadSnapshot(path, envelope)
+	if err != nil {
+		return 0, err
+	}
+	if snapshot.Version == SnapshotFormatVersion && snapshot.SchemaVersion == SnapshotSchemaVersion {
+		return snapshot.SchemaVersion, nil
+	}
+
+	created := snapshot.Created
+	if created.IsZero() {
+		if created, err = time.Parse(time.RFC3339, snapshot.Metadata.CreatedAt); err != nil {
+			created = time.Now()
+		}
+	}
+	if !snapshot.Sealed {
+		envelope = nil
+	}
+	content, err := EncodeSnapshot(snapshot.Metadata, envelope, created)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := DecodeSnapshot(content, envelope); err != nil {
+		return 0, fmt.Errorf("snapshot: the migrated snapshot does not validate: %v", err)
+	}
+	return snapshot.SchemaVersion, writeFileAtomic(path, content)
+}